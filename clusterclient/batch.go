@@ -0,0 +1,171 @@
+package clusterclient
+
+import (
+	"sync"
+
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+)
+
+// batch buffers the writes until Commit, the writes of the keys kept by a data node
+// are sent to it together in ActBatch requests
+type batch struct {
+	d  *ClusterClient
+	lk sync.Mutex
+	// ops keeps the last write of every key in the order the keys are first written
+	ops []batchOp
+	idx map[string]int
+}
+
+type batchOp struct {
+	key   string
+	value []byte
+	del   bool
+}
+
+func (d *ClusterClient) Batch() (ds.Batch, error) {
+	return &batch{
+		d:   d,
+		idx: make(map[string]int),
+	}, nil
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	if b.d.readOnly {
+		return xerrors.Errorf("readonly client!!!")
+	}
+	b.add(batchOp{key: key.String(), value: value})
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	if b.d.readOnly {
+		return xerrors.Errorf("readonly client!!!")
+	}
+	b.add(batchOp{key: key.String(), del: true})
+	return nil
+}
+
+func (b *batch) add(op batchOp) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if i, ok := b.idx[op.key]; ok {
+		b.ops[i] = op
+		return
+	}
+	b.idx[op.key] = len(b.ops)
+	b.ops = append(b.ops, op)
+}
+
+// Commit sends the buffered writes, every write is acknowledged by as many replicas as
+// required by the write consistency level like Put and Delete.
+// Erasure coded keys, values larger than store.MaxValueSize and the writes redirected
+// by data nodes are written one by one.
+func (b *batch) Commit() error {
+	b.lk.Lock()
+	ops := b.ops
+	b.ops = nil
+	b.idx = make(map[string]int)
+	b.lk.Unlock()
+	return b.d.writeBatch(ops)
+}
+
+// batchTarget is the ops sent to a data node, refs are the indexes of the op and the replica
+type batchTarget struct {
+	client core.DataNodeClient
+	ops    []store.BatchOp
+	refs   [][2]int
+}
+
+// writeBatch groups the ops by the data nodes keeping their keys and sends every group
+// in parallel, the first error is returned after all the ops are done
+func (d *ClusterClient) writeBatch(ops []batchOp) error {
+	var single []batchOp
+	replicas := make([][]replica, len(ops))
+	errs := make([][]error, len(ops))
+	targets := make(map[string]*batchTarget)
+	for i, op := range ops {
+		if d.erasureCode(op.key) != nil || len(op.value) > store.MaxValueSize {
+			single = append(single, op)
+			continue
+		}
+		rs, err := d.replicasByKey(op.key)
+		if err != nil {
+			return err
+		}
+		replicas[i] = rs
+		errs[i] = make([]error, len(rs))
+		for j, r := range rs {
+			if d.dead(r.id) {
+				errs[i][j] = errNodeDead
+				continue
+			}
+			t, ok := targets[r.id]
+			if !ok {
+				t = &batchTarget{client: r.client}
+				targets[r.id] = t
+			}
+			t.ops = append(t.ops, store.BatchOp{Key: op.key, Value: op.value, Delete: op.del})
+			t.refs = append(t.refs, [2]int{i, j})
+		}
+	}
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *batchTarget) {
+			defer wg.Done()
+			res := d.sendBatch(t.client, t.ops)
+			for k, ref := range t.refs {
+				errs[ref[0]][ref[1]] = res[k]
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	var err error
+	for i, op := range ops {
+		if replicas[i] == nil {
+			continue
+		}
+		moved, e := d.settle(op.key, replicas[i], errs[i], &hint{Key: op.key, Value: op.value, Delete: op.del})
+		if moved {
+			single = append(single, op)
+			continue
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, op := range single {
+		var e error
+		if op.del {
+			e = d.Delete(ds.RawKey(op.key))
+		} else {
+			e = d.Put(ds.RawKey(op.key), op.value)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// sendBatch sends the ops to the data node in ActBatch requests if it supports them,
+// one by one otherwise
+func (d *ClusterClient) sendBatch(client core.DataNodeClient, ops []store.BatchOp) []error {
+	if bc, ok := client.(store.BatchClient); ok {
+		return bc.Batch(ops)
+	}
+	errs := make([]error, len(ops))
+	for k, op := range ops {
+		errs[k] = d.do(client, func(dn core.DataNode) error {
+			if op.Delete {
+				return dn.Delete(op.Key)
+			}
+			return dn.Put(op.Key, op.Value)
+		})
+	}
+	return errs
+}
@@ -0,0 +1,65 @@
+package clusterclient
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+)
+
+// Blockstore keeps the blocks in the cluster with the keys of a blockstore mounted at
+// blockstore.BlockPrefix like dsclient does, GetMany fetches many blocks at once
+type Blockstore struct {
+	bstore.Blockstore
+	d *ClusterClient
+}
+
+func NewBlockstore(d *ClusterClient) *Blockstore {
+	return &Blockstore{
+		Blockstore: bstore.NewBlockstoreNoPrefix(d),
+		d:          d,
+	}
+}
+
+// GetMany sends the blocks of the cids as they are fetched, the blocks missing or failed are
+// skipped like those not found by an exchange. The channel is closed once all the cids are done.
+func (bs *Blockstore) GetMany(ctx context.Context, cids []cid.Cid) <-chan blocks.Block {
+	keys := make([]ds.Key, 0, len(cids))
+	byKey := make(map[string][]cid.Cid, len(cids))
+	for _, c := range cids {
+		k := dshelp.MultihashToDsKey(c.Hash())
+		if _, ok := byKey[k.String()]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k.String()] = append(byKey[k.String()], c)
+	}
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for r := range bs.d.GetMany(ctx, keys) {
+			if r.Err != nil {
+				logging.Warnf("get block %s failed: %s", r.Key, r.Err)
+				continue
+			}
+			if !r.Exists {
+				continue
+			}
+			for _, c := range byKey[r.Key] {
+				b, err := blocks.NewBlockWithCid(r.Value, c)
+				if err != nil {
+					logging.Warnf("get block %s failed: %s", c, err)
+					continue
+				}
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
@@ -2,17 +2,23 @@ package clusterclient
 
 import (
 	context "context"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/filedrive-team/go-ds-cluster/config"
 	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/mutcaskds"
 	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/p2p/gossip"
+	"github.com/filedrive-team/go-ds-cluster/p2p/meta"
 	"github.com/filedrive-team/go-ds-cluster/p2p/store"
 	"github.com/filedrive-team/go-ds-cluster/shard"
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
 	log "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	ma "github.com/multiformats/go-multiaddr"
@@ -22,25 +28,91 @@ import (
 var logging = log.Logger("clusterclient")
 var _ ds.Batching = (*ClusterClient)(nil)
 
+// maxRedirects limits how many times a request follows MOVED and ASK redirections
+const maxRedirects = 5
+
 type ClusterClient struct {
-	ctx      context.Context
-	sm       *shard.SlotsManager
-	nodeMap  map[string]core.DataNodeClient
+	*cluster
+	readLevel  Consistency
+	writeLevel Consistency
+	// hintSpool is given by WithHintStore
+	hintSpool ds.Datastore
+}
+
+// cluster is the state shared by the clients returned by ClusterClient.With
+type cluster struct {
+	ctx context.Context
+	// lk guards the cluster layout which may change during slots migration
+	lk          sync.RWMutex
+	sm          *shard.SlotsManager
+	nodeMap     map[string]core.DataNodeClient
+	swarm       map[string][]string
+	leaving     map[string]bool
+	pending     map[string]bool
+	epoch       uint64
+	hashTag     bool
+	replication int
+	keyHash     shard.KeyHashFunc
+	// slots being migrated and the nodes receiving slots before owning any
+	migrating []shard.SlotMove
+	joining   []config.Node
+	// erasure coded key prefixes
+	erasure  []config.ErasureCode
 	host     host.Host
 	readOnly bool
+	// capability is presented to the data nodes with every request
+	capability string
+	// handoff is nil when hinted handoff is disabled
+	handoff    *handoff
+	closeSpool func() error
+	// meta is nil when the cluster runs without the metadata service
+	meta *meta.Client
+	raft *config.RaftConf
+	// members is nil unless the client observes the liveness of data nodes
+	members *gossip.Membership
+	// adminKey verifies the layouts pulled by Refresh, nil if they are not signed
+	adminKey crypto.PubKey
+	// signer signs the layouts published by the client, nil if the client doesn't hold the admin key
+	signer crypto.PrivKey
+	// refreshStop is nil unless the layout is pulled periodically
+	refreshStop chan struct{}
+	refreshDone chan struct{}
 }
 
-func NewClusterClient(ctx context.Context, cfg *config.Config) (*ClusterClient, error) {
+func NewClusterClient(ctx context.Context, cfg *config.Config, opts ...Option) (*ClusterClient, error) {
 	if len(cfg.Nodes) == 0 {
 		return nil, xerrors.New("There hasn't any cluster node in config")
 	}
+	readLevel, err := ParseConsistency(cfg.ReadConsistency, DefaultReadConsistency)
+	if err != nil {
+		return nil, err
+	}
+	writeLevel, err := ParseConsistency(cfg.WriteConsistency, DefaultWriteConsistency)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateErasureCoding(cfg.ErasureCoding); err != nil {
+		return nil, err
+	}
+	adminKey, err := cfg.AdminPubKey()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid admin key: %w", err)
+	}
+	signer, err := cfg.AdminPrivKey()
+	if err != nil {
+		return nil, xerrors.Errorf("load admin key failed: %w", err)
+	}
 	h, err := p2p.HostFromConf(cfg)
 	if err != nil {
 		return nil, err
 	}
+	// the nodes receiving slots of a migration failed halfway own no slot yet
+	nds := make([]config.Node, 0, len(cfg.Nodes)+len(cfg.Joining))
+	nds = append(nds, cfg.Nodes...)
+	nds = append(nds, cfg.Joining...)
 	// protect the connection with server node
 	cm := h.ConnManager()
-	for _, nd := range cfg.Nodes {
+	for _, nd := range nds {
 		pid, err := peer.Decode(nd.ID)
 		if err != nil {
 			return nil, err
@@ -51,29 +123,567 @@ func NewClusterClient(ctx context.Context, cfg *config.Config) (*ClusterClient,
 	if err != nil {
 		return nil, err
 	}
-	nodeMap, err := makeNodeMap(ctx, h, cfg)
+	var keyHash shard.KeyHashFunc
+	if cfg.HashTag {
+		keyHash = shard.HashTagKey
+		sm.SetKeyHashFunc(keyHash)
+	}
+	sm.SetReplication(cfg.Replication)
+	nodeMap, err := makeNodeMap(ctx, h, nds, cfg.Capability)
 	if err != nil {
 		return nil, err
 	}
-	return &ClusterClient{
-		sm:       sm,
-		ctx:      ctx,
-		host:     h,
-		nodeMap:  nodeMap,
-		readOnly: cfg.ReadOnlyClient,
-	}, nil
+	swarm := make(map[string][]string)
+	leaving := make(map[string]bool)
+	pending := make(map[string]bool)
+	for _, nd := range nds {
+		swarm[nd.ID] = nd.Swarm
+		if nd.Leaving {
+			leaving[nd.ID] = true
+		}
+		if nd.Pending {
+			pending[nd.ID] = true
+		}
+	}
+	d := &ClusterClient{
+		cluster: &cluster{
+			sm:          sm,
+			ctx:         ctx,
+			host:        h,
+			nodeMap:     nodeMap,
+			swarm:       swarm,
+			leaving:     leaving,
+			pending:     pending,
+			epoch:       cfg.Epoch,
+			migrating:   cfg.Migrating,
+			joining:     cfg.Joining,
+			hashTag:     cfg.HashTag,
+			replication: cfg.Replication,
+			keyHash:     keyHash,
+			erasure:     cfg.ErasureCoding,
+			raft:        cfg.Raft,
+			readOnly:    cfg.ReadOnlyClient,
+			adminKey:    adminKey,
+			signer:      signer,
+			capability:  cfg.Capability,
+		},
+		readLevel:  readLevel,
+		writeLevel: writeLevel,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if cfg.Raft != nil {
+		d.meta = meta.NewClient(ctx, h, cfg.Nodes)
+		if err := d.SyncLayout(); err != nil {
+			logging.Warnf("fetch cluster layout from metadata service failed: %s", err)
+		}
+	}
+	if err := d.setupHandoff(cfg.HintedHandoff); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if err := d.setupMembers(cfg.GossipInterval); err != nil {
+		d.Close()
+		return nil, err
+	}
+	if err := d.setupRefresh(cfg.RefreshInterval); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
 }
 
-func (d *ClusterClient) nodeByKey(kstr string) (core.DataNodeClient, error) {
-	sn, err := d.sm.NodeByKey(kstr)
+// SyncLayout fetches the layout committed by the metadata service and switches to it if it's newer
+func (d *ClusterClient) SyncLayout() error {
+	if d.meta == nil {
+		return xerrors.New("metadata service is not enabled")
+	}
+	cc, err := d.meta.Layout()
+	if err != nil {
+		return err
+	}
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.applyClusterConf(cc)
+}
+
+// setupHandoff starts hinted handoff if the spool is given by option or config
+func (d *ClusterClient) setupHandoff(conf *config.HintedHandoffConf) error {
+	spool := d.hintSpool
+	d.hintSpool = nil
+	if conf == nil {
+		conf = &config.HintedHandoffConf{}
+	}
+	if spool == nil && conf.Path != "" {
+		mds, err := mutcaskds.NewMutcaskDS(d.ctx, &mutcaskds.Config{Path: conf.Path, CaskNum: 1})
+		if err != nil {
+			return err
+		}
+		spool = mds
+		d.closeSpool = mds.Close
+	}
+	if spool == nil {
+		return nil
+	}
+	hd, err := newHandoff(d.ctx, spool, *conf)
+	if err != nil {
+		if d.closeSpool != nil {
+			d.closeSpool()
+		}
+		return err
+	}
+	d.handoff = hd
+	go d.replayLoop()
+	return nil
+}
+
+// SetKeyHashFunc customizes the part of keys to be hashed to figure out slots,
+// keys sharing the same hash input are kept by the same node.
+// All the clients and data nodes of a cluster must use the same function.
+func (d *ClusterClient) SetKeyHashFunc(f shard.KeyHashFunc) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.keyHash = f
+	d.sm.SetKeyHashFunc(f)
+}
+
+// Nodes returns the current cluster nodes info
+func (d *ClusterClient) Nodes() []config.Node {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.nodes()
+}
+
+// ClusterConf returns the cluster layout known by the client
+func (d *ClusterClient) ClusterConf() *config.ClusterConf {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.clusterConf()
+}
+
+// clusterConf should be called with lk held
+func (d *ClusterClient) clusterConf() *config.ClusterConf {
+	cc := &config.ClusterConf{
+		Nodes:       d.nodes(),
+		HashTag:     d.hashTag,
+		Replication: d.replication,
+		Epoch:       d.epoch,
+		Raft:        d.raft,
+	}
+	if len(d.erasure) > 0 {
+		cc.ErasureCoding = append([]config.ErasureCode(nil), d.erasure...)
+	}
+	if len(d.migrating) > 0 {
+		cc.Migrating = append([]shard.SlotMove(nil), d.migrating...)
+	}
+	if len(d.joining) > 0 {
+		cc.Joining = append([]config.Node(nil), d.joining...)
+	}
+	return cc
+}
+
+// nodes should be called with lk held
+func (d *ClusterClient) nodes() []config.Node {
+	nds := d.sm.Nodes()
+	res := make([]config.Node, 0, len(nds))
+	for _, nd := range nds {
+		res = append(res, config.Node{
+			Node:    nd,
+			Swarm:   d.swarm[nd.ID],
+			Leaving: d.leaving[nd.ID],
+			Pending: d.pending[nd.ID],
+		})
+	}
+	return res
+}
+
+// replica is one of the nodes keeping a key
+type replica struct {
+	id     string
+	client core.DataNodeClient
+}
+
+// replicasByKey returns the nodes keeping the key, the primary owner comes first
+func (d *ClusterClient) replicasByKey(kstr string) ([]replica, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	nds, err := d.sm.ReplicasByKey(kstr)
 	if err != nil {
 		return nil, err
 	}
-	client, ok := d.nodeMap[sn.ID]
+	res := make([]replica, 0, len(nds))
+	for _, nd := range nds {
+		client, ok := d.nodeMap[nd.ID]
+		if !ok {
+			return nil, xerrors.Errorf("can not find DataNodeClient by: %s", nd.ID)
+		}
+		res = append(res, replica{id: nd.ID, client: client})
+	}
+	return res, nil
+}
+
+// write runs op on every replica of the key, it fails when fewer replicas than
+// required by the write consistency level succeed.
+// On ErrMoved the cluster layout is refreshed from the replying node and the write is retried.
+func (d *ClusterClient) write(kstr string, value []byte, del bool) error {
+	op := func(dn core.DataNode) error {
+		if del {
+			return dn.Delete(kstr)
+		}
+		return dn.Put(kstr, value)
+	}
+	var err error
+	for i := 0; i < maxRedirects; i++ {
+		var replicas []replica
+		replicas, err = d.replicasByKey(kstr)
+		if err != nil {
+			return err
+		}
+		errs := make([]error, len(replicas))
+		if len(replicas) == 1 {
+			errs[0] = d.doAlive(replicas[0], op)
+		} else {
+			var wg sync.WaitGroup
+			for j, r := range replicas {
+				wg.Add(1)
+				go func(j int, r replica) {
+					defer wg.Done()
+					errs[j] = d.doAlive(r, op)
+				}(j, r)
+			}
+			wg.Wait()
+		}
+		var moved bool
+		if moved, err = d.settle(kstr, replicas, errs, &hint{Key: kstr, Value: value, Delete: del}); !moved {
+			return err
+		}
+	}
+	return err
+}
+
+// settle counts the replicas acknowledging the write of the key, the writes to replicas
+// unreachable are hinted after h unless h is nil. moved is set if a replica redirected the write.
+func (d *ClusterClient) settle(kstr string, replicas []replica, errs []error, h *hint) (moved bool, err error) {
+	var acked int
+	for j, e := range errs {
+		if e == nil {
+			acked++
+			if d.handoff != nil {
+				d.handoff.remove(replicas[j].id, kstr)
+			}
+			continue
+		}
+		var re *store.RedirectError
+		if xerrors.As(e, &re) {
+			moved = true
+			d.refreshOrWarn(replicas[j].client, re.Epoch)
+		} else if h != nil && d.handoff != nil && (xerrors.Is(e, errNodeDead) || !replicas[j].client.IsTargetConnected()) {
+			hc := *h
+			hc.Node, hc.Time = replicas[j].id, time.Now()
+			d.hintOrWarn(&hc)
+		}
+		logging.Warnf("write %s to %s failed: %s", kstr, replicas[j].id, e)
+		if err == nil {
+			err = xerrors.Errorf("write %s to %s failed: %w", kstr, replicas[j].id, e)
+		}
+	}
+	if moved {
+		return true, err
+	}
+	required := d.writeLevel.required(len(replicas))
+	if acked >= required {
+		return false, nil
+	}
+	if len(replicas) == 1 {
+		return false, err
+	}
+	return false, &ConsistencyError{
+		Op:       "write",
+		Key:      kstr,
+		Level:    d.writeLevel,
+		Replicas: len(replicas),
+		Required: required,
+		Acked:    acked,
+		Err:      err,
+	}
+}
+
+// read asks the replicas of the key and resolves their answers, a missing key is an answer.
+// With ConsistencyOne replicas are asked in order until one of them has the key or answers last,
+// otherwise they are asked in parallel until enough of them answer.
+// With repair, all the replicas are compared in background once the read returned, and those missing
+// the key or keeping another value are fixed by read repair.
+// On ErrMoved the cluster layout is refreshed from the replying node and the read is retried.
+func (d *ClusterClient) read(kstr string, op func(dn core.DataNode) (answer, error), repair bool) (answer, error) {
+	var err error
+	for i := 0; i < maxRedirects; i++ {
+		var replicas []replica
+		replicas, err = d.replicasByKey(kstr)
+		if err != nil {
+			return answer{}, err
+		}
+		var answers []result
+		var rest func() []result
+		var moved bool
+		if d.readLevel == ConsistencyQuorum || d.readLevel == ConsistencyAll {
+			answers, rest, moved, err = d.readAll(kstr, replicas, op)
+		} else {
+			answers, moved, err = d.readOne(kstr, replicas, op)
+		}
+		if len(answers) > 0 {
+			ans := resolve(answers)
+			if repair && !d.readOnly && len(replicas) > 1 {
+				go d.readRepair(kstr, replicas, op, answers, rest)
+			}
+			return ans, nil
+		}
+		if !moved {
+			return answer{}, err
+		}
+	}
+	return answer{}, err
+}
+
+// readOne returns once a replica has the key, replicas missing the key come before it.
+// When no replica has the key the answers of all the replicas answering are returned.
+// Replicas known dead are asked last.
+func (d *ClusterClient) readOne(kstr string, replicas []replica, op func(dn core.DataNode) (answer, error)) ([]result, bool, error) {
+	var err error
+	var answers []result
+	for _, j := range d.aliveFirst(replicas) {
+		r := replicas[j]
+		var ans answer
+		err = d.do(r.client, func(dn core.DataNode) (e error) {
+			ans, e = op(dn)
+			return
+		})
+		if err == nil {
+			answers = append(answers, result{idx: j, ans: ans})
+			if ans.found {
+				return answers, false, nil
+			}
+			continue
+		}
+		var re *store.RedirectError
+		if xerrors.As(err, &re) {
+			d.refreshOrWarn(r.client, re.Epoch)
+			return nil, true, err
+		}
+		logging.Warnf("read %s from %s failed: %s", kstr, r.id, err)
+	}
+	if len(answers) > 0 {
+		return answers, false, nil
+	}
+	if len(replicas) <= 1 {
+		return nil, false, err
+	}
+	return nil, false, &ConsistencyError{
+		Op:       "read",
+		Key:      kstr,
+		Level:    ConsistencyOne,
+		Replicas: len(replicas),
+		Required: 1,
+		Err:      err,
+	}
+}
+
+// readAll asks all the replicas and returns once enough of them answered,
+// rest waits for the answers of the other replicas. Replicas known dead fail at once.
+func (d *ClusterClient) readAll(kstr string, replicas []replica, op func(dn core.DataNode) (answer, error)) (answers []result, rest func() []result, moved bool, err error) {
+	ch := make(chan result, len(replicas))
+	for j, r := range replicas {
+		go func(j int, r replica) {
+			var ans answer
+			err := d.doAlive(r, func(dn core.DataNode) (e error) {
+				ans, e = op(dn)
+				return
+			})
+			ch <- result{idx: j, ans: ans, err: err}
+		}(j, r)
+	}
+	required := d.readLevel.required(len(replicas))
+	answers = make([]result, 0, len(replicas))
+	n := 0
+	for ; n < len(replicas) && len(answers) < required; n++ {
+		res := <-ch
+		if res.err == nil {
+			answers = append(answers, res)
+			continue
+		}
+		r := replicas[res.idx]
+		var re *store.RedirectError
+		if xerrors.As(res.err, &re) {
+			moved = true
+			d.refreshOrWarn(r.client, re.Epoch)
+		}
+		logging.Warnf("read %s from %s failed: %s", kstr, r.id, res.err)
+		err = xerrors.Errorf("read %s from %s failed: %w", kstr, r.id, res.err)
+	}
+	if len(answers) >= required {
+		rest = func() []result {
+			var late []result
+			for ; n < len(replicas); n++ {
+				if res := <-ch; res.err == nil {
+					late = append(late, res)
+				}
+			}
+			return late
+		}
+		return answers, rest, false, nil
+	}
+	return nil, nil, moved, &ConsistencyError{
+		Op:       "read",
+		Key:      kstr,
+		Level:    d.readLevel,
+		Replicas: len(replicas),
+		Required: required,
+		Acked:    len(answers),
+		Err:      err,
+	}
+}
+
+// do runs op on the data node, the request is sent to the node importing the slot
+// once on ErrAsk
+func (d *ClusterClient) do(client core.DataNodeClient, op func(dn core.DataNode) error) error {
+	err := op(client)
+	var re *store.RedirectError
+	if !xerrors.As(err, &re) || re.Code != store.ErrAsk {
+		return err
+	}
+	target, aerr := d.asking(re.Redirect)
+	if aerr != nil {
+		// the importing node is unknown to a stale layout
+		if rerr := d.refresh(client, re.Epoch); rerr != nil {
+			return aerr
+		}
+		if target, aerr = d.asking(re.Redirect); aerr != nil {
+			return aerr
+		}
+	}
+	return op(target)
+}
+
+func (d *ClusterClient) refreshOrWarn(dc core.DataNodeClient, epoch uint64) {
+	if err := d.refresh(dc, epoch); err != nil {
+		logging.Warnf("refresh cluster layout failed: %s", err)
+	}
+}
+
+// refresh fetches the cluster layout from the data node if it knows a newer epoch.
+// With the admin key only layouts signed by it are taken, layouts older than current one are refused.
+func (d *ClusterClient) refresh(dc core.DataNodeClient, epoch uint64) error {
+	d.lk.RLock()
+	current := d.epoch
+	d.lk.RUnlock()
+	if epoch <= current {
+		return nil
+	}
+	tc, ok := dc.(store.TopologyClient)
 	if !ok {
-		return nil, xerrors.Errorf("can not find DataNodeClient by: %s", sn.ID)
+		return nil
 	}
-	return client, nil
+	m, err := tc.GetManifest()
+	if err != nil {
+		return err
+	}
+	if d.adminKey != nil {
+		if err := m.Verify(d.adminKey); err != nil {
+			return err
+		}
+	}
+	if m.Layout.Epoch < current {
+		return xerrors.Errorf("%w: epoch %d is older than %d", config.ErrManifestDowngrade, m.Layout.Epoch, current)
+	}
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.applyClusterConf(m.Layout)
+}
+
+// applyClusterConf switches to the cluster layout if it's newer, should be called with lk held
+func (d *ClusterClient) applyClusterConf(cc *config.ClusterConf) error {
+	if cc.Epoch <= d.epoch {
+		return nil
+	}
+	if err := validateErasureCoding(cc.ErasureCoding); err != nil {
+		return err
+	}
+	sm, err := shard.RestoreSlotsManager(shardNodes(cc.Nodes))
+	if err != nil {
+		return err
+	}
+	if d.keyHash != nil {
+		sm.SetKeyHashFunc(d.keyHash)
+	}
+	sm.SetReplication(cc.Replication)
+	nds := make([]config.Node, 0, len(cc.Nodes)+len(cc.Joining))
+	nds = append(nds, cc.Nodes...)
+	nds = append(nds, cc.Joining...)
+	leaving := make(map[string]bool)
+	pending := make(map[string]bool)
+	for _, nd := range nds {
+		if swarm, ok := d.swarm[nd.ID]; ok && !sameSwarm(swarm, nd.Swarm) {
+			// the node has moved, dial it at the new addresses
+			delete(d.nodeMap, nd.ID)
+		}
+		if err := d.addNodeClient(nd); err != nil {
+			return err
+		}
+		d.swarm[nd.ID] = nd.Swarm
+		if nd.Leaving {
+			leaving[nd.ID] = true
+		}
+		if nd.Pending {
+			pending[nd.ID] = true
+		}
+	}
+	d.dropNodeClients(nds)
+	logging.Infof("cluster layout refreshed from epoch %d to %d", d.epoch, cc.Epoch)
+	d.sm = sm
+	d.leaving = leaving
+	d.pending = pending
+	d.replication = cc.Replication
+	d.epoch = cc.Epoch
+	d.migrating = cc.Migrating
+	d.joining = cc.Joining
+	d.erasure = cc.ErasureCoding
+	d.raft = cc.Raft
+	if d.meta != nil {
+		d.meta.SetNodes(cc.Nodes)
+	}
+	return nil
+}
+
+// dropNodeClients forgets the nodes not in nds, should be called with lk held.
+// The clients share the host of the cluster client so they are not closed,
+// requests in flight with them are not affected.
+func (d *ClusterClient) dropNodeClients(nds []config.Node) {
+	keep := make(map[string]bool, len(nds))
+	for _, nd := range nds {
+		keep[nd.ID] = true
+	}
+	for id := range d.nodeMap {
+		if keep[id] {
+			continue
+		}
+		delete(d.nodeMap, id)
+		delete(d.swarm, id)
+		if pid, err := peer.Decode(id); err == nil {
+			d.host.ConnManager().Unprotect(pid, "cluster-node")
+		}
+	}
+}
+
+func sameSwarm(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func (d *ClusterClient) Put(k ds.Key, value []byte) error {
@@ -82,41 +692,93 @@ func (d *ClusterClient) Put(k ds.Key, value []byte) error {
 	}
 	kstr := k.String()
 	//logging.Infof("put %s", kstr)
-	client, err := d.nodeByKey(kstr)
-	if err != nil {
-		return err
+	if ec := d.erasureCode(kstr); ec != nil {
+		return d.putErasure(kstr, value, ec)
+	}
+	if len(value) > store.MaxValueSize {
+		return xerrors.Errorf("%w: value of %s is %d bytes, larger than %d, put it with PutStream", store.ErrValueTooLarge, kstr, len(value), store.MaxValueSize)
+	}
+	return d.write(kstr, value, false)
+}
+
+func getOp(kstr string) func(dn core.DataNode) (answer, error) {
+	return func(dn core.DataNode) (answer, error) {
+		v, err := dn.Get(kstr)
+		if err != nil {
+			return notFound(err)
+		}
+		return answer{found: true, value: v, size: len(v)}, nil
 	}
-	return client.Put(kstr, value)
 }
 
-func (d *ClusterClient) Get(k ds.Key) ([]byte, error) {
+func (d *ClusterClient) Get(k ds.Key) (value []byte, err error) {
 	kstr := k.String()
 	//logging.Infof("get %s", kstr)
-	client, err := d.nodeByKey(kstr)
+	ans, err := d.read(kstr, getOp(kstr), true)
+	if err != nil {
+		return nil, err
+	}
+	if !ans.found {
+		return nil, ds.ErrNotFound
+	}
+	// only values under erasure coded prefixes may be manifests
+	if d.erasureCode(kstr) == nil {
+		return ans.value, nil
+	}
+	m, err := decodeManifest(ans.value)
 	if err != nil {
 		return nil, err
 	}
-	return client.Get(kstr)
+	if m != nil {
+		return d.getErasure(kstr, m)
+	}
+	return ans.value, nil
 }
 
-func (d *ClusterClient) Has(k ds.Key) (bool, error) {
+func (d *ClusterClient) Has(k ds.Key) (exists bool, err error) {
 	kstr := k.String()
 	//logging.Infof("has %s", kstr)
-	client, err := d.nodeByKey(kstr)
-	if err != nil {
-		return false, err
-	}
-	return client.Has(kstr)
+	ans, err := d.read(kstr, func(dn core.DataNode) (answer, error) {
+		exists, err := dn.Has(kstr)
+		return answer{found: exists}, err
+	}, false)
+	return ans.found, err
 }
 
-func (d *ClusterClient) GetSize(k ds.Key) (int, error) {
+func (d *ClusterClient) GetSize(k ds.Key) (size int, err error) {
 	kstr := k.String()
 	//logging.Infof("get size %s", kstr)
-	client, err := d.nodeByKey(kstr)
+	if d.erasureCode(kstr) != nil {
+		ans, err := d.read(kstr, getOp(kstr), true)
+		if err != nil {
+			return -1, err
+		}
+		if !ans.found {
+			return -1, ds.ErrNotFound
+		}
+		m, err := decodeManifest(ans.value)
+		if err != nil {
+			return -1, err
+		}
+		if m != nil {
+			return m.Size, nil
+		}
+		return ans.size, nil
+	}
+	ans, err := d.read(kstr, func(dn core.DataNode) (answer, error) {
+		size, err := dn.GetSize(kstr)
+		if err != nil {
+			return notFound(err)
+		}
+		return answer{found: true, size: size}, nil
+	}, false)
 	if err != nil {
 		return -1, err
 	}
-	return client.GetSize(kstr)
+	if !ans.found {
+		return -1, ds.ErrNotFound
+	}
+	return ans.size, nil
 }
 
 func (d *ClusterClient) Delete(k ds.Key) error {
@@ -125,11 +787,10 @@ func (d *ClusterClient) Delete(k ds.Key) error {
 	}
 	kstr := k.String()
 	//logging.Infof("delete %s", kstr)
-	client, err := d.nodeByKey(kstr)
-	if err != nil {
-		return err
+	if d.erasureCode(kstr) != nil {
+		return d.deleteErasure(kstr)
 	}
-	return client.Delete(kstr)
+	return d.write(kstr, nil, true)
 }
 
 func (d *ClusterClient) Sync(ds.Key) error {
@@ -137,6 +798,18 @@ func (d *ClusterClient) Sync(ds.Key) error {
 }
 
 func (d *ClusterClient) Close() error {
+	d.stopRefresh()
+	if d.members != nil {
+		d.members.Close()
+	}
+	if d.handoff != nil {
+		d.handoff.close()
+	}
+	if d.closeSpool != nil {
+		if err := d.closeSpool(); err != nil {
+			logging.Warnf("close hint spool failed: %s", err)
+		}
+	}
 	return d.host.Close()
 }
 
@@ -152,6 +825,45 @@ func (d *ClusterClient) Query(q dsq.Query) (dsq.Results, error) {
 	var stopOnce sync.Once
 	var outOnce sync.Once
 
+	d.lk.RLock()
+	ids := make([]string, 0, len(d.nodeMap))
+	clients := make([]core.DataNodeClient, 0, len(d.nodeMap))
+	for id, dc := range d.nodeMap {
+		ids = append(ids, id)
+		clients = append(clients, dc)
+	}
+	replicated := d.sm.Replication() > 1
+	d.lk.RUnlock()
+
+	// keys kept by several replicas are returned once: a node only lists the keys of the slots it is
+	// the first replica of, among the nodes answering the query
+	queried := make(map[string]bool, len(clients))
+	queries := make([]dsq.Results, len(clients))
+	for i, dc := range clients {
+		results, err := dc.Query(q)
+		if err != nil {
+			logging.Error(err)
+			continue
+		}
+		queried[ids[i]] = true
+		queries[i] = results
+	}
+	owned := func(id, kstr string) bool {
+		if !replicated {
+			return true
+		}
+		replicas, err := d.replicasByKey(kstr)
+		if err != nil {
+			return true
+		}
+		for _, r := range replicas {
+			if queried[r.id] {
+				return r.id == id
+			}
+		}
+		return true
+	}
+
 	// figure out when to close all the channel
 	cc := make(chan struct{})
 	var closeCount int64
@@ -163,21 +875,19 @@ func (d *ClusterClient) Query(q dsq.Query) (dsq.Results, error) {
 				return
 			case <-cc:
 				atomic.AddInt64(&closeCount, 1)
-				if atomic.LoadInt64(&closeCount) >= int64(len(d.nodeMap)) {
+				if atomic.LoadInt64(&closeCount) >= int64(len(clients)) {
 					stopOnce.Do(closeStop)
 				}
 			}
 		}
 	}(stop, cc)
 
-	for _, dc := range d.nodeMap {
-		go func(dc core.DataNodeClient, q dsq.Query, ch chan dsq.Result, stop chan struct{}, cc chan struct{}) {
+	for i, results := range queries {
+		go func(id string, results dsq.Results, ch chan dsq.Result, stop chan struct{}, cc chan struct{}) {
 			defer func() {
 				cc <- struct{}{}
 			}()
-			results, err := dc.Query(q)
-			if err != nil {
-				logging.Error(err)
+			if results == nil {
 				return
 			}
 			for {
@@ -189,24 +899,36 @@ func (d *ClusterClient) Query(q dsq.Query) (dsq.Results, error) {
 					if !ok {
 						return
 					}
+					if result.Error == nil && !owned(id, result.Key) {
+						continue
+					}
 					out <- result
 				}
 			}
 
-		}(dc, q, out, stop, cc)
+		}(ids[i], results, out, stop, cc)
 	}
 
 	nextValue := func() (dsq.Result, bool) {
-		result, ok := <-out
-		if !ok {
-			return dsq.Result{}, false
-		}
+		for {
+			result, ok := <-out
+			if !ok {
+				return dsq.Result{}, false
+			}
 
-		if result.Error != nil {
-			return result, false
-		}
+			if result.Error != nil {
+				return result, false
+			}
+			// shards are listed by the keys of erasure coded values
+			if strings.HasPrefix(result.Key, config.ErasureShardPrefix+"/") {
+				continue
+			}
+			if err := d.queryErasure(&result.Entry, q); err != nil {
+				return dsq.Result{Error: err}, false
+			}
 
-		return result, true
+			return result, true
+		}
 	}
 
 	return dsq.ResultsFromIterator(q, dsq.Iterator{
@@ -221,6 +943,8 @@ func (d *ClusterClient) Query(q dsq.Query) (dsq.Results, error) {
 func (d *ClusterClient) HashSlots(k ds.Key) (*shard.Node, error) {
 	kstr := k.String()
 	//logging.Infof("get %s", kstr)
+	d.lk.RLock()
+	defer d.lk.RUnlock()
 	sn, err := d.sm.NodeByKey(kstr)
 	if err != nil {
 		return nil, err
@@ -228,56 +952,45 @@ func (d *ClusterClient) HashSlots(k ds.Key) (*shard.Node, error) {
 	return sn, nil
 }
 
-type batch struct {
-	s ds.Datastore
-}
-
-func (d *ClusterClient) Batch() (ds.Batch, error) {
-	return &batch{d}, nil
-}
-
-func (b *batch) Put(key ds.Key, value []byte) error {
-	return b.s.Put(key, value)
-}
-
-func (b *batch) Delete(key ds.Key) error {
-	return b.s.Delete(key)
-}
-
-func (b *batch) Commit() error {
-	return nil
-}
-
-func makeNodeMap(ctx context.Context, host host.Host, cfg *config.Config) (map[string]core.DataNodeClient, error) {
+func makeNodeMap(ctx context.Context, host host.Host, nds []config.Node, capability string) (map[string]core.DataNodeClient, error) {
 	res := make(map[string]core.DataNodeClient)
-	for _, nd := range cfg.Nodes {
-		pid, err := peer.Decode(nd.ID)
+	for _, nd := range nds {
+		client, err := makeNodeClient(ctx, host, nd, capability)
 		if err != nil {
 			return nil, err
 		}
-		addrs := make([]ma.Multiaddr, 0, len(nd.Swarm))
-		for _, addr := range nd.Swarm {
-			maddr, err := ma.NewMultiaddr(addr)
-			if err != nil {
-				return nil, err
-			}
-			addrs = append(addrs, maddr)
-		}
-		res[nd.ID] = store.NewStoreClient(ctx, host, peer.AddrInfo{
-			ID:    pid,
-			Addrs: addrs,
-		}, store.PROTOCOL_V1)
+		res[nd.ID] = client
 	}
 	return res, nil
 }
 
+func makeNodeClient(ctx context.Context, host host.Host, nd config.Node, capability string) (core.DataNodeClient, error) {
+	pid, err := peer.Decode(nd.ID)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]ma.Multiaddr, 0, len(nd.Swarm))
+	for _, addr := range nd.Swarm {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, maddr)
+	}
+	var opts []store.ClientOption
+	if capability != "" {
+		opts = append(opts, store.WithCapability(capability))
+	}
+	return store.NewStoreClient(ctx, host, peer.AddrInfo{
+		ID:    pid,
+		Addrs: addrs,
+	}, store.PROTOCOL_V1, opts...), nil
+}
+
 func shardNodes(nds []config.Node) []shard.Node {
 	res := make([]shard.Node, 0, len(nds))
 	for _, nd := range nds {
-		res = append(res, shard.Node{
-			ID:    nd.ID,
-			Slots: nd.Slots,
-		})
+		res = append(res, nd.Node)
 	}
 	return res
 }
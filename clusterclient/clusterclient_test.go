@@ -10,8 +10,10 @@ import (
 	"github.com/filedrive-team/go-ds-cluster/core"
 	"github.com/filedrive-team/go-ds-cluster/p2p"
 	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	"github.com/filedrive-team/go-ds-cluster/shard"
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
 )
 
 type Pair struct {
@@ -371,3 +373,381 @@ func serverFromCfg(ctx context.Context, cfg *config.Config) (core.DataNodeServer
 	memStore := ds.NewMapDatastore()
 	return store.NewStoreServer(ctx, h, store.PROTOCOL_V1, memStore, false), nil
 }
+
+func TestClusterClientMoved(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the slot ranges have been rotated among the nodes since the client config was written
+	cc := clientCfg.ClusterConf()
+	cc.Nodes = make([]config.Node, len(clientCfg.Nodes))
+	for i, nd := range clientCfg.Nodes {
+		cc.Nodes[i] = nd
+		cc.Nodes[i].Slots = clientCfg.Nodes[(i+1)%len(clientCfg.Nodes)].Slots
+	}
+	cc.Epoch = 2
+	sm, err := shard.RestoreSlotsManager(shardNodes(cc.Nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, store.WithClusterConf(cc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, item := range tdata {
+		if err := client.Put(ds.NewKey(item.Key), item.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if epoch := client.ClusterConf().Epoch; epoch != 2 {
+		t.Fatalf("client should refresh layout to epoch 2, got %d", epoch)
+	}
+	for _, item := range tdata {
+		k := ds.NewKey(item.Key)
+		nd, err := sm.NodeByKey(k.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := stores[nd.ID].Get(k)
+		if err != nil {
+			t.Fatalf("key %s should be kept by %s: %s", k, nd.ID, err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+}
+
+func TestClusterClientBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// half of the keys of the stale client config are redirected
+	cc := clientCfg.ClusterConf()
+	cc.Nodes = make([]config.Node, len(clientCfg.Nodes))
+	for i, nd := range clientCfg.Nodes {
+		cc.Nodes[i] = nd
+		cc.Nodes[i].Slots = clientCfg.Nodes[(i+1)%len(clientCfg.Nodes)].Slots
+	}
+	cc.Epoch = 2
+	sm, err := shard.RestoreSlotsManager(shardNodes(cc.Nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := dssync.MutexWrap(ds.NewMapDatastore())
+		srv, err := serverWithStore(ctx, cfg, memStore, store.WithClusterConf(cc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	b, err := client.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range tdata {
+		if err := b.Put(ds.NewKey(item.Key), []byte("overwritten")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(ds.NewKey(item.Key), item.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range tdata {
+		k := ds.NewKey(item.Key)
+		nd, err := sm.NodeByKey(k.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := stores[nd.ID].Get(k)
+		if err != nil {
+			t.Fatalf("key %s should be kept by %s: %s", k, nd.ID, err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+
+	for _, item := range tdata {
+		if err := b.Delete(ds.NewKey(item.Key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range tdata {
+		has, err := client.Has(ds.NewKey(item.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has {
+			t.Fatalf("%s should be deleted", item.Key)
+		}
+	}
+}
+
+func TestClusterClientAsk(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm, err := shard.RestoreSlotsManager(shardNodes(clientCfg.Nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := ds.NewKey(tdata[0].Key)
+	asked := ds.NewKey(tdata[1].Key)
+	// the slots of both keys are being migrated to the next node
+	cc := clientCfg.ClusterConf()
+	cc.Epoch = 1
+	targets := make(map[ds.Key]string)
+	for _, k := range []ds.Key{kept, asked} {
+		slot := sm.SlotByKey(k.String())
+		owner, err := sm.NodeBySlot(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to := clientCfg.Nodes[0].ID
+		for i, nd := range clientCfg.Nodes {
+			if nd.ID == owner.ID {
+				to = clientCfg.Nodes[(i+1)%len(clientCfg.Nodes)].ID
+			}
+		}
+		targets[k] = to
+		cc.Migrating = append(cc.Migrating, shard.SlotMove{Slot: slot, From: owner.ID, To: to})
+	}
+
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, store.WithClusterConf(cc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+	}
+
+	// the key not moved yet is still served by its owner
+	owner, err := sm.NodeByKey(kept.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[owner.ID].Put(kept, tdata[0].Value); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	v, err := client.Get(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, tdata[0].Value) {
+		t.Fatal("retrived value not match")
+	}
+
+	// new key of the migrating slot goes to the importing node
+	if err := client.Put(asked, tdata[1].Value); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := stores[targets[asked]].Has(asked); !has {
+		t.Fatalf("key %s should be written to the importing node %s", asked, targets[asked])
+	}
+	v, err = client.Get(asked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, tdata[1].Value) {
+		t.Fatal("retrived value not match")
+	}
+}
+
+func TestClusterClientReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Replication = 2
+	clientCfg.Epoch = 1
+	sm, err := shard.RestoreSlotsManager(shardNodes(clientCfg.Nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.SetReplication(2)
+
+	stores := make(map[string]ds.Datastore)
+	servers := make(map[string]core.DataNodeServer)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, store.WithClusterConf(clientCfg.ClusterConf()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+		servers[cfg.Identity.PeerID] = srv
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, item := range tdata {
+		if err := client.Put(ds.NewKey(item.Key), item.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every key is kept by its primary and one replica
+	for _, item := range tdata {
+		k := ds.NewKey(item.Key)
+		nds, err := sm.ReplicasByKey(k.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kept int
+		for id, st := range stores {
+			has, err := st.Has(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !has {
+				continue
+			}
+			kept++
+			if id != nds[0].ID && id != nds[1].ID {
+				t.Fatalf("key %s should not be kept by %s", k, id)
+			}
+		}
+		if kept != 2 {
+			t.Fatalf("key %s should be kept by 2 nodes, got %d", k, kept)
+		}
+	}
+
+	// keys are listed once
+	results, err := client.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents, err := results.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != len(tdata) {
+		t.Fatalf("expected %d query results, got %d", len(tdata), len(ents))
+	}
+
+	// reads fall back to the replica when the primary is down
+	down := clientCfg.Nodes[0].ID
+	servers[down].Close()
+	for _, item := range tdata {
+		v, err := client.Get(ds.NewKey(item.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+	// the keys of the node down are listed from their replicas
+	results, err = client.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents, err = results.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != len(tdata) {
+		t.Fatalf("expected %d query results with a node down, got %d", len(tdata), len(ents))
+	}
+
+	// deletes reach all the replicas
+	for _, item := range tdata {
+		k := ds.NewKey(item.Key)
+		nds, err := sm.ReplicasByKey(k.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nds[0].ID == down || nds[1].ID == down {
+			continue
+		}
+		if err := client.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		for _, nd := range nds {
+			if has, _ := stores[nd.ID].Has(k); has {
+				t.Fatalf("key %s should be deleted from %s", k, nd.ID)
+			}
+		}
+	}
+}
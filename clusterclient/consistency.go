@@ -0,0 +1,191 @@
+package clusterclient
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+)
+
+// Consistency decides how many replicas must answer an operation
+type Consistency int
+
+const (
+	// ConsistencyOne needs one replica
+	ConsistencyOne Consistency = 1 + iota
+	// ConsistencyQuorum needs a majority of replicas
+	ConsistencyQuorum
+	// ConsistencyAll needs all the replicas
+	ConsistencyAll
+)
+
+// default consistency levels keep writes on a majority of the replicas, so a replica down doesn't
+// fail the writes of its slots, and read from the first replica answering.
+// The replicas missing writes catch up with hinted handoff, read repair and anti-entropy.
+const (
+	DefaultReadConsistency  = ConsistencyOne
+	DefaultWriteConsistency = ConsistencyQuorum
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "ONE"
+	case ConsistencyQuorum:
+		return "QUORUM"
+	case ConsistencyAll:
+		return "ALL"
+	default:
+		return "Unknown"
+	}
+}
+
+// ParseConsistency parses ONE, QUORUM or ALL case-insensitively, empty string gives def
+func ParseConsistency(s string, def Consistency) (Consistency, error) {
+	switch strings.ToUpper(s) {
+	case "":
+		return def, nil
+	case "ONE":
+		return ConsistencyOne, nil
+	case "QUORUM":
+		return ConsistencyQuorum, nil
+	case "ALL":
+		return ConsistencyAll, nil
+	default:
+		return 0, xerrors.Errorf("unknown consistency level: %s", s)
+	}
+}
+
+// required returns how many of n replicas must answer
+func (c Consistency) required(n int) int {
+	switch c {
+	case ConsistencyAll:
+		return n
+	case ConsistencyQuorum:
+		return n/2 + 1
+	default:
+		if n == 0 {
+			return 0
+		}
+		return 1
+	}
+}
+
+// ConsistencyError is returned when fewer replicas than required by the consistency level
+// acknowledged an operation
+type ConsistencyError struct {
+	Op       string
+	Key      string
+	Level    Consistency
+	Replicas int
+	Required int
+	Acked    int
+	// Err is the error of one of the failed replicas
+	Err error
+}
+
+func (e *ConsistencyError) Error() string {
+	return fmt.Sprintf("%s %s: %d of %d replicas acknowledged, %s requires %d: %s", e.Op, e.Key, e.Acked, e.Replicas, e.Level, e.Required, e.Err)
+}
+
+func (e *ConsistencyError) Unwrap() error {
+	return e.Err
+}
+
+// Option configures the ClusterClient
+type Option func(d *ClusterClient)
+
+// WithReadConsistency sets the consistency level of Get, Has and GetSize
+func WithReadConsistency(c Consistency) Option {
+	return func(d *ClusterClient) {
+		d.readLevel = c
+	}
+}
+
+// WithWriteConsistency sets the consistency level of Put and Delete
+func WithWriteConsistency(c Consistency) Option {
+	return func(d *ClusterClient) {
+		d.writeLevel = c
+	}
+}
+
+// WithHintStore enables hinted handoff with the spool, the writes for unreachable data nodes
+// are kept in it and replayed once the nodes are connected again.
+// Limits are taken from the hinted_handoff settings of the config.
+// It only works with NewClusterClient.
+func WithHintStore(spool ds.Datastore) Option {
+	return func(d *ClusterClient) {
+		d.hintSpool = spool
+	}
+}
+
+// With returns a client sharing connections and cluster layout with d, options are
+// applied to the returned client only, e.g. to use another consistency level for some operations
+func (d *ClusterClient) With(opts ...Option) *ClusterClient {
+	cp := &ClusterClient{
+		cluster:    d.cluster,
+		readLevel:  d.readLevel,
+		writeLevel: d.writeLevel,
+	}
+	for _, opt := range opts {
+		opt(cp)
+	}
+	return cp
+}
+
+// answer is what a replica knows about a key
+type answer struct {
+	found bool
+	value []byte
+	size  int
+}
+
+func (a answer) equal(b answer) bool {
+	return a.found == b.found && a.size == b.size && bytes.Equal(a.value, b.value)
+}
+
+// notFound turns ds.ErrNotFound into an answer
+func notFound(err error) (answer, error) {
+	if xerrors.Is(err, ds.ErrNotFound) {
+		return answer{}, nil
+	}
+	return answer{}, err
+}
+
+// result is the answer of the replica at idx of the replica list
+type result struct {
+	idx int
+	ans answer
+	err error
+}
+
+// resolve picks the answer given by the most replicas. A replica keeping the key wins over
+// those missing it, since values are seldom deleted and a missing key is likely a failed write.
+// Ties go to the replica coming first in the replica list.
+func resolve(answers []result) answer {
+	sort.Slice(answers, func(i, j int) bool {
+		return answers[i].idx < answers[j].idx
+	})
+	best, votes := -1, 0
+	for i, r := range answers {
+		if !r.ans.found {
+			continue
+		}
+		n := 0
+		for _, o := range answers {
+			if r.ans.equal(o.ans) {
+				n++
+			}
+		}
+		if n > votes {
+			best, votes = i, n
+		}
+	}
+	if best < 0 {
+		return answer{}
+	}
+	return answers[best].ans
+}
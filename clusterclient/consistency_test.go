@@ -0,0 +1,145 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+)
+
+func TestParseConsistency(t *testing.T) {
+	cases := []struct {
+		s      string
+		expect Consistency
+	}{
+		{"", ConsistencyAll},
+		{"one", ConsistencyOne},
+		{"Quorum", ConsistencyQuorum},
+		{"ALL", ConsistencyAll},
+	}
+	for _, c := range cases {
+		lv, err := ParseConsistency(c.s, ConsistencyAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lv != c.expect {
+			t.Fatalf("%q expected %s, got %s", c.s, c.expect, lv)
+		}
+	}
+	if _, err := ParseConsistency("two", ConsistencyOne); err == nil {
+		t.Fatal("should fail with unknown consistency level")
+	}
+	for n, expect := range map[int]int{1: 1, 2: 2, 3: 2, 4: 3, 5: 3} {
+		if got := ConsistencyQuorum.required(n); got != expect {
+			t.Fatalf("quorum of %d replicas expected %d, got %d", n, expect, got)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	v1 := answer{found: true, value: []byte("v1"), size: 2}
+	v2 := answer{found: true, value: []byte("v2"), size: 2}
+	cases := []struct {
+		answers []result
+		expect  answer
+	}{
+		{[]result{{idx: 0}, {idx: 1}}, answer{}},
+		{[]result{{idx: 1, ans: v1}, {idx: 0}, {idx: 2}}, v1},
+		{[]result{{idx: 1, ans: v1}, {idx: 0, ans: v2}}, v2},
+		{[]result{{idx: 0, ans: v2}, {idx: 1, ans: v1}, {idx: 2, ans: v1}}, v1},
+	}
+	for i, c := range cases {
+		if got := resolve(c.answers); !got.equal(c.expect) {
+			t.Fatalf("case %d expected %v, got %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestClusterClientConsistency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Replication = 3
+	clientCfg.Epoch = 1
+	clientCfg.ReadConsistency = "quorum"
+	clientCfg.WriteConsistency = "quorum"
+
+	var servers []core.DataNodeServer
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, err := serverWithStore(ctx, cfg, ds.NewMapDatastore(), store.WithClusterConf(clientCfg.ClusterConf()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		servers = append(servers, srv)
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	all := client.With(WithReadConsistency(ConsistencyAll), WithWriteConsistency(ConsistencyAll))
+	one := client.With(WithReadConsistency(ConsistencyOne), WithWriteConsistency(ConsistencyOne))
+
+	k := ds.NewKey(tdata[0].Key)
+	value := tdata[0].Value
+	if err := all.Put(k, value); err != nil {
+		t.Fatal(err)
+	}
+
+	expectConsistencyError := func(err error, acked, required int) {
+		t.Helper()
+		var ce *ConsistencyError
+		if !xerrors.As(err, &ce) {
+			t.Fatalf("expected ConsistencyError, got %v", err)
+		}
+		if ce.Acked != acked || ce.Required != required || ce.Replicas != 3 {
+			t.Fatalf("expected %d of 3 replicas acknowledged and %d required, got %s", acked, required, ce)
+		}
+	}
+	expectValue := func(cl *ClusterClient) {
+		t.Helper()
+		v, err := cl.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+
+	// one node down, a quorum is still reachable
+	servers[0].Close()
+	expectConsistencyError(all.Put(k, value), 2, 3)
+	if err := client.Put(k, value); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(client)
+	_, err = all.Get(k)
+	expectConsistencyError(err, 2, 3)
+
+	// two nodes down, only ONE works
+	servers[1].Close()
+	expectConsistencyError(client.Put(k, value), 1, 2)
+	expectConsistencyError(client.Delete(k), 1, 2)
+	if err := one.Put(k, value); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(one)
+	_, err = client.Has(k)
+	expectConsistencyError(err, 1, 2)
+}
@@ -0,0 +1,389 @@
+package clusterclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/klauspost/reedsolomon"
+	"golang.org/x/xerrors"
+)
+
+// ecMagic starts the manifest kept at the key of an erasure coded value
+var ecMagic = []byte("\x00dsec1\x00")
+
+// maxShardSalts bounds the search of a shard key landing on a node not used yet
+const maxShardSalts = 4096
+
+// ecManifest is kept at the key of an erasure coded value, it's replicated like other values.
+// Shard keys are recorded so that shards are found after the cluster layout changed.
+type ecManifest struct {
+	Size   int      `json:"size"`
+	Data   int      `json:"data"`
+	Parity int      `json:"parity"`
+	Shards []string `json:"shards"`
+	Hashes [][]byte `json:"hashes"`
+}
+
+func (m *ecManifest) encode() ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), ecMagic...), b...), nil
+}
+
+// decodeManifest returns nil if the value isn't a manifest
+func decodeManifest(v []byte) (*ecManifest, error) {
+	if !bytes.HasPrefix(v, ecMagic) {
+		return nil, nil
+	}
+	m := new(ecManifest)
+	if err := json.Unmarshal(v[len(ecMagic):], m); err != nil {
+		return nil, xerrors.Errorf("invalid erasure coding manifest: %w", err)
+	}
+	if m.Data < 1 || m.Parity < 0 || len(m.Shards) != m.Data+m.Parity || len(m.Hashes) != len(m.Shards) {
+		return nil, xerrors.New("invalid erasure coding manifest")
+	}
+	return m, nil
+}
+
+func validateErasureCoding(ecs []config.ErasureCode) error {
+	for _, ec := range ecs {
+		if err := ec.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// erasureCode returns the erasure coding of the key by the longest prefix, nil if the key is replicated
+func (d *ClusterClient) erasureCode(kstr string) *config.ErasureCode {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	var res *config.ErasureCode
+	for i, ec := range d.erasure {
+		prefix := strings.TrimSuffix(ec.Prefix, "/")
+		if kstr != prefix && !strings.HasPrefix(kstr, prefix+"/") {
+			continue
+		}
+		if res == nil || len(ec.Prefix) > len(res.Prefix) {
+			res = &d.erasure[i]
+		}
+	}
+	return res
+}
+
+// shardTagEscaper escapes the hash tags of keys, so the shard keys of a tagged key
+// aren't all hashed to the slot of the tag
+var shardTagEscaper = strings.NewReplacer("%", "%25", "{", "%7B", "}", "%7D")
+
+// shardVersion returns a random version of the shards of a write, shards of distinct writes of a key
+// never share their keys so an overwrite failing halfway leaves the former value whole
+func shardVersion() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// shardKeys derives the keys of the shards of a write version, each of them lands on a distinct node
+// of current layout as long as there are enough nodes. An error is returned if a node
+// not used yet can't be reached while there are some left.
+func (d *ClusterClient) shardKeys(kstr, version string, n int) ([]string, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	nodes := len(d.sm.Nodes())
+	base := config.ErasureShardPrefix + shardTagEscaper.Replace(kstr) + "/" + version
+	used := make(map[string]bool)
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		var key string
+		var placed bool
+		for salt := 0; salt < maxShardSalts; salt++ {
+			key = fmt.Sprintf("%s/%d-%d", base, i, salt)
+			nd, err := d.sm.NodeByKey(key)
+			if err != nil {
+				return nil, err
+			}
+			if !used[nd.ID] || len(used) >= nodes {
+				used[nd.ID] = true
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			return nil, xerrors.Errorf("no distinct node found for shard %d of %s", i, kstr)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// putErasure writes the shards to their primary owners then the manifest to the replicas of the key.
+// The former shards are removed once the new manifest is written, and the new ones if the write fails.
+// Writing at least Data shards is needed by ConsistencyOne, half of the parity shards more by
+// ConsistencyQuorum and all the shards by ConsistencyAll. Empty values are not split.
+func (d *ClusterClient) putErasure(kstr string, value []byte, ec *config.ErasureCode) error {
+	if len(value) == 0 {
+		return d.write(kstr, value, false)
+	}
+	enc, err := reedsolomon.New(ec.Data, ec.Parity)
+	if err != nil {
+		return err
+	}
+	shards, err := enc.Split(value)
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return err
+	}
+	version, err := shardVersion()
+	if err != nil {
+		return err
+	}
+	keys, err := d.shardKeys(kstr, version, len(shards))
+	if err != nil {
+		return err
+	}
+	// the former shards are removed once the new manifest is written
+	old, _ := d.getManifest(kstr)
+
+	m := &ecManifest{
+		Size:   len(value),
+		Data:   ec.Data,
+		Parity: ec.Parity,
+		Shards: keys,
+		Hashes: make([][]byte, len(shards)),
+	}
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i := range shards {
+		h := sha256.Sum256(shards[i])
+		m.Hashes[i] = h[:]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = d.writePrimary(m.Shards[i], shards[i], false)
+		}(i)
+	}
+	wg.Wait()
+	var acked int
+	var lastErr error
+	for i, e := range errs {
+		if e == nil {
+			acked++
+			continue
+		}
+		logging.Warnf("write shard %s failed: %s", m.Shards[i], e)
+		lastErr = e
+	}
+	required := ec.Data + ec.Parity
+	switch d.writeLevel {
+	case ConsistencyOne:
+		required = ec.Data
+	case ConsistencyQuorum:
+		required = ec.Data + (ec.Parity+1)/2
+	}
+	if acked < required {
+		d.deleteShards(m.Shards, errs)
+		return &ConsistencyError{
+			Op:       "write shards of",
+			Key:      kstr,
+			Level:    d.writeLevel,
+			Replicas: len(shards),
+			Required: required,
+			Acked:    acked,
+			Err:      lastErr,
+		}
+	}
+	b, err := m.encode()
+	if err != nil {
+		return err
+	}
+	if err := d.write(kstr, b, false); err != nil {
+		// the manifest may still be kept by some replicas, its shards are kept as well
+		var ce *ConsistencyError
+		if !xerrors.As(err, &ce) || ce.Acked == 0 {
+			d.deleteShards(m.Shards, errs)
+		}
+		return err
+	}
+	if old != nil {
+		d.deleteShards(old.Shards, nil)
+	}
+	return nil
+}
+
+// deleteShards removes the shards whose write didn't fail, errs is nil when all of them were written
+func (d *ClusterClient) deleteShards(keys []string, errs []error) {
+	for i, k := range keys {
+		if errs != nil && errs[i] != nil {
+			continue
+		}
+		d.deleteShard(k)
+	}
+}
+
+// getManifest reads the manifest of the key, nil if the value isn't erasure coded
+func (d *ClusterClient) getManifest(kstr string) (*ecManifest, error) {
+	ans, err := d.read(kstr, getOp(kstr), true)
+	if err != nil {
+		return nil, err
+	}
+	if !ans.found {
+		return nil, ds.ErrNotFound
+	}
+	return decodeManifest(ans.value)
+}
+
+// getErasure fetches the shards in parallel and rebuilds the value from the first Data shards
+// passing the hash check
+func (d *ClusterClient) getErasure(kstr string, m *ecManifest) ([]byte, error) {
+	enc, err := reedsolomon.New(m.Data, m.Parity)
+	if err != nil {
+		return nil, err
+	}
+	type fetched struct {
+		idx   int
+		value []byte
+		err   error
+	}
+	ch := make(chan fetched, len(m.Shards))
+	one := d.With(WithReadConsistency(ConsistencyOne))
+	for i, k := range m.Shards {
+		go func(i int, k string) {
+			ans, err := one.read(k, getOp(k), false)
+			switch {
+			case err != nil:
+			case !ans.found:
+				err = ds.ErrNotFound
+			default:
+				if h := sha256.Sum256(ans.value); !bytes.Equal(h[:], m.Hashes[i]) {
+					err = xerrors.New("hash mismatch")
+				}
+			}
+			ch <- fetched{idx: i, value: ans.value, err: err}
+		}(i, k)
+	}
+	shards := make([][]byte, len(m.Shards))
+	var got int
+	var lastErr error
+	for n := 0; n < len(m.Shards) && got < m.Data; n++ {
+		f := <-ch
+		if f.err != nil {
+			logging.Warnf("read shard %s failed: %s", m.Shards[f.idx], f.err)
+			lastErr = xerrors.Errorf("read shard %s failed: %w", m.Shards[f.idx], f.err)
+			continue
+		}
+		shards[f.idx] = f.value
+		got++
+	}
+	if got < m.Data {
+		return nil, &ConsistencyError{
+			Op:       "read shards of",
+			Key:      kstr,
+			Level:    ConsistencyOne,
+			Replicas: len(m.Shards),
+			Required: m.Data,
+			Acked:    got,
+			Err:      lastErr,
+		}
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, m.Size))
+	if err := enc.Join(buf, shards, m.Size); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deleteErasure removes the manifest then the shards of the key
+func (d *ClusterClient) deleteErasure(kstr string) error {
+	m, err := d.getManifest(kstr)
+	if err != nil && !xerrors.Is(err, ds.ErrNotFound) {
+		return err
+	}
+	if err := d.write(kstr, nil, true); err != nil {
+		return err
+	}
+	if m != nil {
+		for _, k := range m.Shards {
+			d.deleteShard(k)
+		}
+	}
+	return nil
+}
+
+func (d *ClusterClient) deleteShard(k string) {
+	if err := d.writePrimary(k, nil, true); err != nil && !xerrors.Is(err, ds.ErrNotFound) {
+		logging.Warnf("delete shard %s failed: %s", k, err)
+	}
+}
+
+// writePrimary writes the key to its primary owner only, shards are not replicated
+func (d *ClusterClient) writePrimary(kstr string, value []byte, del bool) error {
+	op := func(dn core.DataNode) error {
+		if del {
+			return dn.Delete(kstr)
+		}
+		return dn.Put(kstr, value)
+	}
+	var err error
+	for i := 0; i < maxRedirects; i++ {
+		var replicas []replica
+		replicas, err = d.replicasByKey(kstr)
+		if err != nil {
+			return err
+		}
+		err = d.do(replicas[0].client, op)
+		var re *store.RedirectError
+		if !xerrors.As(err, &re) {
+			return err
+		}
+		d.refreshOrWarn(replicas[0].client, re.Epoch)
+	}
+	return err
+}
+
+// queryErasure fills the value and size of an erasure coded entry of query results
+func (d *ClusterClient) queryErasure(e *dsq.Entry, q dsq.Query) error {
+	if d.erasureCode(e.Key) == nil {
+		return nil
+	}
+	if !q.KeysOnly {
+		m, err := decodeManifest(e.Value)
+		if err != nil || m == nil {
+			return err
+		}
+		v, err := d.getErasure(e.Key, m)
+		if err != nil {
+			return err
+		}
+		e.Value = v
+		e.Size = len(v)
+		return nil
+	}
+	if q.ReturnsSizes {
+		size, err := d.GetSize(ds.RawKey(e.Key))
+		if err != nil {
+			return err
+		}
+		e.Size = size
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"golang.org/x/xerrors"
+)
+
+func TestErasureCoding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Replication = 2
+	clientCfg.Epoch = 1
+	clientCfg.ErasureCoding = []config.ErasureCode{{Prefix: "/blocks", Data: 2, Parity: 1}}
+	clientCfg.WriteConsistency = "one"
+
+	var servers []core.DataNodeServer
+	var stores []ds.Datastore
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, st, store.WithClusterConf(clientCfg.ClusterConf()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		servers = append(servers, srv)
+		stores = append(stores, st)
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	value := bytes.Repeat([]byte("Destributed storage provider "), 1000)
+	k := ds.NewKey("/blocks/x")
+	if err := client.Put(k, value); err != nil {
+		t.Fatal(err)
+	}
+	plain := ds.NewKey(tdata[0].Key)
+	if err := client.Put(plain, tdata[0].Value); err != nil {
+		t.Fatal(err)
+	}
+
+	// every store keeps one shard
+	shards := func() (n int) {
+		for i, st := range stores {
+			res, err := st.Query(dsq.Query{KeysOnly: true, Prefix: config.ErasureShardPrefix})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 1 {
+				t.Fatalf("store %d keeps %d shards", i, len(entries))
+			}
+			n += len(entries)
+		}
+		return n
+	}
+	if n := shards(); n != 3 {
+		t.Fatalf("expected 3 shards, got %d", n)
+	}
+
+	size, err := client.GetSize(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(value) {
+		t.Fatalf("expected size %d, got %d", len(value), size)
+	}
+
+	res, err := client.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Key, config.ErasureShardPrefix) {
+			t.Fatalf("shard %s should not be listed", e.Key)
+		}
+		if e.Key == k.String() && !bytes.Equal(e.Value, value) {
+			t.Fatal("queried value not match")
+		}
+	}
+
+	// an overwrite replaces the shards
+	value = bytes.Repeat([]byte("Distributed storage provider "), 1000)
+	if err := client.Put(k, value); err != nil {
+		t.Fatal(err)
+	}
+	if n := shards(); n != 3 {
+		t.Fatalf("expected 3 shards after overwrite, got %d", n)
+	}
+
+	// any two shards rebuild the value
+	servers[0].Close()
+	v, err := client.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, value) {
+		t.Fatal("retrived value not match")
+	}
+
+	// an overwrite failing halfway leaves the former value whole
+	err = client.With(WithWriteConsistency(ConsistencyAll)).Put(k, []byte("failed overwrite"))
+	var ce *ConsistencyError
+	if !xerrors.As(err, &ce) {
+		t.Fatalf("expected consistency error, got %v", err)
+	}
+	v, err = client.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, value) {
+		t.Fatal("retrived value not match after failed overwrite")
+	}
+	if n := shards(); n != 3 {
+		t.Fatalf("expected the shards of the failed write removed, got %d shards", n)
+	}
+	v, err = client.Get(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, tdata[0].Value) {
+		t.Fatal("retrived value not match")
+	}
+
+	if err := client.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(k); !xerrors.Is(err, ds.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if n := shards(); n != 1 {
+		t.Fatalf("expected the shard of the closed node left, got %d shards", n)
+	}
+
+	// values out of the erasure coded prefixes are never taken for manifests
+	forged, err := (&ecManifest{Size: 1, Data: 2, Parity: 1, Shards: []string{"/a", "/b", "/c"}}).encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := ds.NewKey("/other/x")
+	if err := client.Put(other, forged); err != nil {
+		t.Fatal(err)
+	}
+	v, err = client.Get(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, forged) {
+		t.Fatal("retrived value not match")
+	}
+}
+
+func TestShardKeysHashTag(t *testing.T) {
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm, err := shard.RestoreSlotsManager(shardNodes(clientCfg.Nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.SetKeyHashFunc(shard.HashTagKey)
+	d := &ClusterClient{cluster: &cluster{sm: sm}}
+
+	// shards of a tagged key still land on distinct nodes
+	keys, err := d.shardKeys("/blocks/{tag}/x", "v", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := make(map[string]bool)
+	for _, key := range keys {
+		if strings.ContainsAny(key, "{}") {
+			t.Fatalf("hash tag kept in shard key %s", key)
+		}
+		nd, err := sm.NodeByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		used[nd.ID] = true
+	}
+	if len(used) != 3 {
+		t.Fatalf("expected shards on 3 nodes, got %d", len(used))
+	}
+}
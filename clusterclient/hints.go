@@ -0,0 +1,469 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	metrics "github.com/ipfs/go-metrics-interface"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultHintMaxBytes       = 64 << 20
+	defaultHintMaxAge         = 3 * time.Hour
+	defaultHintReplayInterval = 10 * time.Second
+)
+
+// hintPrefix is the key prefix of hints in the spool, hints are keyed by node and key
+// so the latest write of a key replaces the former ones
+const hintPrefix = "/hints"
+
+var errHintSpoolFull = xerrors.New("hint spool is full")
+
+// hint is a write kept for an unreachable data node
+type hint struct {
+	Node   string    `json:"node"`
+	Key    string    `json:"key"`
+	Value  []byte    `json:"value,omitempty"`
+	Delete bool      `json:"delete,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func (h *hint) apply(dn core.DataNode) error {
+	if h.Delete {
+		return dn.Delete(h.Key)
+	}
+	return dn.Put(h.Key, h.Value)
+}
+
+func hintKey(node, key string) ds.Key {
+	return ds.NewKey(hintPrefix + "/" + node + key)
+}
+
+// HintStats describes the writes kept for unreachable data nodes
+type HintStats struct {
+	// Hints and Bytes are the backlog of the spool
+	Hints int
+	Bytes int64
+	// Replayed counts the writes delivered after nodes came back
+	Replayed uint64
+	// Dropped counts the writes given up for the spool being full, hints expired
+	// or nodes no longer keeping the keys
+	Dropped uint64
+}
+
+type hintMeta struct {
+	size int64
+	time time.Time
+}
+
+// handoff keeps writes for unreachable data nodes in a spool and replays them
+// when the nodes are connected again
+type handoff struct {
+	lk       sync.Mutex
+	spool    ds.Datastore
+	maxBytes int64
+	maxAge   time.Duration
+	interval time.Duration
+	// pending hints by node and key
+	pending map[string]map[string]hintMeta
+	stats   HintStats
+
+	hintsGauge      metrics.Gauge
+	bytesGauge      metrics.Gauge
+	replayedCounter metrics.Counter
+	droppedCounter  metrics.Counter
+
+	// kick triggers a replay before the next interval
+	kick    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func newHandoff(ctx context.Context, spool ds.Datastore, conf config.HintedHandoffConf) (*handoff, error) {
+	hd := &handoff{
+		spool:    spool,
+		maxBytes: conf.MaxBytes,
+		maxAge:   defaultHintMaxAge,
+		interval: defaultHintReplayInterval,
+		pending:  make(map[string]map[string]hintMeta),
+		kick:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+
+		hintsGauge:      metrics.NewCtx(ctx, "hinted_handoff_hints", "Writes kept for unreachable data nodes").Gauge(),
+		bytesGauge:      metrics.NewCtx(ctx, "hinted_handoff_bytes", "Size of the writes kept for unreachable data nodes").Gauge(),
+		replayedCounter: metrics.NewCtx(ctx, "hinted_handoff_replayed_total", "Writes replayed to data nodes").Counter(),
+		droppedCounter:  metrics.NewCtx(ctx, "hinted_handoff_dropped_total", "Writes given up by hinted handoff").Counter(),
+	}
+	if hd.maxBytes <= 0 {
+		hd.maxBytes = defaultHintMaxBytes
+	}
+	var err error
+	if conf.MaxAge != "" {
+		if hd.maxAge, err = time.ParseDuration(conf.MaxAge); err != nil {
+			return nil, xerrors.Errorf("invalid hinted handoff max age: %w", err)
+		}
+	}
+	if conf.ReplayInterval != "" {
+		if hd.interval, err = time.ParseDuration(conf.ReplayInterval); err != nil {
+			return nil, xerrors.Errorf("invalid hinted handoff replay interval: %w", err)
+		}
+	}
+	if err := hd.load(); err != nil {
+		return nil, err
+	}
+	return hd, nil
+}
+
+// load indexes the hints left in the spool
+func (hd *handoff) load() error {
+	results, err := hd.spool.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for res := range results.Next() {
+		if res.Error != nil {
+			return res.Error
+		}
+		if !strings.HasPrefix(res.Key, hintPrefix+"/") {
+			continue
+		}
+		b, err := hd.spool.Get(ds.NewKey(res.Key))
+		if err != nil {
+			return err
+		}
+		h := new(hint)
+		if err := json.Unmarshal(b, h); err != nil {
+			return xerrors.Errorf("invalid hint %s: %w", res.Key, err)
+		}
+		hd.index(h.Node, h.Key, hintMeta{size: int64(len(b)), time: h.Time})
+	}
+	hd.updateGauges()
+	return nil
+}
+
+// index records the hint, should be called with lk held or before handoff is shared
+func (hd *handoff) index(node, key string, meta hintMeta) {
+	keys, ok := hd.pending[node]
+	if !ok {
+		keys = make(map[string]hintMeta)
+		hd.pending[node] = keys
+	}
+	if old, ok := keys[key]; ok {
+		hd.stats.Hints--
+		hd.stats.Bytes -= old.size
+	}
+	keys[key] = meta
+	hd.stats.Hints++
+	hd.stats.Bytes += meta.size
+}
+
+// unindex forgets the hint, should be called with lk held
+func (hd *handoff) unindex(node, key string) bool {
+	meta, ok := hd.pending[node][key]
+	if !ok {
+		return false
+	}
+	delete(hd.pending[node], key)
+	if len(hd.pending[node]) == 0 {
+		delete(hd.pending, node)
+	}
+	hd.stats.Hints--
+	hd.stats.Bytes -= meta.size
+	return true
+}
+
+func (hd *handoff) updateGauges() {
+	hd.hintsGauge.Set(float64(hd.stats.Hints))
+	hd.bytesGauge.Set(float64(hd.stats.Bytes))
+}
+
+func (hd *handoff) drop(n int) {
+	hd.stats.Dropped += uint64(n)
+	hd.droppedCounter.Add(float64(n))
+}
+
+// add keeps the write for the node, it replaces the former write of the same key
+func (hd *handoff) add(h *hint) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	hd.lk.Lock()
+	defer hd.lk.Unlock()
+	size := int64(len(b))
+	if old, ok := hd.pending[h.Node][h.Key]; ok {
+		size -= old.size
+	}
+	if hd.stats.Bytes+size > hd.maxBytes {
+		hd.drop(1)
+		return errHintSpoolFull
+	}
+	if err := hd.spool.Put(hintKey(h.Node, h.Key), b); err != nil {
+		return err
+	}
+	hd.index(h.Node, h.Key, hintMeta{size: int64(len(b)), time: h.Time})
+	hd.updateGauges()
+	return nil
+}
+
+// remove forgets the write kept for the node, it's called once the node got a newer write of the key
+func (hd *handoff) remove(node, key string) {
+	hd.lk.Lock()
+	defer hd.lk.Unlock()
+	if !hd.unindex(node, key) {
+		return
+	}
+	if err := hd.spool.Delete(hintKey(node, key)); err != nil {
+		logging.Warnf("remove hint %s for %s failed: %s", key, node, err)
+	}
+	hd.updateGauges()
+}
+
+// nodes returns the nodes having hints
+func (hd *handoff) nodes() []string {
+	hd.lk.Lock()
+	defer hd.lk.Unlock()
+	res := make([]string, 0, len(hd.pending))
+	for node := range hd.pending {
+		res = append(res, node)
+	}
+	return res
+}
+
+// keys returns the keys kept for the node
+func (hd *handoff) keys(node string) []string {
+	hd.lk.Lock()
+	defer hd.lk.Unlock()
+	res := make([]string, 0, len(hd.pending[node]))
+	for key := range hd.pending[node] {
+		res = append(res, key)
+	}
+	return res
+}
+
+// get loads the hint, nil if it has been removed
+func (hd *handoff) get(node, key string) (*hint, error) {
+	hd.lk.Lock()
+	defer hd.lk.Unlock()
+	if _, ok := hd.pending[node][key]; !ok {
+		return nil, nil
+	}
+	b, err := hd.spool.Get(hintKey(node, key))
+	if err != nil {
+		return nil, err
+	}
+	h := new(hint)
+	if err := json.Unmarshal(b, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// finish forgets the hint if it hasn't been replaced since it was loaded,
+// replayed tells whether the write reached the node or was dropped
+func (hd *handoff) finish(h *hint, replayed bool) {
+	hd.lk.Lock()
+	defer hd.lk.Unlock()
+	if meta, ok := hd.pending[h.Node][h.Key]; !ok || !meta.time.Equal(h.Time) {
+		return
+	}
+	hd.unindex(h.Node, h.Key)
+	if err := hd.spool.Delete(hintKey(h.Node, h.Key)); err != nil {
+		logging.Warnf("remove hint %s for %s failed: %s", h.Key, h.Node, err)
+	}
+	if replayed {
+		hd.stats.Replayed++
+		hd.replayedCounter.Inc()
+	} else {
+		hd.drop(1)
+	}
+	hd.updateGauges()
+}
+
+// expire drops the hints older than maxAge whatever their nodes, so hints of nodes
+// which never come back don't hold the spool
+func (hd *handoff) expire() {
+	hd.lk.Lock()
+	defer hd.lk.Unlock()
+	var n int
+	for node, keys := range hd.pending {
+		for key, meta := range keys {
+			if time.Since(meta.time) <= hd.maxAge {
+				continue
+			}
+			logging.Warnf("hint %s for %s expired", key, node)
+			hd.unindex(node, key)
+			if err := hd.spool.Delete(hintKey(node, key)); err != nil {
+				logging.Warnf("remove hint %s for %s failed: %s", key, node, err)
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		hd.drop(n)
+		hd.updateGauges()
+	}
+}
+
+func (hd *handoff) hintStats() HintStats {
+	hd.lk.Lock()
+	defer hd.lk.Unlock()
+	return hd.stats
+}
+
+// replaySoon asks the replay loop to run now, e.g. a node has come back
+func (hd *handoff) replaySoon() {
+	select {
+	case hd.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (hd *handoff) close() {
+	close(hd.closing)
+	<-hd.done
+}
+
+// replayLoop replays hints every interval until ctx is done or handoff is closed
+func (d *ClusterClient) replayLoop() {
+	hd := d.handoff
+	defer close(hd.done)
+	ticker := time.NewTicker(hd.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-hd.closing:
+			return
+		case <-ticker.C:
+			d.replayHints()
+		case <-hd.kick:
+			d.replayHints()
+		}
+	}
+}
+
+// replayHints sends the kept writes to the nodes connected again, nodes known dead are skipped.
+// Expired hints are dropped first, whether their nodes are alive or not.
+func (d *ClusterClient) replayHints() {
+	hd := d.handoff
+	hd.expire()
+	for _, node := range hd.nodes() {
+		if d.dead(node) {
+			continue
+		}
+		d.lk.RLock()
+		client, ok := d.nodeMap[node]
+		d.lk.RUnlock()
+		if !ok {
+			// the node has left the cluster, its slots have been migrated
+			for _, key := range hd.keys(node) {
+				if h, err := hd.get(node, key); err == nil && h != nil {
+					hd.finish(h, false)
+				}
+			}
+			continue
+		}
+		if !client.IsTargetConnected() {
+			if err := client.ConnectTarget(); err != nil {
+				continue
+			}
+		}
+		for _, key := range hd.keys(node) {
+			h, err := hd.get(node, key)
+			if err != nil {
+				logging.Warnf("load hint %s for %s failed: %s", key, node, err)
+				continue
+			}
+			if h == nil {
+				continue
+			}
+			if time.Since(h.Time) > hd.maxAge {
+				logging.Warnf("hint %s for %s expired", key, node)
+				hd.finish(h, false)
+				continue
+			}
+			if !d.hintCurrent(h) {
+				logging.Infof("drop hint %s for %s, the key has been written again", key, node)
+				hd.finish(h, false)
+				continue
+			}
+			err = h.apply(client)
+			var re *store.RedirectError
+			switch {
+			case err == nil, h.Delete && xerrors.Is(err, ds.ErrNotFound):
+				err = nil
+				hd.finish(h, true)
+			case xerrors.As(err, &re):
+				// the node doesn't keep the key any more
+				hd.finish(h, false)
+			default:
+				logging.Warnf("replay hint %s for %s failed: %s", key, node, err)
+			}
+			if err != nil && re == nil {
+				// try the node again next time
+				break
+			}
+		}
+	}
+}
+
+// hintCurrent tells whether the hint is still the latest write of its key. Data nodes keep no version
+// of values, so the other replicas which took the write are asked: the hint is stale once any of them
+// holds something else, e.g. another client wrote the key since, and replaying it would overwrite
+// the newer value. The hint is kept while none of them answers.
+func (d *ClusterClient) hintCurrent(h *hint) bool {
+	replicas, err := d.replicasByKey(h.Key)
+	if err != nil {
+		return true
+	}
+	for _, r := range replicas {
+		if r.id == h.Node {
+			continue
+		}
+		var same bool
+		err := d.do(r.client, func(dn core.DataNode) error {
+			v, err := dn.Get(h.Key)
+			switch {
+			case err == ds.ErrNotFound:
+				same = h.Delete
+				return nil
+			case err != nil:
+				return err
+			}
+			same = !h.Delete && bytes.Equal(v, h.Value)
+			return nil
+		})
+		if err == nil && !same {
+			return false
+		}
+	}
+	return true
+}
+
+// HintStats returns the backlog of hinted handoff, all zero if it's disabled
+func (d *ClusterClient) HintStats() HintStats {
+	if d.handoff == nil {
+		return HintStats{}
+	}
+	return d.handoff.hintStats()
+}
+
+func (d *ClusterClient) hintOrWarn(h *hint) {
+	if err := d.handoff.add(h); err != nil {
+		logging.Warnf("keep hint %s for %s failed: %s", h.Key, h.Node, err)
+	}
+}
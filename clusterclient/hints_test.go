@@ -0,0 +1,184 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+)
+
+func TestHandoffSpool(t *testing.T) {
+	ctx := context.Background()
+	spool := ds.NewMapDatastore()
+	hd, err := newHandoff(ctx, spool, config.HintedHandoffConf{MaxBytes: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := hd.add(&hint{Node: "n1", Key: "/a", Value: []byte("v1"), Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	// the latest write of a key replaces the former one
+	if err := hd.add(&hint{Node: "n1", Key: "/a", Value: []byte("v2"), Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hd.add(&hint{Node: "n2", Key: "/b", Delete: true, Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	err = hd.add(&hint{Node: "n2", Key: "/c", Value: make([]byte, 512), Time: now})
+	if !xerrors.Is(err, errHintSpoolFull) {
+		t.Fatalf("expected spool full, got %v", err)
+	}
+	stats := hd.hintStats()
+	if stats.Hints != 2 || stats.Dropped != 1 {
+		t.Fatalf("expected 2 hints and 1 dropped, got %+v", stats)
+	}
+
+	// hints survive restart
+	hd2, err := newHandoff(ctx, spool, config.HintedHandoffConf{MaxBytes: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := hd2.hintStats(); s.Hints != stats.Hints || s.Bytes != stats.Bytes {
+		t.Fatalf("expected %+v after reload, got %+v", stats, s)
+	}
+	h, err := hd2.get("n1", "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Value, []byte("v2")) {
+		t.Fatalf("expected latest value, got %s", h.Value)
+	}
+	hd2.finish(h, true)
+	hd2.remove("n2", "/b")
+	if s := hd2.hintStats(); s.Hints != 0 || s.Bytes != 0 || s.Replayed != 1 {
+		t.Fatalf("expected empty spool, got %+v", s)
+	}
+
+	// expired hints are dropped whatever their nodes
+	if err := hd2.add(&hint{Node: "n3", Key: "/d", Value: []byte("v"), Time: now.Add(-4 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hd2.add(&hint{Node: "n3", Key: "/e", Value: []byte("v"), Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	hd2.expire()
+	if s := hd2.hintStats(); s.Hints != 1 || s.Dropped != 1 {
+		t.Fatalf("expected 1 hint and 1 dropped, got %+v", s)
+	}
+	if has, err := spool.Has(hintKey("n3", "/d")); err != nil || has {
+		t.Fatalf("expected expired hint removed, got %v %v", has, err)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Replication = 3
+	clientCfg.Epoch = 1
+	clientCfg.WriteConsistency = "quorum"
+	clientCfg.HintedHandoff = &config.HintedHandoffConf{ReplayInterval: "100ms"}
+
+	var cfgs []*config.Config
+	var stores []ds.Datastore
+	var servers []core.DataNodeServer
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, store.WithClusterConf(clientCfg.ClusterConf()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Serve()
+		cfgs = append(cfgs, cfg)
+		stores = append(stores, memStore)
+		servers = append(servers, srv)
+	}
+	defer func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}()
+
+	client, err := NewClusterClient(ctx, clientCfg, WithHintStore(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	put := ds.NewKey(tdata[0].Key)
+	del := ds.NewKey(tdata[1].Key)
+	if err := client.Put(del, tdata[1].Value); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first node is down, its writes are kept
+	servers[0].Close()
+	if err := client.Put(put, tdata[0].Value); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(del); err != nil {
+		t.Fatal(err)
+	}
+	// another client writes the key again, the hint kept for it is stale
+	stale := ds.NewKey(tdata[2].Key)
+	if err := client.Put(stale, tdata[2].Value); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range stores[1:] {
+		if err := st.Put(stale, []byte("newer")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := client.HintStats(); stats.Hints != 3 {
+		t.Fatalf("expected 3 hints, got %+v", stats)
+	}
+
+	// the node is back, writes are replayed
+	srv, err := serverWithStore(ctx, cfgs[0], stores[0], store.WithClusterConf(clientCfg.ClusterConf()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Serve()
+	servers[0] = srv
+	for i := 0; ; i++ {
+		stats := client.HintStats()
+		if stats.Hints == 0 {
+			if stats.Replayed != 2 || stats.Dropped != 1 {
+				t.Fatalf("expected 2 writes replayed and 1 dropped, got %+v", stats)
+			}
+			break
+		}
+		if i == 300 {
+			t.Fatalf("hints not replayed, got %+v", stats)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	v, err := stores[0].Get(put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, tdata[0].Value) {
+		t.Fatal("retrived value not match")
+	}
+	if has, _ := stores[0].Has(del); has {
+		t.Fatalf("key %s should be deleted", del)
+	}
+	if has, _ := stores[0].Has(stale); has {
+		t.Fatalf("stale write of %s should not be replayed", stale)
+	}
+}
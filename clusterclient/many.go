@@ -0,0 +1,149 @@
+package clusterclient
+
+import (
+	"context"
+	"sync"
+
+	"github.com/filedrive-team/go-ds-cluster/core"
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// manyChunk is the number of keys of each GetMany or HasMany request, the requests to
+	// a data node are pipelined and their results sent as soon as they arrive
+	manyChunk = 128
+	// manyWorkers bounds the keys read one by one in parallel by GetMany and HasMany
+	manyWorkers = 16
+)
+
+// manyKey is a key asked to a data node, replicated keys missing on it are read one by one
+type manyKey struct {
+	key        string
+	replicated bool
+}
+
+// GetMany fetches the keys from the data nodes keeping them in parallel and sends the results
+// as they arrive, in no particular order. The channel is closed once every key is answered.
+// With ConsistencyOne the keys are asked to their first alive replica with GetMany requests,
+// keys failed or missing there, erasure coded keys and the keys read with other levels
+// are read one by one like Get.
+func (d *ClusterClient) GetMany(ctx context.Context, keys []ds.Key) <-chan core.KeyResult {
+	return d.readMany(ctx, keys, false)
+}
+
+// HasMany checks the keys like GetMany
+func (d *ClusterClient) HasMany(ctx context.Context, keys []ds.Key) <-chan core.KeyResult {
+	return d.readMany(ctx, keys, true)
+}
+
+func (d *ClusterClient) readMany(ctx context.Context, keys []ds.Key, has bool) <-chan core.KeyResult {
+	out := make(chan core.KeyResult, len(keys))
+	single := make(chan string, len(keys))
+	groups := make(map[string][]manyKey)
+	clients := make(map[string]core.DataNodeClient)
+	for _, k := range keys {
+		kstr := k.String()
+		if d.readLevel != ConsistencyOne || d.erasureCode(kstr) != nil {
+			single <- kstr
+			continue
+		}
+		replicas, err := d.replicasByKey(kstr)
+		if err != nil {
+			out <- core.KeyResult{Key: kstr, Err: err}
+			continue
+		}
+		r := replicas[d.aliveFirst(replicas)[0]]
+		groups[r.id] = append(groups[r.id], manyKey{key: kstr, replicated: len(replicas) > 1})
+		clients[r.id] = r.client
+	}
+
+	var chunks sync.WaitGroup
+	for id, mks := range groups {
+		for start := 0; start < len(mks); start += manyChunk {
+			end := start + manyChunk
+			if end > len(mks) {
+				end = len(mks)
+			}
+			chunks.Add(1)
+			go func(client core.DataNodeClient, mks []manyKey) {
+				defer chunks.Done()
+				d.readChunk(ctx, client, mks, has, out, single)
+			}(clients[id], mks[start:end])
+		}
+	}
+	go func() {
+		chunks.Wait()
+		close(single)
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < manyWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for kstr := range single {
+				out <- d.readKey(ctx, kstr, has)
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// readChunk asks the keys to the data node, the keys it doesn't answer are read one by one
+func (d *ClusterClient) readChunk(ctx context.Context, client core.DataNodeClient, mks []manyKey, has bool, out chan<- core.KeyResult, single chan<- string) {
+	keys := make([]string, len(mks))
+	for i, mk := range mks {
+		keys[i] = mk.key
+	}
+	if ctx.Err() != nil {
+		for _, k := range keys {
+			out <- core.KeyResult{Key: k, Err: ctx.Err()}
+		}
+		return
+	}
+	var results []core.KeyResult
+	var err error
+	if has {
+		results, err = client.HasMany(keys)
+	} else {
+		results, err = client.GetMany(keys)
+	}
+	if err != nil {
+		logging.Warnf("read %d keys failed: %s", len(keys), err)
+		for _, k := range keys {
+			single <- k
+		}
+		return
+	}
+	for i, r := range results {
+		if r.Err != nil || (!r.Exists && mks[i].replicated) {
+			single <- r.Key
+			continue
+		}
+		out <- r
+	}
+}
+
+// readKey reads the key like Get or Has
+func (d *ClusterClient) readKey(ctx context.Context, kstr string, has bool) core.KeyResult {
+	if err := ctx.Err(); err != nil {
+		return core.KeyResult{Key: kstr, Err: err}
+	}
+	k := ds.RawKey(kstr)
+	if has {
+		exists, err := d.Has(k)
+		return core.KeyResult{Key: kstr, Exists: exists, Err: err}
+	}
+	v, err := d.Get(k)
+	if err == ds.ErrNotFound {
+		return core.KeyResult{Key: kstr}
+	}
+	if err != nil {
+		return core.KeyResult{Key: kstr, Err: err}
+	}
+	return core.KeyResult{Key: kstr, Value: v, Exists: true}
+}
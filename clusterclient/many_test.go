@@ -0,0 +1,106 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestGetMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, err := serverFromCfg(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+	}
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	values := make(map[string][]byte)
+	keys := []ds.Key{ds.NewKey("missing")}
+	for _, item := range tdata {
+		k := ds.NewKey(item.Key)
+		if err := client.Put(k, item.Value); err != nil {
+			t.Fatal(err)
+		}
+		values[k.String()] = item.Value
+		keys = append(keys, k)
+	}
+
+	answered := 0
+	for r := range client.GetMany(ctx, keys) {
+		answered++
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		v, ok := values[r.Key]
+		if r.Exists != ok {
+			t.Fatalf("%s exists %v, expected %v", r.Key, r.Exists, ok)
+		}
+		if !bytes.Equal(r.Value, v) {
+			t.Fatalf("%s value not match", r.Key)
+		}
+	}
+	if answered != len(keys) {
+		t.Fatalf("expected %d results, got %d", len(keys), answered)
+	}
+	answered = 0
+	for r := range client.HasMany(ctx, keys) {
+		answered++
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if _, ok := values[r.Key]; r.Exists != ok {
+			t.Fatalf("%s exists %v, expected %v", r.Key, r.Exists, ok)
+		}
+	}
+	if answered != len(keys) {
+		t.Fatalf("expected %d results, got %d", len(keys), answered)
+	}
+
+	bs := NewBlockstore(client)
+	cids := make([]cid.Cid, 0, len(tdata)+1)
+	for _, item := range tdata {
+		b := blocks.NewBlock(item.Value)
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, b.Cid())
+	}
+	cids = append(cids, blocks.NewBlock([]byte("missing")).Cid())
+	fetched := 0
+	for b := range bs.GetMany(ctx, cids) {
+		fetched++
+		got, err := bs.Get(b.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.RawData(), b.RawData()) {
+			t.Fatalf("block %s not match", b.Cid())
+		}
+	}
+	if fetched != len(tdata) {
+		t.Fatalf("expected %d blocks, got %d", len(tdata), fetched)
+	}
+}
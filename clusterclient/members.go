@@ -0,0 +1,90 @@
+package clusterclient
+
+import (
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/gossip"
+	"golang.org/x/xerrors"
+)
+
+// errNodeDead is returned for the requests not sent to data nodes known dead
+var errNodeDead = xerrors.New("data node is dead")
+
+// setupMembers observes the liveness of data nodes if the gossip interval is set
+func (d *ClusterClient) setupMembers(interval string) error {
+	if interval == "" {
+		return nil
+	}
+	probe, err := time.ParseDuration(interval)
+	if err != nil {
+		return xerrors.Errorf("invalid gossip interval: %w", err)
+	}
+	if probe <= 0 {
+		return nil
+	}
+	d.members = gossip.NewMembership(d.ctx, d.host, func() []config.Node {
+		d.lk.RLock()
+		defer d.lk.RUnlock()
+		return d.nodes()
+	},
+		gossip.WithProbeInterval(probe),
+		gossip.OnChange(func(m gossip.Member) {
+			// replay the writes kept for the node as soon as it's back
+			if m.State == gossip.StateAlive && d.handoff != nil {
+				d.handoff.replaySoon()
+			}
+		}),
+	)
+	d.members.Start()
+	return nil
+}
+
+// dead tells whether the data node is known dead, it must not be called with lk held
+func (d *ClusterClient) dead(id string) bool {
+	return d.members != nil && d.members.State(id) == gossip.StateDead
+}
+
+// doAlive runs op on the replica unless it's known dead
+func (d *ClusterClient) doAlive(r replica, op func(dn core.DataNode) error) error {
+	if d.dead(r.id) {
+		return errNodeDead
+	}
+	return d.do(r.client, op)
+}
+
+// aliveFirst returns the indexes of the replicas, those known dead come last
+func (d *ClusterClient) aliveFirst(replicas []replica) []int {
+	res := make([]int, 0, len(replicas))
+	var dead []int
+	for j, r := range replicas {
+		if d.dead(r.id) {
+			dead = append(dead, j)
+			continue
+		}
+		res = append(res, j)
+	}
+	return append(res, dead...)
+}
+
+// Members returns the liveness of data nodes, observed by the client if it gossips,
+// asked to the data nodes otherwise
+func (d *ClusterClient) Members() ([]gossip.Member, error) {
+	if d.members != nil {
+		return d.members.Members(), nil
+	}
+	d.lk.RLock()
+	nds := d.nodes()
+	d.lk.RUnlock()
+	var err error
+	for _, nd := range nds {
+		var ms []gossip.Member
+		ms, err = gossip.FetchMembers(d.ctx, d.host, nd)
+		if err == nil {
+			return ms, nil
+		}
+		logging.Warnf("fetch members from %s failed: %s", nd.ID, err)
+	}
+	return nil, xerrors.Errorf("no data node reports members: %w", err)
+}
@@ -0,0 +1,126 @@
+package clusterclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/p2p/gossip"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestDeadReplicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Replication = 3
+	clientCfg.Epoch = 1
+	clientCfg.WriteConsistency = "quorum"
+	clientCfg.GossipInterval = "100ms"
+	// hints are only replayed when the node is found alive again
+	clientCfg.HintedHandoff = &config.HintedHandoffConf{ReplayInterval: "1h"}
+	layout := func() []config.Node {
+		return clientCfg.Nodes
+	}
+
+	start := func(cfg *config.Config, st ds.Datastore) (core.DataNodeServer, *gossip.Membership) {
+		h, err := p2p.HostFromConf(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := store.NewStoreServer(ctx, h, store.PROTOCOL_V1, st, false, store.WithClusterConf(clientCfg.ClusterConf()))
+		m := gossip.NewMembership(ctx, h, layout, gossip.WithProbeInterval(100*time.Millisecond))
+		srv.Serve()
+		m.Serve()
+		m.Start()
+		return srv, m
+	}
+	var cfgs []*config.Config
+	var stores []ds.Datastore
+	var servers []core.DataNodeServer
+	var members []*gossip.Membership
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := ds.NewMapDatastore()
+		srv, m := start(cfg, st)
+		cfgs = append(cfgs, cfg)
+		stores = append(stores, st)
+		servers = append(servers, srv)
+		members = append(members, m)
+	}
+	defer func() {
+		for i := range servers {
+			members[i].Close()
+			servers[i].Close()
+		}
+	}()
+
+	client, err := NewClusterClient(ctx, clientCfg, WithHintStore(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the first node is down and found dead
+	down := clientCfg.Nodes[0].ID
+	members[0].Close()
+	servers[0].Close()
+	waitDead := time.Now().Add(10 * time.Second)
+	for !client.dead(down) {
+		if time.Now().After(waitDead) {
+			t.Fatal("timeout waiting for dead data node")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	ms, err := client.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range ms {
+		if m.ID == down && m.State != gossip.StateDead {
+			t.Fatalf("expected %s dead, got %s", m.ID, m.State)
+		}
+	}
+
+	// writes to the dead replica are kept without trying it
+	key := ds.NewKey(tdata[0].Key)
+	if err := client.Put(key, tdata[0].Value); err != nil {
+		t.Fatal(err)
+	}
+	if stats := client.HintStats(); stats.Hints != 1 {
+		t.Fatalf("expected 1 hint, got %+v", stats)
+	}
+	v, err := client.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != string(tdata[0].Value) {
+		t.Fatal("retrived value not match")
+	}
+
+	// the node is back, the hint is replayed at once
+	servers[0], members[0] = start(cfgs[0], stores[0])
+	for i := 0; ; i++ {
+		if stats := client.HintStats(); stats.Hints == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("hint not replayed, got %+v", client.HintStats())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if has, _ := stores[0].Has(key); !has {
+		t.Fatalf("key %s should be replayed", key)
+	}
+}
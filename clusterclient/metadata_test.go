@@ -0,0 +1,152 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/p2p/meta"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"golang.org/x/xerrors"
+)
+
+func TestMetadataService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Epoch = 1
+	clientCfg.Raft = &config.RaftConf{}
+	seed := clientCfg.ClusterConf()
+	// layouts are proposed by the client through the metadata service, signed by the admin key
+	adminKey := withAdminKey(t, clientCfg)
+	sk, err := clientCfg.AdminPrivKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.GetPublic()
+
+	var rafts []*meta.Raft
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := p2p.HostFromConf(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raft *meta.Raft
+		srv := store.NewStoreServer(ctx, h, store.PROTOCOL_V1, ds.NewMapDatastore(), false,
+			store.WithClusterConf(seed),
+			adminKey,
+			store.WithTopologyProposer(func(m *config.Manifest) error {
+				return raft.Propose(m)
+			}),
+		)
+		defer srv.Close()
+		ts := srv.(store.TopologyServer)
+		raft, err = meta.NewRaft(ctx, h, dssync.MutexWrap(ds.NewMapDatastore()), seed,
+			meta.WithElectionTimeout(300*time.Millisecond),
+			meta.WithHeartbeat(50*time.Millisecond),
+			meta.WithAdminKey(pk),
+			meta.OnApply(func(cc *config.ClusterConf) {
+				ts.UpdateTopology(cc)
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer raft.Close()
+		srv.Serve()
+		raft.Serve()
+		raft.Start()
+		rafts = append(rafts, raft)
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, item := range tdata {
+		if err := client.Put(ds.NewKey(item.Key), item.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the layouts of the migration are agreed by the metadata service
+	to := clientCfg.Nodes[2].ID
+	if err := client.MoveSlots(0, 99, to, nil); err != nil {
+		t.Fatal(err)
+	}
+	epoch := client.ClusterConf().Epoch
+	if epoch != 3 {
+		t.Fatalf("expected epoch 3 after migration, got %d", epoch)
+	}
+	for _, raft := range rafts {
+		cc, err := raft.Layout()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cc.Epoch != epoch {
+			t.Fatalf("expected committed epoch %d, got %d", epoch, cc.Epoch)
+		}
+	}
+
+	// a client started with the former layout fetches the committed one
+	staleCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleCfg.Epoch = 1
+	staleCfg.Raft = &config.RaftConf{}
+	staleCfg.AdminKeyPath = clientCfg.AdminKeyPath
+	stale, err := NewClusterClient(ctx, staleCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Close()
+	if got := stale.ClusterConf().Epoch; got != epoch {
+		t.Fatalf("expected epoch %d fetched, got %d", epoch, got)
+	}
+	nd, err := stale.HashSlots(ds.NewKey(tdata[0].Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect, _ := client.HashSlots(ds.NewKey(tdata[0].Key)); expect.ID != nd.ID {
+		t.Fatalf("expected %s owning %s, got %s", expect.ID, tdata[0].Key, nd.ID)
+	}
+	for _, item := range tdata {
+		v, err := stale.Get(ds.NewKey(item.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+
+	// layouts not following the committed epoch are rejected
+	m, err := config.SignManifest(stale.signer, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.meta.Propose(m); !xerrors.Is(err, meta.ErrStaleLayout) {
+		t.Fatalf("expected stale layout, got %v", err)
+	}
+	// so are the layouts not signed by the admin key
+	next := client.ClusterConf()
+	next.Epoch++
+	if err := stale.meta.Propose(&config.Manifest{Version: next.Epoch, Layout: next}); !xerrors.Is(err, meta.ErrPermissionDenied) {
+		t.Fatalf("expected unsigned layout denied, got %v", err)
+	}
+}
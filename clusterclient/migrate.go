@@ -0,0 +1,762 @@
+package clusterclient
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+)
+
+// applyTimeout bounds how long a data node is waited to apply a layout agreed by the metadata service
+const applyTimeout = 10 * time.Second
+const applyPollInterval = 100 * time.Millisecond
+
+// MigrateProgress reports the state of slots migration after a slot flipped
+type MigrateProgress struct {
+	Slot  uint16
+	From  string
+	To    string
+	Keys  int
+	Done  int
+	Total int
+}
+
+// FlipFunc will be called every time a slot flipped to its new owner,
+// cc is the cluster layout after the flip which should be persisted
+type FlipFunc func(p MigrateProgress, cc *config.ClusterConf) error
+
+// AddNode brings a new data node into the running cluster.
+// Slots are moved from current owners to the new node, a slot flips to
+// the new node only after all of its keys have been moved.
+func (d *ClusterClient) AddNode(nd config.Node, onFlip FlipFunc) error {
+	if d.readOnly {
+		return xerrors.Errorf("readonly client!!!")
+	}
+	d.lk.Lock()
+	moves, err := d.sm.PlanAddNode(nd.Node)
+	if err != nil {
+		d.lk.Unlock()
+		return err
+	}
+	_, known := d.nodeMap[nd.ID]
+	d.sm.SetWeight(nd.ID, nd.Weight)
+	if err := d.addNodeClient(nd); err != nil {
+		d.sm.ForgetWeight(nd.ID)
+		d.lk.Unlock()
+		return err
+	}
+	d.joining = []config.Node{nd}
+	d.lk.Unlock()
+	_, _, err = d.migrate(moves, onFlip)
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if err != nil && len(d.migrating) > 0 {
+		// keys may have been moved to the node already, it's kept joining until the migration is resumed
+		return err
+	}
+	d.joining = nil
+	if err != nil {
+		d.abortJoin(nd.ID, !known)
+	}
+	return err
+}
+
+// abortJoin forgets the node which failed to join unless some slots have flipped to it already,
+// its client is dropped if it was added for the join. It should be called with lk held.
+func (d *ClusterClient) abortJoin(id string, dropClient bool) {
+	if len(d.sm.SlotsOf(id)) > 0 {
+		logging.Warnf("node %s joined partially, it keeps the slots flipped to it", id)
+		return
+	}
+	d.sm.ForgetWeight(id)
+	if !dropClient {
+		return
+	}
+	delete(d.nodeMap, id)
+	delete(d.swarm, id)
+	if pid, err := peer.Decode(id); err == nil {
+		d.host.ConnManager().Unprotect(pid, "cluster-node")
+	}
+}
+
+// RemoveNode drains all slots of the data node to the remaining nodes.
+// The node is marked as leaving during the drain, keys it holds are moved to
+// the new owners and verified there before their slots flip, then the node is removed from the cluster.
+func (d *ClusterClient) RemoveNode(id string, onFlip FlipFunc) (*DrainResult, error) {
+	if d.readOnly {
+		return nil, xerrors.Errorf("readonly client!!!")
+	}
+	d.lk.Lock()
+	moves, err := d.sm.PlanRemoveNode(id)
+	if err != nil {
+		d.lk.Unlock()
+		return nil, err
+	}
+	d.leaving[id] = true
+	d.lk.Unlock()
+
+	listed, verified, err := d.migrate(moves, onFlip)
+	if err != nil {
+		return nil, xerrors.Errorf("drain %s not completed: %w", id, err)
+	}
+
+	d.lk.Lock()
+	delete(d.nodeMap, id)
+	delete(d.swarm, id)
+	delete(d.leaving, id)
+	d.lk.Unlock()
+	if pid, err := peer.Decode(id); err == nil {
+		d.host.ConnManager().Unprotect(pid, "cluster-node")
+	}
+	return &DrainResult{
+		Slots:    len(moves),
+		Keys:     listed,
+		Verified: verified,
+	}, nil
+}
+
+// MoveSlots hands over slots from start to end to an existing node of the cluster
+func (d *ClusterClient) MoveSlots(start, end uint16, to string, onFlip FlipFunc) error {
+	if d.readOnly {
+		return xerrors.Errorf("readonly client!!!")
+	}
+	d.lk.RLock()
+	moves, err := d.sm.PlanMoveSlots(start, end, to)
+	d.lk.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, _, err = d.migrate(moves, onFlip)
+	return err
+}
+
+// Rebalance moves slots between nodes until every node owns its weighted share of slots,
+// e.g. after weights of nodes have been changed
+func (d *ClusterClient) Rebalance(onFlip FlipFunc) error {
+	if d.readOnly {
+		return xerrors.Errorf("readonly client!!!")
+	}
+	d.lk.RLock()
+	moves := d.sm.PlanRebalance()
+	d.lk.RUnlock()
+	_, _, err := d.migrate(moves, onFlip)
+	return err
+}
+
+// ResumeMigration carries on the migration which failed halfway, e.g. after the client restarted
+// with the layout persisted when the migration failed. The slots still migrating are moved to their
+// importing nodes and flipped like the other ones.
+func (d *ClusterClient) ResumeMigration(onFlip FlipFunc) error {
+	if d.readOnly {
+		return xerrors.Errorf("readonly client!!!")
+	}
+	d.lk.Lock()
+	moves := append([]shard.SlotMove(nil), d.migrating...)
+	for _, nd := range d.joining {
+		if len(d.sm.SlotsOf(nd.ID)) == 0 {
+			d.sm.SetWeight(nd.ID, nd.Weight)
+		}
+	}
+	// the primary moves are the ones handed over by current owners of the slots, the other moves
+	// follow from them
+	primary := make([]shard.SlotMove, 0, len(moves))
+	for _, mv := range moves {
+		if mv.Copy {
+			continue
+		}
+		replicas, err := d.sm.ReplicasBySlot(mv.Slot)
+		if err != nil {
+			d.lk.Unlock()
+			return err
+		}
+		if replicas[0].ID == mv.From {
+			primary = append(primary, mv)
+		}
+	}
+	d.lk.Unlock()
+	if len(moves) == 0 {
+		return nil
+	}
+	if _, _, err := d.runMigration(primary, moves, onFlip); err != nil {
+		return err
+	}
+	d.lk.Lock()
+	d.joining = nil
+	d.lk.Unlock()
+	return nil
+}
+
+// DrainResult summarizes a node drain
+type DrainResult struct {
+	Slots    int
+	Keys     int
+	Verified int
+}
+
+// addNodeClient should be called with lk held
+func (d *ClusterClient) addNodeClient(nd config.Node) error {
+	if _, ok := d.nodeMap[nd.ID]; ok {
+		return nil
+	}
+	pid, err := peer.Decode(nd.ID)
+	if err != nil {
+		return err
+	}
+	client, err := makeNodeClient(d.ctx, d.host, nd, d.capability)
+	if err != nil {
+		return err
+	}
+	d.host.ConnManager().Protect(pid, "cluster-node")
+	d.nodeMap[nd.ID] = client
+	d.swarm[nd.ID] = nd.Swarm
+	return nil
+}
+
+func (d *ClusterClient) dataNodeClient(id string) (core.DataNodeClient, error) {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	client, ok := d.nodeMap[id]
+	if !ok {
+		return nil, xerrors.Errorf("can not find DataNodeClient by: %s", id)
+	}
+	return client, nil
+}
+
+// publish bumps the epoch of the cluster layout and pushes the layout to all the data nodes,
+// signed if the client holds the admin key.
+// Failing to push to one of the required nodes is an error, others are only logged.
+// With the metadata service the layout is proposed once, then the required nodes are waited
+// until they have applied it.
+func (d *ClusterClient) publish(required ...string) (*config.ClusterConf, error) {
+	d.lk.Lock()
+	d.epoch++
+	cc := d.clusterConf()
+	clients := make(map[string]core.DataNodeClient, len(d.nodeMap))
+	for id, dc := range d.nodeMap {
+		clients[id] = dc
+	}
+	d.lk.Unlock()
+
+	// data nodes only take the layouts pushed by clients if they are signed by the admin key,
+	// so does the metadata service
+	m := &config.Manifest{Version: cc.Epoch, Layout: cc}
+	if d.signer != nil {
+		var err error
+		if m, err = config.SignManifest(d.signer, cc); err != nil {
+			return nil, xerrors.Errorf("sign cluster layout epoch %d failed: %w", cc.Epoch, err)
+		}
+	}
+	if d.meta != nil {
+		if err := d.meta.Propose(m); err != nil {
+			return nil, xerrors.Errorf("publish cluster layout epoch %d failed: %w", cc.Epoch, err)
+		}
+		for _, id := range required {
+			if err := waitApplied(clients[id], cc.Epoch); err != nil {
+				return nil, xerrors.Errorf("wait cluster layout epoch %d on %s failed: %w", cc.Epoch, id, err)
+			}
+		}
+		return cc, nil
+	}
+	for id, dc := range clients {
+		tc, ok := dc.(store.TopologyClient)
+		if !ok {
+			continue
+		}
+		if err := tc.SetManifest(m); err != nil {
+			for _, r := range required {
+				if r == id {
+					return nil, xerrors.Errorf("push cluster layout epoch %d to %s failed: %w", cc.Epoch, id, err)
+				}
+			}
+			logging.Warnf("push cluster layout epoch %d to %s failed: %s", cc.Epoch, id, err)
+		}
+	}
+	return cc, nil
+}
+
+// waitApplied polls the data node until it knows the epoch
+func waitApplied(dc core.DataNodeClient, epoch uint64) error {
+	tc, ok := dc.(store.TopologyClient)
+	if !ok {
+		return nil
+	}
+	deadline := time.Now().Add(applyTimeout)
+	for {
+		cc, err := tc.GetTopology()
+		if err == nil && cc.Epoch >= epoch {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = xerrors.Errorf("still at epoch %d", cc.Epoch)
+			}
+			return err
+		}
+		time.Sleep(applyPollInterval)
+	}
+}
+
+// migrate moves keys of the slots to their new owners.
+// With replication a primary move changes the replica sets of slots, every node leaving
+// the replica set of a slot hands over the slot to a node joining the set.
+// It returns how many keys were listed and how many keys were verified.
+func (d *ClusterClient) migrate(primary []shard.SlotMove, onFlip FlipFunc) (listed int, verified int, err error) {
+	d.lk.RLock()
+	moves, err := d.sm.ReplicaMoves(primary)
+	d.lk.RUnlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	return d.runMigration(primary, moves, onFlip)
+}
+
+// runMigration moves the keys of the slots, moves are the primary moves along with the replica moves.
+// All the moving slots are published as migrating first, so that a node handing over a slot
+// keeps serving the keys it holds and redirects other requests to the importing node with ErrAsk.
+// Every key is copied to the importing node then deleted from the node handing it over.
+// The slots handed over by a source flip to their new owners, are published and handed to onFlip as soon
+// as all their keys have been moved and found on the importing nodes. With replication, the flips changing
+// the nodes of the cluster change the replica sets of other slots as well, they are left to the end.
+// If the migrating layout can't be published, the former layout is published back. A migration failing
+// later keeps the slots not flipped yet migrating, so that it can be carried on by ResumeMigration.
+func (d *ClusterClient) runMigration(primary, moves []shard.SlotMove, onFlip FlipFunc) (listed int, verified int, err error) {
+	// group slots by source node
+	bySource := make(map[string]map[uint16][]shard.SlotMove)
+	sources := make([]string, 0)
+	required := make([]string, 0)
+	// how many sources are left for every slot
+	remaining := make(map[uint16]int)
+	for _, mv := range moves {
+		if _, ok := bySource[mv.From]; !ok {
+			bySource[mv.From] = make(map[uint16][]shard.SlotMove)
+			sources = append(sources, mv.From)
+		}
+		if _, ok := bySource[mv.From][mv.Slot]; !ok {
+			remaining[mv.Slot]++
+		}
+		bySource[mv.From][mv.Slot] = append(bySource[mv.From][mv.Slot], mv)
+		required = append(required, mv.From, mv.To)
+	}
+	sort.Strings(sources)
+	flips := make(map[uint16]shard.SlotMove, len(primary))
+	for _, mv := range primary {
+		flips[mv.Slot] = mv
+	}
+
+	d.lk.Lock()
+	d.migrating = moves
+	d.lk.Unlock()
+	if _, err := d.publish(required...); err != nil {
+		d.lk.Lock()
+		d.migrating = nil
+		d.lk.Unlock()
+		if _, rerr := d.publish(); rerr != nil {
+			logging.Warnf("publish cluster layout back failed: %s", rerr)
+		}
+		return 0, 0, err
+	}
+
+	fl := &flipper{d: d, onFlip: onFlip, total: len(primary), keys: make(map[uint16]int)}
+	for _, from := range sources {
+		src, err := d.dataNodeClient(from)
+		if err != nil {
+			return listed, verified, err
+		}
+		moving := bySource[from]
+		keys, err := d.slotKeys(src, moving)
+		if err != nil {
+			return listed, verified, xerrors.Errorf("list keys of %s failed: %w", from, err)
+		}
+		if _, err := d.moveKeys(src, moving, keys, false); err != nil {
+			return listed, verified, xerrors.Errorf("move keys of %s failed: %w", from, err)
+		}
+		// keys updated on the source while being moved are left behind, move them as well
+		swept, err := d.slotKeys(src, moving)
+		if err != nil {
+			return listed, verified, xerrors.Errorf("list keys of %s failed: %w", from, err)
+		}
+		if _, err := d.moveKeys(src, moving, swept, true); err != nil {
+			return listed, verified, xerrors.Errorf("sweep keys of %s failed: %w", from, err)
+		}
+		keys = mergeKeys(keys, swept)
+		for slot, ks := range keys {
+			listed += len(ks)
+			if len(ks) > fl.keys[slot] {
+				fl.keys[slot] = len(ks)
+			}
+		}
+		n, err := d.verifyKeys(src, moving, keys)
+		verified += n
+		if err != nil {
+			return listed, verified, xerrors.Errorf("verify keys of %s failed: %w", from, err)
+		}
+
+		slots := make([]int, 0, len(moving))
+		for slot := range moving {
+			slots = append(slots, int(slot))
+		}
+		sort.Ints(slots)
+		done := make([]shard.SlotMove, 0, len(slots))
+		for _, slot := range slots {
+			remaining[uint16(slot)]--
+			if mv, ok := flips[uint16(slot)]; ok && remaining[uint16(slot)] == 0 {
+				done = append(done, mv)
+			}
+		}
+		if err := fl.flip(done); err != nil {
+			return listed, verified, err
+		}
+	}
+	if err := fl.finish(required); err != nil {
+		return listed, verified, err
+	}
+	return listed, verified, nil
+}
+
+// flipper flips the slots whose keys have been moved
+type flipper struct {
+	d      *ClusterClient
+	onFlip FlipFunc
+	total  int
+	done   int
+	// keys counts the keys of every slot
+	keys map[uint16]int
+	// deferred are the flips changing the nodes of a replicated cluster
+	deferred []shard.SlotMove
+}
+
+// flip assigns the slots to their new owners and publishes the layout in which they are not migrating
+// any longer, the flips changing the nodes of a replicated cluster are deferred
+func (f *flipper) flip(mvs []shard.SlotMove) error {
+	d := f.d
+	d.lk.Lock()
+	flipped := make([]shard.SlotMove, 0, len(mvs))
+	slots := make(map[uint16]bool, len(mvs))
+	for _, mv := range mvs {
+		if d.sm.Replication() > 1 {
+			after := d.sm.Clone()
+			if err := after.Assign(mv.Slot, mv.To); err != nil {
+				d.lk.Unlock()
+				return err
+			}
+			if !sameNodes(after.Nodes(), d.sm.Nodes()) {
+				f.deferred = append(f.deferred, mv)
+				continue
+			}
+		}
+		if err := d.sm.Assign(mv.Slot, mv.To); err != nil {
+			d.lk.Unlock()
+			return err
+		}
+		flipped = append(flipped, mv)
+		slots[mv.Slot] = true
+	}
+	if len(flipped) == 0 {
+		d.lk.Unlock()
+		return nil
+	}
+	required := make([]string, 0)
+	migrating := make([]shard.SlotMove, 0, len(d.migrating))
+	for _, m := range d.migrating {
+		if slots[m.Slot] {
+			required = append(required, m.From, m.To)
+			continue
+		}
+		migrating = append(migrating, m)
+	}
+	d.migrating = migrating
+	d.dropJoined()
+	d.lk.Unlock()
+	cc, err := d.publish(required...)
+	if err != nil {
+		return err
+	}
+	for _, mv := range flipped {
+		if err := f.flipped(mv, cc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish flips the deferred slots at once, the slots still migrating are cleared
+func (f *flipper) finish(required []string) error {
+	d := f.d
+	d.lk.Lock()
+	if len(f.deferred) == 0 && len(d.migrating) == 0 {
+		d.lk.Unlock()
+		return nil
+	}
+	for _, mv := range f.deferred {
+		if err := d.sm.Assign(mv.Slot, mv.To); err != nil {
+			d.lk.Unlock()
+			return err
+		}
+	}
+	d.migrating = nil
+	d.dropJoined()
+	d.lk.Unlock()
+	cc, err := d.publish(required...)
+	if err != nil {
+		return err
+	}
+	for _, mv := range f.deferred {
+		if err := f.flipped(mv, cc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *flipper) flipped(mv shard.SlotMove, cc *config.ClusterConf) error {
+	f.done++
+	if f.onFlip == nil {
+		return nil
+	}
+	return f.onFlip(MigrateProgress{
+		Slot:  mv.Slot,
+		From:  mv.From,
+		To:    mv.To,
+		Keys:  f.keys[mv.Slot],
+		Done:  f.done,
+		Total: f.total,
+	}, cc)
+}
+
+// dropJoined forgets the joining nodes owning slots, they are listed with the other nodes.
+// It should be called with lk held.
+func (d *ClusterClient) dropJoined() {
+	joining := d.joining[:0:0]
+	for _, nd := range d.joining {
+		if len(d.sm.SlotsOf(nd.ID)) == 0 {
+			joining = append(joining, nd)
+		}
+	}
+	d.joining = joining
+}
+
+// sameNodes tells whether a and b list the same nodes in the same order
+func sameNodes(a, b []shard.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// asking returns the view of the importing node which accepts keys of migrating slots
+func (d *ClusterClient) asking(id string) (core.DataNode, error) {
+	dc, err := d.dataNodeClient(id)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := dc.(store.TopologyClient); ok {
+		return tc.Asking(), nil
+	}
+	return dc, nil
+}
+
+// slotKeys lists keys of the node which belong to the moving slots
+func (d *ClusterClient) slotKeys(src core.DataNodeClient, moving map[uint16][]shard.SlotMove) (map[uint16][]string, error) {
+	results, err := src.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	keys := make(map[uint16][]string)
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		slot := d.sm.SlotByKey(result.Key)
+		if _, ok := moving[slot]; ok {
+			keys[slot] = append(keys[slot], result.Key)
+		}
+	}
+	return keys, nil
+}
+
+// mergeKeys adds the keys of b missing in a
+func mergeKeys(a, b map[uint16][]string) map[uint16][]string {
+	for slot, ks := range b {
+		seen := make(map[string]bool, len(a[slot]))
+		for _, k := range a[slot] {
+			seen[k] = true
+		}
+		for _, k := range ks {
+			if !seen[k] {
+				a[slot] = append(a[slot], k)
+			}
+		}
+	}
+	return a
+}
+
+// verifyKeys checks every key listed on the source is kept by the importing nodes of its slot.
+// A key missing on an importing node is verified if the source doesn't keep it either, it has been
+// deleted during the migration. It fails on the first key missing while the source still keeps it.
+// It returns how many keys have been verified.
+func (d *ClusterClient) verifyKeys(src core.DataNodeClient, moving map[uint16][]shard.SlotMove, keys map[uint16][]string) (int, error) {
+	var verified int
+	for slot, ks := range keys {
+		dsts := make([]core.DataNode, 0, len(moving[slot]))
+		for _, mv := range moving[slot] {
+			dst, err := d.asking(mv.To)
+			if err != nil {
+				return verified, err
+			}
+			dsts = append(dsts, dst)
+		}
+		for _, k := range ks {
+			missing := ""
+			for i, dst := range dsts {
+				has, err := dst.Has(k)
+				if err != nil {
+					return verified, err
+				}
+				if !has {
+					missing = moving[slot][i].To
+					break
+				}
+			}
+			if missing != "" {
+				has, err := src.Has(k)
+				var re *store.RedirectError
+				if xerrors.As(err, &re) && re.Code == store.ErrAsk {
+					has, err = false, nil
+				}
+				if err != nil {
+					return verified, err
+				}
+				if has {
+					return verified, xerrors.Errorf("%s not found on %s", k, missing)
+				}
+			}
+			verified++
+		}
+	}
+	return verified, nil
+}
+
+// moveKeys copies the keys of the source to the importing nodes of their slots,
+// the keys are deleted from the source unless it keeps the slot.
+// If missingOnly is true, keys of slots kept by the source are only copied to the nodes missing them.
+// It returns how many keys have been moved.
+func (d *ClusterClient) moveKeys(src core.DataNodeClient, moving map[uint16][]shard.SlotMove, keys map[uint16][]string, missingOnly bool) (int, error) {
+	var moved int
+	for slot, ks := range keys {
+		dsts := make([]core.DataNode, 0, len(moving[slot]))
+		keep := false
+		for _, mv := range moving[slot] {
+			dst, err := d.asking(mv.To)
+			if err != nil {
+				return moved, err
+			}
+			dsts = append(dsts, dst)
+			keep = keep || mv.Copy
+		}
+		for _, k := range ks {
+			targets := dsts
+			if keep && missingOnly {
+				targets = make([]core.DataNode, 0, len(dsts))
+				for _, dst := range dsts {
+					has, err := dst.Has(k)
+					if err != nil {
+						return moved, err
+					}
+					if !has {
+						targets = append(targets, dst)
+					}
+				}
+				if len(targets) == 0 {
+					continue
+				}
+			}
+			ok, err := moveKey(src, targets, k, !keep)
+			if err != nil {
+				return moved, xerrors.Errorf("move %s failed: %w", k, err)
+			}
+			if ok {
+				moved++
+			}
+		}
+	}
+	return moved, nil
+}
+
+// moveKey copies the key to the importing nodes then deletes it from the source if remove is true,
+// it returns false if the key has been deleted by others
+func moveKey(src core.DataNode, dsts []core.DataNode, k string, remove bool) (bool, error) {
+	v, err := src.Get(k)
+	if xerrors.Is(err, store.ErrValueTooLarge) {
+		err = streamKey(src, dsts, k)
+	} else if err == nil {
+		for _, dst := range dsts {
+			if err := dst.Put(k, v); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err != nil {
+		var re *store.RedirectError
+		if xerrors.Is(err, ds.ErrNotFound) || (xerrors.As(err, &re) && re.Code == store.ErrAsk) {
+			// deleted during migration
+			return false, nil
+		}
+		return false, err
+	}
+	if remove {
+		if err := src.Delete(k); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// streamKey copies the value larger than store.MaxValueSize to the importing nodes in chunks
+func streamKey(src core.DataNode, dsts []core.DataNode, k string) error {
+	sc, ok := src.(store.StreamClient)
+	if !ok {
+		return errNoStream
+	}
+	writers := make([]store.ValueWriter, 0, len(dsts))
+	ws := make([]io.Writer, 0, len(dsts))
+	for _, dst := range dsts {
+		dc, ok := dst.(store.StreamClient)
+		if !ok {
+			abortWriters(writers)
+			return errNoStream
+		}
+		w, err := dc.PutWriter(k)
+		if err != nil {
+			abortWriters(writers)
+			return err
+		}
+		writers = append(writers, w)
+		ws = append(ws, w)
+	}
+	if err := sc.GetStream(k, io.MultiWriter(ws...)); err != nil {
+		abortWriters(writers)
+		return err
+	}
+	for _, w := range writers {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
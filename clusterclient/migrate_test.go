@@ -0,0 +1,622 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/xerrors"
+)
+
+func TestAddNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminKey := withAdminKey(t, clientCfg)
+
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, adminKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+	}
+
+	// the new data node
+	newCfg, err := config.GenClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newStore := ds.NewMapDatastore()
+	newSrv, err := serverWithStore(ctx, newCfg, newStore, adminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newSrv.Close()
+	newSrv.Serve()
+	stores[newCfg.Identity.PeerID] = newStore
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, item := range tdata {
+		if err := client.Put(ds.NewKey(item.Key), item.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var flips int
+	var layout []config.Node
+	err = client.AddNode(config.Node{
+		Node:  shard.Node{ID: newCfg.Identity.PeerID},
+		Swarm: newCfg.Addresses.Swarm,
+	}, func(p MigrateProgress, cc *config.ClusterConf) error {
+		flips++
+		layout = cc.Nodes
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flips != shard.SLOTS_NUM/4 {
+		t.Fatalf("expected %d slots flipped, got %d", shard.SLOTS_NUM/4, flips)
+	}
+	if len(layout) != 4 {
+		t.Fatalf("expected 4 nodes after adding node, got %d", len(layout))
+	}
+
+	for _, item := range tdata {
+		v, err := client.Get(ds.NewKey(item.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+
+	// every key should only be kept by its owner
+	sm, err := shard.RestoreSlotsManager(shardNodes(layout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int
+	for id, st := range stores {
+		results, err := st.Query(dsq.Query{KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents, err := results.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ent := range ents {
+			nd, err := sm.NodeByKey(ent.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nd.ID != id {
+				t.Fatalf("key %s should be kept by %s, found on %s", ent.Key, nd.ID, id)
+			}
+		}
+		total += len(ents)
+	}
+	if total != len(tdata) {
+		t.Fatalf("expected %d keys in cluster, got %d", len(tdata), total)
+	}
+}
+
+func TestResumeMigration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminKey := withAdminKey(t, clientCfg)
+
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, adminKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+	}
+	newCfg, err := config.GenClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newStore := ds.NewMapDatastore()
+	newSrv, err := serverWithStore(ctx, newCfg, newStore, adminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newSrv.Close()
+	newSrv.Serve()
+	stores[newCfg.Identity.PeerID] = newStore
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range tdata {
+		if err := client.Put(ds.NewKey(item.Key), item.Value); err != nil {
+			client.Close()
+			t.Fatal(err)
+		}
+	}
+
+	// the migration stops once the slots of the first source flipped
+	errStop := xerrors.New("stop")
+	var flips int
+	err = client.AddNode(config.Node{
+		Node:  shard.Node{ID: newCfg.Identity.PeerID},
+		Swarm: newCfg.Addresses.Swarm,
+	}, func(p MigrateProgress, cc *config.ClusterConf) error {
+		flips++
+		return errStop
+	})
+	if !xerrors.Is(err, errStop) {
+		client.Close()
+		t.Fatalf("expected migration stopped, got %v", err)
+	}
+	cc := client.ClusterConf()
+	if len(cc.Migrating) == 0 {
+		client.Close()
+		t.Fatal("expected slots still migrating")
+	}
+	if len(cc.Nodes) != 4 {
+		client.Close()
+		t.Fatalf("expected slots flipped to the new node, got %d nodes", len(cc.Nodes))
+	}
+	// keys are served during the migration
+	for _, item := range tdata {
+		v, err := client.Get(ds.NewKey(item.Key))
+		if err != nil {
+			client.Close()
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			client.Close()
+			t.Fatal("retrived value not match")
+		}
+	}
+	client.Close()
+
+	// a client restarted with the persisted layout carries on
+	clientCfg.SetClusterConf(cc)
+	client, err = NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var layout *config.ClusterConf
+	err = client.ResumeMigration(func(p MigrateProgress, cc *config.ClusterConf) error {
+		flips++
+		layout = cc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout == nil || len(layout.Migrating) != 0 || len(layout.Joining) != 0 {
+		t.Fatalf("expected migration completed, got %+v", layout)
+	}
+	sm, err := shard.RestoreSlotsManager(shardNodes(layout.Nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sm.SlotsOf(newCfg.Identity.PeerID)); n != shard.SLOTS_NUM/4 {
+		t.Fatalf("expected %d slots owned by the new node, got %d", shard.SLOTS_NUM/4, n)
+	}
+	for _, item := range tdata {
+		v, err := client.Get(ds.NewKey(item.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+	for id, st := range stores {
+		results, err := st.Query(dsq.Query{KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents, err := results.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ent := range ents {
+			nd, err := sm.NodeByKey(ent.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nd.ID != id {
+				t.Fatalf("key %s should be kept by %s, found on %s", ent.Key, nd.ID, id)
+			}
+		}
+	}
+}
+
+func TestAddNodeFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminKey := withAdminKey(t, clientCfg)
+
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, err := serverWithStore(ctx, cfg, ds.NewMapDatastore(), adminKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the new data node is not running
+	newCfg, err := config.GenClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddNode(config.Node{
+		Node:  shard.Node{ID: newCfg.Identity.PeerID, Weight: 8},
+		Swarm: newCfg.Addresses.Swarm,
+	}, nil)
+	if err == nil {
+		t.Fatal("adding an unreachable node should fail")
+	}
+	if _, err := client.dataNodeClient(newCfg.Identity.PeerID); err == nil {
+		t.Fatal("client of the node failed to join should be dropped")
+	}
+	if n := len(client.Nodes()); n != 3 {
+		t.Fatalf("expected 3 nodes, got %d", n)
+	}
+	client.lk.RLock()
+	sm := client.sm.Clone()
+	client.lk.RUnlock()
+	// the weight of the node is forgotten as well
+	if err := sm.Assign(0, newCfg.Identity.PeerID); err != nil {
+		t.Fatal(err)
+	}
+	for _, nd := range sm.Nodes() {
+		if nd.ID == newCfg.Identity.PeerID && nd.Weight != 0 {
+			t.Fatalf("expected weight of the node forgotten, got %d", nd.Weight)
+		}
+	}
+}
+
+// withAdminKey gives the client the admin key to sign the layouts it publishes,
+// the option returned makes data nodes accept them
+func withAdminKey(t *testing.T, cfg *config.Config) store.ServerOption {
+	keyPath := filepath.Join(t.TempDir(), config.DefaultAdminKeyFile)
+	b, err := config.GenAdminKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := crypto.UnmarshalPublicKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.AdminKeyPath = keyPath
+	return store.WithAdminKey(pk)
+}
+
+func serverWithStore(ctx context.Context, cfg *config.Config, st ds.Datastore, opts ...store.ServerOption) (core.DataNodeServer, error) {
+	h, err := p2p.HostFromConf(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return store.NewStoreServer(ctx, h, store.PROTOCOL_V1, st, false, opts...), nil
+}
+
+func TestRemoveNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leavingID := clientCfg.Nodes[2].ID
+	adminKey := withAdminKey(t, clientCfg)
+
+	// data nodes should learn the node is leaving during drain
+	var sawLeaving int32
+	onUpdate := store.OnTopologyUpdate(func(cc *config.ClusterConf) {
+		for _, nd := range cc.Nodes {
+			if nd.ID == leavingID && nd.Leaving {
+				atomic.StoreInt32(&sawLeaving, 1)
+			}
+		}
+	})
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, onUpdate, adminKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, item := range tdata {
+		if err := client.Put(ds.NewKey(item.Key), item.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := stores[leavingID].Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents, err := results.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var layout []config.Node
+	res, err := client.RemoveNode(leavingID, func(p MigrateProgress, cc *config.ClusterConf) error {
+		layout = cc.Nodes
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&sawLeaving) == 0 {
+		t.Fatal("node should be marked as leaving during drain")
+	}
+	if res.Keys != len(ents) || res.Verified != len(ents) {
+		t.Fatalf("expected %d keys drained, got %d keys, %d verified", len(ents), res.Keys, res.Verified)
+	}
+	if len(layout) != 2 {
+		t.Fatalf("expected 2 nodes after removing node, got %d", len(layout))
+	}
+	for _, nd := range layout {
+		if nd.ID == leavingID {
+			t.Fatal("leaving node should be removed from nodes")
+		}
+	}
+
+	for _, item := range tdata {
+		v, err := client.Get(ds.NewKey(item.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+}
+
+func TestVerifyKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		// data nodes without layout serve every key
+		srv, err := serverWithStore(ctx, cfg, memStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		ids = append(ids, cfg.Identity.PeerID)
+		stores[cfg.Identity.PeerID] = memStore
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	from, to := ids[0], ids[1]
+	src, err := client.dataNodeClient(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := func(ks ...string) (map[uint16][]shard.SlotMove, map[uint16][]string) {
+		moving := make(map[uint16][]shard.SlotMove)
+		res := make(map[uint16][]string)
+		for _, k := range ks {
+			slot := client.sm.SlotByKey(k)
+			moving[slot] = []shard.SlotMove{{Slot: slot, From: from, To: to}}
+			res[slot] = append(res[slot], k)
+		}
+		return moving, res
+	}
+
+	// keys on the new owner are verified, and keys deleted during the migration as well
+	moved := ds.NewKey("/moved")
+	if err := stores[to].Put(moved, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	moving, ks := keys(moved.String(), "/deleted")
+	n, err := client.verifyKeys(src, moving, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 keys verified, got %d", n)
+	}
+
+	// keys still on the source only are not
+	left := ds.NewKey("/left")
+	if err := stores[from].Put(left, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	moving, ks = keys(left.String())
+	if _, err := client.verifyKeys(src, moving, ks); err == nil {
+		t.Fatal("expected key missing on the new owner")
+	}
+}
+
+func TestAddNodeReplicated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Replication = 2
+	adminKey := withAdminKey(t, clientCfg)
+
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, adminKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+	}
+	newCfg, err := config.GenClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newStore := ds.NewMapDatastore()
+	newSrv, err := serverWithStore(ctx, newCfg, newStore, adminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newSrv.Close()
+	newSrv.Serve()
+	stores[newCfg.Identity.PeerID] = newStore
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, item := range tdata {
+		if err := client.Put(ds.NewKey(item.Key), item.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var layout *config.ClusterConf
+	err = client.AddNode(config.Node{
+		Node:  shard.Node{ID: newCfg.Identity.PeerID},
+		Swarm: newCfg.Addresses.Swarm,
+	}, func(p MigrateProgress, cc *config.ClusterConf) error {
+		layout = cc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.Replication != 2 || len(layout.Nodes) != 4 {
+		t.Fatalf("unexpected layout: replication %d, %d nodes", layout.Replication, len(layout.Nodes))
+	}
+
+	// every key should be kept by exactly its replicas
+	sm, err := shard.RestoreSlotsManager(shardNodes(layout.Nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.SetReplication(layout.Replication)
+	for _, item := range tdata {
+		k := ds.NewKey(item.Key)
+		nds, err := sm.ReplicasByKey(k.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]bool{nds[0].ID: true, nds[1].ID: true}
+		for id, st := range stores {
+			has, err := st.Has(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has != expected[id] {
+				t.Fatalf("key %s kept by %s: %v, expected %v", k, id, has, expected[id])
+			}
+		}
+		v, err := client.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, item.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+}
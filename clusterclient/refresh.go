@@ -0,0 +1,90 @@
+package clusterclient
+
+import (
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/p2p/share"
+	"golang.org/x/xerrors"
+)
+
+// setupRefresh pulls the cluster layout periodically if the refresh interval is set
+func (d *ClusterClient) setupRefresh(interval string) error {
+	if interval == "" {
+		return nil
+	}
+	every, err := time.ParseDuration(interval)
+	if err != nil {
+		return xerrors.Errorf("invalid refresh interval: %w", err)
+	}
+	if every <= 0 {
+		return nil
+	}
+	d.refreshStop = make(chan struct{})
+	d.refreshDone = make(chan struct{})
+	go d.refreshLoop(every)
+	return nil
+}
+
+func (d *ClusterClient) refreshLoop(every time.Duration) {
+	defer close(d.refreshDone)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.refreshStop:
+			return
+		case <-ticker.C:
+			if err := d.Refresh(); err != nil {
+				logging.Warnf("refresh cluster layout failed: %s", err)
+			}
+		}
+	}
+}
+
+// Refresh pulls the cluster layout from the data nodes and switches to it if it's newer.
+// The layout committed by the metadata service is used if it's enabled, with the admin key
+// only layouts signed by it are taken.
+func (d *ClusterClient) Refresh() error {
+	if d.meta != nil {
+		return d.SyncLayout()
+	}
+	d.lk.RLock()
+	nds := d.nodes()
+	epoch := d.epoch
+	d.lk.RUnlock()
+	var cc *config.ClusterConf
+	if d.adminKey != nil {
+		m, err := share.FetchManifest(d.ctx, d.host, nds, d.adminKey, epoch)
+		if err != nil {
+			return err
+		}
+		cc = m.Layout
+	} else {
+		var err error
+		if cc, err = share.FetchClusterConf(d.ctx, d.host, nds); err != nil {
+			return err
+		}
+	}
+	return d.UpdateClusterConf(cc)
+}
+
+// UpdateClusterConf swaps in the cluster layout if it's newer than the one known by the client.
+// Clients of new data nodes are created, those of the nodes gone are dropped,
+// requests in flight finish with the clients they started with.
+func (d *ClusterClient) UpdateClusterConf(cc *config.ClusterConf) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.applyClusterConf(cc)
+}
+
+// stopRefresh waits for the refresh loop to exit
+func (d *ClusterClient) stopRefresh() {
+	if d.refreshStop == nil {
+		return
+	}
+	close(d.refreshStop)
+	<-d.refreshDone
+}
@@ -0,0 +1,185 @@
+package clusterclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/p2p/share"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/xerrors"
+)
+
+// the layout of the first two nodes, the third one joins at epoch 2
+var twoNodes = `[
+	{"id":"12D3KooWM1dWYafTFGJc6Kq5XYX6RRbQTCbZ58kXFWsjdHREJtCB","slots":{"start":0,"end":8191},"swarm":["/ip4/0.0.0.0/tcp/9690"]},
+	{"id":"12D3KooWQHrRAyak1wYc9u27Tu9HnAqkafdWhZkaohSP834igaiZ","slots":{"start":8192,"end":16383},"swarm":["/ip4/0.0.0.0/tcp/9691"]}
+]`
+
+func TestRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var cfgs []*config.Config
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Epoch = 2
+		h, err := p2p.HostFromConf(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := store.NewStoreServer(ctx, h, store.PROTOCOL_V1, ds.NewMapDatastore(), false, store.WithClusterConf(cfg.ClusterConf()))
+		defer srv.Close()
+		srv.Serve()
+		shareSrv := share.NewShareServer(ctx, h, cfg)
+		shareSrv.Serve()
+		cfgs = append(cfgs, cfg)
+	}
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Nodes = nil
+	if err := json.Unmarshal([]byte(twoNodes), &clientCfg.Nodes); err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Epoch = 1
+	clientCfg.RefreshInterval = "100ms"
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the node joined is picked up without restarting the client
+	third := cfgs[2].Identity.PeerID
+	for i := 0; ; i++ {
+		if _, err := client.dataNodeClient(third); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("timeout waiting for the cluster layout refreshed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if cc := client.ClusterConf(); cc.Epoch != 2 || len(cc.Nodes) != 3 {
+		t.Fatalf("expected 3 nodes at epoch 2, got %d at epoch %d", len(cc.Nodes), cc.Epoch)
+	}
+	for _, d := range tdata {
+		if err := client.Put(ds.NewKey(d.Key), d.Value); err != nil {
+			t.Fatal(err)
+		}
+		v, err := client.Get(ds.NewKey(d.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != string(d.Value) {
+			t.Fatal("retrived value not match")
+		}
+	}
+
+	// the first node leaves, its client is dropped
+	cc := cfgs[0].ClusterConf()
+	cc.Epoch = 3
+	cc.Nodes = cc.Nodes[1:]
+	cc.Nodes[0].Slots.Start = 0
+	if err := client.UpdateClusterConf(cc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.dataNodeClient(cfgs[0].Identity.PeerID); err == nil {
+		t.Fatal("expected the client of the node gone dropped")
+	}
+	// older layouts are ignored
+	if err := client.UpdateClusterConf(cfgs[0].ClusterConf()); err != nil {
+		t.Fatal(err)
+	}
+	if cc := client.ClusterConf(); cc.Epoch != 3 || len(cc.Nodes) != 2 {
+		t.Fatalf("expected 2 nodes at epoch 3, got %d at epoch %d", len(cc.Nodes), cc.Epoch)
+	}
+}
+
+func TestRefreshSigned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sk, pk, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkb, err := crypto.MarshalPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfgs []*config.Config
+	for i, str := range []string{srv1cfg, srv2cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Epoch = 2
+		h, err := p2p.HostFromConf(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first node keeps the layout unsigned
+		opt := store.WithClusterConf(cfg.ClusterConf())
+		if i == 1 {
+			m, err := config.SignManifest(sk, cfg.ClusterConf())
+			if err != nil {
+				t.Fatal(err)
+			}
+			opt = store.WithManifest(m)
+		}
+		srv := store.NewStoreServer(ctx, h, store.PROTOCOL_V1, ds.NewMapDatastore(), false, opt, store.WithAdminKey(pk))
+		defer srv.Close()
+		srv.Serve()
+		cfgs = append(cfgs, cfg)
+	}
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Nodes = nil
+	if err := json.Unmarshal([]byte(twoNodes), &clientCfg.Nodes); err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Epoch = 1
+	clientCfg.AdminKey = pkb
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	dc, err := client.dataNodeClient(cfgs[0].Identity.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.refresh(dc, 2); !xerrors.Is(err, config.ErrInvalidManifest) {
+		t.Fatalf("expected unsigned layout refused, got %v", err)
+	}
+	if epoch := client.ClusterConf().Epoch; epoch != 1 {
+		t.Fatalf("expected epoch 1, got %d", epoch)
+	}
+	dc, err = client.dataNodeClient(cfgs[1].Identity.PeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.refresh(dc, 2); err != nil {
+		t.Fatal(err)
+	}
+	if cc := client.ClusterConf(); cc.Epoch != 2 || len(cc.Nodes) != 3 {
+		t.Fatalf("expected 3 nodes at epoch 2, got %d at epoch %d", len(cc.Nodes), cc.Epoch)
+	}
+}
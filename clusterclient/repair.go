@@ -0,0 +1,53 @@
+package clusterclient
+
+import (
+	"github.com/filedrive-team/go-ds-cluster/core"
+)
+
+// readRepair runs once the read answered the caller: the replicas not asked by the read are asked as well,
+// the answers are resolved again and the winning value is written back to the replicas missing the key or
+// keeping another value. rest if not nil gives the answers arriving after the read returned.
+// Replicas failing to answer are not repaired, and nothing is written when no replica keeps the key.
+func (d *ClusterClient) readRepair(kstr string, replicas []replica, op func(dn core.DataNode) (answer, error), answers []result, rest func() []result) {
+	all := make([]result, 0, len(replicas))
+	all = append(all, answers...)
+	if rest != nil {
+		all = append(all, rest()...)
+	}
+	asked := make(map[int]bool, len(all))
+	for _, res := range all {
+		asked[res.idx] = true
+	}
+	for j, r := range replicas {
+		if asked[j] {
+			continue
+		}
+		var ans answer
+		err := d.doAlive(r, func(dn core.DataNode) (e error) {
+			ans, e = op(dn)
+			return
+		})
+		if err != nil {
+			continue
+		}
+		all = append(all, result{idx: j, ans: ans})
+	}
+
+	ans := resolve(all)
+	if !ans.found {
+		return
+	}
+	for _, res := range all {
+		if res.ans.equal(ans) {
+			continue
+		}
+		r := replicas[res.idx]
+		logging.Infof("read repair %s on %s", kstr, r.id)
+		err := d.do(r.client, func(dn core.DataNode) error {
+			return dn.Put(kstr, ans.value)
+		})
+		if err != nil {
+			logging.Warnf("read repair %s on %s failed: %s", kstr, r.id, err)
+		}
+	}
+}
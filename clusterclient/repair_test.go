@@ -0,0 +1,133 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestReadRepair(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg.Replication = 3
+	clientCfg.Epoch = 1
+	sm, err := shard.RestoreSlotsManager(shardNodes(clientCfg.Nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.SetReplication(3)
+
+	stores := make(map[string]ds.Datastore)
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memStore := ds.NewMapDatastore()
+		srv, err := serverWithStore(ctx, cfg, memStore, store.WithClusterConf(clientCfg.ClusterConf()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+		stores[cfg.Identity.PeerID] = memStore
+	}
+
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	waitRepaired := func(k ds.Key, value []byte, nds ...shard.Node) {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			var repaired int
+			for _, nd := range nds {
+				v, err := stores[nd.ID].Get(k)
+				if err == nil && bytes.Equal(v, value) {
+					repaired++
+				}
+			}
+			if repaired == len(nds) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("key %s was not repaired", k)
+	}
+
+	// the key is missing on the primary, replicas after the one having the key are read in background
+	// and the replicas missing it are repaired
+	k := ds.NewKey(tdata[0].Key)
+	nds, err := sm.ReplicasByKey(k.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[nds[1].ID].Put(k, tdata[0].Value); err != nil {
+		t.Fatal(err)
+	}
+	v, err := client.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, tdata[0].Value) {
+		t.Fatal("retrived value not match")
+	}
+	waitRepaired(k, tdata[0].Value, nds...)
+
+	// the last replica lost the key, the read answered by the primary repairs it
+	k = ds.NewKey(tdata[2].Key)
+	nds, err = sm.ReplicasByKey(k.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nd := range nds[:2] {
+		if err := stores[nd.ID].Put(k, tdata[2].Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err = client.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, tdata[2].Value) {
+		t.Fatal("retrived value not match")
+	}
+	waitRepaired(k, tdata[2].Value, nds...)
+
+	// the value differs on the last replica, the majority wins
+	k = ds.NewKey(tdata[1].Key)
+	nds, err = sm.ReplicasByKey(k.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := []byte("stale value")
+	for i, nd := range nds {
+		value := tdata[1].Value
+		if i == 2 {
+			value = stale
+		}
+		if err := stores[nd.ID].Put(k, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err = client.With(WithReadConsistency(ConsistencyQuorum)).Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, tdata[1].Value) {
+		t.Fatal("retrived value not match")
+	}
+	waitRepaired(k, tdata[1].Value, nds...)
+}
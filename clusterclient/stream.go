@@ -0,0 +1,214 @@
+package clusterclient
+
+import (
+	"io"
+	"sync"
+
+	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+)
+
+// errNoStream is returned for the data node clients not streaming values
+var errNoStream = xerrors.New("data node client doesn't stream values")
+
+// PutStream puts the value read from r to the replicas of the key in chunks of store.ChunkSize,
+// so values larger than store.MaxValueSize can be put. The write is acknowledged like Put,
+// but the replicas unreachable are not hinted since the value is not kept.
+// Erasure coded keys are not streamed.
+func (d *ClusterClient) PutStream(k ds.Key, r io.Reader) error {
+	if d.readOnly {
+		return xerrors.Errorf("readonly client!!!")
+	}
+	kstr := k.String()
+	if d.erasureCode(kstr) != nil {
+		return xerrors.Errorf("%s is erasure coded, put it with Put", kstr)
+	}
+	var err error
+	for i := 0; i < maxRedirects; i++ {
+		var replicas []replica
+		replicas, err = d.replicasByKey(kstr)
+		if err != nil {
+			return err
+		}
+		writers, errs := d.openWriters(kstr, replicas)
+		var moved bool
+		var opened int
+		for j, e := range errs {
+			var re *store.RedirectError
+			if xerrors.As(e, &re) {
+				moved = true
+				err = xerrors.Errorf("write %s to %s failed: %w", kstr, replicas[j].id, e)
+				d.refreshOrWarn(replicas[j].client, re.Epoch)
+			}
+			if e == nil {
+				opened++
+			}
+		}
+		if moved {
+			abortWriters(writers)
+			continue
+		}
+		// nothing is read from r unless enough replicas may acknowledge the write
+		if opened < d.writeLevel.required(len(replicas)) {
+			abortWriters(writers)
+			_, err = d.settle(kstr, replicas, errs, nil)
+			return err
+		}
+
+		fw := &fanoutWriter{writers: writers, errs: errs}
+		if _, err := io.Copy(fw, r); err != nil && err != errNoReplica {
+			abortWriters(writers)
+			return err
+		}
+		var wg sync.WaitGroup
+		for j, w := range writers {
+			if w == nil || errs[j] != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(j int, w store.ValueWriter) {
+				defer wg.Done()
+				errs[j] = w.Close()
+			}(j, w)
+		}
+		wg.Wait()
+		_, err = d.settle(kstr, replicas, errs, nil)
+		return err
+	}
+	return err
+}
+
+// openWriters opens the writers of the value of the key on the replicas in parallel
+func (d *ClusterClient) openWriters(kstr string, replicas []replica) ([]store.ValueWriter, []error) {
+	writers := make([]store.ValueWriter, len(replicas))
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for j, r := range replicas {
+		wg.Add(1)
+		go func(j int, r replica) {
+			defer wg.Done()
+			errs[j] = d.doAlive(r, func(dn core.DataNode) error {
+				sc, ok := dn.(store.StreamClient)
+				if !ok {
+					return errNoStream
+				}
+				w, err := sc.PutWriter(kstr)
+				if err != nil {
+					return err
+				}
+				writers[j] = w
+				return nil
+			})
+		}(j, r)
+	}
+	wg.Wait()
+	return writers, errs
+}
+
+func abortWriters(writers []store.ValueWriter) {
+	for _, w := range writers {
+		if w != nil {
+			w.Abort()
+		}
+	}
+}
+
+// errNoReplica stops copying the value once every replica failed
+var errNoReplica = xerrors.New("no replica left to write")
+
+// fanoutWriter writes to every replica not failed yet, a failed replica is aborted and
+// its error kept in errs
+type fanoutWriter struct {
+	writers []store.ValueWriter
+	errs    []error
+}
+
+func (fw *fanoutWriter) Write(p []byte) (int, error) {
+	var live int
+	for j, w := range fw.writers {
+		if w == nil || fw.errs[j] != nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			fw.errs[j] = err
+			w.Abort()
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errNoReplica
+	}
+	return len(p), nil
+}
+
+// GetStream writes the value of the key to w in chunks of store.ChunkSize, so values larger
+// than store.MaxValueSize can be got. The value is read from one replica whatever the read
+// consistency level, the replicas are asked in turn, those known dead last, as long as
+// nothing is written to w. Erasure coded keys are not streamed.
+func (d *ClusterClient) GetStream(k ds.Key, w io.Writer) error {
+	kstr := k.String()
+	if d.erasureCode(kstr) != nil {
+		return xerrors.Errorf("%s is erasure coded, get it with Get", kstr)
+	}
+	cw := &countWriter{w: w}
+	var err error
+	for i := 0; i < maxRedirects; i++ {
+		var replicas []replica
+		replicas, err = d.replicasByKey(kstr)
+		if err != nil {
+			return err
+		}
+		var moved, notFound bool
+		for _, j := range d.aliveFirst(replicas) {
+			r := replicas[j]
+			e := d.do(r.client, func(dn core.DataNode) error {
+				sc, ok := dn.(store.StreamClient)
+				if !ok {
+					return errNoStream
+				}
+				return sc.GetStream(kstr, cw)
+			})
+			if e == nil {
+				return nil
+			}
+			if cw.n > 0 {
+				return xerrors.Errorf("read %s from %s failed: %w", kstr, r.id, e)
+			}
+			if e == ds.ErrNotFound {
+				notFound = true
+				continue
+			}
+			logging.Warnf("read %s from %s failed: %s", kstr, r.id, e)
+			err = xerrors.Errorf("read %s from %s failed: %w", kstr, r.id, e)
+			var re *store.RedirectError
+			if xerrors.As(e, &re) {
+				moved = true
+				d.refreshOrWarn(r.client, re.Epoch)
+				break
+			}
+		}
+		if moved {
+			continue
+		}
+		if notFound {
+			return ds.ErrNotFound
+		}
+		return err
+	}
+	return err
+}
+
+// countWriter counts the bytes written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,68 @@
+package clusterclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/xerrors"
+)
+
+func TestStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, str := range []string{srv1cfg, srv2cfg, srv3cfg} {
+		cfg, err := cfgFromString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, err := serverFromCfg(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Serve()
+	}
+
+	clientCfg, err := cfgFromString(c1cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClusterClient(ctx, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), (store.MaxValueSize+store.ChunkSize/2)/16)
+	if err := client.Put(ds.NewKey("large"), large); !xerrors.Is(err, store.ErrValueTooLarge) {
+		t.Fatalf("expected too large error, got %v", err)
+	}
+	for _, item := range tdata {
+		k := ds.NewKey(item.Key)
+		if err := client.PutStream(k, bytes.NewReader(large)); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := client.GetStream(k, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), large) {
+			t.Fatalf("%s value not match", k)
+		}
+		size, err := client.GetSize(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != len(large) {
+			t.Fatalf("%s size %d, expected %d", k, size, len(large))
+		}
+	}
+	var buf bytes.Buffer
+	if err := client.GetStream(ds.NewKey("missing"), &buf); err != ds.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"time"
 
 	"github.com/filedrive-team/go-ds-cluster/config"
 	log "github.com/ipfs/go-log/v2"
@@ -24,6 +26,7 @@ func main() {
 	local := []*cli.Command{
 		clientCmd,
 		clusterCmd,
+		capabilityCmd,
 	}
 
 	app := &cli.App{
@@ -47,6 +50,28 @@ var clusterCmd = &cli.Command{
 			Required: true,
 			Usage:    "specify the cluster node number",
 		},
+		&cli.IntSliceFlag{
+			Name:  "weights",
+			Usage: "specify weight of each node, e.g. disk capacity in TB, nodes get slots in proportion to weights",
+		},
+		&cli.BoolFlag{
+			Name:  "hash-tag",
+			Usage: "only hash the part of keys between \"{\" and \"}\" if there is one, to keep related keys on the same node",
+		},
+		&cli.IntFlag{
+			Name:  "replication",
+			Value: 1,
+			Usage: "how many nodes keep each slot, the primary owner included",
+		},
+		&cli.BoolFlag{
+			Name:  "raft",
+			Usage: "replicate the cluster layout between data nodes with raft",
+		},
+		&cli.DurationFlag{
+			Name:  "join-token-ttl",
+			Value: 24 * time.Hour,
+			Usage: "how long the join tokens of the other data nodes are valid",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		outdir := c.Args().First()
@@ -63,20 +88,50 @@ var clusterCmd = &cli.Command{
 		}
 
 		nodeNum := c.Int("cluster-node-number")
-		clustercfg, err := config.GenClusterConf(nodeNum)
+		replication := c.Int("replication")
+		if replication < 1 || replication > nodeNum {
+			return xerrors.Errorf("replication should be between 1 and %d", nodeNum)
+		}
+		clustercfg, err := config.GenClusterConf(nodeNum, c.IntSlice("weights"))
+		if err != nil {
+			return err
+		}
+		clustercfg.HashTag = c.Bool("hash-tag")
+		clustercfg.Replication = replication
+		if c.Bool("raft") {
+			clustercfg.Raft = &config.RaftConf{}
+		}
+		// the bootstrap node keeps the admin key and signs the cluster manifests
+		clustercfg.AdminKeyPath = config.DefaultAdminKeyFile
+		clustercfg.AdminKey, err = config.GenAdminKey(path.Join(outdir, config.DefaultAdminKeyFile))
 		if err != nil {
 			return err
 		}
+		// data nodes and clients only talk to the peers sharing the swarm key
+		clustercfg.SwarmKeyPath = config.DefaultSwarmKeyFile
+		if err := config.GenSwarmKey(path.Join(outdir, config.DefaultSwarmKeyFile)); err != nil {
+			return err
+		}
 
 		cfgbytes, err := json.MarshalIndent(&clustercfg, "", "\t")
 		if err != nil {
 			return err
 		}
-		err = ioutil.WriteFile(path.Join(outdir, config.DefaultConfigJson), cfgbytes, 0644)
+		err = ioutil.WriteFile(path.Join(outdir, config.DefaultConfigJson), cfgbytes, 0600)
 		if err != nil {
 			return err
 		}
 
+		// the other data nodes generate their own keys and join with a one-time token
+		tokens, err := clustercfg.JoinTokens(c.Duration("join-token-ttl"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("admin key: %s\n", base64.StdEncoding.EncodeToString(clustercfg.AdminKey))
+		fmt.Printf("swarm key: %s, copy it to the other data nodes and clients over a secure channel\n", path.Join(outdir, config.DefaultSwarmKeyFile))
+		for i, token := range tokens {
+			fmt.Printf("join token of node %d: %s\n", i+1, token)
+		}
 		return nil
 	},
 }
@@ -84,7 +139,12 @@ var clusterCmd = &cli.Command{
 var clientCmd = &cli.Command{
 	Name:  "client",
 	Usage: "generate a client config file",
-	Flags: []cli.Flag{},
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "swarm-key",
+			Usage: "swarm key file of the cluster, it's kept next to the config file",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		outpath := c.Args().First()
 		if outpath == "" {
@@ -94,6 +154,12 @@ var clientCmd = &cli.Command{
 		if err != nil {
 			return err
 		}
+		if keypath := c.String("swarm-key"); keypath != "" {
+			clientCfg.SwarmKeyPath, err = config.InstallSwarmKey(keypath, path.Dir(outpath))
+			if err != nil {
+				return err
+			}
+		}
 		cfgbytes, err := json.MarshalIndent(clientCfg, "", "\t")
 		if err != nil {
 			return err
@@ -101,3 +167,46 @@ var clientCmd = &cli.Command{
 		return ioutil.WriteFile(outpath, cfgbytes, 0644)
 	},
 }
+
+var capabilityCmd = &cli.Command{
+	Name:  "capability",
+	Usage: "issue a capability granting permissions on the data nodes to a client",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "admin-key-file",
+			Required: true,
+			Usage:    "the private admin key generated by dscfg cluster",
+		},
+		&cli.StringFlag{
+			Name:     "peer",
+			Required: true,
+			Usage:    "peer id of the client",
+		},
+		&cli.StringSliceFlag{
+			Name:     "perms",
+			Required: true,
+			Usage:    "permissions granted, any of read, write, delete and topology",
+		},
+		&cli.DurationFlag{
+			Name:  "ttl",
+			Value: 24 * time.Hour,
+			Usage: "how long the capability is valid",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		keypath, err := homedir.Expand(c.String("admin-key-file"))
+		if err != nil {
+			return err
+		}
+		sk, err := config.LoadAdminKey(keypath)
+		if err != nil {
+			return err
+		}
+		token, err := config.IssueCapability(sk, c.String("peer"), c.StringSlice("perms"), c.Duration("ttl"))
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	},
+}
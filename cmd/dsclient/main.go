@@ -15,6 +15,7 @@ import (
 	"github.com/filedrive-team/go-ds-cluster/config"
 	"github.com/filedrive-team/go-ds-cluster/p2p"
 	"github.com/filedrive-team/go-ds-cluster/p2p/share"
+	"github.com/filedrive-team/go-ds-cluster/shard"
 	"github.com/filedrive-team/go-ds-cluster/utils"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
@@ -26,9 +27,7 @@ import (
 	log "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-merkledag"
 	ufsio "github.com/ipfs/go-unixfs/io"
-	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/mitchellh/go-homedir"
-	ma "github.com/multiformats/go-multiaddr"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
 )
@@ -48,6 +47,13 @@ func main() {
 		initCmd,
 		hashslotCmd,
 		boundCmd,
+		addNodeCmd,
+		removeNodeCmd,
+		slotsCmd,
+		moveSlotsCmd,
+		rebalanceCmd,
+		resumeMigrationCmd,
+		membersCmd,
 	}
 
 	app := &cli.App{
@@ -317,6 +323,304 @@ var boundCmd = &cli.Command{
 	},
 }
 
+var addNodeCmd = &cli.Command{
+	Name:  "add-node",
+	Usage: "add a data node to the running cluster and migrate slots to it",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "id",
+			Required: true,
+			Usage:    "peer id of the new data node",
+		},
+		&cli.StringSliceFlag{
+			Name:     "swarm",
+			Required: true,
+			Usage:    "swarm address of the new data node",
+		},
+		&cli.IntFlag{
+			Name:  "weight",
+			Value: 1,
+			Usage: "weight of the new data node, decides its share of slots, e.g. according to disk capacity",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		confPath := c.String("conf")
+		confPath, err := homedir.Expand(confPath)
+		if err != nil {
+			return err
+		}
+		cfgPath := path.Join(confPath, config.DefaultConfigJson)
+		cfg, err := config.ReadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		client, err := clusterclient.NewClusterClient(context.Background(), cfg)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		nd := config.Node{
+			Node: shard.Node{
+				ID:     c.String("id"),
+				Weight: c.Int("weight"),
+			},
+			Swarm: c.StringSlice("swarm"),
+		}
+		err = client.AddNode(nd, persistFlip(cfgPath, cfg))
+		if err != nil {
+			return saveMigrating(cfgPath, cfg, client, err)
+		}
+		fmt.Printf("node %s added, cluster layout epoch %d saved to %s\n", nd.ID, cfg.Epoch, cfgPath)
+		return nil
+	},
+}
+
+var removeNodeCmd = &cli.Command{
+	Name:  "remove-node",
+	Usage: "drain slots of a data node to the remaining nodes and remove it from the cluster",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "id",
+			Required: true,
+			Usage:    "peer id of the data node to be removed",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		confPath := c.String("conf")
+		confPath, err := homedir.Expand(confPath)
+		if err != nil {
+			return err
+		}
+		cfgPath := path.Join(confPath, config.DefaultConfigJson)
+		cfg, err := config.ReadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		client, err := clusterclient.NewClusterClient(context.Background(), cfg)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		id := c.String("id")
+		res, err := client.RemoveNode(id, persistFlip(cfgPath, cfg))
+		if err != nil {
+			return saveMigrating(cfgPath, cfg, client, err)
+		}
+		fmt.Printf("node %s removed, %d slots drained, %d keys listed, %d keys verified on new owners\n", id, res.Slots, res.Keys, res.Verified)
+		fmt.Printf("cluster layout epoch %d saved to %s, the node can be shut down\n", cfg.Epoch, cfgPath)
+		return nil
+	},
+}
+
+var resumeMigrationCmd = &cli.Command{
+	Name:  "resume-migration",
+	Usage: "carry on the slots migration saved when add-node, remove-node, move-slots or rebalance failed halfway",
+	Action: func(c *cli.Context) error {
+		confPath := c.String("conf")
+		confPath, err := homedir.Expand(confPath)
+		if err != nil {
+			return err
+		}
+		cfgPath := path.Join(confPath, config.DefaultConfigJson)
+		cfg, err := config.ReadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		if len(cfg.Migrating) == 0 {
+			fmt.Println("no slot is migrating")
+			return nil
+		}
+		client, err := clusterclient.NewClusterClient(context.Background(), cfg)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		if err := client.ResumeMigration(persistFlip(cfgPath, cfg)); err != nil {
+			return saveMigrating(cfgPath, cfg, client, err)
+		}
+		cfg.SetClusterConf(client.ClusterConf())
+		if err := config.WriteConfig(cfgPath, cfg); err != nil {
+			return err
+		}
+		fmt.Printf("slots migration completed, cluster layout epoch %d saved to %s\n", cfg.Epoch, cfgPath)
+		return nil
+	},
+}
+
+// persistFlip persists the layout after every flip, flipped slots survive an interrupted migration
+func persistFlip(cfgPath string, cfg *config.Config) clusterclient.FlipFunc {
+	return func(p clusterclient.MigrateProgress, cc *config.ClusterConf) error {
+		cfg.SetClusterConf(cc)
+		if err := config.WriteConfig(cfgPath, cfg); err != nil {
+			return err
+		}
+		fmt.Printf("[%d/%d] slot %d moved from %s to %s, %d keys\n", p.Done, p.Total, p.Slot, p.From, p.To, p.Keys)
+		return nil
+	}
+}
+
+// saveMigrating persists the slots still migrating after the migration failed, so it can be resumed
+func saveMigrating(cfgPath string, cfg *config.Config, client *clusterclient.ClusterClient, err error) error {
+	cc := client.ClusterConf()
+	if len(cc.Migrating) == 0 {
+		return err
+	}
+	cfg.SetClusterConf(cc)
+	if werr := config.WriteConfig(cfgPath, cfg); werr != nil {
+		return xerrors.Errorf("%w, save the migrating slots failed: %s", err, werr)
+	}
+	return xerrors.Errorf("%w, the migrating slots are saved to %s, carry on with resume-migration", err, cfgPath)
+}
+
+var slotsCmd = &cli.Command{
+	Name:  "slots",
+	Usage: "print the slot table of the cluster",
+	Action: func(c *cli.Context) error {
+		confPath := c.String("conf")
+		confPath, err := homedir.Expand(confPath)
+		if err != nil {
+			return err
+		}
+		cfg, err := config.ReadConfig(path.Join(confPath, config.DefaultConfigJson))
+		if err != nil {
+			return err
+		}
+		if err := cfg.CheckNodes(); err != nil {
+			return err
+		}
+		replication := cfg.Replication
+		if replication < 1 {
+			replication = 1
+		}
+		fmt.Printf("epoch: %d, replication: %d\n", cfg.Epoch, replication)
+		for _, nd := range cfg.Nodes {
+			fmt.Printf("id: %s, weight: %d, slots: %d", nd.ID, nd.SlotsWeight(), nd.SlotsNum())
+			if nd.Leaving {
+				fmt.Printf(", leaving")
+			}
+			fmt.Printf("\n")
+			for _, sr := range nd.SlotRanges() {
+				fmt.Printf("\t%d-%d\n", sr.Start, sr.End)
+			}
+		}
+		return nil
+	},
+}
+
+var moveSlotsCmd = &cli.Command{
+	Name:  "move-slots",
+	Usage: "move a range of slots to a data node of the cluster along with the data",
+	Flags: []cli.Flag{
+		&cli.UintFlag{
+			Name:     "start",
+			Required: true,
+			Usage:    "the first slot to be moved",
+		},
+		&cli.UintFlag{
+			Name:     "end",
+			Required: true,
+			Usage:    "the last slot to be moved",
+		},
+		&cli.StringFlag{
+			Name:     "to",
+			Required: true,
+			Usage:    "peer id of the data node receiving the slots",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		confPath := c.String("conf")
+		confPath, err := homedir.Expand(confPath)
+		if err != nil {
+			return err
+		}
+		cfgPath := path.Join(confPath, config.DefaultConfigJson)
+		cfg, err := config.ReadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		start, end := c.Uint("start"), c.Uint("end")
+		if end >= shard.SLOTS_NUM || start > end {
+			return xerrors.Errorf("invalid slots range %d-%d", start, end)
+		}
+		client, err := clusterclient.NewClusterClient(context.Background(), cfg)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		err = client.MoveSlots(uint16(start), uint16(end), c.String("to"), persistFlip(cfgPath, cfg))
+		if err != nil {
+			return saveMigrating(cfgPath, cfg, client, err)
+		}
+		fmt.Printf("slots %d-%d moved, cluster layout epoch %d saved to %s\n", start, end, cfg.Epoch, cfgPath)
+		return nil
+	},
+}
+
+var rebalanceCmd = &cli.Command{
+	Name:  "rebalance",
+	Usage: "move slots between data nodes until every node owns the share of slots according to its weight",
+	Action: func(c *cli.Context) error {
+		confPath := c.String("conf")
+		confPath, err := homedir.Expand(confPath)
+		if err != nil {
+			return err
+		}
+		cfgPath := path.Join(confPath, config.DefaultConfigJson)
+		cfg, err := config.ReadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		client, err := clusterclient.NewClusterClient(context.Background(), cfg)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		err = client.Rebalance(persistFlip(cfgPath, cfg))
+		if err != nil {
+			return saveMigrating(cfgPath, cfg, client, err)
+		}
+		fmt.Printf("cluster rebalanced, cluster layout epoch %d saved to %s\n", cfg.Epoch, cfgPath)
+		return nil
+	},
+}
+
+var membersCmd = &cli.Command{
+	Name:  "members",
+	Usage: "print the liveness of data nodes detected by gossip",
+	Action: func(c *cli.Context) error {
+		confPath := c.String("conf")
+		confPath, err := homedir.Expand(confPath)
+		if err != nil {
+			return err
+		}
+		cfg, err := config.ReadConfig(path.Join(confPath, config.DefaultConfigJson))
+		if err != nil {
+			return err
+		}
+		// a client just started knows nothing, ask the view of the data nodes
+		cfg.GossipInterval = ""
+		client, err := clusterclient.NewClusterClient(context.Background(), cfg)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		members, err := client.Members()
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			fmt.Printf("id: %s, state: %s, incarnation: %d\n", m.ID, m.State, m.Incarnation)
+		}
+		return nil
+	},
+}
+
 var statCmd = &cli.Command{
 	Name:  "stat",
 	Usage: "",
@@ -443,9 +747,17 @@ var getCmd = &cli.Command{
 var initCmd = &cli.Command{
 	Name: "init",
 	Flags: []cli.Flag{
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:  "bootstrapper",
-			Usage: "",
+			Usage: "p2p address of a data node to retrieve cluster info from, can be repeated and is tried in order",
+		},
+		&cli.StringFlag{
+			Name:  "swarm-key",
+			Usage: "swarm key file copied from the cluster, it's kept in the config dir",
+		},
+		&cli.StringFlag{
+			Name:  "admin-key",
+			Usage: "base64 public admin key, the cluster info is taken from the manifest signed by it",
 		},
 	},
 	Usage: "",
@@ -468,12 +780,28 @@ var initCmd = &cli.Command{
 			}
 		}
 		ctxbg := context.Background()
-		bootstrapper := c.String("bootstrapper")
-		if len(cfg.Nodes) == 0 {
-			if bootstrapper == "" {
+		bootstrappers := c.StringSlice("bootstrapper")
+		if keypath := c.String("swarm-key"); keypath != "" {
+			if cfg.SwarmKeyPath, err = config.InstallSwarmKey(keypath, confPath); err != nil {
+				return err
+			}
+			if len(cfg.Nodes) > 0 {
+				if err := config.WriteConfig(path.Join(confPath, config.DefaultConfigJson), cfg); err != nil {
+					return err
+				}
+			}
+		}
+		if s := c.String("admin-key"); s != "" {
+			if cfg.AdminKey, _, err = config.ParseAdminKey(s); err != nil {
+				return err
+			}
+		}
+		// signed cluster info is refreshed from the bootstrappers, older manifests are refused
+		if len(cfg.Nodes) == 0 || (len(cfg.AdminKey) > 0 && len(bootstrappers) > 0) {
+			if len(bootstrappers) == 0 {
 				return xerrors.Errorf("missing cluster nodes config info")
 			}
-			err = initClientConfig(ctxbg, cfg, confPath, bootstrapper)
+			err = initClientConfig(ctxbg, cfg, confPath, bootstrappers)
 			if err != nil {
 				logging.Error(err)
 				return err
@@ -488,33 +816,50 @@ var initCmd = &cli.Command{
 	},
 }
 
-func initClientConfig(ctxbg context.Context, cfg *config.Config, confPath, bootstrapper string) (err error) {
-	h1, err := p2p.MakeBasicHost(utils.RandPort())
+func initClientConfig(ctxbg context.Context, cfg *config.Config, confPath string, bootstrappers []string) (err error) {
+	// the identity of the client is used so that data nodes with an allowlist accept it
+	h1, err := p2p.HostFromConf(cfg)
 	if err != nil {
 		return
 	}
 	defer h1.Close()
-	baddr, err := ma.NewMultiaddr(bootstrapper)
-	if err != nil {
-		return
-	}
-	pinfo, err := peer.AddrInfoFromP2pAddr(baddr)
+
+	pk, err := cfg.AdminPubKey()
 	if err != nil {
-		return
+		return xerrors.Errorf("invalid admin key: %w", err)
 	}
-
-	client := share.NewShareClient(ctxbg, h1, *pinfo)
-
-	bs, err := client.GetClusterInfo()
+	cc := &config.ClusterConf{}
+	err = share.Bootstrap(ctxbg, h1, bootstrappers, func(client *share.Client) error {
+		if pk != nil {
+			bs, err := client.GetManifest()
+			if err != nil {
+				return err
+			}
+			var current uint64
+			if cfg.Manifest != nil {
+				current = cfg.Manifest.Version
+			}
+			m, err := config.ParseManifest(bs, pk, current)
+			if err != nil {
+				return err
+			}
+			cfg.Manifest = m
+			cc = m.Layout
+			return nil
+		}
+		bs, err := client.GetClusterConf()
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(bs, cc)
+	})
 	if err != nil {
 		return
 	}
-	nodes := make([]config.Node, 0)
-	err = json.Unmarshal(bs, &nodes)
-	if err != nil {
+	cfg.SetClusterConf(cc)
+	if err = cfg.CheckNodes(); err != nil {
 		return
 	}
-	cfg.Nodes = nodes
 	cfgbs, err := json.MarshalIndent(cfg, "", "\t")
 	if err != nil {
 		return
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/p2p/store"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+)
+
+// Allowlist gates the connections of the data node if the allowlist is configured, nil otherwise
+func Allowlist(cfg *config.Config) (*p2p.Allowlist, error) {
+	if cfg.Allowlist == nil {
+		return nil, nil
+	}
+	if err := cfg.Allowlist.Check(); err != nil {
+		return nil, err
+	}
+	al := p2p.NewAllowlist()
+	updateAllowlist(al, cfg)
+	return al, nil
+}
+
+// permissions returns the allowlist checking the requests of peers, al if the connections are
+// restricted by it. Otherwise peers not listed are allowed everything but publishing layouts.
+func permissions(al *p2p.Allowlist, cfg *config.Config) *p2p.Allowlist {
+	if al != nil {
+		return al
+	}
+	al = p2p.NewAllowlist()
+	al.AllowOthers(config.RolePerms(config.RoleWrite))
+	updateAllowlist(al, cfg)
+	return al
+}
+
+// updateAllowlist follows the nodes of the layout, the bootstrap node accepts unknown peers
+// while nodes are pending so that they can join with their tokens
+func updateAllowlist(al *p2p.Allowlist, cfg *config.Config) {
+	var clients []config.ClientPeer
+	var open bool
+	if cfg.Allowlist != nil {
+		clients = cfg.Allowlist.Clients
+		open = cfg.Allowlist.Open
+	}
+	if cfg.BootstrapNode {
+		for _, nd := range cfg.Nodes {
+			if nd.Pending {
+				open = true
+			}
+		}
+	}
+	al.Update(cfg.Nodes, clients, open)
+}
+
+// maxCapabilities bounds the capabilities kept verified
+const maxCapabilities = 1024
+
+// authorize checks the permission needed by each request, granted to the peer by the allowlist
+// or by the capability signed by the admin key presented with the request
+func authorize(al *p2p.Allowlist, adminKey crypto.PubKey) func(p peer.ID, act store.Act, token string) error {
+	// capabilities are verified once per peer
+	var lk sync.Mutex
+	verified := make(map[string]*config.Capability)
+	parse := func(token string, p peer.ID) (*config.Capability, error) {
+		key := p.Pretty() + "/" + token
+		lk.Lock()
+		c, ok := verified[key]
+		lk.Unlock()
+		if ok && time.Now().Unix() <= c.Expire {
+			return c, nil
+		}
+		c, err := config.ParseCapability(token, adminKey, p.Pretty())
+		if err != nil {
+			return nil, err
+		}
+		lk.Lock()
+		defer lk.Unlock()
+		if len(verified) >= maxCapabilities {
+			verified = make(map[string]*config.Capability)
+		}
+		verified[key] = c
+		return c, nil
+	}
+	return func(p peer.ID, act store.Act, token string) error {
+		perm := act.Perm()
+		if al.Allows(p, perm) {
+			return nil
+		}
+		if token == "" {
+			return xerrors.Errorf("%s needs the %q permission", act, perm)
+		}
+		if adminKey == nil {
+			return xerrors.New("capabilities are not accepted without the admin key")
+		}
+		c, err := parse(token, p)
+		if err != nil {
+			return err
+		}
+		if !c.Allows(perm) {
+			return xerrors.Errorf("%s needs the %q permission", act, perm)
+		}
+		return nil
+	}
+}
@@ -10,23 +10,30 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
 	"github.com/filedrive-team/go-ds-cluster/mutcaskds"
 	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/p2p/antientropy"
+	"github.com/filedrive-team/go-ds-cluster/p2p/gossip"
+	"github.com/filedrive-team/go-ds-cluster/p2p/meta"
 	"github.com/filedrive-team/go-ds-cluster/p2p/share"
 	"github.com/filedrive-team/go-ds-cluster/p2p/store"
-	"github.com/filedrive-team/go-ds-cluster/utils"
 	ds "github.com/ipfs/go-datastore"
 	log "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/mitchellh/go-homedir"
 	ma "github.com/multiformats/go-multiaddr"
 	"go.uber.org/fx"
+	"golang.org/x/xerrors"
 )
 
 var logging = log.Logger("dscluster")
@@ -34,16 +41,26 @@ var confpath string
 var mutcask string
 var loglevel string
 var disableDelete string
-var identityIdx int
+var joinToken string
 var bootstrapper string
+var adminKey string
+var swarmKey string
+
+const defaultAntiEntropyInterval = 10 * time.Minute
+
+const defaultGossipInterval = time.Second
+
+const joinManifestTimeout = 10 * time.Second
 
 func main() {
 	flag.StringVar(&confpath, "conf", config.DefaultConfigPath, "")
 	flag.StringVar(&mutcask, "mutcask", "", "")
 	flag.StringVar(&loglevel, "log-level", "error", "")
 	flag.StringVar(&disableDelete, "disable-delete", "", "")
-	flag.IntVar(&identityIdx, "identity", 0, "get node identity from bootstrap node")
-	flag.StringVar(&bootstrapper, "bootstrapper", "", "")
+	flag.StringVar(&joinToken, "join-token", "", "join token issued by the bootstrap node, the node generates its own key and takes the place of a pending node")
+	flag.StringVar(&bootstrapper, "bootstrapper", "", "comma separated p2p addresses of bootstrap nodes to join the cluster through, tried in order")
+	flag.StringVar(&adminKey, "admin-key", "", "base64 public admin key, the layout fetched when joining must be signed by it")
+	flag.StringVar(&swarmKey, "swarm-key", "", "swarm key file copied from the bootstrap node, it's kept in the config dir")
 	flag.Parse()
 	log.SetLogLevel("*", loglevel)
 	var disabledel bool
@@ -68,9 +85,9 @@ func main() {
 	}
 	cfg, err := config.ReadConfig(path.Join(confpath, config.DefaultConfigJson))
 	if err != nil {
-		// other nodes get identity and cluster nodes info from bootstrap node
-		if identityIdx > 0 && bootstrapper != "" {
-			cfg, err = initClusterConfig(ctxbg, confpath, bootstrapper, disabledel)
+		// other nodes join the cluster through bootstrap nodes
+		if bootstrapper != "" && joinToken != "" {
+			cfg, err = initClusterConfig(ctxbg, confpath, strings.Split(bootstrapper, ","), joinToken, adminKey, swarmKey, disabledel)
 			if err != nil {
 				logging.Error(err)
 				return
@@ -81,16 +98,15 @@ func main() {
 		}
 	}
 	// bootstrap node should hold the cluster nodes info
-	if cfg.BootstrapNode && (len(cfg.Nodes) == 0 || len(cfg.IdentityList) == 0) {
-		logging.Error("Bootstrap node but doesn't hold cluster nodes info or doesn't hold indentity info")
+	if cfg.BootstrapNode && len(cfg.Nodes) == 0 {
+		logging.Error("Bootstrap node but doesn't hold cluster nodes info")
 		return
 	}
-	// todo:
-	// currently use idx 0 identity as bootstrap node
-	// need a way make it more flexible
-	if cfg.BootstrapNode && cfg.Identity.PeerID != cfg.IdentityList[0].PeerID {
-		logging.Error("Bootstrap node identity not match")
-		return
+	if len(cfg.Nodes) > 0 {
+		if err := cfg.CheckNodes(); err != nil {
+			logging.Errorf("invalid slot table of cluster nodes: %s", err)
+			return
+		}
 	}
 
 	cfg.ConfPath = confpath
@@ -126,6 +142,7 @@ func main() {
 		confOption,
 		dsOption,
 		fx.Provide(
+			Allowlist,
 			BasicHost,
 			ProtocolID,
 		),
@@ -150,39 +167,241 @@ func main() {
 	}
 }
 
-func Kickoff(lc fx.Lifecycle, h host.Host, pid protocol.ID, ds ds.Datastore, cfg *config.Config) {
+func Kickoff(lc fx.Lifecycle, h host.Host, pid protocol.ID, ds ds.Datastore, cfg *config.Config, al *p2p.Allowlist) error {
 	ctx, cancel := context.WithCancel(context.Background())
-	server := store.NewStoreServer(ctx, h, pid, ds, cfg.DisableDelete)
+	var server core.DataNodeServer
+	var raft *meta.Raft
+	var ms *manifests
+	// every data node hands out cluster info so that nodes and clients can bootstrap from any of them,
+	// the bootstrap node admits the nodes joining with the tokens it issued
+	var shareOpts []share.ServerOption
 	var shareSrv *share.Server
 	if cfg.BootstrapNode {
-		shareSrv = share.NewShareServer(ctx, h, cfg)
+		shareOpts = append(shareOpts, share.WithJoin(func(cc *config.ClusterConf) error {
+			if raft != nil {
+				// the leader takes the layout if it's signed by the admin key held by the node, or from a voter
+				return raft.Propose(ms.proposal(cc))
+			}
+			if err := server.(store.TopologyServer).UpdateTopology(cc); err != nil {
+				return err
+			}
+			// the layout has been signed on update if the node holds the admin key
+			m := shareSrv.Manifest()
+			if m == nil || m.Version != cc.Epoch {
+				m = &config.Manifest{Version: cc.Epoch, Layout: cc}
+			}
+			go pushTopology(ctx, h, m)
+			return nil
+		}))
+	}
+	shareSrv = share.NewShareServer(ctx, h, cfg, shareOpts...)
+	var cfgLk sync.Mutex
+	perms := permissions(al, cfg)
+	ms, err := newManifests(ctx, h, cfg, &cfgLk, shareSrv)
+	if err != nil {
+		cancel()
+		return err
+	}
+	// persist the cluster layout pushed by the client migrating slots
+	opts := []store.ServerOption{
+		store.OnTopologyUpdate(func(cc *config.ClusterConf) {
+			cfgLk.Lock()
+			defer cfgLk.Unlock()
+			shareSrv.SetClusterConf(cc)
+			if m := ms.sign(cc); m != nil {
+				if err := server.(store.TopologyServer).ApplyManifest(m); err != nil {
+					logging.Warnf("keep cluster manifest version %d failed: %s", m.Version, err)
+				}
+			}
+			updateAllowlist(perms, cfg)
+			if err := config.WriteConfig(path.Join(cfg.ConfPath, config.DefaultConfigJson), cfg); err != nil {
+				logging.Errorf("persist cluster layout epoch %d failed: %s", cc.Epoch, err)
+			}
+		}),
+	}
+	switch {
+	case cfg.Manifest != nil && cfg.Manifest.Version == cfg.Epoch:
+		opts = append(opts, store.WithManifest(cfg.Manifest))
+	case len(cfg.Nodes) > 0:
+		opts = append(opts, store.WithClusterConf(cfg.ClusterConf()))
+	}
+	adminKey, err := cfg.AdminPubKey()
+	if err != nil {
+		cancel()
+		return xerrors.Errorf("invalid admin key: %w", err)
+	}
+	// layouts are only taken from the nodes of the cluster, or from clients holding the admin key
+	if adminKey != nil {
+		opts = append(opts, store.WithAdminKey(adminKey))
+	}
+	opts = append(opts, store.WithAuthorizer(authorize(perms, adminKey)))
+	if cfg.Raft != nil {
+		// layouts pushed by clients are agreed by the metadata service before being applied
+		opts = append(opts, store.WithTopologyProposer(func(m *config.Manifest) error {
+			return raft.Propose(m)
+		}))
+	}
+	server = store.NewStoreServer(ctx, h, pid, ds, cfg.DisableDelete, opts...)
+	var closeRaftStore func() error
+	if cfg.Raft != nil {
+		raft, closeRaftStore, err = metadataService(ctx, h, cfg, server.(store.TopologyServer))
+		if err != nil {
+			cancel()
+			return err
+		}
+	}
+	// replicas compare their slots with anti-entropy so cold data converges after outages
+	ae := antientropy.NewAntiEntropy(ctx, h, ds, func() *config.ClusterConf {
+		cfgLk.Lock()
+		defer cfgLk.Unlock()
+		if len(cfg.Nodes) == 0 {
+			return nil
+		}
+		return cfg.ClusterConf()
+	})
+	aeInterval := defaultAntiEntropyInterval
+	if cfg.AntiEntropyInterval != "" {
+		d, err := time.ParseDuration(cfg.AntiEntropyInterval)
+		if err != nil {
+			logging.Errorf("invalid anti-entropy interval: %s", err)
+		} else {
+			aeInterval = d
+		}
+	}
+	// data nodes gossip liveness so that clients observing them route around dead nodes
+	var members *gossip.Membership
+	gossipInterval := defaultGossipInterval
+	if cfg.GossipInterval != "" {
+		d, err := time.ParseDuration(cfg.GossipInterval)
+		if err != nil {
+			logging.Errorf("invalid gossip interval: %s", err)
+		} else {
+			gossipInterval = d
+		}
+	}
+	if gossipInterval > 0 {
+		members = gossip.NewMembership(ctx, h, func() []config.Node {
+			cfgLk.Lock()
+			defer cfgLk.Unlock()
+			return cfg.Nodes
+		}, gossip.WithProbeInterval(gossipInterval))
 	}
 
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) (err error) {
 			defer cancel()
-			if cfg.BootstrapNode {
-				err = shareSrv.Close()
+			ae.Close()
+			if ms != nil {
+				ms.close()
+			}
+			if members != nil {
+				members.Close()
+			}
+			if raft != nil {
+				raft.Close()
+				if err := closeRaftStore(); err != nil {
+					logging.Error(err)
+				}
+			}
+			err = shareSrv.Close()
+			if serr := server.Close(); err == nil {
+				err = serr
 			}
-			err = server.Close()
 			return
 		},
 		OnStart: func(ctx context.Context) error {
 			server.Serve()
-			if cfg.BootstrapNode {
-				shareSrv.Serve()
+			shareSrv.Serve()
+			ae.Serve()
+			if aeInterval > 0 {
+				ae.Start(aeInterval)
+			}
+			if ms != nil {
+				// layouts signed by the admin key are applied even if the node missed them
+				ms.start(manifestInterval, func(m *config.Manifest) error {
+					if raft != nil {
+						return nil
+					}
+					return server.(store.TopologyServer).ApplyManifest(m)
+				})
+			}
+			if members != nil {
+				members.Serve()
+				members.Start()
+			}
+			if raft != nil {
+				raft.Serve()
+				raft.Start()
 			}
 			return nil
 		},
 	})
+	return nil
+}
+
+// metadataService starts from the layout of the config, the layouts agreed by the cluster are applied
+// to the store server which persists them
+func metadataService(ctx context.Context, h host.Host, cfg *config.Config, ts store.TopologyServer) (*meta.Raft, func() error, error) {
+	if len(cfg.Nodes) == 0 {
+		return nil, nil, xerrors.New("metadata service needs the cluster nodes info")
+	}
+	raftPath := cfg.Raft.Path
+	if raftPath == "" {
+		raftPath = "raft"
+	}
+	if !strings.HasPrefix(raftPath, "/") {
+		raftPath = filepath.Join(cfg.ConfPath, raftPath)
+	}
+	var opts []meta.Option
+	if cfg.Raft.ElectionTimeout != "" {
+		d, err := time.ParseDuration(cfg.Raft.ElectionTimeout)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("invalid raft election timeout: %w", err)
+		}
+		opts = append(opts, meta.WithElectionTimeout(d))
+	}
+	if cfg.Raft.HeartbeatInterval != "" {
+		d, err := time.ParseDuration(cfg.Raft.HeartbeatInterval)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("invalid raft heartbeat interval: %w", err)
+		}
+		opts = append(opts, meta.WithHeartbeat(d))
+	}
+	adminKey, err := cfg.AdminPubKey()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid admin key: %w", err)
+	}
+	// layouts are proposed by the voters, or by anyone holding the admin key
+	if adminKey != nil {
+		opts = append(opts, meta.WithAdminKey(adminKey))
+	}
+	opts = append(opts, meta.OnApply(func(cc *config.ClusterConf) {
+		if err := ts.UpdateTopology(cc); err != nil {
+			logging.Debugf("skip cluster layout epoch %d: %s", cc.Epoch, err)
+		}
+	}))
+	rds, err := mutcaskds.NewMutcaskDS(ctx, &mutcaskds.Config{Path: raftPath, CaskNum: 1})
+	if err != nil {
+		return nil, nil, err
+	}
+	raft, err := meta.NewRaft(ctx, h, rds, cfg.ClusterConf(), opts...)
+	if err != nil {
+		rds.Close()
+		return nil, nil, err
+	}
+	return raft, rds.Close, nil
 }
 
 func ProtocolID() protocol.ID {
 	return store.PROTOCOL_V1
 }
 
-func BasicHost(lc fx.Lifecycle, cfg *config.Config) (host.Host, error) {
-	h, err := p2p.HostFromConf(cfg)
+func BasicHost(lc fx.Lifecycle, cfg *config.Config, al *p2p.Allowlist) (host.Host, error) {
+	var opts []libp2p.Option
+	if al != nil {
+		opts = append(opts, libp2p.ConnectionGater(al))
+	}
+	h, err := p2p.HostFromConf(cfg, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -196,61 +415,128 @@ func BasicHost(lc fx.Lifecycle, cfg *config.Config) (host.Host, error) {
 	return h, nil
 }
 
-func initClusterConfig(ctxbg context.Context, confpath, bootstrapper string, disabledel bool) (cfg *config.Config, err error) {
-	h1, err := p2p.MakeBasicHost(utils.RandPort())
-	if err != nil {
-		return
+// initClusterConfig generates the key of the node and joins the cluster with the token,
+// the node takes the place of the pending node the token was issued for.
+// With the admin key the layout is taken from the manifest signed by it
+func initClusterConfig(ctxbg context.Context, confpath string, bootstrappers []string, token, adminKey, swarmKey string, disabledel bool) (cfg *config.Config, err error) {
+	var pkBytes []byte
+	var pk crypto.PubKey
+	if adminKey != "" {
+		if pkBytes, pk, err = config.ParseAdminKey(adminKey); err != nil {
+			return
+		}
 	}
-	defer h1.Close()
-	baddr, err := ma.NewMultiaddr(bootstrapper)
+	// the host of the node itself presents the token so that its peer id is recorded
+	tmp, err := config.GenClientConf()
 	if err != nil {
 		return
 	}
-	pinfo, err := peer.AddrInfoFromP2pAddr(baddr)
+	if swarmKey != "" {
+		if tmp.SwarmKeyPath, err = config.InstallSwarmKey(swarmKey, confpath); err != nil {
+			return
+		}
+	}
+	h1, err := p2p.HostFromConf(tmp)
 	if err != nil {
 		return
 	}
+	defer h1.Close()
 
-	client := share.NewShareClient(ctxbg, h1, *pinfo)
-
-	// test get identity
-	bs, err := client.GetIdentity(identityIdx)
+	cc := &config.ClusterConf{}
+	err = share.Bootstrap(ctxbg, h1, bootstrappers, func(client *share.Client) error {
+		bs, err := client.Join(token)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(bs, cc)
+	})
 	if err != nil {
 		return
 	}
-	ident := config.Identity{}
-	err = json.Unmarshal(bs, &ident)
-	if err != nil {
-		return
+	var manifest *config.Manifest
+	if pk != nil {
+		if manifest, err = joinManifest(ctxbg, h1, bootstrappers, pk, cc.Epoch); err != nil {
+			return
+		}
+		cc = manifest.Layout
 	}
-	bs, err = client.GetClusterInfo()
-	if err != nil {
-		return
+	var swarm []string
+	for _, nd := range cc.Nodes {
+		if nd.ID == tmp.Identity.PeerID {
+			swarm = nd.Swarm
+		}
 	}
-	nodes := make([]config.Node, 0)
-	err = json.Unmarshal(bs, &nodes)
-	if err != nil {
-		return
+	if swarm == nil {
+		return nil, xerrors.Errorf("%s is not a node of the cluster", tmp.Identity.PeerID)
 	}
 	cfg = &config.Config{
-		Identity: ident,
-		Nodes:    nodes,
+		Identity: tmp.Identity,
 		Addresses: config.Addresses{
-			Swarm: nodes[identityIdx].Swarm,
+			Swarm: swarm,
 		},
 		DisableDelete: disabledel,
+		AdminKey:      pkBytes,
+		Manifest:      manifest,
+		SwarmKeyPath:  tmp.SwarmKeyPath,
 	}
+	cfg.SetClusterConf(cc)
 	cfgbs, err := json.MarshalIndent(cfg, "", "\t")
 	if err != nil {
 		return
 	}
-	err = ioutil.WriteFile(path.Join(confpath, config.DefaultConfigJson), cfgbs, 0644)
+	err = ioutil.WriteFile(path.Join(confpath, config.DefaultConfigJson), cfgbs, 0600)
 	if err != nil {
 		return
 	}
 	return
 }
 
+// joinManifest waits for the bootstrap nodes to sign the layout with the joined node,
+// the manifest of an older layout is refused
+func joinManifest(ctx context.Context, h host.Host, bootstrappers []string, pk crypto.PubKey, epoch uint64) (m *config.Manifest, err error) {
+	deadline := time.Now().Add(joinManifestTimeout)
+	for {
+		err = share.Bootstrap(ctx, h, bootstrappers, func(client *share.Client) error {
+			bs, err := client.GetManifest()
+			if err != nil {
+				return err
+			}
+			m, err = config.ParseManifest(bs, pk, epoch)
+			return err
+		})
+		if err == nil || time.Now().After(deadline) {
+			return
+		}
+		logging.Debugf("wait for cluster manifest: %s", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// pushTopology hands the layout to the other data nodes, nodes missing it learn it
+// from clients redirected to them or from the manifests of other nodes
+func pushTopology(ctx context.Context, h host.Host, m *config.Manifest) {
+	cc := m.Layout
+	for _, nd := range cc.Nodes {
+		if nd.Pending || nd.ID == h.ID().Pretty() {
+			continue
+		}
+		pid, err := peer.Decode(nd.ID)
+		if err != nil {
+			continue
+		}
+		var addrs []ma.Multiaddr
+		for _, addr := range nd.Swarm {
+			if maddr, err := ma.NewMultiaddr(addr); err == nil {
+				addrs = append(addrs, maddr)
+			}
+		}
+		dc := store.NewStoreClient(ctx, h, peer.AddrInfo{ID: pid, Addrs: addrs}, store.PROTOCOL_V1)
+		if err := dc.(store.TopologyClient).SetManifest(m); err != nil {
+			logging.Warnf("push cluster layout epoch %d to %s failed: %s", cc.Epoch, nd.ID, err)
+		}
+	}
+}
+
 func loadMutcaskConf(cfg *config.Config, mutcaskConf string) (conf *mutcaskds.Config, err error) {
 	conf = &mutcaskds.Config{
 		Path:            cfg.Mutcask.Path,
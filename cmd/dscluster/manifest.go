@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/p2p/share"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"golang.org/x/xerrors"
+)
+
+const manifestInterval = time.Minute
+
+// manifests signs the layouts applied by the node holding the admin key,
+// other nodes fetch the manifests signed by it and apply newer layouts
+type manifests struct {
+	ctx      context.Context
+	host     host.Host
+	cfg      *config.Config
+	cfgLk    *sync.Mutex
+	shareSrv *share.Server
+	sk       crypto.PrivKey
+	pk       crypto.PubKey
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newManifests returns nil if the cluster doesn't use manifests
+func newManifests(ctx context.Context, h host.Host, cfg *config.Config, cfgLk *sync.Mutex, shareSrv *share.Server) (*manifests, error) {
+	ms := &manifests{
+		ctx:      ctx,
+		host:     h,
+		cfg:      cfg,
+		cfgLk:    cfgLk,
+		shareSrv: shareSrv,
+		closing:  make(chan struct{}),
+	}
+	var err error
+	if ms.sk, err = cfg.AdminPrivKey(); err != nil {
+		return nil, xerrors.Errorf("load admin key failed: %w", err)
+	}
+	if ms.sk != nil {
+		ms.pk = ms.sk.GetPublic()
+	} else if ms.pk, err = cfg.AdminPubKey(); err != nil {
+		return nil, xerrors.Errorf("invalid admin key: %w", err)
+	}
+	if ms.pk == nil {
+		return nil, nil
+	}
+	if ms.sk != nil && len(cfg.Nodes) > 0 && (cfg.Manifest == nil || cfg.Manifest.Version < cfg.Epoch) {
+		ms.sign(cfg.ClusterConf())
+	}
+	return ms, nil
+}
+
+// sign hands out the layout signed by the admin key, it should be called with cfgLk held.
+// The manifest is returned, nil if the node doesn't hold the admin key.
+func (ms *manifests) sign(cc *config.ClusterConf) *config.Manifest {
+	if ms == nil || ms.sk == nil {
+		return nil
+	}
+	m, err := config.SignManifest(ms.sk, cc)
+	if err != nil {
+		logging.Errorf("sign cluster manifest epoch %d failed: %s", cc.Epoch, err)
+		return nil
+	}
+	ms.shareSrv.SetManifest(m)
+	return m
+}
+
+// proposal is the manifest of the layout proposed to the metadata service,
+// signed if the node holds the admin key
+func (ms *manifests) proposal(cc *config.ClusterConf) *config.Manifest {
+	if ms != nil && ms.sk != nil {
+		m, err := config.SignManifest(ms.sk, cc)
+		if err == nil {
+			return m
+		}
+		logging.Errorf("sign cluster manifest epoch %d failed: %s", cc.Epoch, err)
+	}
+	return &config.Manifest{Version: cc.Epoch, Layout: cc}
+}
+
+// start fetches newer manifests every interval, apply is called with them
+func (ms *manifests) start(interval time.Duration, apply func(m *config.Manifest) error) {
+	ms.wg.Add(1)
+	go func() {
+		defer ms.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ms.ctx.Done():
+				return
+			case <-ms.closing:
+				return
+			case <-ticker.C:
+				ms.refresh(apply)
+			}
+		}
+	}()
+}
+
+func (ms *manifests) refresh(apply func(m *config.Manifest) error) {
+	ms.cfgLk.Lock()
+	nodes := ms.cfg.Nodes
+	ms.cfgLk.Unlock()
+	var current uint64
+	if m := ms.shareSrv.Manifest(); m != nil {
+		current = m.Version
+	}
+	m, err := share.FetchManifest(ms.ctx, ms.host, nodes, ms.pk, current)
+	if err != nil {
+		logging.Warnf("refresh cluster manifest failed: %s", err)
+		return
+	}
+	ms.cfgLk.Lock()
+	newer := ms.shareSrv.SetManifest(m)
+	ms.cfgLk.Unlock()
+	if !newer {
+		return
+	}
+	logging.Infof("cluster manifest refreshed to version %d", m.Version)
+	if err := apply(m); err != nil {
+		logging.Warnf("apply cluster manifest version %d failed: %s", m.Version, err)
+	}
+	ms.cfgLk.Lock()
+	defer ms.cfgLk.Unlock()
+	if err := config.WriteConfig(path.Join(ms.cfg.ConfPath, config.DefaultConfigJson), ms.cfg); err != nil {
+		logging.Errorf("persist cluster manifest version %d failed: %s", m.Version, err)
+	}
+}
+
+func (ms *manifests) close() {
+	close(ms.closing)
+	ms.wg.Wait()
+}
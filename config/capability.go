@@ -0,0 +1,87 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/xerrors"
+)
+
+var ErrInvalidCapability = xerrors.New("invalid capability")
+
+// Capability grants permissions on the data nodes to a peer, it's signed by the admin key
+type Capability struct {
+	// Peer is the id of the peer allowed to present the capability
+	Peer   string   `json:"peer"`
+	Perms  []string `json:"perms"`
+	Expire int64    `json:"expire"`
+	Sig    []byte   `json:"sig,omitempty"`
+}
+
+func (c *Capability) payload() ([]byte, error) {
+	cp := *c
+	cp.Sig = nil
+	return json.Marshal(&cp)
+}
+
+// IssueCapability signs the permissions of the peer valid for ttl with the admin key
+func IssueCapability(sk crypto.PrivKey, peer string, perms []string, ttl time.Duration) (string, error) {
+	if err := checkPerms(perms); err != nil {
+		return "", err
+	}
+	c := &Capability{
+		Peer:   peer,
+		Perms:  perms,
+		Expire: time.Now().Add(ttl).Unix(),
+	}
+	data, err := c.payload()
+	if err != nil {
+		return "", err
+	}
+	if c.Sig, err = sk.Sign(data); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ParseCapability checks the capability is signed by the admin key, issued to the peer and not expired
+func ParseCapability(s string, pk crypto.PubKey, peer string) (*Capability, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, xerrors.Errorf("%w: %s", ErrInvalidCapability, err)
+	}
+	c := new(Capability)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, xerrors.Errorf("%w: %s", ErrInvalidCapability, err)
+	}
+	data, err := c.payload()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := pk.Verify(data, c.Sig); err != nil || !ok {
+		return nil, xerrors.Errorf("%w: bad signature", ErrInvalidCapability)
+	}
+	if c.Peer != peer {
+		return nil, xerrors.Errorf("%w: issued to %s", ErrInvalidCapability, c.Peer)
+	}
+	if time.Now().Unix() > c.Expire {
+		return nil, xerrors.Errorf("%w: expired", ErrInvalidCapability)
+	}
+	return c, nil
+}
+
+// Allows tells whether the capability grants the permission
+func (c *Capability) Allows(perm string) bool {
+	for _, p := range c.Perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
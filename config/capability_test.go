@@ -0,0 +1,61 @@
+package config
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/xerrors"
+)
+
+func TestCapability(t *testing.T) {
+	sk, pk, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := GenClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := cfg.Identity.PeerID
+	token, err := IssueCapability(sk, peer, []string{PermRead, PermWrite}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ParseCapability(token, pk, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Allows(PermWrite) || c.Allows(PermDelete) {
+		t.Fatalf("unexpected permissions %v", c.Perms)
+	}
+
+	// capabilities only serve the peer they are issued to
+	other, err := GenClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseCapability(token, pk, other.Identity.PeerID); !xerrors.Is(err, ErrInvalidCapability) {
+		t.Fatalf("expected invalid capability, got %v", err)
+	}
+	// capabilities not signed by the admin key are refused
+	_, otherPK, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseCapability(token, otherPK, peer); !xerrors.Is(err, ErrInvalidCapability) {
+		t.Fatalf("expected invalid capability, got %v", err)
+	}
+	// capabilities expire
+	expired, err := IssueCapability(sk, peer, []string{PermRead}, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseCapability(expired, pk, peer); !xerrors.Is(err, ErrInvalidCapability) {
+		t.Fatalf("expected expired capability, got %v", err)
+	}
+	if _, err := IssueCapability(sk, peer, []string{"admin"}, time.Hour); err == nil {
+		t.Fatal("expected unknown permission refused")
+	}
+}
@@ -3,15 +3,21 @@ package config
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"github.com/filedrive-team/go-ds-cluster/shard"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"go.uber.org/fx"
+	"golang.org/x/xerrors"
 )
 
 const DefaultConfigPath = ".dscluster"
 const DefaultConfigJson = "config.json"
 const DefaultMutcaskPath = "mutcask"
 const DefaultCaskNum = 8
+const DefaultAdminKeyFile = "admin.key"
+const DefaultSwarmKeyFile = "swarm.key"
 
 type Config struct {
 	Identity       Identity    `json:"identity"`
@@ -21,8 +27,232 @@ type Config struct {
 	DisableDelete  bool        `json:"disable_delete"`
 	ReadOnlyClient bool        `json:"read_only_client"`
 	BootstrapNode  bool        `json:"bootstrap_node"`
-	IdentityList   []Identity  `json:"identity_list"`
 	Mutcask        MutcaskConf `json:"mutcask"`
+	// HashTag enables redis style hash tags, only the part of a key between "{" and "}" is hashed
+	HashTag bool `json:"hash_tag,omitempty"`
+	// Replication is how many nodes keep each slot, the primary owner included. Zero is treated as 1.
+	Replication int `json:"replication,omitempty"`
+	// Epoch is the version of the cluster layout, it increases every time the layout changes
+	Epoch uint64 `json:"epoch,omitempty"`
+	// Migrating lists the slots being moved to other nodes
+	Migrating []shard.SlotMove `json:"migrating,omitempty"`
+	// Joining lists the nodes receiving migrating slots which own no slot yet
+	Joining []Node `json:"joining,omitempty"`
+	// ErasureCoding lists the key prefixes whose values are erasure coded instead of replicated
+	ErasureCoding []ErasureCode `json:"erasure_coding,omitempty"`
+	// ReadConsistency and WriteConsistency are the default consistency levels of the client,
+	// one of "one", "quorum" and "all". Reads default to "one" and writes to "quorum".
+	ReadConsistency  string `json:"read_consistency,omitempty"`
+	WriteConsistency string `json:"write_consistency,omitempty"`
+	// AntiEntropyInterval is how often a data node compares its slots with other replicas,
+	// e.g. "10m" which is the default, "0" disables it
+	AntiEntropyInterval string `json:"anti_entropy_interval,omitempty"`
+	// GossipInterval is how often a data node probes another one to detect failures,
+	// e.g. "1s" which is the default, "0" disables it. Clients with it observe the
+	// liveness of data nodes to route around the dead ones.
+	GossipInterval string `json:"gossip_interval,omitempty"`
+	// RefreshInterval is how often a client pulls the cluster layout from data nodes to pick up
+	// nodes joining and leaving, e.g. "1m". Empty or "0" disables it.
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+	// HintedHandoff keeps the writes of the client for unreachable data nodes
+	HintedHandoff *HintedHandoffConf `json:"hinted_handoff,omitempty"`
+	// Raft enables the metadata service replicating the cluster layout between data nodes,
+	// clients with it fetch the layout from the service and publish layout changes through it
+	Raft *RaftConf `json:"raft,omitempty"`
+	// AdminKey is the public key signing cluster manifests, layouts fetched from the network
+	// are verified with it
+	AdminKey []byte `json:"admin_key,omitempty"`
+	// AdminKeyPath is the file of the private admin key, the data node holding it signs
+	// the layouts it applies
+	AdminKeyPath string `json:"admin_key_path,omitempty"`
+	// Manifest is the latest signed layout known by the node
+	Manifest *Manifest `json:"manifest,omitempty"`
+	// Allowlist makes data nodes only accept connections from the nodes of the cluster and the clients listed
+	Allowlist *AllowlistConf `json:"allowlist,omitempty"`
+	// Capability is the token presented by the client to data nodes, granting it the permissions
+	// signed by the admin key
+	Capability string `json:"capability,omitempty"`
+	// SwarmKeyPath is the file of the libp2p pre-shared key of the cluster, relative to the config dir.
+	// Hosts with it only talk to the peers sharing the key.
+	SwarmKeyPath string `json:"swarm_key_path,omitempty"`
+}
+
+// roles of the peers allowed to connect to data nodes
+const (
+	// RoleNode is the role of the data nodes of the cluster, which are allowed everything
+	RoleNode = "node"
+	// RoleRead allows a client to read and list keys and to fetch the cluster layout
+	RoleRead = "read"
+	// RoleWrite allows a client to write and delete keys as well, cluster layouts are only published
+	// by the nodes or signed by the admin key
+	RoleWrite = "write"
+)
+
+// permissions of the store actions, granted by roles and capabilities
+const (
+	// PermRead allows Get, Has, GetSize, Query and GetTopology
+	PermRead = "read"
+	// PermWrite allows Put
+	PermWrite = "write"
+	// PermDelete allows Delete
+	PermDelete = "delete"
+	// PermTopology allows SetTopology, i.e. publishing cluster layouts
+	PermTopology = "topology"
+)
+
+// RolePerms returns the permissions granted by the role
+func RolePerms(role string) []string {
+	switch role {
+	case RoleNode:
+		return []string{PermRead, PermWrite, PermDelete, PermTopology}
+	case RoleWrite:
+		return []string{PermRead, PermWrite, PermDelete}
+	case RoleRead:
+		return []string{PermRead}
+	default:
+		return nil
+	}
+}
+
+func checkPerms(perms []string) error {
+	for _, perm := range perms {
+		switch perm {
+		case PermRead, PermWrite, PermDelete, PermTopology:
+		default:
+			return xerrors.Errorf("invalid permission %q", perm)
+		}
+	}
+	return nil
+}
+
+// AllowlistConf lists the client peers allowed to connect to a data node
+type AllowlistConf struct {
+	Clients []ClientPeer `json:"clients,omitempty"`
+	// Open accepts connections from peers not listed as well, their requests are only allowed
+	// by the capabilities they present
+	Open bool `json:"open,omitempty"`
+}
+
+// ClientPeer authorises a client peer with RoleRead or RoleWrite,
+// Perms replaces the permissions of the role if it's set
+type ClientPeer struct {
+	ID    string   `json:"id"`
+	Role  string   `json:"role,omitempty"`
+	Perms []string `json:"perms,omitempty"`
+}
+
+// Permissions returns the permissions granted to the client
+func (c ClientPeer) Permissions() []string {
+	if len(c.Perms) > 0 {
+		return c.Perms
+	}
+	return RolePerms(c.Role)
+}
+
+// Check makes sure the peer ids and the roles of the clients are valid
+func (al *AllowlistConf) Check() error {
+	for _, c := range al.Clients {
+		if _, err := peer.Decode(c.ID); err != nil {
+			return xerrors.Errorf("invalid client peer id %s: %w", c.ID, err)
+		}
+		if len(c.Perms) > 0 {
+			if err := checkPerms(c.Perms); err != nil {
+				return xerrors.Errorf("client %s: %w", c.ID, err)
+			}
+			continue
+		}
+		if c.Role != RoleRead && c.Role != RoleWrite {
+			return xerrors.Errorf("invalid role %q of client %s, expected %q or %q", c.Role, c.ID, RoleRead, RoleWrite)
+		}
+	}
+	return nil
+}
+
+// RaftConf configures the raft metadata service of data nodes
+type RaftConf struct {
+	// Path of the raft log, "raft" under the config directory by default
+	Path string `json:"path,omitempty"`
+	// ElectionTimeout e.g. "1s" which is the default
+	ElectionTimeout string `json:"election_timeout,omitempty"`
+	// HeartbeatInterval e.g. "200ms" which is the default
+	HeartbeatInterval string `json:"heartbeat_interval,omitempty"`
+}
+
+// HintedHandoffConf configures the spool keeping writes for unreachable data nodes,
+// the writes are replayed when the nodes are connected again
+type HintedHandoffConf struct {
+	// Path of the spool, hinted handoff is disabled when it's empty
+	Path string `json:"path"`
+	// MaxBytes bounds the size of the spool, 64MiB by default
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// MaxAge is how long a write is kept, e.g. "3h" which is the default
+	MaxAge string `json:"max_age,omitempty"`
+	// ReplayInterval is how often unreachable nodes are checked, e.g. "10s" which is the default
+	ReplayInterval string `json:"replay_interval,omitempty"`
+}
+
+// ClusterConf holds the settings which should be the same on every node and client of the cluster
+type ClusterConf struct {
+	Nodes       []Node           `json:"nodes"`
+	HashTag     bool             `json:"hash_tag,omitempty"`
+	Replication int              `json:"replication,omitempty"`
+	Epoch       uint64           `json:"epoch,omitempty"`
+	Migrating   []shard.SlotMove `json:"migrating,omitempty"`
+	Joining     []Node           `json:"joining,omitempty"`
+	// ErasureCoding is kept by data nodes so that clients learn it with the cluster layout
+	ErasureCoding []ErasureCode `json:"erasure_coding,omitempty"`
+	Raft          *RaftConf     `json:"raft,omitempty"`
+}
+
+// ErasureShardPrefix is the namespace of the shards of erasure coded values
+const ErasureShardPrefix = "/_ec"
+
+// ErasureCode splits the values of the keys under Prefix into Data data shards
+// plus Parity parity shards placed on distinct nodes, any Data shards rebuild the value
+type ErasureCode struct {
+	Prefix string `json:"prefix"`
+	Data   int    `json:"data"`
+	Parity int    `json:"parity"`
+}
+
+// Validate checks the shards numbers and the prefix
+func (ec ErasureCode) Validate() error {
+	if ec.Prefix == "" || ec.Prefix == "/" {
+		return xerrors.New("erasure coding prefix is empty")
+	}
+	if ec.Data < 1 || ec.Parity < 1 {
+		return xerrors.Errorf("erasure coding %s needs at least one data shard and one parity shard", ec.Prefix)
+	}
+	if ec.Data+ec.Parity > 256 {
+		return xerrors.Errorf("erasure coding %s has more than 256 shards", ec.Prefix)
+	}
+	return nil
+}
+
+// ClusterConf extracts the cluster-wide settings
+func (cfg *Config) ClusterConf() *ClusterConf {
+	return &ClusterConf{
+		Nodes:         cfg.Nodes,
+		HashTag:       cfg.HashTag,
+		Replication:   cfg.Replication,
+		Epoch:         cfg.Epoch,
+		Migrating:     cfg.Migrating,
+		Joining:       cfg.Joining,
+		ErasureCoding: cfg.ErasureCoding,
+		Raft:          cfg.Raft,
+	}
+}
+
+// SetClusterConf applies the cluster-wide settings
+func (cfg *Config) SetClusterConf(cc *ClusterConf) {
+	cfg.Nodes = cc.Nodes
+	cfg.HashTag = cc.HashTag
+	cfg.Replication = cc.Replication
+	cfg.Epoch = cc.Epoch
+	cfg.Migrating = cc.Migrating
+	cfg.Joining = cc.Joining
+	cfg.ErasureCoding = cc.ErasureCoding
+	cfg.Raft = cc.Raft
 }
 
 type MutcaskConf struct {
@@ -35,6 +265,11 @@ type MutcaskConf struct {
 type Node struct {
 	shard.Node
 	Swarm []string `json:"swarm"`
+	// Leaving marks the node is being drained and will be removed from the cluster
+	Leaving bool `json:"leaving,omitempty"`
+	// Pending marks the place kept for a data node joining with a token,
+	// the id is replaced by the one of the joining node
+	Pending bool `json:"pending,omitempty"`
 }
 
 type Identity struct {
@@ -46,6 +281,15 @@ type Addresses struct {
 	Swarm []string `json:"swarm"`
 }
 
+// CheckNodes validates the slot table kept by the cluster nodes
+func (cfg *Config) CheckNodes() error {
+	nds := make([]shard.Node, 0, len(cfg.Nodes))
+	for _, nd := range cfg.Nodes {
+		nds = append(nds, nd.Node)
+	}
+	return shard.Validate(nds)
+}
+
 func LoadConfig(path string) (fx.Option, error) {
 	cfg, err := ReadConfig(path + "/config.json")
 	if err != nil {
@@ -69,3 +313,46 @@ func ReadConfig(path string) (*Config, error) {
 	}
 	return cfg, nil
 }
+
+// WriteConfig writes the config to a temporary file of the same dir then renames it over path,
+// so a crash while writing never leaves a truncated config
+func WriteConfig(path string, cfg *Config) error {
+	b, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir flushes the entries of the dir, e.g. a file renamed into it. It's best effort since
+// some file systems don't sync dirs.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	_ = d.Sync()
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"crypto/rand"
 	"fmt"
+	"time"
 
 	"github.com/filedrive-team/go-ds-cluster/shard"
 	"github.com/filedrive-team/go-ds-cluster/utils"
@@ -11,9 +12,15 @@ import (
 )
 
 // GenClusterConf
-// Generate config json files for server nodes in cluster
+// Generate config json file for the bootstrap node of the cluster
 // num - how many servers in the cluster
-func GenClusterConf(num int) (*Config, error) {
+// weights - optional, weight of each server which decides its share of slots
+// The other servers are pending nodes, they generate their own keys and join with
+// the tokens issued by Config.JoinTokens
+func GenClusterConf(num int, weights []int) (*Config, error) {
+	if len(weights) > 0 && len(weights) != num {
+		return nil, fmt.Errorf("expected %d weights, got %d", num, len(weights))
+	}
 	nodeIdentities := make([]Identity, num)
 	for i := range nodeIdentities {
 		priv, _, err := crypto.GenerateECDSAKeyPair(rand.Reader)
@@ -31,7 +38,10 @@ func GenClusterConf(num int) (*Config, error) {
 		}
 		nodeIdentities[i] = Identity{
 			PeerID: pid.Pretty(),
-			SK:     sk,
+		}
+		// only the key of the bootstrap node is kept, the ids of the others are placeholders
+		if i == 0 {
+			nodeIdentities[i].SK = sk
 		}
 	}
 	shardStartNodes := make([]shard.Node, num)
@@ -39,6 +49,9 @@ func GenClusterConf(num int) (*Config, error) {
 		shardStartNodes[i] = shard.Node{
 			ID: nodeIdentities[i].PeerID,
 		}
+		if len(weights) > 0 {
+			shardStartNodes[i].Weight = weights[i]
+		}
 	}
 	shardStartNodes = shard.InitSlotManager(shardStartNodes).Nodes()
 
@@ -51,6 +64,7 @@ func GenClusterConf(num int) (*Config, error) {
 				fmt.Sprintf("/ip4/0.0.0.0/tcp/%s", rport),
 				fmt.Sprintf("/ip4/0.0.0.0/udp/%s/quic", rport),
 			},
+			Pending: i > 0,
 		}
 	}
 
@@ -60,7 +74,6 @@ func GenClusterConf(num int) (*Config, error) {
 		},
 		Identity:      nodeIdentities[0],
 		Nodes:         cfgNodes,
-		IdentityList:  nodeIdentities,
 		BootstrapNode: true,
 	}
 	fmt.Printf("%s/p2p/%s\n", cfgNodes[0].Swarm[0], cfgNodes[0].Node.ID)
@@ -68,6 +81,26 @@ func GenClusterConf(num int) (*Config, error) {
 	return res, nil
 }
 
+// JoinTokens issues a join token for every pending node in order, signed by the key of the node
+func (cfg *Config) JoinTokens(ttl time.Duration) ([]string, error) {
+	sk, err := crypto.UnmarshalPrivateKey(cfg.Identity.SK)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, nd := range cfg.Nodes {
+		if !nd.Pending {
+			continue
+		}
+		token, err := IssueJoinToken(sk, nd.ID, ttl)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, token)
+	}
+	return res, nil
+}
+
 // GenClientConf
 // Generate config json for cluster client node
 // 	- key pair
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/libp2p/go-libp2p-core/crypto"
@@ -37,3 +39,49 @@ func TestGenClientConf(t *testing.T) {
 		t.Fatal("pid should be the same")
 	}
 }
+
+func TestGenClusterConfWeights(t *testing.T) {
+	cfg, err := GenClusterConf(3, []int{4, 8, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.CheckNodes(); err != nil {
+		t.Fatal(err)
+	}
+	if n := cfg.Nodes[1].SlotsNum(); n != 8192 {
+		t.Fatalf("node with double weight should own 8192 slots, got %d", n)
+	}
+	if _, err := GenClusterConf(3, []int{1, 2}); err == nil {
+		t.Fatal("should refuse unmatched weights")
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DefaultConfigJson)
+	cfg, err := GenClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		cfg.Epoch = uint64(i)
+		if err := WriteConfig(path, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Epoch != 1 || got.Identity.PeerID != cfg.Identity.PeerID {
+		t.Fatalf("unexpected config read back, epoch %d", got.Epoch)
+	}
+	// no temporary file is left
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the config in the dir, got %d files", len(entries))
+	}
+}
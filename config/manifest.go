@@ -0,0 +1,136 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/xerrors"
+)
+
+var ErrInvalidManifest = xerrors.New("invalid cluster manifest")
+var ErrManifestDowngrade = xerrors.New("cluster manifest downgrade")
+
+// Manifest is the cluster layout signed by the admin key, its version is the epoch of the layout.
+// Layouts received from the network are only trusted through manifests when the admin key is configured.
+type Manifest struct {
+	Version uint64       `json:"version"`
+	Layout  *ClusterConf `json:"layout"`
+	Sig     []byte       `json:"sig,omitempty"`
+}
+
+func (m *Manifest) payload() ([]byte, error) {
+	cp := *m
+	cp.Sig = nil
+	return json.Marshal(&cp)
+}
+
+// SignManifest signs the layout with the admin key
+func SignManifest(sk crypto.PrivKey, cc *ClusterConf) (*Manifest, error) {
+	m := &Manifest{
+		Version: cc.Epoch,
+		Layout:  cc,
+	}
+	data, err := m.payload()
+	if err != nil {
+		return nil, err
+	}
+	if m.Sig, err = sk.Sign(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Verify checks the manifest is signed by the admin key
+func (m *Manifest) Verify(pk crypto.PubKey) error {
+	if m.Layout == nil || m.Layout.Epoch != m.Version {
+		return xerrors.Errorf("%w: version %d doesn't match the layout", ErrInvalidManifest, m.Version)
+	}
+	data, err := m.payload()
+	if err != nil {
+		return err
+	}
+	if ok, err := pk.Verify(data, m.Sig); err != nil || !ok {
+		return xerrors.Errorf("%w: bad signature", ErrInvalidManifest)
+	}
+	return nil
+}
+
+// ParseManifest decodes the manifest and checks it's signed by the admin key
+// and not older than version current
+func ParseManifest(b []byte, pk crypto.PubKey, current uint64) (*Manifest, error) {
+	m := new(Manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, xerrors.Errorf("%w: %s", ErrInvalidManifest, err)
+	}
+	if err := m.Verify(pk); err != nil {
+		return nil, err
+	}
+	if m.Version < current {
+		return nil, xerrors.Errorf("%w: version %d is older than %d", ErrManifestDowngrade, m.Version, current)
+	}
+	return m, nil
+}
+
+// GenAdminKey generates the admin key, the private key is written to path
+// and the marshaled public key is returned
+func GenAdminKey(path string) ([]byte, error) {
+	priv, pub, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, sk, 0600); err != nil {
+		return nil, err
+	}
+	return crypto.MarshalPublicKey(pub)
+}
+
+// LoadAdminKey reads the private admin key written by GenAdminKey
+func LoadAdminKey(path string) (crypto.PrivKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPrivateKey(b)
+}
+
+// ParseAdminKey decodes the public admin key given by --admin-key flags
+func ParseAdminKey(s string) ([]byte, crypto.PubKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid admin key: %w", err)
+	}
+	pk, err := crypto.UnmarshalPublicKey(b)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid admin key: %w", err)
+	}
+	return b, pk, nil
+}
+
+// AdminPrivKey loads the private admin key of AdminKeyPath, relative to the config dir,
+// nil if the config doesn't hold the admin key
+func (cfg *Config) AdminPrivKey() (crypto.PrivKey, error) {
+	if cfg.AdminKeyPath == "" {
+		return nil, nil
+	}
+	keyPath := cfg.AdminKeyPath
+	if !filepath.IsAbs(keyPath) {
+		keyPath = filepath.Join(cfg.ConfPath, keyPath)
+	}
+	return LoadAdminKey(keyPath)
+}
+
+// AdminPubKey returns the public admin key of the config, nil if manifests are not verified
+func (cfg *Config) AdminPubKey() (crypto.PubKey, error) {
+	if len(cfg.AdminKey) == 0 {
+		return nil, nil
+	}
+	return crypto.UnmarshalPublicKey(cfg.AdminKey)
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/xerrors"
+)
+
+func TestManifest(t *testing.T) {
+	cfg, err := GenClusterConf(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), DefaultAdminKeyFile)
+	cfg.AdminKey, err = GenAdminKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, err := LoadAdminKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := cfg.AdminPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc := cfg.ClusterConf()
+	cc.Epoch = 2
+	m, err := SignManifest(sk, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseManifest(bs, pk, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 2 || len(got.Layout.Nodes) != 3 {
+		t.Fatalf("unexpected manifest %+v", got)
+	}
+
+	// older manifests are refused
+	if _, err := ParseManifest(bs, pk, 3); !xerrors.Is(err, ErrManifestDowngrade) {
+		t.Fatalf("expected downgrade, got %v", err)
+	}
+	// tampered layouts are refused
+	got.Layout.Nodes[0].Swarm = []string{"/ip4/10.0.0.1/tcp/1"}
+	tampered, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseManifest(tampered, pk, 0); !xerrors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("expected invalid manifest, got %v", err)
+	}
+	// manifests signed by another key are refused
+	other, _, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := SignManifest(other, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := forged.Verify(pk); !xerrors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("expected invalid manifest, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"golang.org/x/xerrors"
+)
+
+const swarmKeyHeader = "/key/swarm/psk/1.0.0/\n/base16/\n"
+
+// GenSwarmKey writes a new libp2p pre-shared key to path, hosts with it only talk to the peers sharing it
+func GenSwarmKey(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(swarmKeyHeader+hex.EncodeToString(key)+"\n"), 0600)
+}
+
+// InstallSwarmKey checks the swarm key copied from the cluster and keeps it in the config dir,
+// the path of the installed key is returned
+func InstallSwarmKey(src, confPath string) (string, error) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	if _, err := pnet.DecodeV1PSK(bytes.NewReader(b)); err != nil {
+		return "", xerrors.Errorf("invalid swarm key: %w", err)
+	}
+	dst, err := filepath.Abs(filepath.Join(confPath, DefaultSwarmKeyFile))
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(dst, b, 0600); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// SwarmKeyFile returns the path of the swarm key, relative paths are under the config dir.
+// Empty if the hosts are not in a private network.
+func (cfg *Config) SwarmKeyFile() string {
+	if cfg.SwarmKeyPath == "" || filepath.IsAbs(cfg.SwarmKeyPath) {
+		return cfg.SwarmKeyPath
+	}
+	return filepath.Join(cfg.ConfPath, cfg.SwarmKeyPath)
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSwarmKey(t *testing.T) {
+	clusterDir := t.TempDir()
+	src := filepath.Join(clusterDir, DefaultSwarmKeyFile)
+	if err := GenSwarmKey(src); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{ConfPath: clusterDir, SwarmKeyPath: DefaultSwarmKeyFile}
+	if cfg.SwarmKeyFile() != src {
+		t.Fatalf("expected %s, got %s", src, cfg.SwarmKeyFile())
+	}
+
+	clientDir := t.TempDir()
+	dst, err := InstallSwarmKey(src, clientDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = &Config{SwarmKeyPath: dst}
+	if cfg.SwarmKeyFile() != filepath.Join(clientDir, DefaultSwarmKeyFile) {
+		t.Fatalf("unexpected installed key %s", cfg.SwarmKeyFile())
+	}
+	// files which are not swarm keys are refused
+	if _, err := InstallSwarmKey(filepath.Join(clientDir, "missing"), clientDir); err == nil {
+		t.Fatal("expected missing key refused")
+	}
+	bad := filepath.Join(clusterDir, "config.json")
+	if err := WriteConfig(bad, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InstallSwarmKey(bad, clientDir); err == nil {
+		t.Fatal("expected invalid key refused")
+	}
+}
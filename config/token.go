@@ -0,0 +1,91 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+)
+
+var ErrInvalidJoinToken = xerrors.New("invalid join token")
+
+// JoinToken allows a data node to take the place of a pending node of the cluster layout,
+// it's signed by the bootstrap node which issued it and accepted only once by that node
+type JoinToken struct {
+	// Issuer is the peer id of the bootstrap node
+	Issuer string `json:"issuer"`
+	// Node is the id of the pending node taken by the joining node
+	Node   string `json:"node"`
+	Expire int64  `json:"expire"`
+	Nonce  []byte `json:"nonce"`
+	Sig    []byte `json:"sig,omitempty"`
+}
+
+func (t *JoinToken) payload() ([]byte, error) {
+	cp := *t
+	cp.Sig = nil
+	return json.Marshal(&cp)
+}
+
+// IssueJoinToken signs a token for the pending node valid for ttl
+func IssueJoinToken(sk crypto.PrivKey, node string, ttl time.Duration) (string, error) {
+	issuer, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return "", err
+	}
+	t := &JoinToken{
+		Issuer: issuer.Pretty(),
+		Node:   node,
+		Expire: time.Now().Add(ttl).Unix(),
+		Nonce:  make([]byte, 16),
+	}
+	if _, err := rand.Read(t.Nonce); err != nil {
+		return "", err
+	}
+	data, err := t.payload()
+	if err != nil {
+		return "", err
+	}
+	if t.Sig, err = sk.Sign(data); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ParseJoinToken checks the token is issued by the key of pk and not expired
+func ParseJoinToken(s string, pk crypto.PubKey) (*JoinToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, xerrors.Errorf("%w: %s", ErrInvalidJoinToken, err)
+	}
+	t := new(JoinToken)
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, xerrors.Errorf("%w: %s", ErrInvalidJoinToken, err)
+	}
+	issuer, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	if t.Issuer != issuer.Pretty() {
+		return nil, xerrors.Errorf("%w: issued by %s", ErrInvalidJoinToken, t.Issuer)
+	}
+	data, err := t.payload()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := pk.Verify(data, t.Sig); err != nil || !ok {
+		return nil, xerrors.Errorf("%w: bad signature", ErrInvalidJoinToken)
+	}
+	if time.Now().Unix() > t.Expire {
+		return nil, xerrors.Errorf("%w: expired", ErrInvalidJoinToken)
+	}
+	return t, nil
+}
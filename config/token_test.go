@@ -0,0 +1,62 @@
+package config
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/xerrors"
+)
+
+func TestJoinTokens(t *testing.T) {
+	cfg, err := GenClusterConf(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Nodes[0].Pending || !cfg.Nodes[1].Pending || !cfg.Nodes[2].Pending {
+		t.Fatal("expected every node but the bootstrap node pending")
+	}
+	tokens, err := cfg.JoinTokens(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(tokens))
+	}
+	sk, err := crypto.UnmarshalPrivateKey(cfg.Identity.SK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := ParseJoinToken(tokens[1], sk.GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Node != cfg.Nodes[2].ID {
+		t.Fatalf("expected token for %s, got %s", cfg.Nodes[2].ID, tk.Node)
+	}
+
+	// tokens of another issuer are refused
+	other, _, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseJoinToken(tokens[0], other.GetPublic()); !xerrors.Is(err, ErrInvalidJoinToken) {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+	forged, err := IssueJoinToken(other, cfg.Nodes[1].ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseJoinToken(forged, sk.GetPublic()); !xerrors.Is(err, ErrInvalidJoinToken) {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+	// tokens expire
+	expired, err := IssueJoinToken(sk, cfg.Nodes[1].ID, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseJoinToken(expired, sk.GetPublic()); !xerrors.Is(err, ErrInvalidJoinToken) {
+		t.Fatalf("expected expired token, got %v", err)
+	}
+}
@@ -9,10 +9,22 @@ type Pair struct {
 	Value []byte
 }
 
+// KeyResult is the answer for a key of GetMany and HasMany,
+// a missing key is not Exists and has no Err
+type KeyResult struct {
+	Key    string
+	Value  []byte
+	Exists bool
+	Err    error
+}
+
 // DataNode - basic Datastore operations
 type DataNode interface {
 	Get(key string) (value []byte, err error)
 	Has(key string) (exists bool, err error)
+	// GetMany and HasMany answer the keys in order
+	GetMany(keys []string) ([]KeyResult, error)
+	HasMany(keys []string) ([]KeyResult, error)
 	GetSize(key string) (size int, err error)
 	Put(key string, value []byte) error
 	Delete(key string) error
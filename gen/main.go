@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/filedrive-team/go-ds-cluster/p2p/antientropy"
+	"github.com/filedrive-team/go-ds-cluster/p2p/gossip"
+	"github.com/filedrive-team/go-ds-cluster/p2p/meta"
 	"github.com/filedrive-team/go-ds-cluster/p2p/remoteds"
 	"github.com/filedrive-team/go-ds-cluster/p2p/share"
 	"github.com/filedrive-team/go-ds-cluster/p2p/store"
@@ -16,6 +19,11 @@ func main() {
 		store.ReplyMessage{},
 		store.QueryResultEntry{},
 		store.Query{},
+		store.RequestFrame{},
+		store.ReplyFrame{},
+		store.BatchOp{},
+		store.BatchResult{},
+		store.Chunk{},
 	)
 	if err != nil {
 		fmt.Println(err)
@@ -34,6 +42,34 @@ func main() {
 		remoteds.ReplyMessage{},
 		remoteds.QueryResultEntry{},
 		remoteds.Query{},
+		remoteds.BatchOp{},
+	)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = gen.WriteTupleEncodersToFile("./p2p/antientropy/cbor_gen.go", "antientropy",
+		antientropy.Request{},
+		antientropy.Reply{},
+		antientropy.Entry{},
+	)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = gen.WriteTupleEncodersToFile("./p2p/meta/cbor_gen.go", "meta",
+		meta.Request{},
+		meta.Reply{},
+		meta.Entry{},
+	)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = gen.WriteTupleEncodersToFile("./p2p/gossip/cbor_gen.go", "gossip",
+		gossip.Request{},
+		gossip.Reply{},
+		gossip.Update{},
 	)
 	if err != nil {
 		fmt.Println(err)
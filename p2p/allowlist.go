@@ -0,0 +1,105 @@
+package p2p
+
+import (
+	"sync"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Allowlist is a connection gater accepting inbound connections only from the peers listed,
+// outbound connections are not restricted
+type Allowlist struct {
+	lk    sync.RWMutex
+	perms map[peer.ID][]string
+	// open accepts peers not listed as well, e.g. while data nodes are joining
+	open bool
+	// others are the permissions of the peers not listed
+	others []string
+}
+
+func NewAllowlist() *Allowlist {
+	return &Allowlist{
+		perms: make(map[peer.ID][]string),
+	}
+}
+
+// Update replaces the peers allowed with the nodes of the cluster and the clients,
+// peers not listed are accepted if open is set
+func (al *Allowlist) Update(nodes []config.Node, clients []config.ClientPeer, open bool) {
+	perms := make(map[peer.ID][]string, len(nodes)+len(clients))
+	for _, c := range clients {
+		if pid, err := peer.Decode(c.ID); err == nil {
+			perms[pid] = c.Permissions()
+		}
+	}
+	for _, nd := range nodes {
+		if nd.Pending {
+			continue
+		}
+		if pid, err := peer.Decode(nd.ID); err == nil {
+			perms[pid] = config.RolePerms(config.RoleNode)
+		}
+	}
+	al.lk.Lock()
+	defer al.lk.Unlock()
+	al.perms = perms
+	al.open = open
+}
+
+// AllowOthers grants the permissions to the peers not listed, e.g. when the connections
+// of data nodes are not restricted
+func (al *Allowlist) AllowOthers(perms []string) {
+	al.lk.Lock()
+	defer al.lk.Unlock()
+	al.others = perms
+}
+
+// Allows tells whether the peer is granted the permission
+func (al *Allowlist) Allows(p peer.ID, perm string) bool {
+	al.lk.RLock()
+	defer al.lk.RUnlock()
+	perms, ok := al.perms[p]
+	if !ok {
+		perms = al.others
+	}
+	for _, granted := range perms {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (al *Allowlist) InterceptPeerDial(p peer.ID) bool {
+	return true
+}
+
+func (al *Allowlist) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	return true
+}
+
+func (al *Allowlist) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return true
+}
+
+// InterceptSecured refuses inbound connections of the peers not listed
+func (al *Allowlist) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if dir == network.DirOutbound {
+		return true
+	}
+	al.lk.RLock()
+	defer al.lk.RUnlock()
+	if _, ok := al.perms[p]; ok || al.open {
+		return true
+	}
+	logging.Debugf("refuse connection from %s at %s", p, addrs.RemoteMultiaddr())
+	return false
+}
+
+func (al *Allowlist) InterceptUpgraded(conn network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	"github.com/filedrive-team/go-ds-cluster/utils"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestAllowlist(t *testing.T) {
+	hosts := make([]host.Host, 4)
+	for i := range hosts {
+		h, err := MakeBasicHost(utils.RandPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		hosts[i] = h
+	}
+	nodeHost, clientHost, stranger, pending := hosts[0], hosts[1], hosts[2], hosts[3]
+
+	cfg, err := config.GenClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Addresses.Swarm = []string{"/ip4/127.0.0.1/tcp/" + utils.RandPort()}
+	al := NewAllowlist()
+	nodes := []config.Node{
+		{Node: shard.Node{ID: nodeHost.ID().Pretty()}},
+		{Node: shard.Node{ID: pending.ID().Pretty()}, Pending: true},
+	}
+	clients := []config.ClientPeer{{ID: clientHost.ID().Pretty(), Role: config.RoleRead}}
+	al.Update(nodes, clients, false)
+	gated, err := HostFromConf(cfg, libp2p.ConnectionGater(al))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gated.Close()
+	target := peer.AddrInfo{ID: gated.ID(), Addrs: gated.Addrs()}
+
+	if !al.Allows(nodeHost.ID(), config.PermTopology) || !al.Allows(clientHost.ID(), config.PermRead) ||
+		al.Allows(clientHost.ID(), config.PermWrite) || al.Allows(stranger.ID(), config.PermRead) {
+		t.Fatal("unexpected permissions")
+	}
+	// peers not listed may be granted permissions, the clients listed keep theirs
+	others := NewAllowlist()
+	others.AllowOthers(config.RolePerms(config.RoleWrite))
+	others.Update(nodes, clients, false)
+	if !others.Allows(nodeHost.ID(), config.PermTopology) || !others.Allows(stranger.ID(), config.PermWrite) ||
+		others.Allows(stranger.ID(), config.PermTopology) || others.Allows(clientHost.ID(), config.PermWrite) {
+		t.Fatal("unexpected permissions of peers not listed")
+	}
+	connect := func(h host.Host) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return h.Connect(ctx, target)
+	}
+	if err := connect(nodeHost); err != nil {
+		t.Fatalf("data node should connect: %s", err)
+	}
+	if err := connect(clientHost); err != nil {
+		t.Fatalf("client listed should connect: %s", err)
+	}
+	if err := connect(stranger); err == nil {
+		t.Fatal("peer not listed should not connect")
+	}
+	if err := connect(pending); err == nil {
+		t.Fatal("pending node should not connect")
+	}
+	// gated hosts dial anyone
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gated.Connect(ctx, peer.AddrInfo{ID: stranger.ID(), Addrs: stranger.Addrs()}); err != nil {
+		t.Fatalf("outbound connection should be allowed: %s", err)
+	}
+	stranger.Network().ClosePeer(gated.ID())
+
+	// unknown peers are accepted while the allowlist is open
+	al.Update(nodes, clients, true)
+	stranger.Peerstore().ClearAddrs(gated.ID())
+	if err := connect(stranger); err != nil {
+		t.Fatalf("peer should connect while open: %s", err)
+	}
+}
@@ -0,0 +1,128 @@
+// anti-entropy repair between replicas
+package antientropy
+
+import (
+	"time"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	log "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+var logging = log.Logger("dscluster/p2p/antientropy")
+
+const (
+	PROTOCOL_V1 = "/cluster/antientropy/0.0.1"
+)
+
+var readDeadline = time.Second * 60
+var writeDeadline = time.Second * 60
+
+type Act uint8
+
+const (
+	// ActBuckets asks the digests of the buckets covering the slots
+	ActBuckets Act = 1 + iota
+	// ActSlots asks the digest of each slot
+	ActSlots
+	// ActKeys asks the keys and sizes kept for the slots
+	ActKeys
+	// ActGet asks the values of the keys
+	ActGet
+)
+
+func (a Act) String() string {
+	switch a {
+	case ActBuckets:
+		return "Buckets"
+	case ActSlots:
+		return "Slots"
+	case ActKeys:
+		return "Keys"
+	case ActGet:
+		return "Get"
+	default:
+		return "Unknown"
+	}
+}
+
+type ErrCode uint8
+
+const (
+	ErrNone ErrCode = iota
+
+	ErrOthers = 100
+)
+
+// Request is sent over a stream several times, from the buckets of the shared slots
+// down to the values of the keys missing
+type Request struct {
+	Act   Act
+	Slots []uint64
+	// Entries of ActGet name the keys asked
+	Entries []Entry
+}
+
+type Reply struct {
+	Code ErrCode
+	Msg  string
+	// Buckets and Digests of ActBuckets, Digests of ActSlots in the order of request slots
+	Buckets []uint64
+	Digests [][]byte
+	// Entries of ActKeys and ActGet, values are only filled by ActGet
+	Entries []Entry
+}
+
+type Entry struct {
+	Key   string
+	Size  int64
+	Value []byte
+}
+
+func ReadRequest(s network.Stream, msg *Request) error {
+	if err := s.SetReadDeadline(time.Now().Add(readDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.ReadCborRPC(s, msg); err != nil {
+		_ = s.SetReadDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	return nil
+}
+
+func WriteRequest(s network.Stream, msg *Request) error {
+	if err := s.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.WriteCborRPC(s, msg); err != nil {
+		_ = s.SetWriteDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+func ReadReply(s network.Stream, msg *Reply) error {
+	if err := s.SetReadDeadline(time.Now().Add(readDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.ReadCborRPC(s, msg); err != nil {
+		_ = s.SetReadDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	return nil
+}
+
+func WriteReply(s network.Stream, msg *Reply) error {
+	if err := s.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.WriteCborRPC(s, msg); err != nil {
+		_ = s.SetWriteDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Time{})
+	return nil
+}
@@ -0,0 +1,169 @@
+package antientropy
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	"github.com/filedrive-team/go-ds-cluster/utils"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/host"
+)
+
+type Pair struct {
+	K string
+	V []byte
+}
+
+var tdata = []Pair{
+	{"/Filedrive", []byte("Platform for better use of datasets on web3")},
+	{"/FileDAG", []byte("Destributed storage provider")},
+	{"/afsis", []byte("Africa Soil Information Service (AfSIS) Soil Chemistry")},
+	{"/ipfs", []byte("InterPlanetary File System")},
+}
+
+func TestIndexDigests(t *testing.T) {
+	sm := shard.InitSlotManager([]shard.Node{{ID: "n1"}})
+	d1 := ds.NewMapDatastore()
+	d2 := ds.NewMapDatastore()
+	for _, p := range tdata {
+		if err := d1.Put(ds.NewKey(p.K), p.V); err != nil {
+			t.Fatal(err)
+		}
+		if err := d2.Put(ds.NewKey(p.K), p.V); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix1, err := buildIndex(context.Background(), d1, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.Delete(ds.NewKey(tdata[0].K)); err != nil {
+		t.Fatal(err)
+	}
+	ix2, err := buildIndex(context.Background(), d2, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots := make([]uint64, 0, shard.SLOTS_NUM)
+	for n := 0; n < shard.SLOTS_NUM; n++ {
+		slots = append(slots, uint64(n))
+	}
+	ids1, digests1 := ix1.buckets(slots)
+	ids2, digests2 := ix2.buckets(slots)
+	if len(ids1) != shard.SLOTS_NUM/bucketSize || len(ids2) != len(ids1) {
+		t.Fatalf("expected %d buckets, got %d and %d", shard.SLOTS_NUM/bucketSize, len(ids1), len(ids2))
+	}
+	missing := bucketOf(sm.SlotByKey(tdata[0].K))
+	for i := range ids1 {
+		differ := !bytes.Equal(digests1[i], digests2[i])
+		if differ != (ids1[i] == missing) {
+			t.Fatalf("bucket %d should differ: %v", ids1[i], !differ)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var hosts []host.Host
+	for i := 0; i < 3; i++ {
+		h, err := p2p.MakeBasicHost(utils.RandPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+	}
+	cc := &config.ClusterConf{Replication: 2, Epoch: 1}
+	ranges := []shard.SlotsRange{{Start: 0, End: 5460}, {Start: 5461, End: 10921}, {Start: 10922, End: 16383}}
+	for i, h := range hosts {
+		var swarm []string
+		for _, addr := range h.Addrs() {
+			swarm = append(swarm, addr.String())
+		}
+		cc.Nodes = append(cc.Nodes, config.Node{
+			Node:  shard.Node{ID: h.ID().Pretty(), Slots: ranges[i]},
+			Swarm: swarm,
+		})
+	}
+	sm, err := slotsManager(cc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := make(map[string]ds.Datastore)
+	var aes []*AntiEntropy
+	for _, h := range hosts {
+		d := ds.NewMapDatastore()
+		stores[h.ID().Pretty()] = d
+		ae := NewAntiEntropy(ctx, h, d, func() *config.ClusterConf { return cc })
+		ae.Serve()
+		defer ae.Close()
+		aes = append(aes, ae)
+	}
+
+	// every key is kept by one of its replicas only, the last key differs on the other replica
+	stale := []byte("stale")
+	for i, p := range tdata {
+		nds, err := sm.ReplicasByKey(p.K)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stores[nds[i%2].ID].Put(ds.NewKey(p.K), p.V); err != nil {
+			t.Fatal(err)
+		}
+		if i == len(tdata)-1 {
+			if err := stores[nds[(i+1)%2].ID].Put(ds.NewKey(p.K), stale); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var pulled int
+	for _, ae := range aes {
+		st, err := ae.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pulled += st.Pulled
+	}
+	if pulled != len(tdata) {
+		t.Fatalf("expected %d keys pulled, got %d", len(tdata), pulled)
+	}
+	for i, p := range tdata {
+		nds, err := sm.ReplicasByKey(p.K)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := p.V
+		if i == len(tdata)-1 && i%2 == 1 {
+			// the stale value was kept by the primary
+			expect = stale
+		}
+		for _, nd := range nds {
+			v, err := stores[nd.ID].Get(ds.NewKey(p.K))
+			if err != nil {
+				t.Fatalf("key %s on %s: %s", p.K, nd.ID, err)
+			}
+			if !bytes.Equal(v, expect) {
+				t.Fatalf("key %s on %s expected %s, got %s", p.K, nd.ID, expect, v)
+			}
+		}
+	}
+
+	// replicas have converged
+	for _, ae := range aes {
+		st, err := ae.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Slots != 0 || st.Pulled != 0 {
+			t.Fatalf("expected no difference, got %+v", st)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package antientropy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// bucketSize is how many slots are covered by a bucket, the leaves of the tree are slots
+// and their parents are buckets, so only buckets differing are compared by slots
+const bucketSize = 128
+
+func bucketOf(slot uint16) uint64 {
+	return uint64(slot) / bucketSize
+}
+
+// index keeps the keys and sizes of the local datastore by slot
+type index struct {
+	entries map[uint16][]Entry
+	digests map[uint16][]byte
+}
+
+// buildIndex scans the datastore, the digest of a slot is the hash of its keys and sizes sorted by key
+func buildIndex(ctx context.Context, d ds.Datastore, sm *shard.SlotsManager) (*index, error) {
+	results, err := d.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	ix := &index{
+		entries: make(map[uint16][]Entry),
+		digests: make(map[uint16][]byte),
+	}
+	for res := range results.Next() {
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// shards of erasure coded values are kept by their primary owners only
+		if strings.HasPrefix(res.Key, config.ErasureShardPrefix+"/") {
+			continue
+		}
+		size, err := d.GetSize(ds.RawKey(res.Key))
+		if err != nil {
+			if err == ds.ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		slot := sm.SlotByKey(res.Key)
+		ix.entries[slot] = append(ix.entries[slot], Entry{Key: res.Key, Size: int64(size)})
+	}
+	for slot, ents := range ix.entries {
+		sort.Slice(ents, func(i, j int) bool {
+			return ents[i].Key < ents[j].Key
+		})
+		h := sha256.New()
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, e := range ents {
+			h.Write([]byte(e.Key))
+			h.Write([]byte{0})
+			h.Write(buf[:binary.PutVarint(buf, e.Size)])
+		}
+		ix.digests[slot] = h.Sum(nil)
+	}
+	return ix, nil
+}
+
+// buckets returns the digests of the buckets covering the slots, slots should be sorted
+func (ix *index) buckets(slots []uint64) ([]uint64, [][]byte) {
+	var ids []uint64
+	var digests [][]byte
+	for i := 0; i < len(slots); {
+		b := bucketOf(uint16(slots[i]))
+		h := sha256.New()
+		var n int
+		for ; i < len(slots) && bucketOf(uint16(slots[i])) == b; i++ {
+			d := ix.digests[uint16(slots[i])]
+			if len(d) == 0 {
+				continue
+			}
+			h.Write([]byte{byte(slots[i] >> 8), byte(slots[i])})
+			h.Write(d)
+			n++
+		}
+		ids = append(ids, b)
+		if n == 0 {
+			digests = append(digests, nil)
+		} else {
+			digests = append(digests, h.Sum(nil))
+		}
+	}
+	return ids, digests
+}
+
+func (ix *index) slots(slots []uint64) [][]byte {
+	res := make([][]byte, 0, len(slots))
+	for _, s := range slots {
+		res = append(res, ix.digests[uint16(s)])
+	}
+	return res
+}
+
+func (ix *index) keys(slots []uint64) []Entry {
+	var res []Entry
+	for _, s := range slots {
+		res = append(res, ix.entries[uint16(s)]...)
+	}
+	return res
+}
+
+// slotsManager restores the slot table of the layout
+func slotsManager(cc *config.ClusterConf, keyHash shard.KeyHashFunc) (*shard.SlotsManager, error) {
+	nds := make([]shard.Node, 0, len(cc.Nodes))
+	for _, nd := range cc.Nodes {
+		nds = append(nds, nd.Node)
+	}
+	sm, err := shard.RestoreSlotsManager(nds)
+	if err != nil {
+		return nil, err
+	}
+	sm.SetReplication(cc.Replication)
+	switch {
+	case keyHash != nil:
+		sm.SetKeyHashFunc(keyHash)
+	case cc.HashTag:
+		sm.SetKeyHashFunc(shard.HashTagKey)
+	}
+	return sm, nil
+}
@@ -0,0 +1,162 @@
+package antientropy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"golang.org/x/xerrors"
+)
+
+// AntiEntropy compares the keys of the slots shared with other replicas and pulls
+// the keys missing from them. It also serves the digests of the local datastore to other replicas.
+type AntiEntropy struct {
+	ctx      context.Context
+	host     host.Host
+	protocol protocol.ID
+	ds       ds.Datastore
+	// layout returns current cluster layout, nil if the node knows nothing about the cluster
+	layout  func() *config.ClusterConf
+	keyHash shard.KeyHashFunc
+
+	// lk serializes sync rounds
+	lk      sync.Mutex
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+type Option func(ae *AntiEntropy)
+
+// WithKeyHashFunc overrides the hash function given by the cluster layout,
+// it should be the same as the one of the store server
+func WithKeyHashFunc(f shard.KeyHashFunc) Option {
+	return func(ae *AntiEntropy) {
+		ae.keyHash = f
+	}
+}
+
+func NewAntiEntropy(ctx context.Context, h host.Host, d ds.Datastore, layout func() *config.ClusterConf, opts ...Option) *AntiEntropy {
+	ae := &AntiEntropy{
+		ctx:      ctx,
+		host:     h,
+		protocol: PROTOCOL_V1,
+		ds:       d,
+		layout:   layout,
+		closing:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(ae)
+	}
+	return ae
+}
+
+func (ae *AntiEntropy) Serve() {
+	logging.Info("anti-entropy server set stream handler")
+	ae.host.SetStreamHandler(ae.protocol, ae.handleStream)
+}
+
+// Start runs a sync round every interval in background
+func (ae *AntiEntropy) Start(interval time.Duration) {
+	ae.wg.Add(1)
+	go func() {
+		defer ae.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ae.ctx.Done():
+				return
+			case <-ae.closing:
+				return
+			case <-ticker.C:
+				st, err := ae.Sync()
+				if err != nil {
+					logging.Warnf("anti-entropy round failed: %s", err)
+				}
+				if st.Pulled > 0 {
+					logging.Infof("anti-entropy pulled %d keys of %d slots", st.Pulled, st.Slots)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops serving and the background rounds, the host is left open
+func (ae *AntiEntropy) Close() error {
+	ae.host.RemoveStreamHandler(ae.protocol)
+	close(ae.closing)
+	ae.wg.Wait()
+	return nil
+}
+
+func (ae *AntiEntropy) handleStream(s network.Stream) {
+	defer s.Close()
+	// the index is built by the first request of the stream and kept for the following ones
+	var ix *index
+	for {
+		req := new(Request)
+		if err := ReadRequest(s, req); err != nil {
+			if err != io.EOF {
+				logging.Error(err)
+			}
+			return
+		}
+		reply := &Reply{}
+		if err := ae.serve(req, reply, &ix); err != nil {
+			reply.Code = ErrOthers
+			reply.Msg = err.Error()
+		}
+		if err := WriteReply(s, reply); err != nil {
+			logging.Error(err)
+			return
+		}
+	}
+}
+
+func (ae *AntiEntropy) serve(req *Request, reply *Reply, ix **index) error {
+	if req.Act == ActGet {
+		for _, e := range req.Entries {
+			k := e.Key
+			v, err := ae.ds.Get(ds.RawKey(k))
+			if err != nil {
+				if err == ds.ErrNotFound {
+					continue
+				}
+				return err
+			}
+			reply.Entries = append(reply.Entries, Entry{Key: k, Size: int64(len(v)), Value: v})
+		}
+		return nil
+	}
+	if *ix == nil {
+		cc := ae.layout()
+		if cc == nil {
+			return xerrors.New("no cluster layout")
+		}
+		sm, err := slotsManager(cc, ae.keyHash)
+		if err != nil {
+			return err
+		}
+		if *ix, err = buildIndex(ae.ctx, ae.ds, sm); err != nil {
+			return err
+		}
+	}
+	switch req.Act {
+	case ActBuckets:
+		reply.Buckets, reply.Digests = (*ix).buckets(req.Slots)
+	case ActSlots:
+		reply.Digests = (*ix).slots(req.Slots)
+	case ActKeys:
+		reply.Entries = (*ix).keys(req.Slots)
+	default:
+		return xerrors.Errorf("unhandled act: %s", req.Act)
+	}
+	return nil
+}
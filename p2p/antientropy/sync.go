@@ -0,0 +1,216 @@
+package antientropy
+
+import (
+	"bytes"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/xerrors"
+)
+
+// getBatch limits how many values are asked by a request
+const getBatch = 64
+
+// SyncStats describes a sync round
+type SyncStats struct {
+	// Slots differing from other replicas
+	Slots int
+	// Pulled keys from other replicas
+	Pulled int
+}
+
+// Sync compares the slots shared with every other replica and pulls the keys missing locally.
+// A key whose size differs is pulled only from the primary owner of the slot.
+// Keys are never deleted, so a key deleted while a replica was down comes back.
+// Slots being migrated are skipped.
+func (ae *AntiEntropy) Sync() (SyncStats, error) {
+	ae.lk.Lock()
+	defer ae.lk.Unlock()
+	var st SyncStats
+	cc := ae.layout()
+	if cc == nil || len(cc.Nodes) == 0 {
+		return st, nil
+	}
+	sm, err := slotsManager(cc, ae.keyHash)
+	if err != nil {
+		return st, err
+	}
+	if sm.Replication() < 2 {
+		return st, nil
+	}
+	self := ae.host.ID().Pretty()
+	migrating := make(map[uint16]bool)
+	for _, mv := range cc.Migrating {
+		migrating[mv.Slot] = true
+	}
+	shared := make(map[string][]uint64)
+	primary := make(map[uint16]string)
+	for n := 0; n < shard.SLOTS_NUM; n++ {
+		slot := uint16(n)
+		if migrating[slot] {
+			continue
+		}
+		replicas, err := sm.ReplicasBySlot(slot)
+		if err != nil {
+			return st, err
+		}
+		var kept bool
+		for _, nd := range replicas {
+			if nd.ID == self {
+				kept = true
+			}
+		}
+		if !kept {
+			continue
+		}
+		primary[slot] = replicas[0].ID
+		for _, nd := range replicas {
+			if nd.ID != self {
+				shared[nd.ID] = append(shared[nd.ID], uint64(slot))
+			}
+		}
+	}
+	if len(shared) == 0 {
+		return st, nil
+	}
+	ix, err := buildIndex(ae.ctx, ae.ds, sm)
+	if err != nil {
+		return st, err
+	}
+	var firstErr error
+	for _, nd := range cc.Nodes {
+		slots, ok := shared[nd.ID]
+		if !ok {
+			continue
+		}
+		differ, pulled, err := ae.syncPeer(nd, sm, ix, slots, primary)
+		st.Slots += differ
+		st.Pulled += pulled
+		if err != nil {
+			logging.Warnf("anti-entropy with %s failed: %s", nd.ID, err)
+			if firstErr == nil {
+				firstErr = xerrors.Errorf("anti-entropy with %s failed: %w", nd.ID, err)
+			}
+		}
+	}
+	return st, firstErr
+}
+
+// syncPeer compares buckets, then slots of the buckets differing, then keys of the slots differing
+func (ae *AntiEntropy) syncPeer(nd config.Node, sm *shard.SlotsManager, ix *index, slots []uint64, primary map[uint16]string) (differ int, pulled int, err error) {
+	pid, err := peer.Decode(nd.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+	addrs := make([]ma.Multiaddr, 0, len(nd.Swarm))
+	for _, addr := range nd.Swarm {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return 0, 0, err
+		}
+		addrs = append(addrs, maddr)
+	}
+	ae.host.Peerstore().AddAddrs(pid, addrs, peerstore.PermanentAddrTTL)
+	s, err := ae.host.NewStream(ae.ctx, pid, ae.protocol)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer s.Close()
+
+	reply, err := roundTrip(s, &Request{Act: ActBuckets, Slots: slots})
+	if err != nil {
+		return 0, 0, err
+	}
+	ids, digests := ix.buckets(slots)
+	if len(reply.Buckets) != len(ids) || len(reply.Digests) != len(ids) {
+		return 0, 0, xerrors.Errorf("expected %d buckets, got %d", len(ids), len(reply.Buckets))
+	}
+	buckets := make(map[uint64]bool)
+	for i, id := range ids {
+		if reply.Buckets[i] != id {
+			return 0, 0, xerrors.Errorf("expected bucket %d, got %d", id, reply.Buckets[i])
+		}
+		if !bytes.Equal(digests[i], reply.Digests[i]) {
+			buckets[id] = true
+		}
+	}
+	if len(buckets) == 0 {
+		return 0, 0, nil
+	}
+
+	var candidates []uint64
+	for _, slot := range slots {
+		if buckets[bucketOf(uint16(slot))] {
+			candidates = append(candidates, slot)
+		}
+	}
+	reply, err = roundTrip(s, &Request{Act: ActSlots, Slots: candidates})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(reply.Digests) != len(candidates) {
+		return 0, 0, xerrors.Errorf("expected %d slots, got %d", len(candidates), len(reply.Digests))
+	}
+	var differing []uint64
+	for i, d := range ix.slots(candidates) {
+		if !bytes.Equal(d, reply.Digests[i]) {
+			differing = append(differing, candidates[i])
+		}
+	}
+	if len(differing) == 0 {
+		return 0, 0, nil
+	}
+
+	reply, err = roundTrip(s, &Request{Act: ActKeys, Slots: differing})
+	if err != nil {
+		return len(differing), 0, err
+	}
+	local := make(map[string]int64)
+	for _, e := range ix.keys(differing) {
+		local[e.Key] = e.Size
+	}
+	var wanted []Entry
+	for _, e := range reply.Entries {
+		size, ok := local[e.Key]
+		if !ok || (size != e.Size && primary[sm.SlotByKey(e.Key)] == nd.ID) {
+			wanted = append(wanted, Entry{Key: e.Key})
+		}
+	}
+	for len(wanted) > 0 {
+		n := getBatch
+		if n > len(wanted) {
+			n = len(wanted)
+		}
+		reply, err = roundTrip(s, &Request{Act: ActGet, Entries: wanted[:n]})
+		if err != nil {
+			return len(differing), pulled, err
+		}
+		wanted = wanted[n:]
+		for _, e := range reply.Entries {
+			if err := ae.ds.Put(ds.RawKey(e.Key), e.Value); err != nil {
+				return len(differing), pulled, err
+			}
+			pulled++
+		}
+	}
+	return len(differing), pulled, nil
+}
+
+func roundTrip(s network.Stream, req *Request) (*Reply, error) {
+	if err := WriteRequest(s, req); err != nil {
+		return nil, err
+	}
+	reply := new(Reply)
+	if err := ReadReply(s, reply); err != nil {
+		return nil, err
+	}
+	if reply.Code != ErrNone {
+		return nil, xerrors.New(reply.Msg)
+	}
+	return reply, nil
+}
@@ -0,0 +1,120 @@
+// swim style membership and failure detection
+package gossip
+
+import (
+	"time"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	log "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+var logging = log.Logger("dscluster/p2p/gossip")
+
+const (
+	PROTOCOL_V1 = "/cluster/gossip/0.0.1"
+)
+
+var readDeadline = time.Second * 20
+var writeDeadline = time.Second * 20
+
+type Act uint8
+
+const (
+	// ActPing probes the node, updates are piggybacked on the ping and the ack
+	ActPing Act = 1 + iota
+	// ActPingReq asks the node to probe Target on behalf of the sender
+	ActPingReq
+	// ActMembers asks the membership view of the node
+	ActMembers
+)
+
+func (a Act) String() string {
+	switch a {
+	case ActPing:
+		return "Ping"
+	case ActPingReq:
+		return "PingReq"
+	case ActMembers:
+		return "Members"
+	default:
+		return "Unknown"
+	}
+}
+
+// State of a member, a member is suspected when it doesn't answer probes and
+// declared dead if it doesn't refute the suspicion in time
+type State uint8
+
+const (
+	StateAlive State = 1 + iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+type ErrCode uint8
+
+const (
+	ErrNone ErrCode = iota
+
+	ErrOthers = 100
+)
+
+// Update tells the state of a member, a member refutes suspicions by increasing its incarnation
+type Update struct {
+	ID          string
+	State       State
+	Incarnation uint64
+}
+
+type Request struct {
+	Act     Act
+	From    string
+	Target  string
+	Updates []Update
+}
+
+// Reply.Ack reports whether the target of ActPing or ActPingReq answered
+type Reply struct {
+	Code    ErrCode
+	Msg     string
+	Ack     bool
+	Updates []Update
+}
+
+func ReadRequest(s network.Stream, msg *Request) error {
+	if err := s.SetReadDeadline(time.Now().Add(readDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.ReadCborRPC(s, msg); err != nil {
+		_ = s.SetReadDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	return nil
+}
+
+func WriteReply(s network.Stream, msg *Reply) error {
+	if err := s.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.WriteCborRPC(s, msg); err != nil {
+		_ = s.SetWriteDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Time{})
+	return nil
+}
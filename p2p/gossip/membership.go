@@ -0,0 +1,535 @@
+package gossip
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/xerrors"
+)
+
+const defaultProbeInterval = time.Second
+
+// indirectProbes is how many members are asked to probe a member not answering
+const indirectProbes = 3
+
+// maxPiggyback limits the updates carried by a message
+const maxPiggyback = 8
+
+// Member is the state of a node known by the membership
+type Member struct {
+	ID          string
+	State       State
+	Incarnation uint64
+	// Since is when the state was learned
+	Since time.Time
+}
+
+type member struct {
+	Member
+	node config.Node
+}
+
+// broadcast is an update gossiped a limited number of times
+type broadcast struct {
+	update    Update
+	transmits int
+}
+
+// Membership probes a random member every interval, a member not answering is probed
+// through other members, then suspected, then declared dead after the suspect timeout
+// unless it refutes the suspicion. State changes are piggybacked on probes.
+// Members are the nodes of the cluster layout. A host not in the layout, e.g. a client,
+// only observes the cluster, it probes the members but isn't probed.
+type Membership struct {
+	ctx      context.Context
+	host     host.Host
+	protocol protocol.ID
+	self     string
+	nodes    func() []config.Node
+
+	interval       time.Duration
+	timeout        time.Duration
+	suspectTimeout time.Duration
+	onChange       func(m Member)
+
+	lk          sync.Mutex
+	incarnation uint64
+	members     map[string]*member
+	queue       []*broadcast
+	// probe order, shuffled every round
+	order []string
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type Option func(m *Membership)
+
+// WithProbeInterval sets how often a member is probed, the probe timeout is half of it
+// and the suspect timeout five times of it unless they are set
+func WithProbeInterval(d time.Duration) Option {
+	return func(m *Membership) {
+		m.interval = d
+	}
+}
+
+func WithProbeTimeout(d time.Duration) Option {
+	return func(m *Membership) {
+		m.timeout = d
+	}
+}
+
+func WithSuspectTimeout(d time.Duration) Option {
+	return func(m *Membership) {
+		m.suspectTimeout = d
+	}
+}
+
+// OnChange registers the callback called when the state of a member changes
+func OnChange(f func(m Member)) Option {
+	return func(m *Membership) {
+		m.onChange = f
+	}
+}
+
+// NewMembership tracks the nodes returned by nodes, which is called every probe
+// so that members follow the cluster layout
+func NewMembership(ctx context.Context, h host.Host, nodes func() []config.Node, opts ...Option) *Membership {
+	m := &Membership{
+		ctx:      ctx,
+		host:     h,
+		protocol: PROTOCOL_V1,
+		self:     h.ID().Pretty(),
+		nodes:    nodes,
+		interval: defaultProbeInterval,
+		members:  make(map[string]*member),
+		closing:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.timeout == 0 {
+		m.timeout = m.interval / 2
+	}
+	if m.suspectTimeout == 0 {
+		m.suspectTimeout = 5 * m.interval
+	}
+	m.refresh()
+	return m
+}
+
+func (m *Membership) Serve() {
+	logging.Info("gossip set stream handler")
+	m.host.SetStreamHandler(m.protocol, m.handleStream)
+}
+
+// Start probes the members in background
+func (m *Membership) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-m.closing:
+				return
+			case <-ticker.C:
+				m.probe()
+			}
+		}
+	}()
+}
+
+// Close stops probing, the host is left open
+func (m *Membership) Close() error {
+	m.closeOnce.Do(func() {
+		m.host.RemoveStreamHandler(m.protocol)
+		close(m.closing)
+	})
+	m.wg.Wait()
+	return nil
+}
+
+// State returns the state of the member, StateAlive for nodes not tracked
+func (m *Membership) State(id string) State {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if mb, ok := m.members[id]; ok {
+		return mb.State
+	}
+	return StateAlive
+}
+
+// Members returns the members sorted by id, the node itself included
+func (m *Membership) Members() []Member {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.view()
+}
+
+func (m *Membership) view() []Member {
+	res := make([]Member, 0, len(m.members)+1)
+	for _, mb := range m.members {
+		res = append(res, mb.Member)
+	}
+	if m.isMember() {
+		res = append(res, Member{ID: m.self, State: StateAlive, Incarnation: m.incarnation})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// refresh follows the nodes of the cluster layout, pending nodes are not members until they join
+func (m *Membership) refresh() {
+	nds := m.nodes()
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	current := make(map[string]bool, len(nds))
+	for _, nd := range nds {
+		if nd.Pending {
+			continue
+		}
+		current[nd.ID] = true
+		if nd.ID == m.self {
+			continue
+		}
+		if mb, ok := m.members[nd.ID]; ok {
+			mb.node = nd
+			continue
+		}
+		m.members[nd.ID] = &member{
+			Member: Member{ID: nd.ID, State: StateAlive, Since: time.Now()},
+			node:   nd,
+		}
+	}
+	for id := range m.members {
+		if !current[id] {
+			delete(m.members, id)
+		}
+	}
+}
+
+func (m *Membership) isMember() bool {
+	for _, nd := range m.nodes() {
+		if nd.ID == m.self {
+			return true
+		}
+	}
+	return false
+}
+
+// probe runs a protocol period: declares dead the members suspected for too long,
+// then probes the next member directly and indirectly
+func (m *Membership) probe() {
+	m.refresh()
+	m.lk.Lock()
+	for _, mb := range m.members {
+		if mb.State == StateSuspect && time.Since(mb.Since) > m.suspectTimeout {
+			m.set(mb, StateDead, mb.Incarnation)
+		}
+	}
+	target, ok := m.next()
+	m.lk.Unlock()
+	if !ok {
+		return
+	}
+	if m.ping(target) {
+		return
+	}
+	if m.pingIndirect(target) {
+		return
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if mb, ok := m.members[target.ID]; ok && mb.State == StateAlive {
+		logging.Infof("suspect %s", mb.ID)
+		m.set(mb, StateSuspect, mb.Incarnation)
+	}
+}
+
+// next returns the member to be probed, members are probed in turn in a random order.
+// Dead members are probed as well so that they are found back. lk should be held.
+func (m *Membership) next() (config.Node, bool) {
+	for len(m.order) > 0 {
+		id := m.order[0]
+		m.order = m.order[1:]
+		if mb, ok := m.members[id]; ok {
+			return mb.node, true
+		}
+	}
+	for id := range m.members {
+		m.order = append(m.order, id)
+	}
+	if len(m.order) == 0 {
+		return config.Node{}, false
+	}
+	rand.Shuffle(len(m.order), func(i, j int) {
+		m.order[i], m.order[j] = m.order[j], m.order[i]
+	})
+	id := m.order[0]
+	m.order = m.order[1:]
+	return m.members[id].node, true
+}
+
+// ping probes the member directly, the suspicion about the member is sent along to be refuted
+func (m *Membership) ping(nd config.Node) bool {
+	m.lk.Lock()
+	updates := m.piggyback()
+	if mb, ok := m.members[nd.ID]; ok && mb.State != StateAlive {
+		updates = append(updates, Update{ID: mb.ID, State: mb.State, Incarnation: mb.Incarnation})
+	}
+	m.lk.Unlock()
+	reply, err := m.call(nd, &Request{Act: ActPing, From: m.self, Updates: updates}, m.timeout)
+	if err != nil {
+		logging.Debugf("ping %s failed: %s", nd.ID, err)
+		return false
+	}
+	m.merge(reply.Updates)
+	return reply.Ack
+}
+
+// pingIndirect asks other alive members to probe the member
+func (m *Membership) pingIndirect(nd config.Node) bool {
+	m.lk.Lock()
+	var helpers []config.Node
+	for _, mb := range m.members {
+		if mb.ID != nd.ID && mb.State == StateAlive {
+			helpers = append(helpers, mb.node)
+		}
+	}
+	updates := m.piggyback()
+	m.lk.Unlock()
+	if len(helpers) == 0 {
+		return false
+	}
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	if len(helpers) > indirectProbes {
+		helpers = helpers[:indirectProbes]
+	}
+	ch := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func(h config.Node) {
+			reply, err := m.call(h, &Request{Act: ActPingReq, From: m.self, Target: nd.ID, Updates: updates}, 2*m.timeout)
+			if err != nil {
+				logging.Debugf("ask %s to ping %s failed: %s", h.ID, nd.ID, err)
+				ch <- false
+				return
+			}
+			m.merge(reply.Updates)
+			ch <- reply.Ack
+		}(h)
+	}
+	for range helpers {
+		if <-ch {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Membership) handleStream(s network.Stream) {
+	defer s.Close()
+	req := new(Request)
+	if err := ReadRequest(s, req); err != nil {
+		logging.Errorf("gossip read request failed: %s", err)
+		return
+	}
+	m.merge(req.Updates)
+	reply := &Reply{}
+	switch req.Act {
+	case ActPing:
+		reply.Ack = true
+	case ActPingReq:
+		m.lk.Lock()
+		mb, ok := m.members[req.Target]
+		m.lk.Unlock()
+		if ok {
+			reply.Ack = m.ping(mb.node)
+		} else {
+			reply.Code = ErrOthers
+			reply.Msg = "unknown member " + req.Target
+		}
+	case ActMembers:
+		m.lk.Lock()
+		for _, mb := range m.view() {
+			reply.Updates = append(reply.Updates, Update{ID: mb.ID, State: mb.State, Incarnation: mb.Incarnation})
+		}
+		m.lk.Unlock()
+		if err := WriteReply(s, reply); err != nil {
+			logging.Errorf("gossip write reply failed: %s", err)
+		}
+		return
+	default:
+		reply.Code = ErrOthers
+		reply.Msg = "unknown action " + req.Act.String()
+	}
+	m.lk.Lock()
+	reply.Updates = m.piggyback()
+	m.lk.Unlock()
+	if err := WriteReply(s, reply); err != nil {
+		logging.Errorf("gossip write reply failed: %s", err)
+	}
+}
+
+// merge applies the updates received
+func (m *Membership) merge(updates []Update) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for _, u := range updates {
+		m.apply(u)
+	}
+}
+
+// apply follows the precedence of swim: a higher incarnation wins, with the same incarnation
+// suspect wins over alive and dead wins over both. Suspicions about the node itself
+// are refuted with a higher incarnation. lk should be held.
+func (m *Membership) apply(u Update) {
+	if u.ID == m.self {
+		if u.State != StateAlive && u.Incarnation >= m.incarnation {
+			m.incarnation = u.Incarnation + 1
+			logging.Infof("refute %s with incarnation %d", u.State, m.incarnation)
+			m.enqueue(Update{ID: m.self, State: StateAlive, Incarnation: m.incarnation})
+		}
+		return
+	}
+	mb, ok := m.members[u.ID]
+	if !ok {
+		return
+	}
+	if u.Incarnation < mb.Incarnation || (u.Incarnation == mb.Incarnation && u.State <= mb.State) {
+		return
+	}
+	m.set(mb, u.State, u.Incarnation)
+}
+
+// set changes the state of the member and gossips it, lk should be held
+func (m *Membership) set(mb *member, st State, incarnation uint64) {
+	changed := mb.State != st
+	mb.State = st
+	mb.Incarnation = incarnation
+	m.enqueue(Update{ID: mb.ID, State: st, Incarnation: incarnation})
+	if !changed {
+		return
+	}
+	mb.Since = time.Now()
+	logging.Infof("member %s is %s", mb.ID, st)
+	if st == StateAlive {
+		// the failed dials to the member no longer hold back connecting to it
+		if sw, ok := m.host.Network().(*swarm.Swarm); ok {
+			if id, err := peer.Decode(mb.ID); err == nil {
+				sw.Backoff().Clear(id)
+			}
+		}
+	}
+	if m.onChange != nil {
+		go m.onChange(mb.Member)
+	}
+}
+
+// enqueue replaces the updates of the same member, lk should be held
+func (m *Membership) enqueue(u Update) {
+	for i, b := range m.queue {
+		if b.update.ID == u.ID {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			break
+		}
+	}
+	m.queue = append(m.queue, &broadcast{update: u})
+}
+
+// piggyback returns the updates to be carried by a message, an update is gossiped
+// about 3*log(n) times. The alive update of the node itself is always carried. lk should be held.
+func (m *Membership) piggyback() []Update {
+	limit := 3 * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	var res []Update
+	kept := m.queue[:0]
+	for _, b := range m.queue {
+		if len(res) < maxPiggyback {
+			res = append(res, b.update)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	m.queue = kept
+	if m.isMember() {
+		res = append(res, Update{ID: m.self, State: StateAlive, Incarnation: m.incarnation})
+	}
+	return res
+}
+
+func (m *Membership) call(nd config.Node, req *Request, timeout time.Duration) (*Reply, error) {
+	return call(m.ctx, m.host, m.protocol, nd, req, timeout)
+}
+
+// FetchMembers asks the membership view of the data node
+func FetchMembers(ctx context.Context, h host.Host, nd config.Node) ([]Member, error) {
+	reply, err := call(ctx, h, PROTOCOL_V1, nd, &Request{Act: ActMembers, From: h.ID().Pretty()}, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Code != ErrNone {
+		return nil, xerrors.New(reply.Msg)
+	}
+	res := make([]Member, 0, len(reply.Updates))
+	for _, u := range reply.Updates {
+		res = append(res, Member{ID: u.ID, State: u.State, Incarnation: u.Incarnation})
+	}
+	return res, nil
+}
+
+func call(ctx context.Context, h host.Host, pid protocol.ID, nd config.Node, req *Request, timeout time.Duration) (*Reply, error) {
+	id, err := peer.Decode(nd.ID)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]ma.Multiaddr, 0, len(nd.Swarm))
+	for _, addr := range nd.Swarm {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, maddr)
+	}
+	h.Peerstore().AddAddrs(id, addrs, peerstore.PermanentAddrTTL)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	s, err := h.NewStream(ctx, id, pid)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if err := s.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if err := cborutil.WriteCborRPC(s, req); err != nil {
+		return nil, err
+	}
+	reply := new(Reply)
+	if err := cborutil.ReadCborRPC(s, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,136 @@
+package gossip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	"github.com/filedrive-team/go-ds-cluster/utils"
+	"github.com/libp2p/go-libp2p-core/host"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var hosts []host.Host
+	var nodes []config.Node
+	for i := 0; i < 4; i++ {
+		h, err := p2p.MakeBasicHost(utils.RandPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+		var swarm []string
+		for _, addr := range h.Addrs() {
+			swarm = append(swarm, addr.String())
+		}
+		nodes = append(nodes, config.Node{
+			Node:  shard.Node{ID: h.ID().Pretty()},
+			Swarm: swarm,
+		})
+	}
+	layout := func() []config.Node {
+		return nodes
+	}
+	opts := []Option{
+		WithProbeInterval(100 * time.Millisecond),
+		WithSuspectTimeout(500 * time.Millisecond),
+	}
+
+	var members []*Membership
+	for _, h := range hosts {
+		m := NewMembership(ctx, h, layout, opts...)
+		m.Serve()
+		m.Start()
+		defer m.Close()
+		members = append(members, m)
+	}
+
+	// every member knows every node alive
+	for _, m := range members {
+		ms := m.Members()
+		if len(ms) != len(nodes) {
+			t.Fatalf("expected %d members, got %d", len(nodes), len(ms))
+		}
+		for _, mb := range ms {
+			if mb.State != StateAlive {
+				t.Fatalf("expected %s alive, got %s", mb.ID, mb.State)
+			}
+		}
+	}
+
+	// a client host observes the cluster without being a member
+	ch, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	observer := NewMembership(ctx, ch, layout, opts...)
+	observer.Start()
+	defer observer.Close()
+	if got := len(observer.Members()); got != len(nodes) {
+		t.Fatalf("expected %d members observed, got %d", len(nodes), got)
+	}
+
+	// a stopped node is suspected then declared dead by everyone
+	down := nodes[3].ID
+	members[3].Close()
+	hosts[3].Close()
+	for _, m := range []*Membership{members[0], members[1], members[2], observer} {
+		m := m
+		waitFor(t, "dead member", func() bool {
+			return m.State(down) == StateDead
+		})
+	}
+	for _, nd := range nodes[:3] {
+		if st := observer.State(nd.ID); st != StateAlive {
+			t.Fatalf("expected %s alive, got %s", nd.ID, st)
+		}
+	}
+
+	// the data node reports its view
+	ms, err := FetchMembers(ctx, ch, nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mb := range ms {
+		expect := StateAlive
+		if mb.ID == down {
+			expect = StateDead
+		}
+		if mb.State != expect {
+			t.Fatalf("expected %s %s, got %s", mb.ID, expect, mb.State)
+		}
+	}
+
+	// a node suspected wrongly refutes the suspicion
+	m0 := members[0]
+	m0.lk.Lock()
+	m0.set(m0.members[nodes[1].ID], StateSuspect, 0)
+	m0.lk.Unlock()
+	waitFor(t, "refuted suspicion", func() bool {
+		return m0.State(nodes[1].ID) == StateAlive
+	})
+	members[1].lk.Lock()
+	inc := members[1].incarnation
+	members[1].lk.Unlock()
+	if inc == 0 {
+		t.Fatal("expected incarnation increased by the refutation")
+	}
+}
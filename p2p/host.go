@@ -8,12 +8,15 @@ import (
 	"io/ioutil"
 
 	"github.com/filedrive-team/go-ds-cluster/config"
+	log "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/pnet"
 )
 
+var logging = log.Logger("dscluster/p2p")
+
 func MakeBasicHost(listenPort string) (host.Host, error) {
 	priv, _, err := crypto.GenerateECDSAKeyPair(rand.Reader)
 	if err != nil {
@@ -30,17 +33,26 @@ func MakeBasicHost(listenPort string) (host.Host, error) {
 	return libp2p.New(context.Background(), opts...)
 }
 
-func HostFromConf(cfg *config.Config) (host.Host, error) {
+// HostFromConf makes the host with the identity and the addresses of the config, opts are appended
+// to the libp2p options, e.g. a connection gater
+func HostFromConf(cfg *config.Config, opts ...libp2p.Option) (host.Host, error) {
 	priv, err := crypto.UnmarshalPrivateKey(cfg.Identity.SK)
 	if err != nil {
 		return nil, err
 	}
 
-	opts := []libp2p.Option{
+	opts = append([]libp2p.Option{
 		libp2p.ListenAddrStrings(cfg.Addresses.Swarm...),
 		libp2p.Identity(priv),
 		libp2p.DisableRelay(),
 		libp2p.DefaultTransports,
+	}, opts...)
+	if keypath := cfg.SwarmKeyFile(); keypath != "" {
+		opt, err := privateNetwork(keypath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
 	}
 	h, err := libp2p.New(context.Background(), opts...)
 	if err != nil {
@@ -63,16 +75,25 @@ func MakeHost(listenPort string, keypath string) (host.Host, error) {
 		libp2p.DefaultTransports,
 	}
 	if keypath != "" {
-		kb, err := ioutil.ReadFile(keypath)
+		opt, err := privateNetwork(keypath)
 		if err != nil {
 			return nil, err
 		}
-		psk, err := pnet.DecodeV1PSK(bytes.NewReader(kb))
-		if err != nil {
-			return nil, fmt.Errorf("failed to configure private network: %s", err)
-		}
-		opts = append(opts, libp2p.PrivateNetwork(psk))
+		opts = append(opts, opt)
 	}
 
 	return libp2p.New(context.Background(), opts...)
 }
+
+// privateNetwork reads the pre-shared swarm key at keypath
+func privateNetwork(keypath string) (libp2p.Option, error) {
+	kb, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		return nil, err
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(kb))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure private network: %s", err)
+	}
+	return libp2p.PrivateNetwork(psk), nil
+}
@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/utils"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestPrivateNetwork(t *testing.T) {
+	dir := t.TempDir()
+	if err := config.GenSwarmKey(filepath.Join(dir, config.DefaultSwarmKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+	privateHost := func() host.Host {
+		cfg, err := config.GenClientConf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.ConfPath = dir
+		cfg.SwarmKeyPath = config.DefaultSwarmKeyFile
+		cfg.Addresses.Swarm = []string{"/ip4/127.0.0.1/tcp/" + utils.RandPort()}
+		h, err := HostFromConf(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	h1 := privateHost()
+	defer h1.Close()
+	h2 := privateHost()
+	defer h2.Close()
+	outsider, err := MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outsider.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatalf("hosts sharing the swarm key should connect: %s", err)
+	}
+	if err := outsider.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err == nil {
+		t.Fatal("hosts without the swarm key should not connect")
+	}
+}
@@ -0,0 +1,164 @@
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/xerrors"
+)
+
+// callTimeout bounds a request of the client, a proposal may wait for an election
+const callTimeout = proposeTimeout + 5*time.Second
+
+// Client reaches the leader of the metadata service through any node of the cluster
+type Client struct {
+	ctx      context.Context
+	host     host.Host
+	protocol protocol.ID
+	// lk guards the nodes and the last leader known
+	lk     sync.Mutex
+	nodes  []config.Node
+	leader string
+}
+
+func NewClient(ctx context.Context, h host.Host, nodes []config.Node) *Client {
+	return &Client{
+		ctx:      ctx,
+		host:     h,
+		protocol: PROTOCOL_V1,
+		nodes:    nodes,
+	}
+}
+
+// SetNodes updates the nodes reached by the client, e.g. after the layout changed
+func (cl *Client) SetNodes(nodes []config.Node) {
+	cl.lk.Lock()
+	defer cl.lk.Unlock()
+	cl.nodes = nodes
+}
+
+// Propose replicates the layout of the manifest, see Raft.Propose
+func (cl *Client) Propose(m *config.Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = cl.do(&Request{Act: ActPropose, Data: data})
+	return err
+}
+
+// Layout reads the layout committed by the cluster
+func (cl *Client) Layout() (*config.ClusterConf, error) {
+	reply, err := cl.do(&Request{Act: ActLayout})
+	if err != nil {
+		return nil, err
+	}
+	cc := new(config.ClusterConf)
+	if err := json.Unmarshal(reply.Data, cc); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// do sends the request to the leader known, or to every node in turn following the leader they know
+func (cl *Client) do(req *Request) (*Reply, error) {
+	deadline := time.Now().Add(proposeTimeout)
+	var lastErr error = ErrNoLeader
+	for i := 0; time.Now().Before(deadline); i++ {
+		nd, ok := cl.target(i)
+		if !ok {
+			return nil, xerrors.New("no node of metadata service")
+		}
+		reply, err := call(cl.ctx, cl.host, cl.protocol, nd, req, callTimeout)
+		switch {
+		case err != nil:
+			lastErr = xerrors.Errorf("%s %s failed: %w", req.Act, nd.ID, err)
+			cl.setLeader("")
+		case reply.Code == ErrNone:
+			return reply, nil
+		case reply.Code == ErrNotLeader:
+			lastErr = ErrNoLeader
+			cl.setLeader(reply.Leader)
+			if reply.Leader != "" && reply.Leader != nd.ID {
+				continue
+			}
+		case reply.Code == ErrStale:
+			return nil, xerrors.Errorf("%w: %s", ErrStaleLayout, reply.Msg)
+		case reply.Code == ErrDenied:
+			return nil, xerrors.Errorf("%w: %s", ErrPermissionDenied, reply.Msg)
+		default:
+			return nil, xerrors.New(reply.Msg)
+		}
+		// wait for an election
+		select {
+		case <-time.After(defaultHeartbeat):
+		case <-cl.ctx.Done():
+			return nil, cl.ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+// target returns the leader known, or the nodes in turn
+func (cl *Client) target(i int) (config.Node, bool) {
+	cl.lk.Lock()
+	defer cl.lk.Unlock()
+	if len(cl.nodes) == 0 {
+		return config.Node{}, false
+	}
+	for _, nd := range cl.nodes {
+		if cl.leader != "" && nd.ID == cl.leader {
+			return nd, true
+		}
+	}
+	return cl.nodes[i%len(cl.nodes)], true
+}
+
+func (cl *Client) setLeader(id string) {
+	cl.lk.Lock()
+	defer cl.lk.Unlock()
+	cl.leader = id
+}
+
+func call(ctx context.Context, h host.Host, pid protocol.ID, nd config.Node, req *Request, timeout time.Duration) (*Reply, error) {
+	id, err := peer.Decode(nd.ID)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]ma.Multiaddr, 0, len(nd.Swarm))
+	for _, addr := range nd.Swarm {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, maddr)
+	}
+	h.Peerstore().AddAddrs(id, addrs, peerstore.PermanentAddrTTL)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	s, err := h.NewStream(ctx, id, pid)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if err := s.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if err := cborutil.WriteCborRPC(s, req); err != nil {
+		return nil, err
+	}
+	reply := new(Reply)
+	if err := cborutil.ReadCborRPC(s, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,146 @@
+// raft replicated cluster metadata
+package meta
+
+import (
+	"time"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	log "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+var logging = log.Logger("dscluster/p2p/meta")
+
+const (
+	PROTOCOL_V1 = "/cluster/meta/0.0.1"
+)
+
+var readDeadline = time.Second * 20
+var writeDeadline = time.Second * 20
+
+type Act uint8
+
+const (
+	// ActVote asks the vote of a node for the candidate, votes and entries are only taken from the nodes of the cluster
+	ActVote Act = 1 + iota
+	// ActAppend replicates log entries from the leader, it's the heartbeat as well
+	ActAppend
+	// ActPropose proposes a new cluster layout, only the leader accepts it,
+	// from a voter or signed by the admin key if it's configured
+	ActPropose
+	// ActLayout reads the committed cluster layout from the leader
+	ActLayout
+)
+
+func (a Act) String() string {
+	switch a {
+	case ActVote:
+		return "Vote"
+	case ActAppend:
+		return "Append"
+	case ActPropose:
+		return "Propose"
+	case ActLayout:
+		return "Layout"
+	default:
+		return "Unknown"
+	}
+}
+
+type ErrCode uint8
+
+const (
+	ErrNone ErrCode = iota
+	// ErrNotLeader means the node isn't the leader, Reply.Leader is the leader known by the node
+	ErrNotLeader
+	// ErrStale means the epoch of the proposed layout doesn't follow the epoch of current layout
+	ErrStale
+	// ErrDenied means the peer isn't allowed to take the action
+	ErrDenied
+
+	ErrOthers = 100
+)
+
+// Request is the message of every action.
+// From is the sender, the receiver identifies it by the connection instead.
+// For ActVote, PrevIndex and PrevTerm describe the last entry of the log of the candidate.
+// For ActAppend, Entries follow the entry at PrevIndex whose term is PrevTerm,
+// Snapshot is the layout at PrevIndex when the entries before have been compacted.
+// For ActPropose, Data is the manifest of the proposed layout.
+type Request struct {
+	Act       Act
+	Term      uint64
+	From      string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []Entry
+	Commit    uint64
+	Snapshot  []byte
+	Data      []byte
+}
+
+// Reply.Index is the last index matched by the follower for ActAppend
+type Reply struct {
+	Code    ErrCode
+	Msg     string
+	Term    uint64
+	Success bool
+	Index   uint64
+	Leader  string
+	Data    []byte
+}
+
+// Entry of the raft log, Data is a cluster layout, empty for the entry appended by a new leader
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Data  []byte
+}
+
+func ReadRequest(s network.Stream, msg *Request) error {
+	if err := s.SetReadDeadline(time.Now().Add(readDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.ReadCborRPC(s, msg); err != nil {
+		_ = s.SetReadDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	return nil
+}
+
+func WriteRequest(s network.Stream, msg *Request) error {
+	if err := s.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.WriteCborRPC(s, msg); err != nil {
+		_ = s.SetWriteDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+func ReadReply(s network.Stream, msg *Reply) error {
+	if err := s.SetReadDeadline(time.Now().Add(readDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.ReadCborRPC(s, msg); err != nil {
+		_ = s.SetReadDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	return nil
+}
+
+func WriteReply(s network.Stream, msg *Reply) error {
+	if err := s.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.WriteCborRPC(s, msg); err != nil {
+		_ = s.SetWriteDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Time{})
+	return nil
+}
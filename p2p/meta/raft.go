@@ -0,0 +1,1098 @@
+package meta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"golang.org/x/xerrors"
+)
+
+const defaultElectionTimeout = time.Second
+const defaultHeartbeat = 200 * time.Millisecond
+
+// maxAppend limits how many entries are sent by a request
+const maxAppend = 64
+
+// keepLog is how many applied entries are kept for lagging followers when the log is compacted
+const keepLog = 128
+
+// proposeTimeout bounds how long a proposal waits to be applied
+const proposeTimeout = 10 * time.Second
+
+var ErrNoLeader = xerrors.New("no raft leader")
+var ErrStaleLayout = xerrors.New("stale cluster layout")
+var ErrPermissionDenied = xerrors.New("permission denied")
+var errLeadershipLost = xerrors.New("raft leadership lost, the layout may not be applied")
+
+var stateKey = ds.NewKey("/raft/state")
+var snapshotKey = ds.NewKey("/raft/snapshot")
+
+const logPrefix = "/raft/log/"
+
+func logKey(idx uint64) ds.Key {
+	return ds.NewKey(fmt.Sprintf("%s%020d", logPrefix, idx))
+}
+
+type role uint8
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// hardState is persisted before answering any request
+type hardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote"`
+}
+
+// snapshot is the layout at Index, the log keeps the entries after it
+type snapshot struct {
+	Index  uint64              `json:"index"`
+	Term   uint64              `json:"term"`
+	Layout *config.ClusterConf `json:"layout"`
+}
+
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// Raft replicates the cluster layout between data nodes. Every entry of the log is a whole layout,
+// the state machine is the last layout applied. A layout is accepted by the leader only if its epoch
+// follows the epoch of the last layout of the log, so that changes of the layout are linearizable.
+// The voters are the nodes of the committed layout, a layout changing them takes effect once committed.
+// Votes and entries are only taken from the nodes of the layouts known, identified by their connections.
+type Raft struct {
+	ctx      context.Context
+	host     host.Host
+	protocol protocol.ID
+	store    ds.Datastore
+	self     string
+
+	electionTimeout time.Duration
+	heartbeat       time.Duration
+	onApply         func(cc *config.ClusterConf)
+	// adminKey verifies the layouts proposed, nil if only the voters may propose
+	adminKey crypto.PubKey
+
+	lk       sync.Mutex
+	role     role
+	term     uint64
+	vote     string
+	leader   string
+	entries  []Entry
+	snap     snapshot
+	layout   *config.ClusterConf
+	commit   uint64
+	applied  uint64
+	next     map[string]uint64
+	match    map[string]uint64
+	inflight map[string]bool
+	deadline time.Time
+	waiters  map[uint64][]waiter
+	// layouts applied but not handed to onApply yet
+	pending []*config.ClusterConf
+	applyCh chan struct{}
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+type Option func(r *Raft)
+
+// WithElectionTimeout sets the minimal election timeout, a node waits for a random timeout
+// between it and twice of it before campaigning
+func WithElectionTimeout(d time.Duration) Option {
+	return func(r *Raft) {
+		r.electionTimeout = d
+	}
+}
+
+// WithHeartbeat sets how often the leader replicates its log
+func WithHeartbeat(d time.Duration) Option {
+	return func(r *Raft) {
+		r.heartbeat = d
+	}
+}
+
+// OnApply registers the callback called in order with every layout applied
+func OnApply(f func(cc *config.ClusterConf)) Option {
+	return func(r *Raft) {
+		r.onApply = f
+	}
+}
+
+// WithAdminKey only accepts the layouts proposed in manifests signed by the admin key
+func WithAdminKey(pk crypto.PubKey) Option {
+	return func(r *Raft) {
+		r.adminKey = pk
+	}
+}
+
+// NewRaft restores the raft state kept by store, seed is the layout the log starts with
+// when store is empty, it should be the same on every node
+func NewRaft(ctx context.Context, h host.Host, store ds.Datastore, seed *config.ClusterConf, opts ...Option) (*Raft, error) {
+	r := &Raft{
+		ctx:             ctx,
+		host:            h,
+		protocol:        PROTOCOL_V1,
+		store:           store,
+		self:            h.ID().Pretty(),
+		electionTimeout: defaultElectionTimeout,
+		heartbeat:       defaultHeartbeat,
+		next:            make(map[string]uint64),
+		match:           make(map[string]uint64),
+		inflight:        make(map[string]bool),
+		waiters:         make(map[uint64][]waiter),
+		applyCh:         make(chan struct{}, 1),
+		closing:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.restore(seed); err != nil {
+		return nil, err
+	}
+	r.resetDeadline()
+	return r, nil
+}
+
+func (r *Raft) restore(seed *config.ClusterConf) error {
+	b, err := r.store.Get(stateKey)
+	switch {
+	case err == nil:
+		hs := hardState{}
+		if err := json.Unmarshal(b, &hs); err != nil {
+			return xerrors.Errorf("invalid raft state: %w", err)
+		}
+		r.term = hs.Term
+		r.vote = hs.Vote
+	case err != ds.ErrNotFound:
+		return err
+	}
+	b, err = r.store.Get(snapshotKey)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &r.snap); err != nil {
+			return xerrors.Errorf("invalid raft snapshot: %w", err)
+		}
+	case err == ds.ErrNotFound:
+		if seed == nil {
+			return xerrors.New("raft needs a seed layout")
+		}
+		r.snap = snapshot{Layout: seed}
+	default:
+		return err
+	}
+	if r.snap.Layout == nil {
+		return xerrors.New("raft snapshot without layout")
+	}
+	// some datastores ignore the prefix and values of queries
+	results, err := r.store.Query(dsq.Query{Prefix: logPrefix, KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	var entries []Entry
+	for res := range results.Next() {
+		if res.Error != nil {
+			return res.Error
+		}
+		if !strings.HasPrefix(res.Key, logPrefix) {
+			continue
+		}
+		v, err := r.store.Get(ds.RawKey(res.Key))
+		if err != nil {
+			return err
+		}
+		e := Entry{}
+		if err := json.Unmarshal(v, &e); err != nil {
+			return xerrors.Errorf("invalid raft log entry %s: %w", res.Key, err)
+		}
+		if e.Index > r.snap.Index {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Index < entries[j].Index
+	})
+	// keep the entries following the snapshot without gap
+	for i, e := range entries {
+		if e.Index != r.snap.Index+uint64(i)+1 {
+			entries = entries[:i]
+			break
+		}
+	}
+	r.entries = entries
+	r.layout = r.snap.Layout
+	r.commit = r.snap.Index
+	r.applied = r.snap.Index
+	return nil
+}
+
+func (r *Raft) Serve() {
+	logging.Info("raft set stream handler")
+	r.host.SetStreamHandler(r.protocol, r.handleStream)
+}
+
+// Start runs elections and replication in background, the layout restored is handed to onApply first
+func (r *Raft) Start() {
+	r.lk.Lock()
+	r.pending = append(r.pending, r.layout)
+	r.lk.Unlock()
+	r.notifyApply()
+	r.wg.Add(2)
+	go r.run()
+	go r.applier()
+}
+
+// Close stops the raft, the host and the store are left open
+func (r *Raft) Close() error {
+	r.host.RemoveStreamHandler(r.protocol)
+	close(r.closing)
+	r.wg.Wait()
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.failWaiters(ErrNoLeader)
+	return nil
+}
+
+// Leader returns the leader known by the node, empty if unknown
+func (r *Raft) Leader() string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.leader
+}
+
+func (r *Raft) IsLeader() bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.role == leader
+}
+
+// Applied returns the last layout applied by the node, it may be stale
+func (r *Raft) Applied() *config.ClusterConf {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.layout
+}
+
+// Propose replicates the layout of the manifest through the leader, it returns after the layout is applied
+// by the leader. The epoch of the layout should follow the epoch of current layout,
+// otherwise ErrStaleLayout is returned. Proposing current layout again succeeds.
+// The manifest is forwarded to the leader, which checks its signature if the admin key is set.
+func (r *Raft) Propose(m *config.Manifest) error {
+	if m.Layout == nil {
+		return xerrors.New("cluster layout missing")
+	}
+	err := r.propose(m.Layout)
+	if err != errNotLeader {
+		return err
+	}
+	return r.client().Propose(m)
+}
+
+// Layout reads the layout committed by the cluster from the leader
+func (r *Raft) Layout() (*config.ClusterConf, error) {
+	cc, err := r.readLayout()
+	if err != errNotLeader {
+		return cc, err
+	}
+	return r.client().Layout()
+}
+
+// client reaches the leader through the voters of the node
+func (r *Raft) client() *Client {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	cl := NewClient(r.ctx, r.host, r.lastLayout().Nodes)
+	cl.setLeader(r.leader)
+	return cl
+}
+
+var errNotLeader = xerrors.New("not the raft leader")
+
+func (r *Raft) propose(cc *config.ClusterConf) error {
+	data, err := json.Marshal(cc)
+	if err != nil {
+		return err
+	}
+	r.lk.Lock()
+	if r.role != leader {
+		r.lk.Unlock()
+		return errNotLeader
+	}
+	idx, last := r.lastLayoutIndex()
+	var w waiter
+	switch {
+	case bytes.Equal(data, mustMarshal(last)):
+		if idx <= r.commit {
+			r.lk.Unlock()
+			return nil
+		}
+		w = r.wait(idx, r.termAt(idx))
+	case cc.Epoch != last.Epoch+1:
+		r.lk.Unlock()
+		return xerrors.Errorf("%w: epoch %d, current epoch %d", ErrStaleLayout, cc.Epoch, last.Epoch)
+	default:
+		e := Entry{Term: r.term, Index: r.lastIndex() + 1, Data: data}
+		r.append(e)
+		w = r.wait(e.Index, e.Term)
+	}
+	r.lk.Unlock()
+	r.broadcast()
+	select {
+	case err := <-w.ch:
+		return err
+	case <-time.After(proposeTimeout):
+		return xerrors.New("propose cluster layout timeout")
+	case <-r.closing:
+		return ErrNoLeader
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// readLayout confirms the node is still the leader by a round of heartbeats
+// before returning the applied layout
+func (r *Raft) readLayout() (*config.ClusterConf, error) {
+	timeout := time.After(proposeTimeout)
+	for {
+		r.lk.Lock()
+		if r.role != leader {
+			r.lk.Unlock()
+			return nil, errNotLeader
+		}
+		// the entry appended by the leader should be committed first
+		if r.termAt(r.commit) == r.term {
+			break
+		}
+		r.lk.Unlock()
+		select {
+		case <-time.After(r.heartbeat):
+		case <-timeout:
+			return nil, xerrors.New("read cluster layout timeout")
+		case <-r.closing:
+			return nil, ErrNoLeader
+		}
+	}
+	term := r.term
+	cc := r.layout
+	voters := r.voters()
+	peers := r.peers()
+	req := &Request{Act: ActAppend, Term: term, From: r.self}
+	r.lk.Unlock()
+
+	acks := 0
+	if voters[r.self] {
+		acks++
+	}
+	ch := make(chan *Reply, len(peers))
+	for _, nd := range peers {
+		go func(nd config.Node) {
+			reply, err := r.call(nd, req)
+			if err != nil {
+				logging.Debugf("heartbeat %s failed: %s", nd.ID, err)
+			}
+			ch <- reply
+		}(nd)
+	}
+	for range peers {
+		if acks >= quorum(len(voters)) {
+			break
+		}
+		reply := <-ch
+		if reply == nil {
+			continue
+		}
+		if reply.Term > term {
+			r.lk.Lock()
+			r.stepDown(reply.Term)
+			r.lk.Unlock()
+			return nil, errNotLeader
+		}
+		if reply.Term == term {
+			acks++
+		}
+	}
+	if acks < quorum(len(voters)) {
+		return nil, xerrors.Errorf("%w: leadership not confirmed", ErrNoLeader)
+	}
+	return cc, nil
+}
+
+func (r *Raft) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.closing:
+			return
+		case <-ticker.C:
+			r.lk.Lock()
+			role := r.role
+			expired := time.Now().After(r.deadline)
+			r.lk.Unlock()
+			switch {
+			case role == leader:
+				r.broadcast()
+			case expired:
+				r.campaign()
+			}
+		}
+	}
+}
+
+// applier hands the applied layouts to onApply in order
+func (r *Raft) applier() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.closing:
+			return
+		case <-r.applyCh:
+		}
+		r.lk.Lock()
+		pending := r.pending
+		r.pending = nil
+		r.lk.Unlock()
+		if r.onApply == nil {
+			continue
+		}
+		for _, cc := range pending {
+			r.onApply(cc)
+		}
+	}
+}
+
+func (r *Raft) notifyApply() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) campaign() {
+	r.lk.Lock()
+	voters := r.voters()
+	r.resetDeadline()
+	if !voters[r.self] {
+		r.lk.Unlock()
+		return
+	}
+	r.role = candidate
+	r.term++
+	r.vote = r.self
+	r.leader = ""
+	r.persistState()
+	term := r.term
+	last := r.lastIndex()
+	req := &Request{Act: ActVote, Term: term, From: r.self, PrevIndex: last, PrevTerm: r.termAt(last)}
+	peers := r.peers()
+	logging.Infof("campaign for term %d", term)
+	votes := 1
+	if votes >= quorum(len(voters)) {
+		r.becomeLeader()
+		r.lk.Unlock()
+		r.broadcast()
+		return
+	}
+	r.lk.Unlock()
+
+	ch := make(chan *Reply, len(peers))
+	for _, nd := range peers {
+		go func(nd config.Node) {
+			reply, err := r.call(nd, req)
+			if err != nil {
+				logging.Debugf("ask vote of %s failed: %s", nd.ID, err)
+			}
+			ch <- reply
+		}(nd)
+	}
+	for range peers {
+		reply := <-ch
+		if reply == nil {
+			continue
+		}
+		r.lk.Lock()
+		if reply.Term > r.term {
+			r.stepDown(reply.Term)
+		}
+		if r.role != candidate || r.term != term {
+			r.lk.Unlock()
+			return
+		}
+		if reply.Success {
+			votes++
+		}
+		if votes >= quorum(len(voters)) {
+			r.becomeLeader()
+			r.lk.Unlock()
+			r.broadcast()
+			return
+		}
+		r.lk.Unlock()
+	}
+}
+
+// becomeLeader appends the last layout of the log again, so that entries of former terms are
+// committed with it and nodes seeded with other layouts converge. It should be called with lk held.
+func (r *Raft) becomeLeader() {
+	logging.Infof("become leader of term %d", r.term)
+	r.role = leader
+	r.leader = r.self
+	r.next = make(map[string]uint64)
+	r.match = make(map[string]uint64)
+	_, last := r.lastLayoutIndex()
+	r.append(Entry{Term: r.term, Index: r.lastIndex() + 1, Data: mustMarshal(last)})
+}
+
+// stepDown turns the node into a follower of the term, it should be called with lk held
+func (r *Raft) stepDown(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.vote = ""
+		r.leader = ""
+		r.persistState()
+	}
+	if r.role == leader {
+		logging.Infof("step down at term %d", r.term)
+		r.failWaiters(errLeadershipLost)
+	}
+	r.role = follower
+	r.resetDeadline()
+}
+
+// broadcast replicates the log to the peers without a request in flight
+func (r *Raft) broadcast() {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.role != leader {
+		return
+	}
+	for _, nd := range r.peers() {
+		if r.inflight[nd.ID] {
+			continue
+		}
+		r.inflight[nd.ID] = true
+		go r.replicate(nd)
+	}
+	r.advanceCommit()
+}
+
+func (r *Raft) replicate(nd config.Node) {
+	defer func() {
+		r.lk.Lock()
+		delete(r.inflight, nd.ID)
+		r.lk.Unlock()
+	}()
+	r.lk.Lock()
+	if r.role != leader {
+		r.lk.Unlock()
+		return
+	}
+	term := r.term
+	next, ok := r.next[nd.ID]
+	if !ok {
+		next = r.lastIndex() + 1
+		r.next[nd.ID] = next
+	}
+	req := &Request{Act: ActAppend, Term: term, From: r.self, Commit: r.commit}
+	if next <= r.snap.Index {
+		req.Snapshot = mustMarshal(r.snap.Layout)
+		next = r.snap.Index + 1
+	}
+	req.PrevIndex = next - 1
+	req.PrevTerm = r.termAt(next - 1)
+	req.Entries = r.slice(next, maxAppend)
+	r.lk.Unlock()
+
+	reply, err := r.call(nd, req)
+	if err != nil {
+		logging.Debugf("replicate to %s failed: %s", nd.ID, err)
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+	if r.role != leader || r.term != term {
+		return
+	}
+	if reply.Success {
+		if m := req.PrevIndex + uint64(len(req.Entries)); m > r.match[nd.ID] {
+			r.match[nd.ID] = m
+		}
+		r.next[nd.ID] = r.match[nd.ID] + 1
+		r.advanceCommit()
+		return
+	}
+	// back off to the last index of the follower
+	n := req.PrevIndex
+	if reply.Index+1 < n {
+		n = reply.Index + 1
+	}
+	if n < 1 {
+		n = 1
+	}
+	r.next[nd.ID] = n
+}
+
+// advanceCommit commits the entries of current term kept by a quorum of voters, lk should be held
+func (r *Raft) advanceCommit() {
+	voters := r.voters()
+	for n := r.lastIndex(); n > r.commit; n-- {
+		if r.termAt(n) != r.term {
+			return
+		}
+		count := 0
+		for id := range voters {
+			if (id == r.self && r.role == leader) || r.match[id] >= n {
+				count++
+			}
+		}
+		if count >= quorum(len(voters)) {
+			r.commit = n
+			r.applyCommitted()
+			return
+		}
+	}
+}
+
+// applyCommitted applies the committed entries, lk should be held
+func (r *Raft) applyCommitted() {
+	for r.applied < r.commit {
+		r.applied++
+		e := r.entryAt(r.applied)
+		if len(e.Data) > 0 {
+			cc := new(config.ClusterConf)
+			if err := json.Unmarshal(e.Data, cc); err != nil {
+				logging.Errorf("invalid layout of raft entry %d: %s", e.Index, err)
+			} else {
+				r.layout = cc
+				r.pending = append(r.pending, cc)
+				r.notifyApply()
+			}
+		}
+		for _, w := range r.waiters[r.applied] {
+			if w.term == e.Term {
+				w.ch <- nil
+			} else {
+				w.ch <- errLeadershipLost
+			}
+		}
+		delete(r.waiters, r.applied)
+	}
+	r.compact()
+}
+
+// compact moves the snapshot forward when the log grows, lk should be held
+func (r *Raft) compact() {
+	if len(r.entries) < 2*keepLog || r.applied < r.snap.Index+keepLog {
+		return
+	}
+	idx := r.applied - keepLog
+	snap := snapshot{Index: idx, Term: r.termAt(idx), Layout: r.layoutAt(idx)}
+	if err := r.store.Put(snapshotKey, mustMarshal(&snap)); err != nil {
+		logging.Errorf("persist raft snapshot failed: %s", err)
+		return
+	}
+	for i := r.snap.Index + 1; i <= idx; i++ {
+		if err := r.store.Delete(logKey(i)); err != nil && err != ds.ErrNotFound {
+			logging.Warnf("delete raft log entry %d failed: %s", i, err)
+		}
+	}
+	r.entries = append([]Entry(nil), r.entries[idx-r.snap.Index:]...)
+	r.snap = snap
+}
+
+func (r *Raft) handleStream(s network.Stream) {
+	defer s.Close()
+	req := new(Request)
+	if err := ReadRequest(s, req); err != nil {
+		logging.Errorf("raft read request failed: %s", err)
+		return
+	}
+	// the candidate and the leader are the peer of the connection, whatever the request claims
+	p := s.Conn().RemotePeer().Pretty()
+	var reply *Reply
+	switch req.Act {
+	case ActVote, ActAppend:
+		if !r.isMember(p) {
+			logging.Warnf("refuse raft %s of %s: not a node of the cluster", req.Act, p)
+			reply = &Reply{Code: ErrDenied, Msg: ErrPermissionDenied.Error()}
+		} else if req.Act == ActVote {
+			reply = r.handleVote(p, req)
+		} else {
+			reply = r.handleAppend(p, req)
+		}
+	case ActPropose:
+		reply = r.handlePropose(p, req)
+	case ActLayout:
+		reply = r.handleLayout(req)
+	default:
+		reply = &Reply{Code: ErrOthers, Msg: "unknown action " + req.Act.String()}
+	}
+	if err := WriteReply(s, reply); err != nil {
+		logging.Errorf("raft write reply of %s failed: %s", req.Act, err)
+	}
+}
+
+func (r *Raft) handleVote(p string, req *Request) *Reply {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if req.Term > r.term {
+		r.stepDown(req.Term)
+	}
+	reply := &Reply{Term: r.term}
+	if req.Term < r.term {
+		return reply
+	}
+	last := r.lastIndex()
+	lastTerm := r.termAt(last)
+	upToDate := req.PrevTerm > lastTerm || (req.PrevTerm == lastTerm && req.PrevIndex >= last)
+	if (r.vote == "" || r.vote == p) && upToDate {
+		r.vote = p
+		r.persistState()
+		r.resetDeadline()
+		reply.Success = true
+	}
+	return reply
+}
+
+func (r *Raft) handleAppend(p string, req *Request) *Reply {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if req.Term < r.term {
+		return &Reply{Term: r.term}
+	}
+	if req.Term > r.term || r.role != follower {
+		r.stepDown(req.Term)
+	}
+	r.leader = p
+	r.resetDeadline()
+	reply := &Reply{Term: r.term, Leader: r.leader}
+
+	if len(req.Snapshot) > 0 && req.PrevIndex > r.snap.Index {
+		cc := new(config.ClusterConf)
+		if err := json.Unmarshal(req.Snapshot, cc); err != nil {
+			reply.Code = ErrOthers
+			reply.Msg = err.Error()
+			return reply
+		}
+		r.installSnapshot(snapshot{Index: req.PrevIndex, Term: req.PrevTerm, Layout: cc})
+	}
+	if req.PrevIndex > r.lastIndex() {
+		reply.Index = r.lastIndex()
+		return reply
+	}
+	if req.PrevIndex > r.snap.Index && r.termAt(req.PrevIndex) != req.PrevTerm {
+		reply.Index = req.PrevIndex - 1
+		return reply
+	}
+	for _, e := range req.Entries {
+		if e.Index <= r.snap.Index {
+			continue
+		}
+		if e.Index <= r.lastIndex() {
+			if r.termAt(e.Index) == e.Term {
+				continue
+			}
+			r.truncate(e.Index)
+		}
+		r.append(e)
+	}
+	last := req.PrevIndex + uint64(len(req.Entries))
+	if c := min(req.Commit, last); c > r.commit {
+		r.commit = c
+		r.applyCommitted()
+	}
+	reply.Success = true
+	reply.Index = last
+	return reply
+}
+
+func (r *Raft) handlePropose(p string, req *Request) *Reply {
+	m := new(config.Manifest)
+	err := json.Unmarshal(req.Data, m)
+	if err == nil && m.Layout == nil {
+		err = xerrors.New("cluster layout missing")
+	}
+	if err != nil {
+		return &Reply{Code: ErrOthers, Msg: err.Error()}
+	}
+	if err := r.checkProposal(p, m); err != nil {
+		logging.Warnf("refuse cluster layout epoch %d proposed by %s: %s", m.Layout.Epoch, p, err)
+		return r.errReply(err)
+	}
+	return r.errReply(r.propose(m.Layout))
+}
+
+// checkProposal accepts the layout signed by the admin key if it's configured,
+// otherwise the layout proposed by a voter
+func (r *Raft) checkProposal(p string, m *config.Manifest) error {
+	if r.adminKey != nil {
+		if err := m.Verify(r.adminKey); err != nil {
+			return xerrors.Errorf("%w: %s", ErrPermissionDenied, err)
+		}
+		return nil
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.voters()[p] {
+		return nil
+	}
+	return xerrors.Errorf("%w: %s is not a voter", ErrPermissionDenied, p)
+}
+
+func (r *Raft) handleLayout(req *Request) *Reply {
+	cc, err := r.readLayout()
+	reply := r.errReply(err)
+	if err == nil {
+		reply.Data = mustMarshal(cc)
+	}
+	return reply
+}
+
+func (r *Raft) errReply(err error) *Reply {
+	reply := &Reply{}
+	switch {
+	case err == nil:
+	case err == errNotLeader:
+		reply.Code = ErrNotLeader
+		reply.Msg = err.Error()
+		reply.Leader = r.Leader()
+	case xerrors.Is(err, ErrStaleLayout):
+		reply.Code = ErrStale
+		reply.Msg = err.Error()
+	case xerrors.Is(err, ErrPermissionDenied):
+		reply.Code = ErrDenied
+		reply.Msg = err.Error()
+	default:
+		reply.Code = ErrOthers
+		reply.Msg = err.Error()
+	}
+	return reply
+}
+
+// installSnapshot replaces the log up to the snapshot, lk should be held
+func (r *Raft) installSnapshot(snap snapshot) {
+	if err := r.store.Put(snapshotKey, mustMarshal(&snap)); err != nil {
+		logging.Errorf("persist raft snapshot failed: %s", err)
+		return
+	}
+	var rest []Entry
+	if snap.Index < r.lastIndex() && r.termAt(snap.Index) == snap.Term {
+		rest = append(rest, r.entries[snap.Index-r.snap.Index:]...)
+	}
+	end := snap.Index
+	if len(rest) == 0 && r.lastIndex() > end {
+		end = r.lastIndex()
+	}
+	for i := r.snap.Index + 1; i <= end; i++ {
+		if err := r.store.Delete(logKey(i)); err != nil && err != ds.ErrNotFound {
+			logging.Warnf("delete raft log entry %d failed: %s", i, err)
+		}
+	}
+	r.entries = rest
+	r.snap = snap
+	if r.commit < snap.Index {
+		r.commit = snap.Index
+		r.applied = snap.Index
+		r.layout = snap.Layout
+		r.pending = append(r.pending, snap.Layout)
+		r.notifyApply()
+	}
+}
+
+// append persists the entry and appends it to the log, lk should be held
+func (r *Raft) append(e Entry) {
+	if err := r.store.Put(logKey(e.Index), mustMarshal(&e)); err != nil {
+		logging.Errorf("persist raft log entry %d failed: %s", e.Index, err)
+	}
+	r.entries = append(r.entries, e)
+}
+
+// truncate removes the entries from idx, lk should be held
+func (r *Raft) truncate(idx uint64) {
+	for i := idx; i <= r.lastIndex(); i++ {
+		if err := r.store.Delete(logKey(i)); err != nil && err != ds.ErrNotFound {
+			logging.Warnf("delete raft log entry %d failed: %s", i, err)
+		}
+	}
+	r.entries = r.entries[:idx-r.snap.Index-1]
+}
+
+func (r *Raft) persistState() {
+	if err := r.store.Put(stateKey, mustMarshal(&hardState{Term: r.term, Vote: r.vote})); err != nil {
+		logging.Errorf("persist raft state failed: %s", err)
+	}
+}
+
+func (r *Raft) wait(idx, term uint64) waiter {
+	w := waiter{term: term, ch: make(chan error, 1)}
+	r.waiters[idx] = append(r.waiters[idx], w)
+	return w
+}
+
+func (r *Raft) failWaiters(err error) {
+	for idx, ws := range r.waiters {
+		for _, w := range ws {
+			w.ch <- err
+		}
+		delete(r.waiters, idx)
+	}
+}
+
+func (r *Raft) resetDeadline() {
+	r.deadline = time.Now().Add(r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout))))
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.snap.Index + uint64(len(r.entries))
+}
+
+// termAt returns the term of the entry, zero if it's not in the log
+func (r *Raft) termAt(idx uint64) uint64 {
+	if idx == r.snap.Index {
+		return r.snap.Term
+	}
+	if idx < r.snap.Index || idx > r.lastIndex() {
+		return 0
+	}
+	return r.entries[idx-r.snap.Index-1].Term
+}
+
+func (r *Raft) entryAt(idx uint64) Entry {
+	return r.entries[idx-r.snap.Index-1]
+}
+
+func (r *Raft) slice(from uint64, limit int) []Entry {
+	if from > r.lastIndex() {
+		return nil
+	}
+	ents := r.entries[from-r.snap.Index-1:]
+	if len(ents) > limit {
+		ents = ents[:limit]
+	}
+	return append([]Entry(nil), ents...)
+}
+
+// lastLayoutIndex returns the last layout of the log and its index
+func (r *Raft) lastLayoutIndex() (uint64, *config.ClusterConf) {
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if len(r.entries[i].Data) == 0 {
+			continue
+		}
+		cc := new(config.ClusterConf)
+		if err := json.Unmarshal(r.entries[i].Data, cc); err == nil {
+			return r.entries[i].Index, cc
+		}
+	}
+	return r.snap.Index, r.snap.Layout
+}
+
+func (r *Raft) lastLayout() *config.ClusterConf {
+	_, cc := r.lastLayoutIndex()
+	return cc
+}
+
+func (r *Raft) layoutAt(idx uint64) *config.ClusterConf {
+	for i := idx; i > r.snap.Index; i-- {
+		e := r.entryAt(i)
+		if len(e.Data) == 0 {
+			continue
+		}
+		cc := new(config.ClusterConf)
+		if err := json.Unmarshal(e.Data, cc); err == nil {
+			return cc
+		}
+	}
+	return r.snap.Layout
+}
+
+// voters are the nodes of the committed layout, pending nodes vote once they have joined.
+// A layout changing the voters only counts once it's committed by the former voters.
+func (r *Raft) voters() map[string]bool {
+	res := make(map[string]bool)
+	for _, nd := range r.layoutAt(r.commit).Nodes {
+		if !nd.Pending {
+			res[nd.ID] = true
+		}
+	}
+	return res
+}
+
+// isMember tells whether the peer is a voter of the committed layout or a node of the last layout
+// of the log, so a follower lagging behind still takes the entries of a leader it doesn't know as a voter yet
+func (r *Raft) isMember(p string) bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.voters()[p] {
+		return true
+	}
+	for _, nd := range r.lastLayout().Nodes {
+		if nd.ID == p && !nd.Pending {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Raft) peers() []config.Node {
+	var res []config.Node
+	for _, nd := range r.layoutAt(r.commit).Nodes {
+		if nd.ID != r.self && !nd.Pending {
+			res = append(res, nd)
+		}
+	}
+	return res
+}
+
+// call sends the request bounded by the election timeout, so that an unreachable node
+// doesn't hold elections or replication
+func (r *Raft) call(nd config.Node, req *Request) (*Reply, error) {
+	return call(r.ctx, r.host, r.protocol, nd, req, r.electionTimeout)
+}
+
+func quorum(n int) int {
+	return n/2 + 1
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
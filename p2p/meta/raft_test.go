@@ -0,0 +1,199 @@
+package meta
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	"github.com/filedrive-team/go-ds-cluster/utils"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/host"
+	"golang.org/x/xerrors"
+)
+
+// applied records the epochs applied by a node
+type applied struct {
+	lk     sync.Mutex
+	epochs []uint64
+}
+
+func (a *applied) last() uint64 {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if len(a.epochs) == 0 {
+		return 0
+	}
+	return a.epochs[len(a.epochs)-1]
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func manifest(cc *config.ClusterConf) *config.Manifest {
+	return &config.Manifest{Version: cc.Epoch, Layout: cc}
+}
+
+func TestRaft(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var hosts []host.Host
+	for i := 0; i < 3; i++ {
+		h, err := p2p.MakeBasicHost(utils.RandPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+	}
+	seed := &config.ClusterConf{Epoch: 1}
+	ranges := []shard.SlotsRange{{Start: 0, End: 5460}, {Start: 5461, End: 10921}, {Start: 10922, End: 16383}}
+	for i, h := range hosts {
+		var swarm []string
+		for _, addr := range h.Addrs() {
+			swarm = append(swarm, addr.String())
+		}
+		seed.Nodes = append(seed.Nodes, config.Node{
+			Node:  shard.Node{ID: h.ID().Pretty(), Slots: ranges[i]},
+			Swarm: swarm,
+		})
+	}
+
+	stores := make([]ds.Datastore, len(hosts))
+	rafts := make([]*Raft, len(hosts))
+	logs := make([]*applied, len(hosts))
+	start := func(i int) {
+		t.Helper()
+		if stores[i] == nil {
+			stores[i] = dssync.MutexWrap(ds.NewMapDatastore())
+		}
+		logs[i] = &applied{}
+		a := logs[i]
+		r, err := NewRaft(ctx, hosts[i], stores[i], seed,
+			WithElectionTimeout(300*time.Millisecond),
+			WithHeartbeat(50*time.Millisecond),
+			OnApply(func(cc *config.ClusterConf) {
+				a.lk.Lock()
+				defer a.lk.Unlock()
+				a.epochs = append(a.epochs, cc.Epoch)
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Serve()
+		r.Start()
+		rafts[i] = r
+	}
+	for i := range hosts {
+		start(i)
+	}
+	defer func() {
+		for _, r := range rafts {
+			if r != nil {
+				r.Close()
+			}
+		}
+	}()
+
+	leaderOf := func(exclude int) int {
+		t.Helper()
+		idx := -1
+		waitFor(t, "leader", func() bool {
+			for i, r := range rafts {
+				if i != exclude && r.IsLeader() {
+					idx = i
+					return true
+				}
+			}
+			return false
+		})
+		return idx
+	}
+	ld := leaderOf(-1)
+	fl := (ld + 1) % len(rafts)
+
+	// proposals are forwarded to the leader and applied by every node
+	next := *seed
+	next.Epoch = 2
+	next.Replication = 2
+	if err := rafts[fl].Propose(manifest(&next)); err != nil {
+		t.Fatal(err)
+	}
+	for i := range rafts {
+		waitFor(t, "layout applied", func() bool { return logs[i].last() == 2 })
+	}
+	if err := rafts[fl].Propose(manifest(&next)); err != nil {
+		t.Fatalf("proposing current layout again should succeed: %s", err)
+	}
+	stale := *seed
+	stale.Epoch = 2
+	if err := rafts[ld].Propose(manifest(&stale)); !xerrors.Is(err, ErrStaleLayout) {
+		t.Fatalf("expected stale layout, got %v", err)
+	}
+
+	cl := NewClient(ctx, hosts[fl], seed.Nodes)
+	cc, err := cl.Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Epoch != 2 || cc.Replication != 2 {
+		t.Fatalf("expected layout of epoch 2, got %+v", cc)
+	}
+
+	// peers out of the cluster can't replicate entries, campaign nor propose layouts
+	outsider, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outsider.Close()
+	forged := next
+	forged.Epoch = 3
+	for _, req := range []*Request{
+		{Act: ActAppend, Term: 100, From: seed.Nodes[ld].ID, PrevIndex: 0, Entries: []Entry{{Term: 100, Index: 1, Data: mustMarshal(&forged)}}},
+		{Act: ActVote, Term: 100, From: seed.Nodes[ld].ID, PrevIndex: 100, PrevTerm: 100},
+	} {
+		reply, err := call(ctx, outsider, PROTOCOL_V1, seed.Nodes[fl], req, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Code != ErrDenied || reply.Success {
+			t.Fatalf("expected %s of an outsider denied, got %+v", req.Act, reply)
+		}
+	}
+	if err := NewClient(ctx, outsider, seed.Nodes).Propose(manifest(&forged)); !xerrors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected proposal of an outsider denied, got %v", err)
+	}
+	if got := rafts[fl].Applied().Epoch; got != 2 {
+		t.Fatalf("expected epoch 2 kept, got %d", got)
+	}
+
+	// the remaining nodes elect a new leader
+	rafts[ld].Close()
+	rafts[ld] = nil
+	nld := leaderOf(ld)
+	next.Epoch = 3
+	if err := rafts[nld].Propose(manifest(&next)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the former leader restarts from its log and catches up
+	start(ld)
+	waitFor(t, "restarted node catches up", func() bool { return logs[ld].last() == 3 })
+	if rafts[ld].Applied().Epoch != 3 {
+		t.Fatalf("expected epoch 3 applied, got %d", rafts[ld].Applied().Epoch)
+	}
+}
@@ -18,25 +18,26 @@ var _ = cid.Undef
 var _ = math.E
 var _ = sort.Sort
 
-var lengthBufRequestMessage = []byte{133}
+var lengthBufRequestMessage = []byte{134}
 
 func (t *RequestMessage) MarshalCBOR(w io.Writer) error {
 	if t == nil {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufRequestMessage); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufRequestMessage); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.AccessToken (string) (string)
 	if len(t.AccessToken) > cbg.MaxLength {
 		return xerrors.Errorf("Value in field t.AccessToken was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.AccessToken))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.AccessToken))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.AccessToken)); err != nil {
@@ -48,7 +49,7 @@ func (t *RequestMessage) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Key was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Key))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Key))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Key)); err != nil {
@@ -60,48 +61,67 @@ func (t *RequestMessage) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Byte array in field t.Value was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(t.Value))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(t.Value[:]); err != nil {
+	if _, err := cw.Write(t.Value[:]); err != nil {
 		return err
 	}
 
 	// t.Query (remoteds.Query) (struct)
-	if err := t.Query.MarshalCBOR(w); err != nil {
+	if err := t.Query.MarshalCBOR(cw); err != nil {
 		return err
 	}
 
 	// t.Action (remoteds.Act) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Action)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Action)); err != nil {
 		return err
 	}
+
+	// t.Batch ([]remoteds.BatchOp) (slice)
+	if len(t.Batch) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Batch was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Batch))); err != nil {
+		return err
+	}
+	for _, v := range t.Batch {
+		if err := v.MarshalCBOR(cw); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
+func (t *RequestMessage) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = RequestMessage{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 5 {
+	if extra != 6 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
 	// t.AccessToken (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -111,7 +131,7 @@ func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
 	// t.Key (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -120,7 +140,7 @@ func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Value ([]uint8) (slice)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -136,21 +156,21 @@ func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
 		t.Value = make([]uint8, extra)
 	}
 
-	if _, err := io.ReadFull(br, t.Value[:]); err != nil {
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
 		return err
 	}
 	// t.Query (remoteds.Query) (struct)
 
 	{
 
-		if err := t.Query.UnmarshalCBOR(br); err != nil {
+		if err := t.Query.UnmarshalCBOR(cr); err != nil {
 			return xerrors.Errorf("unmarshaling t.Query: %w", err)
 		}
 
 	}
 	// t.Action (remoteds.Act) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -161,6 +181,35 @@ func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("integer in input was too large for uint8 field")
 	}
 	t.Action = Act(extra)
+	// t.Batch ([]remoteds.BatchOp) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("t.Batch: array too large (%d)", extra)
+	}
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+
+	if extra > 0 {
+		t.Batch = make([]BatchOp, extra)
+	}
+
+	for i := 0; i < int(extra); i++ {
+
+		var v BatchOp
+		if err := v.UnmarshalCBOR(cr); err != nil {
+			return err
+		}
+
+		t.Batch[i] = v
+	}
+
 	return nil
 }
 
@@ -171,14 +220,15 @@ func (t *ReplyMessage) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufReplyMessage); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufReplyMessage); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Code (remoteds.ErrCode) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
 		return err
 	}
 
@@ -187,7 +237,7 @@ func (t *ReplyMessage) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Msg was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Msg))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Msg))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Msg)); err != nil {
@@ -199,21 +249,21 @@ func (t *ReplyMessage) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Byte array in field t.Value was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(t.Value))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(t.Value[:]); err != nil {
+	if _, err := cw.Write(t.Value[:]); err != nil {
 		return err
 	}
 
 	// t.Size (int64) (int64)
 	if t.Size >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Size)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Size)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Size-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Size-1)); err != nil {
 			return err
 		}
 	}
@@ -225,16 +275,21 @@ func (t *ReplyMessage) MarshalCBOR(w io.Writer) error {
 	return nil
 }
 
-func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
+func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = ReplyMessage{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
@@ -245,7 +300,7 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 
 	// t.Code (remoteds.ErrCode) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -259,7 +314,7 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 	// t.Msg (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -268,7 +323,7 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Value ([]uint8) (slice)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -284,12 +339,12 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 		t.Value = make([]uint8, extra)
 	}
 
-	if _, err := io.ReadFull(br, t.Value[:]); err != nil {
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
 		return err
 	}
 	// t.Size (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -314,7 +369,7 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Exists (bool) (bool)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -339,14 +394,15 @@ func (t *QueryResultEntry) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufQueryResultEntry); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufQueryResultEntry); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Code (remoteds.ErrCode) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
 		return err
 	}
 
@@ -355,7 +411,7 @@ func (t *QueryResultEntry) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Msg was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Msg))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Msg))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Msg)); err != nil {
@@ -367,7 +423,7 @@ func (t *QueryResultEntry) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Key was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Key))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Key))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Key)); err != nil {
@@ -379,37 +435,42 @@ func (t *QueryResultEntry) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Byte array in field t.Value was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(t.Value))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(t.Value[:]); err != nil {
+	if _, err := cw.Write(t.Value[:]); err != nil {
 		return err
 	}
 
 	// t.Size (int64) (int64)
 	if t.Size >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Size)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Size)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Size-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Size-1)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
+func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = QueryResultEntry{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
@@ -420,7 +481,7 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 
 	// t.Code (remoteds.ErrCode) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -434,7 +495,7 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 	// t.Msg (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -444,7 +505,7 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 	// t.Key (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -453,7 +514,7 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Value ([]uint8) (slice)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -469,12 +530,12 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 		t.Value = make([]uint8, extra)
 	}
 
-	if _, err := io.ReadFull(br, t.Value[:]); err != nil {
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
 		return err
 	}
 	// t.Size (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -507,18 +568,19 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufQuery); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufQuery); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.AccessToken (string) (string)
 	if len(t.AccessToken) > cbg.MaxLength {
 		return xerrors.Errorf("Value in field t.AccessToken was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.AccessToken))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.AccessToken))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.AccessToken)); err != nil {
@@ -530,7 +592,7 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Prefix was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Prefix))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Prefix))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Prefix)); err != nil {
@@ -539,22 +601,22 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 
 	// t.Limit (int64) (int64)
 	if t.Limit >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Limit)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Limit)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Limit-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Limit-1)); err != nil {
 			return err
 		}
 	}
 
 	// t.Offset (int64) (int64)
 	if t.Offset >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Offset)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Offset)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Offset-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Offset-1)); err != nil {
 			return err
 		}
 	}
@@ -566,16 +628,21 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 	return nil
 }
 
-func (t *Query) UnmarshalCBOR(r io.Reader) error {
+func (t *Query) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = Query{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
@@ -587,7 +654,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	// t.AccessToken (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -597,7 +664,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	// t.Prefix (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -606,7 +673,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Limit (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -631,7 +698,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Offset (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -656,7 +723,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.KeysOnly (bool) (bool)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -673,3 +740,123 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	}
 	return nil
 }
+
+var lengthBufBatchOp = []byte{131}
+
+func (t *BatchOp) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufBatchOp); err != nil {
+		return err
+	}
+
+	// t.Key (string) (string)
+	if len(t.Key) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Key was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Key))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Key)); err != nil {
+		return err
+	}
+
+	// t.Value ([]uint8) (slice)
+	if len(t.Value) > cbg.ByteArrayMaxLen {
+		return xerrors.Errorf("Byte array in field t.Value was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
+		return err
+	}
+
+	if _, err := cw.Write(t.Value[:]); err != nil {
+		return err
+	}
+
+	// t.Delete (bool) (bool)
+	if err := cbg.WriteBool(w, t.Delete); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *BatchOp) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = BatchOp{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 3 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Key (string) (string)
+
+	{
+		sval, err := cbg.ReadString(cr)
+		if err != nil {
+			return err
+		}
+
+		t.Key = string(sval)
+	}
+	// t.Value ([]uint8) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("t.Value: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+
+	if extra > 0 {
+		t.Value = make([]uint8, extra)
+	}
+
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
+		return err
+	}
+	// t.Delete (bool) (bool)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajOther {
+		return fmt.Errorf("booleans must be major type 7")
+	}
+	switch extra {
+	case 20:
+		t.Delete = false
+	case 21:
+		t.Delete = true
+	default:
+		return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+	}
+	return nil
+}
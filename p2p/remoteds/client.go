@@ -16,6 +16,18 @@ import (
 
 const default_time_out = 60 * 3
 
+// BatchClient applies many writes with a single request
+type BatchClient interface {
+	Batch(ops []BatchOp) error
+}
+
+var (
+	// MaxBatchOps bounds the ops sent in a single ActBatch request
+	MaxBatchOps = 1024
+	// MaxBatchBytes bounds the size of the values sent in a single ActBatch request
+	MaxBatchBytes = 8 << 20
+)
+
 type client struct {
 	ctx      context.Context
 	src      host.Host
@@ -92,6 +104,60 @@ func (cl *client) Put(key string, value []byte) error {
 	return nil
 }
 
+// Batch sends the ops in requests of at most MaxBatchOps ops and MaxBatchBytes bytes,
+// it stops at the first request failed
+func (cl *client) Batch(ops []BatchOp) error {
+	for start := 0; start < len(ops); {
+		end, size := start, 0
+		for end < len(ops) && end-start < MaxBatchOps {
+			if end > start && size+len(ops[end].Value) > MaxBatchBytes {
+				break
+			}
+			size += len(ops[end].Value)
+			end++
+		}
+		if err := cl.batch(ops[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+func (cl *client) batch(ops []BatchOp) error {
+	if err := cl.ConnectTarget(); err != nil {
+		return err
+	}
+
+	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	req := &RequestMessage{
+		AccessToken: cl.token,
+		Batch:       ops,
+		Action:      ActBatch,
+	}
+	if err := WriteRequstMsg(s, req, cl.timeout); err != nil {
+		logging.Error(err)
+		return err
+	}
+
+	reply := &ReplyMessage{}
+
+	if err := ReadReplyMsg(s, reply, cl.timeout); err != nil {
+		logging.Error(err)
+		return err
+	}
+
+	if reply.Code != ErrNone {
+		return xerrors.New(reply.Msg)
+	}
+	return nil
+}
+
 func (cl *client) TouchFile(key string, value []byte) error {
 	if err := cl.ConnectTarget(); err != nil {
 		return err
@@ -306,6 +372,32 @@ func (cl *client) Has(key string) (exists bool, err error) {
 	return reply.Exists, nil
 }
 
+// GetMany gets the keys one by one
+func (cl *client) GetMany(keys []string) ([]core.KeyResult, error) {
+	res := make([]core.KeyResult, len(keys))
+	for i, k := range keys {
+		res[i].Key = k
+		v, err := cl.Get(k)
+		if err == nil {
+			res[i].Value = v
+			res[i].Exists = true
+		} else if err != ds.ErrNotFound {
+			res[i].Err = err
+		}
+	}
+	return res, nil
+}
+
+// HasMany checks the keys one by one
+func (cl *client) HasMany(keys []string) ([]core.KeyResult, error) {
+	res := make([]core.KeyResult, len(keys))
+	for i, k := range keys {
+		res[i].Key = k
+		res[i].Exists, res[i].Err = cl.Has(k)
+	}
+	return res, nil
+}
+
 func (cl *client) GetSize(key string) (size int, err error) {
 	if err := cl.ConnectTarget(); err != nil {
 		return -1, err
@@ -15,6 +15,7 @@ const (
 	ActFileInfo
 	ActDeleteFile
 	ActListFiles
+	ActBatch
 )
 
 type ErrCode uint8
@@ -34,6 +35,15 @@ type RequestMessage struct {
 	Value       []byte
 	Query       Query
 	Action      Act
+	// Batch is the writes applied together by ActBatch
+	Batch []BatchOp
+}
+
+// BatchOp is a put or delete of ActBatch
+type BatchOp struct {
+	Key    string
+	Value  []byte
+	Delete bool
 }
 
 type ReplyMessage struct {
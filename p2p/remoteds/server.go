@@ -132,6 +132,8 @@ func (sv *server) handleStream(s network.Stream) {
 		sv.deleteFile(s, req)
 	case ActListFiles:
 		sv.listFiles(s, req)
+	case ActBatch:
+		sv.batch(s, req)
 	default:
 		logging.Warnf("unhandled action: %v", req.Action)
 	}
@@ -170,6 +172,45 @@ func (sv *server) put(s network.Stream, req *Request) {
 	}
 }
 
+// batch applies the ops together, through the batch of the datastore if it supports one
+func (sv *server) batch(s network.Stream, req *Request) {
+	logging.Infof("batch of %d ops", len(req.Batch))
+	res := &ReplyMessage{}
+	if err := sv.applyBatch(req.Batch); err != nil {
+		res.Code = ErrOthers
+		res.Msg = err.Error()
+	}
+	if err := WriteReplyMsg(s, res, sv.timeout); err != nil {
+		logging.Error(err)
+	}
+}
+
+func (sv *server) applyBatch(ops []BatchOp) error {
+	var b ds.Batch
+	if bds, ok := sv.ds.(ds.Batching); ok {
+		var err error
+		if b, err = bds.Batch(); err != nil {
+			return err
+		}
+	} else {
+		b = ds.NewBasicBatch(sv.ds)
+	}
+	for _, op := range ops {
+		var err error
+		if !op.Delete {
+			err = b.Put(ds.NewKey(op.Key), op.Value)
+		} else if sv.disableDelete {
+			logging.Infof("delete operation disabled, ignore delete %s", op.Key)
+		} else {
+			err = b.Delete(ds.NewKey(op.Key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.Commit()
+}
+
 func (sv *server) touchFile(s network.Stream, req *Request) {
 	logging.Infof("put %s, value size: %d", req.InnerFileKey, len(req.Value))
 	res := &ReplyMessage{}
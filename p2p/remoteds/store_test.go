@@ -264,3 +264,53 @@ func findData(k string, ents []Pair) (Pair, bool) {
 	}
 	return Pair{}, false
 }
+
+func TestBatch(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+
+	ctx := context.Background()
+	memStore := ds.NewMapDatastore()
+
+	server := NewStoreServer(ctx, h2, PROTOCOL_V1, memStore, memStore, false, 180, userPrefix)
+	defer server.Close()
+	server.Serve()
+
+	client := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1, 180, "")
+	defer client.Close()
+	bc := client.(BatchClient)
+
+	ops := make([]BatchOp, 0, len(tdata))
+	for _, d := range tdata {
+		ops = append(ops, BatchOp{Key: d.K, Value: d.V})
+	}
+	if err := bc.Batch(ops); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range tdata {
+		v, err := memStore.Get(ds.NewKey(d.K))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, d.V) {
+			t.Fatalf("%s value not match", d.K)
+		}
+	}
+
+	if err := bc.Batch([]BatchOp{{Key: tdata[0].K, Delete: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := memStore.Has(ds.NewKey(tdata[0].K)); has {
+		t.Fatalf("%s should be deleted", tdata[0].K)
+	}
+}
@@ -18,58 +18,76 @@ var _ = cid.Undef
 var _ = math.E
 var _ = sort.Sort
 
-var lengthBufShareRequest = []byte{130}
+var lengthBufShareRequest = []byte{131}
 
 func (t *ShareRequest) MarshalCBOR(w io.Writer) error {
 	if t == nil {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufShareRequest); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufShareRequest); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Type (share.InfoType) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Type)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Type)); err != nil {
 		return err
 	}
 
 	// t.Index (int64) (int64)
 	if t.Index >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Index)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Index)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Index-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Index-1)); err != nil {
 			return err
 		}
 	}
+
+	// t.Token (string) (string)
+	if len(t.Token) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Token was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Token))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Token)); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (t *ShareRequest) UnmarshalCBOR(r io.Reader) error {
+func (t *ShareRequest) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = ShareRequest{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 2 {
+	if extra != 3 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
 	// t.Type (share.InfoType) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -82,7 +100,7 @@ func (t *ShareRequest) UnmarshalCBOR(r io.Reader) error {
 	t.Type = InfoType(extra)
 	// t.Index (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -105,6 +123,16 @@ func (t *ShareRequest) UnmarshalCBOR(r io.Reader) error {
 
 		t.Index = int64(extraI)
 	}
+	// t.Token (string) (string)
+
+	{
+		sval, err := cbg.ReadString(cr)
+		if err != nil {
+			return err
+		}
+
+		t.Token = string(sval)
+	}
 	return nil
 }
 
@@ -115,14 +143,15 @@ func (t *ShareReply) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufShareReply); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufShareReply); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Code (share.ErrCode) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
 		return err
 	}
 
@@ -131,7 +160,7 @@ func (t *ShareReply) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Msg was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Msg))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Msg))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Msg)); err != nil {
@@ -139,7 +168,7 @@ func (t *ShareReply) MarshalCBOR(w io.Writer) error {
 	}
 
 	// t.Type (share.InfoType) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Type)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Type)); err != nil {
 		return err
 	}
 
@@ -148,26 +177,31 @@ func (t *ShareReply) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Byte array in field t.Info was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(t.Info))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Info))); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(t.Info[:]); err != nil {
+	if _, err := cw.Write(t.Info[:]); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (t *ShareReply) UnmarshalCBOR(r io.Reader) error {
+func (t *ShareReply) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = ShareReply{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
@@ -178,7 +212,7 @@ func (t *ShareReply) UnmarshalCBOR(r io.Reader) error {
 
 	// t.Code (share.ErrCode) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -192,7 +226,7 @@ func (t *ShareReply) UnmarshalCBOR(r io.Reader) error {
 	// t.Msg (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -201,7 +235,7 @@ func (t *ShareReply) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Type (share.InfoType) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -214,7 +248,7 @@ func (t *ShareReply) UnmarshalCBOR(r io.Reader) error {
 	t.Type = InfoType(extra)
 	// t.Info ([]uint8) (slice)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -230,7 +264,7 @@ func (t *ShareReply) UnmarshalCBOR(r io.Reader) error {
 		t.Info = make([]uint8, extra)
 	}
 
-	if _, err := io.ReadFull(br, t.Info[:]); err != nil {
+	if _, err := io.ReadFull(cr, t.Info[:]); err != nil {
 		return err
 	}
 	return nil
@@ -2,12 +2,17 @@ package share
 
 import (
 	"context"
+	"encoding/json"
+	"time"
 
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
 	"golang.org/x/xerrors"
 )
 
@@ -74,7 +79,8 @@ func (cl *Client) GetClusterInfo() (value []byte, err error) {
 	return reply.Info, nil
 }
 
-func (cl *Client) GetIdentity(idx int) (value []byte, err error) {
+// GetClusterConf retrieves the cluster-wide settings including cluster nodes info
+func (cl *Client) GetClusterConf() (value []byte, err error) {
 	_ = cl.ConnectTarget()
 
 	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
@@ -84,8 +90,7 @@ func (cl *Client) GetIdentity(idx int) (value []byte, err error) {
 	defer s.Close()
 
 	req := &ShareRequest{
-		Type:  InfoIdentity,
-		Index: int64(idx),
+		Type: InfoClusterConf,
 	}
 
 	if err := WriteRequst(s, req); err != nil {
@@ -104,3 +109,206 @@ func (cl *Client) GetIdentity(idx int) (value []byte, err error) {
 	}
 	return reply.Info, nil
 }
+
+// GetManifest retrieves the latest cluster manifest known by the node, it should be verified
+// with config.ParseManifest
+func (cl *Client) GetManifest() (value []byte, err error) {
+	_ = cl.ConnectTarget()
+
+	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	req := &ShareRequest{
+		Type: InfoManifest,
+	}
+
+	if err := WriteRequst(s, req); err != nil {
+		logging.Error(err)
+		return nil, err
+	}
+
+	reply := &ShareReply{}
+
+	if err := ReadReply(s, reply); err != nil {
+		logging.Error(err)
+		return nil, err
+	}
+	if reply.Code != ErrNone {
+		return nil, xerrors.New(reply.Msg)
+	}
+	return reply.Info, nil
+}
+
+// Join presents the join token, the host of the client takes the place of the pending node
+// and the cluster layout with it is returned
+func (cl *Client) Join(token string) (value []byte, err error) {
+	_ = cl.ConnectTarget()
+
+	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	req := &ShareRequest{
+		Type:  InfoJoin,
+		Token: token,
+	}
+
+	if err := WriteRequst(s, req); err != nil {
+		logging.Error(err)
+		return nil, err
+	}
+
+	reply := &ShareReply{}
+
+	if err := ReadReply(s, reply); err != nil {
+		logging.Error(err)
+		return nil, err
+	}
+	if reply.Code != ErrNone {
+		return nil, xerrors.New(reply.Msg)
+	}
+	return reply.Info, nil
+}
+
+// bootstrapTimeout bounds the requests to a bootstrapper before trying the next one
+var bootstrapTimeout = 10 * time.Second
+
+// Bootstrap runs f with a client of each bootstrapper in order until it succeeds,
+// so that any data node still up can hand out cluster info.
+// Bootstrappers are p2p addresses like /ip4/1.2.3.4/tcp/6735/p2p/QmX.
+func Bootstrap(ctx context.Context, src host.Host, bootstrappers []string, f func(cl *Client) error) error {
+	if len(bootstrappers) == 0 {
+		return xerrors.New("no bootstrapper given")
+	}
+	var err error
+	for _, addr := range bootstrappers {
+		err = tryBootstrapper(ctx, src, addr, f)
+		if err == nil {
+			return nil
+		}
+		logging.Warnf("bootstrap from %s failed: %s", addr, err)
+	}
+	return xerrors.Errorf("all bootstrappers failed, last error: %w", err)
+}
+
+func tryBootstrapper(ctx context.Context, src host.Host, addr string, f func(cl *Client) error) error {
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return err
+	}
+	pinfo, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+	defer cancel()
+	return f(NewShareClient(ctx, src, *pinfo))
+}
+
+// FetchManifest asks the nodes for their manifests and returns the newest one signed by the admin key,
+// manifests older than version current are refused
+func FetchManifest(ctx context.Context, src host.Host, nodes []config.Node, pk crypto.PubKey, current uint64) (*config.Manifest, error) {
+	var res *config.Manifest
+	var err error
+	for _, nd := range nodes {
+		if nd.Pending || nd.ID == src.ID().Pretty() {
+			continue
+		}
+		var m *config.Manifest
+		m, err = fetchManifest(ctx, src, nd, pk, current)
+		if err != nil {
+			logging.Warnf("fetch manifest from %s failed: %s", nd.ID, err)
+			continue
+		}
+		if res == nil || m.Version > res.Version {
+			res = m
+		}
+	}
+	if res == nil {
+		if err == nil {
+			err = xerrors.New("no node to fetch manifest from")
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+func fetchManifest(ctx context.Context, src host.Host, nd config.Node, pk crypto.PubKey, current uint64) (*config.Manifest, error) {
+	pinfo, err := nodeAddrInfo(nd)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+	defer cancel()
+	bs, err := NewShareClient(ctx, src, *pinfo).GetManifest()
+	if err != nil {
+		return nil, err
+	}
+	return config.ParseManifest(bs, pk, current)
+}
+
+// FetchClusterConf asks the nodes for the cluster layout they hold and returns the one of the highest epoch
+func FetchClusterConf(ctx context.Context, src host.Host, nodes []config.Node) (*config.ClusterConf, error) {
+	var res *config.ClusterConf
+	var err error
+	for _, nd := range nodes {
+		if nd.Pending || nd.ID == src.ID().Pretty() {
+			continue
+		}
+		var cc *config.ClusterConf
+		cc, err = fetchClusterConf(ctx, src, nd)
+		if err != nil {
+			logging.Warnf("fetch cluster conf from %s failed: %s", nd.ID, err)
+			continue
+		}
+		if res == nil || cc.Epoch > res.Epoch {
+			res = cc
+		}
+	}
+	if res == nil {
+		if err == nil {
+			err = xerrors.New("no node to fetch cluster conf from")
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+func fetchClusterConf(ctx context.Context, src host.Host, nd config.Node) (*config.ClusterConf, error) {
+	pinfo, err := nodeAddrInfo(nd)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+	defer cancel()
+	bs, err := NewShareClient(ctx, src, *pinfo).GetClusterConf()
+	if err != nil {
+		return nil, err
+	}
+	cc := &config.ClusterConf{}
+	if err := json.Unmarshal(bs, cc); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+func nodeAddrInfo(nd config.Node) (*peer.AddrInfo, error) {
+	pid, err := peer.Decode(nd.ID)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]ma.Multiaddr, 0, len(nd.Swarm))
+	for _, addr := range nd.Swarm {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, maddr)
+	}
+	return &peer.AddrInfo{ID: pid, Addrs: addrs}, nil
+}
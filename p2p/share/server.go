@@ -3,12 +3,15 @@ package share
 import (
 	"context"
 	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/filedrive-team/go-ds-cluster/config"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	"golang.org/x/xerrors"
 )
 
 const waitClose = 5
@@ -17,16 +20,61 @@ type Server struct {
 	ctx      context.Context
 	host     host.Host
 	protocol protocol.ID
-	cfg      *config.Config
+	// lk guards the cluster-wide settings of cfg
+	lk  sync.RWMutex
+	cfg *config.Config
+	// joinLk serializes joining nodes
+	joinLk sync.Mutex
+	onJoin func(cc *config.ClusterConf) error
 }
 
-func NewShareServer(ctx context.Context, h host.Host, cfg *config.Config) *Server {
-	return &Server{
+type ServerOption func(sv *Server)
+
+// WithJoin admits data nodes presenting join tokens issued by the node,
+// f applies the layout with the joining node, e.g. through the metadata service
+func WithJoin(f func(cc *config.ClusterConf) error) ServerOption {
+	return func(sv *Server) {
+		sv.onJoin = f
+	}
+}
+
+func NewShareServer(ctx context.Context, h host.Host, cfg *config.Config, opts ...ServerOption) *Server {
+	sv := &Server{
 		ctx:      ctx,
 		host:     h,
 		protocol: PROTOCOL_V1,
 		cfg:      cfg,
 	}
+	for _, opt := range opts {
+		opt(sv)
+	}
+	return sv
+}
+
+// SetClusterConf updates the cluster-wide settings shared with nodes and clients,
+// e.g. after the cluster layout changed
+func (sv *Server) SetClusterConf(cc *config.ClusterConf) {
+	sv.lk.Lock()
+	defer sv.lk.Unlock()
+	sv.cfg.SetClusterConf(cc)
+}
+
+// Manifest returns the latest signed layout known, nil if none
+func (sv *Server) Manifest() *config.Manifest {
+	sv.lk.RLock()
+	defer sv.lk.RUnlock()
+	return sv.cfg.Manifest
+}
+
+// SetManifest keeps the manifest to be handed out if it's newer, the manifest should be verified
+func (sv *Server) SetManifest(m *config.Manifest) bool {
+	sv.lk.Lock()
+	defer sv.lk.Unlock()
+	if sv.cfg.Manifest != nil && sv.cfg.Manifest.Version >= m.Version {
+		return false
+	}
+	sv.cfg.Manifest = m
+	return true
 }
 
 func (sv *Server) Close() error {
@@ -63,6 +111,12 @@ func (sv *Server) handleStream(s network.Stream) {
 		sv.sendClusterInfo(s, reqMsg)
 	case InfoIdentity:
 		sv.sendIdentity(s, reqMsg)
+	case InfoClusterConf:
+		sv.sendClusterConf(s, reqMsg)
+	case InfoJoin:
+		sv.join(s, reqMsg)
+	case InfoManifest:
+		sv.sendManifest(s, reqMsg)
 	default:
 		logging.Warnf("unhandled type: %v", reqMsg.Type)
 	}
@@ -72,7 +126,9 @@ func (sv *Server) sendClusterInfo(s network.Stream, req *ShareRequest) {
 	res := &ShareReply{
 		Type: InfoClusterNodes,
 	}
+	sv.lk.RLock()
 	bs, err := json.Marshal(sv.cfg.Nodes)
+	sv.lk.RUnlock()
 	if err != nil {
 		res.Code = ErrOthers
 		res.Msg = err.Error()
@@ -85,20 +141,33 @@ func (sv *Server) sendClusterInfo(s network.Stream, req *ShareRequest) {
 	}
 }
 
-func (sv *Server) sendIdentity(s network.Stream, req *ShareRequest) {
+func (sv *Server) sendClusterConf(s network.Stream, req *ShareRequest) {
 	res := &ShareReply{
-		Type: InfoIdentity,
+		Type: InfoClusterConf,
 	}
-	if int(req.Index)+1 > len(sv.cfg.IdentityList) {
+	sv.lk.RLock()
+	bs, err := json.Marshal(sv.cfg.ClusterConf())
+	sv.lk.RUnlock()
+	if err != nil {
 		res.Code = ErrOthers
-		res.Msg = "request identity index out of range"
-		if err := WriteReply(s, res); err != nil {
-			logging.Error(err)
-		}
-		return
+		res.Msg = err.Error()
+	} else {
+		res.Info = bs
 	}
-	bs, err := json.Marshal(sv.cfg.IdentityList[req.Index])
-	if err != nil {
+
+	if err := WriteReply(s, res); err != nil {
+		logging.Error(err)
+	}
+}
+
+func (sv *Server) sendManifest(s network.Stream, req *ShareRequest) {
+	res := &ShareReply{
+		Type: InfoManifest,
+	}
+	if m := sv.Manifest(); m == nil {
+		res.Code = ErrNotFound
+		res.Msg = "no cluster manifest"
+	} else if bs, err := json.Marshal(m); err != nil {
 		res.Code = ErrOthers
 		res.Msg = err.Error()
 	} else {
@@ -109,3 +178,73 @@ func (sv *Server) sendIdentity(s network.Stream, req *ShareRequest) {
 		logging.Error(err)
 	}
 }
+
+func (sv *Server) sendIdentity(s network.Stream, req *ShareRequest) {
+	res := &ShareReply{
+		Type: InfoIdentity,
+		Code: ErrDenied,
+		Msg:  "identities are not shared, join the cluster with a token",
+	}
+	if err := WriteReply(s, res); err != nil {
+		logging.Error(err)
+	}
+}
+
+func (sv *Server) join(s network.Stream, req *ShareRequest) {
+	res := &ShareReply{
+		Type: InfoJoin,
+	}
+	cc, err := sv.admit(req.Token, s.Conn().RemotePeer())
+	if err == nil {
+		res.Info, err = json.Marshal(cc)
+	}
+	if err != nil {
+		logging.Warnf("refuse %s to join: %s", s.Conn().RemotePeer(), err)
+		res.Code = ErrDenied
+		res.Msg = err.Error()
+	}
+	if err := WriteReply(s, res); err != nil {
+		logging.Error(err)
+	}
+}
+
+// admit gives the place of the pending node of the token to the peer, the peer has proved
+// it owns its key by opening the stream. The token can be used once since the node
+// is no longer pending afterward.
+func (sv *Server) admit(token string, pid peer.ID) (*config.ClusterConf, error) {
+	if sv.onJoin == nil {
+		return nil, xerrors.New("the node doesn't admit data nodes")
+	}
+	tk, err := config.ParseJoinToken(token, sv.host.Peerstore().PubKey(sv.host.ID()))
+	if err != nil {
+		return nil, err
+	}
+	sv.joinLk.Lock()
+	defer sv.joinLk.Unlock()
+	sv.lk.RLock()
+	cc := sv.cfg.ClusterConf()
+	sv.lk.RUnlock()
+	nodes := make([]config.Node, len(cc.Nodes))
+	copy(nodes, cc.Nodes)
+	idx := -1
+	for i, nd := range nodes {
+		if nd.ID == pid.Pretty() {
+			return nil, xerrors.Errorf("%s is a node of the cluster already", pid)
+		}
+		if nd.ID == tk.Node && nd.Pending {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, xerrors.Errorf("%w: used or unknown node %s", config.ErrInvalidJoinToken, tk.Node)
+	}
+	nodes[idx].ID = pid.Pretty()
+	nodes[idx].Pending = false
+	cc.Nodes = nodes
+	cc.Epoch++
+	if err := sv.onJoin(cc); err != nil {
+		return nil, err
+	}
+	logging.Infof("%s joined the cluster at epoch %d", pid, cc.Epoch)
+	return cc, nil
+}
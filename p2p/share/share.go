@@ -22,7 +22,13 @@ type InfoType uint8
 
 const (
 	InfoClusterNodes InfoType = 1 + iota
+	// InfoIdentity is no longer served, data nodes join with tokens instead of fetching keys
 	InfoIdentity
+	InfoClusterConf
+	// InfoJoin presents a join token, the peer of the stream takes the place of the pending node
+	InfoJoin
+	// InfoManifest asks the latest cluster manifest signed by the admin key known by the node
+	InfoManifest
 )
 
 type ErrCode uint8
@@ -30,6 +36,7 @@ type ErrCode uint8
 const (
 	ErrNone ErrCode = iota
 	ErrNotFound
+	ErrDenied
 
 	ErrOthers = 100
 )
@@ -37,6 +44,7 @@ const (
 type ShareRequest struct {
 	Type  InfoType
 	Index int64
+	Token string
 }
 
 type ShareReply struct {
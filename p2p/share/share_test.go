@@ -2,19 +2,24 @@ package share
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/filedrive-team/go-ds-cluster/config"
 	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/shard"
 	"github.com/filedrive-team/go-ds-cluster/utils"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
 )
 
 var testNodesInfo = `[{"id":"12D3KooWM1dWYafTFGJc6Kq5XYX6RRbQTCbZ58kXFWsjdHREJtCB","slots":{"start":0,"end":5460},"swarm":["/ip4/0.0.0.0/tcp/9690"]},{"id":"12D3KooWQHrRAyak1wYc9u27Tu9HnAqkafdWhZkaohSP834igaiZ","slots":{"start":5461,"end":10922},"swarm":["/ip4/0.0.0.0/tcp/9691"]},{"id":"12D3KooWQWLzFTEE9XD2oZph4UifRkE4BWiapsqHjWMnB1R5WRtS","slots":{"start":10923,"end":16383},"swarm":["/ip4/0.0.0.0/tcp/9692"]}]`
 
-var identitystr = `{"peer_id":"QmTtSXcwN9BiyWJcLrcdRRKt13tNQk8DvTNKZZC6saMaHV","sk":"CAMSeTB3AgEBBCBsED0AQeHlxwEzU1xq0W79ijOwDvCMIYioAX9XhVfkHaAKBggqhkjOPQMBB6FEA0IABIbPiejDx3vct0c+eN1TIqMXJyP5dvzKmZAWf0MXyqBJAGTRKRTvFCY4Es4E9MCWzfDjI2fG1KluAg8iiNTH0fY="}`
-
 func TestShareNode(t *testing.T) {
 	h1, err := p2p.MakeBasicHost(utils.RandPort())
 	if err != nil {
@@ -36,15 +41,9 @@ func TestShareNode(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	var identity config.Identity
-	err = json.Unmarshal([]byte(identitystr), &identity)
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	server := NewShareServer(ctx, h2, &config.Config{
-		Nodes:        cfgNodes,
-		IdentityList: []config.Identity{identity},
+		Nodes:   cfgNodes,
+		HashTag: true,
 	})
 	defer server.Close()
 	server.Serve()
@@ -62,12 +61,231 @@ func TestShareNode(t *testing.T) {
 		t.Fatal("cluster info not match")
 	}
 
-	// test get identity
-	bs, err := client.GetIdentity(0)
+	// test get cluster conf
+	bs, err := client.GetClusterConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &config.ClusterConf{}
+	if err := json.Unmarshal(bs, cc); err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.Nodes) != len(cfgNodes) || !cc.HashTag {
+		t.Fatal("cluster conf not match")
+	}
+}
+
+func TestBootstrapFailover(t *testing.T) {
+	ctx := context.Background()
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	down, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := fmt.Sprintf("%s/p2p/%s", down.Addrs()[0], down.ID())
+	down.Close()
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	upAddr := fmt.Sprintf("%s/p2p/%s", h2.Addrs()[0], h2.ID())
+
+	var cfgNodes = make([]config.Node, 0)
+	if err := json.Unmarshal([]byte(testNodesInfo), &cfgNodes); err != nil {
+		t.Fatal(err)
+	}
+	// a data node not admitting nodes still hands out cluster info
+	server := NewShareServer(ctx, h2, &config.Config{Nodes: cfgNodes})
+	defer server.Close()
+	server.Serve()
+
+	var tried []string
+	err = Bootstrap(ctx, h1, []string{downAddr, upAddr}, func(cl *Client) error {
+		tried = append(tried, cl.target.ID.Pretty())
+		bs, err := cl.GetClusterConf()
+		if err != nil {
+			return err
+		}
+		cc := &config.ClusterConf{}
+		if err := json.Unmarshal(bs, cc); err != nil {
+			return err
+		}
+		if len(cc.Nodes) != len(cfgNodes) {
+			t.Fatal("cluster conf not match")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tried) != 2 || tried[1] != h2.ID().Pretty() {
+		t.Fatalf("expected to fall back on the second bootstrapper, tried %v", tried)
+	}
+
+	// only the bootstrap node admits nodes
+	err = Bootstrap(ctx, h1, []string{upAddr}, func(cl *Client) error {
+		_, err := cl.Join("token")
+		return err
+	})
+	if err == nil {
+		t.Fatal("expected join refused by a node not admitting nodes")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := config.GenClusterConf(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := cfg.JoinTokens(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := p2p.HostFromConf(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server *Server
+	server = NewShareServer(ctx, h, cfg, WithJoin(func(cc *config.ClusterConf) error {
+		server.SetClusterConf(cc)
+		return nil
+	}))
+	defer server.Close()
+	server.Serve()
+	bootstrapper := []string{fmt.Sprintf("%s/p2p/%s", h.Addrs()[0], h.ID())}
+
+	newHost := func() host.Host {
+		ccfg, err := config.GenClientConf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nh, err := p2p.HostFromConf(ccfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nh
+	}
+	join := func(nh host.Host, token string) (*config.ClusterConf, error) {
+		cc := &config.ClusterConf{}
+		err := Bootstrap(ctx, nh, bootstrapper, func(cl *Client) error {
+			bs, err := cl.Join(token)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(bs, cc)
+		})
+		return cc, err
+	}
+
+	// the joining node takes the place of the pending node with its own key
+	n1 := newHost()
+	defer n1.Close()
+	cc, err := join(n1, tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Nodes[1].ID != n1.ID().Pretty() || cc.Nodes[1].Pending || cc.Epoch != 1 {
+		t.Fatalf("expected %s joined at epoch 1, got %+v", n1.ID(), cc.Nodes[1])
+	}
+	if cc.Nodes[1].SlotsNum() == 0 {
+		t.Fatal("expected slots of the pending node kept")
+	}
+
+	// tokens are used once
+	n2 := newHost()
+	defer n2.Close()
+	if _, err := join(n2, tokens[0]); err == nil {
+		t.Fatal("expected used token refused")
+	}
+	// a node joins once
+	if _, err := join(n1, tokens[1]); err == nil {
+		t.Fatal("expected member refused")
+	}
+	// tokens of other issuers are refused
+	other, err := config.GenClusterConf(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherTokens, err := other.JoinTokens(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := join(n2, otherTokens[1]); err == nil {
+		t.Fatal("expected token of other issuer refused")
+	}
+	cc, err = join(n2, tokens[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Nodes[2].ID != n2.ID().Pretty() || cc.Epoch != 2 {
+		t.Fatalf("expected %s joined at epoch 2, got %+v", n2.ID(), cc.Nodes[2])
+	}
+}
+
+func TestFetchManifest(t *testing.T) {
+	ctx := context.Background()
+	sk, pk, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+
+	// the nodes know manifests of different versions
+	var nodes []config.Node
+	for epoch := uint64(1); epoch <= 2; epoch++ {
+		h, err := p2p.MakeBasicHost(utils.RandPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, config.Node{
+			Node:  shard.Node{ID: h.ID().Pretty()},
+			Swarm: []string{h.Addrs()[0].String()},
+		})
+		server := NewShareServer(ctx, h, &config.Config{})
+		defer server.Close()
+		m, err := config.SignManifest(sk, &config.ClusterConf{Nodes: nodes, Epoch: epoch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !server.SetManifest(m) {
+			t.Fatal("expected manifest kept")
+		}
+		if server.SetManifest(m) {
+			t.Fatal("expected manifest of the same version ignored")
+		}
+		server.Serve()
+	}
+	// a pending node is not asked
+	nodes = append(nodes, config.Node{
+		Node:    shard.Node{ID: "12D3KooWQWLzFTEE9XD2oZph4UifRkE4BWiapsqHjWMnB1R5WRtS"},
+		Pending: true,
+	})
+
+	m, err := FetchManifest(ctx, h1, nodes, pk, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != 2 || len(m.Layout.Nodes) != 2 {
+		t.Fatalf("expected the newest manifest, got version %d", m.Version)
+	}
+	if _, err := FetchManifest(ctx, h1, nodes, pk, 3); !xerrors.Is(err, config.ErrManifestDowngrade) {
+		t.Fatalf("expected downgrade refused, got %v", err)
+	}
+	// manifests not signed by the admin key are refused
+	_, other, err := crypto.GenerateECDSAKeyPair(rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if string(bs) != identitystr {
-		t.Fatal("identity not match")
+	if _, err := FetchManifest(ctx, h1, nodes, other, 0); !xerrors.Is(err, config.ErrInvalidManifest) {
+		t.Fatalf("expected invalid manifest, got %v", err)
 	}
 }
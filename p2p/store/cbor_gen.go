@@ -18,25 +18,26 @@ var _ = cid.Undef
 var _ = math.E
 var _ = sort.Sort
 
-var lengthBufRequestMessage = []byte{132}
+var lengthBufRequestMessage = []byte{135}
 
 func (t *RequestMessage) MarshalCBOR(w io.Writer) error {
 	if t == nil {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufRequestMessage); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufRequestMessage); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Key (string) (string)
 	if len(t.Key) > cbg.MaxLength {
 		return xerrors.Errorf("Value in field t.Key was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Key))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Key))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Key)); err != nil {
@@ -48,48 +49,84 @@ func (t *RequestMessage) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Byte array in field t.Value was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(t.Value))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(t.Value[:]); err != nil {
+	if _, err := cw.Write(t.Value[:]); err != nil {
 		return err
 	}
 
 	// t.Query (store.Query) (struct)
-	if err := t.Query.MarshalCBOR(w); err != nil {
+	if err := t.Query.MarshalCBOR(cw); err != nil {
 		return err
 	}
 
 	// t.Action (store.Act) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Action)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Action)); err != nil {
+		return err
+	}
+
+	// t.Asking (bool) (bool)
+	if err := cbg.WriteBool(w, t.Asking); err != nil {
+		return err
+	}
+
+	// t.Token (string) (string)
+	if len(t.Token) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Token was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Token))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Token)); err != nil {
+		return err
+	}
+
+	// t.Batch ([]store.BatchOp) (slice)
+	if len(t.Batch) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Batch was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Batch))); err != nil {
 		return err
 	}
+	for _, v := range t.Batch {
+		if err := v.MarshalCBOR(cw); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
+func (t *RequestMessage) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = RequestMessage{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 4 {
+	if extra != 7 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
 	// t.Key (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -98,7 +135,7 @@ func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Value ([]uint8) (slice)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -114,21 +151,21 @@ func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
 		t.Value = make([]uint8, extra)
 	}
 
-	if _, err := io.ReadFull(br, t.Value[:]); err != nil {
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
 		return err
 	}
 	// t.Query (store.Query) (struct)
 
 	{
 
-		if err := t.Query.UnmarshalCBOR(br); err != nil {
+		if err := t.Query.UnmarshalCBOR(cr); err != nil {
 			return xerrors.Errorf("unmarshaling t.Query: %w", err)
 		}
 
 	}
 	// t.Action (store.Act) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -139,24 +176,81 @@ func (t *RequestMessage) UnmarshalCBOR(r io.Reader) error {
 		return fmt.Errorf("integer in input was too large for uint8 field")
 	}
 	t.Action = Act(extra)
+	// t.Asking (bool) (bool)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajOther {
+		return fmt.Errorf("booleans must be major type 7")
+	}
+	switch extra {
+	case 20:
+		t.Asking = false
+	case 21:
+		t.Asking = true
+	default:
+		return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+	}
+	// t.Token (string) (string)
+
+	{
+		sval, err := cbg.ReadString(cr)
+		if err != nil {
+			return err
+		}
+
+		t.Token = string(sval)
+	}
+	// t.Batch ([]store.BatchOp) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("t.Batch: array too large (%d)", extra)
+	}
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+
+	if extra > 0 {
+		t.Batch = make([]BatchOp, extra)
+	}
+
+	for i := 0; i < int(extra); i++ {
+
+		var v BatchOp
+		if err := v.UnmarshalCBOR(cr); err != nil {
+			return err
+		}
+
+		t.Batch[i] = v
+	}
+
 	return nil
 }
 
-var lengthBufReplyMessage = []byte{133}
+var lengthBufReplyMessage = []byte{136}
 
 func (t *ReplyMessage) MarshalCBOR(w io.Writer) error {
 	if t == nil {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufReplyMessage); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufReplyMessage); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Code (store.ErrCode) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
 		return err
 	}
 
@@ -165,7 +259,7 @@ func (t *ReplyMessage) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Msg was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Msg))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Msg))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Msg)); err != nil {
@@ -177,21 +271,21 @@ func (t *ReplyMessage) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Byte array in field t.Value was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(t.Value))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(t.Value[:]); err != nil {
+	if _, err := cw.Write(t.Value[:]); err != nil {
 		return err
 	}
 
 	// t.Size (int64) (int64)
 	if t.Size >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Size)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Size)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Size-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Size-1)); err != nil {
 			return err
 		}
 	}
@@ -200,30 +294,67 @@ func (t *ReplyMessage) MarshalCBOR(w io.Writer) error {
 	if err := cbg.WriteBool(w, t.Exists); err != nil {
 		return err
 	}
+
+	// t.Redirect (string) (string)
+	if len(t.Redirect) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Redirect was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Redirect))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Redirect)); err != nil {
+		return err
+	}
+
+	// t.Epoch (uint64) (uint64)
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Epoch)); err != nil {
+		return err
+	}
+
+	// t.Batch ([]store.BatchResult) (slice)
+	if len(t.Batch) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Batch was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(t.Batch))); err != nil {
+		return err
+	}
+	for _, v := range t.Batch {
+		if err := v.MarshalCBOR(cw); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
+func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = ReplyMessage{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
 
-	if extra != 5 {
+	if extra != 8 {
 		return fmt.Errorf("cbor input had wrong number of fields")
 	}
 
 	// t.Code (store.ErrCode) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -237,7 +368,7 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 	// t.Msg (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -246,7 +377,7 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Value ([]uint8) (slice)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -262,12 +393,12 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 		t.Value = make([]uint8, extra)
 	}
 
-	if _, err := io.ReadFull(br, t.Value[:]); err != nil {
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
 		return err
 	}
 	// t.Size (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -292,7 +423,7 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Exists (bool) (bool)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -307,6 +438,59 @@ func (t *ReplyMessage) UnmarshalCBOR(r io.Reader) error {
 	default:
 		return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
 	}
+	// t.Redirect (string) (string)
+
+	{
+		sval, err := cbg.ReadString(cr)
+		if err != nil {
+			return err
+		}
+
+		t.Redirect = string(sval)
+	}
+	// t.Epoch (uint64) (uint64)
+
+	{
+
+		maj, extra, err = cr.ReadHeader()
+		if err != nil {
+			return err
+		}
+		if maj != cbg.MajUnsignedInt {
+			return fmt.Errorf("wrong type for uint64 field")
+		}
+		t.Epoch = uint64(extra)
+
+	}
+	// t.Batch ([]store.BatchResult) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("t.Batch: array too large (%d)", extra)
+	}
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+
+	if extra > 0 {
+		t.Batch = make([]BatchResult, extra)
+	}
+
+	for i := 0; i < int(extra); i++ {
+
+		var v BatchResult
+		if err := v.UnmarshalCBOR(cr); err != nil {
+			return err
+		}
+
+		t.Batch[i] = v
+	}
+
 	return nil
 }
 
@@ -317,14 +501,15 @@ func (t *QueryResultEntry) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufQueryResultEntry); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufQueryResultEntry); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Code (store.ErrCode) (uint8)
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
 		return err
 	}
 
@@ -333,7 +518,7 @@ func (t *QueryResultEntry) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Msg was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Msg))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Msg))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Msg)); err != nil {
@@ -345,7 +530,7 @@ func (t *QueryResultEntry) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Value in field t.Key was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Key))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Key))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Key)); err != nil {
@@ -357,37 +542,42 @@ func (t *QueryResultEntry) MarshalCBOR(w io.Writer) error {
 		return xerrors.Errorf("Byte array in field t.Value was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(t.Value))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(t.Value[:]); err != nil {
+	if _, err := cw.Write(t.Value[:]); err != nil {
 		return err
 	}
 
 	// t.Size (int64) (int64)
 	if t.Size >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Size)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Size)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Size-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Size-1)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
+func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = QueryResultEntry{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
@@ -398,7 +588,7 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 
 	// t.Code (store.ErrCode) (uint8)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -412,7 +602,7 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 	// t.Msg (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -422,7 +612,7 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 	// t.Key (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -431,7 +621,7 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Value ([]uint8) (slice)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -447,12 +637,12 @@ func (t *QueryResultEntry) UnmarshalCBOR(r io.Reader) error {
 		t.Value = make([]uint8, extra)
 	}
 
-	if _, err := io.ReadFull(br, t.Value[:]); err != nil {
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
 		return err
 	}
 	// t.Size (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -485,18 +675,19 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write(lengthBufQuery); err != nil {
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufQuery); err != nil {
 		return err
 	}
 
-	scratch := make([]byte, 9)
-
 	// t.Prefix (string) (string)
 	if len(t.Prefix) > cbg.MaxLength {
 		return xerrors.Errorf("Value in field t.Prefix was too long")
 	}
 
-	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(t.Prefix))); err != nil {
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Prefix))); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, string(t.Prefix)); err != nil {
@@ -505,22 +696,22 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 
 	// t.Limit (int64) (int64)
 	if t.Limit >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Limit)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Limit)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Limit-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Limit-1)); err != nil {
 			return err
 		}
 	}
 
 	// t.Offset (int64) (int64)
 	if t.Offset >= 0 {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Offset)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Offset)); err != nil {
 			return err
 		}
 	} else {
-		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Offset-1)); err != nil {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-t.Offset-1)); err != nil {
 			return err
 		}
 	}
@@ -532,16 +723,21 @@ func (t *Query) MarshalCBOR(w io.Writer) error {
 	return nil
 }
 
-func (t *Query) UnmarshalCBOR(r io.Reader) error {
+func (t *Query) UnmarshalCBOR(r io.Reader) (err error) {
 	*t = Query{}
 
-	br := cbg.GetPeeker(r)
-	scratch := make([]byte, 8)
+	cr := cbg.NewCborReader(r)
 
-	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err := cr.ReadHeader()
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	if maj != cbg.MajArray {
 		return fmt.Errorf("cbor input should be of type array")
 	}
@@ -553,7 +749,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	// t.Prefix (string) (string)
 
 	{
-		sval, err := cbg.ReadStringBuf(br, scratch)
+		sval, err := cbg.ReadString(cr)
 		if err != nil {
 			return err
 		}
@@ -562,7 +758,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Limit (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -587,7 +783,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.Offset (int64) (int64)
 	{
-		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		maj, extra, err := cr.ReadHeader()
 		var extraI int64
 		if err != nil {
 			return err
@@ -612,7 +808,7 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	}
 	// t.KeysOnly (bool) (bool)
 
-	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	maj, extra, err = cr.ReadHeader()
 	if err != nil {
 		return err
 	}
@@ -629,3 +825,553 @@ func (t *Query) UnmarshalCBOR(r io.Reader) error {
 	}
 	return nil
 }
+
+var lengthBufRequestFrame = []byte{130}
+
+func (t *RequestFrame) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufRequestFrame); err != nil {
+		return err
+	}
+
+	// t.ID (uint64) (uint64)
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.ID)); err != nil {
+		return err
+	}
+
+	// t.Request (store.RequestMessage) (struct)
+	if err := t.Request.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *RequestFrame) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = RequestFrame{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.ID (uint64) (uint64)
+
+	{
+
+		maj, extra, err = cr.ReadHeader()
+		if err != nil {
+			return err
+		}
+		if maj != cbg.MajUnsignedInt {
+			return fmt.Errorf("wrong type for uint64 field")
+		}
+		t.ID = uint64(extra)
+
+	}
+	// t.Request (store.RequestMessage) (struct)
+
+	{
+
+		if err := t.Request.UnmarshalCBOR(cr); err != nil {
+			return xerrors.Errorf("unmarshaling t.Request: %w", err)
+		}
+
+	}
+	return nil
+}
+
+var lengthBufReplyFrame = []byte{130}
+
+func (t *ReplyFrame) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufReplyFrame); err != nil {
+		return err
+	}
+
+	// t.ID (uint64) (uint64)
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.ID)); err != nil {
+		return err
+	}
+
+	// t.Reply (store.ReplyMessage) (struct)
+	if err := t.Reply.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *ReplyFrame) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = ReplyFrame{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.ID (uint64) (uint64)
+
+	{
+
+		maj, extra, err = cr.ReadHeader()
+		if err != nil {
+			return err
+		}
+		if maj != cbg.MajUnsignedInt {
+			return fmt.Errorf("wrong type for uint64 field")
+		}
+		t.ID = uint64(extra)
+
+	}
+	// t.Reply (store.ReplyMessage) (struct)
+
+	{
+
+		if err := t.Reply.UnmarshalCBOR(cr); err != nil {
+			return xerrors.Errorf("unmarshaling t.Reply: %w", err)
+		}
+
+	}
+	return nil
+}
+
+var lengthBufBatchOp = []byte{131}
+
+func (t *BatchOp) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufBatchOp); err != nil {
+		return err
+	}
+
+	// t.Key (string) (string)
+	if len(t.Key) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Key was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Key))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Key)); err != nil {
+		return err
+	}
+
+	// t.Value ([]uint8) (slice)
+	if len(t.Value) > cbg.ByteArrayMaxLen {
+		return xerrors.Errorf("Byte array in field t.Value was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
+		return err
+	}
+
+	if _, err := cw.Write(t.Value[:]); err != nil {
+		return err
+	}
+
+	// t.Delete (bool) (bool)
+	if err := cbg.WriteBool(w, t.Delete); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *BatchOp) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = BatchOp{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 3 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Key (string) (string)
+
+	{
+		sval, err := cbg.ReadString(cr)
+		if err != nil {
+			return err
+		}
+
+		t.Key = string(sval)
+	}
+	// t.Value ([]uint8) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("t.Value: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+
+	if extra > 0 {
+		t.Value = make([]uint8, extra)
+	}
+
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
+		return err
+	}
+	// t.Delete (bool) (bool)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajOther {
+		return fmt.Errorf("booleans must be major type 7")
+	}
+	switch extra {
+	case 20:
+		t.Delete = false
+	case 21:
+		t.Delete = true
+	default:
+		return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+	}
+	return nil
+}
+
+var lengthBufBatchResult = []byte{134}
+
+func (t *BatchResult) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufBatchResult); err != nil {
+		return err
+	}
+
+	// t.Code (store.ErrCode) (uint8)
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Code)); err != nil {
+		return err
+	}
+
+	// t.Msg (string) (string)
+	if len(t.Msg) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Msg was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Msg))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Msg)); err != nil {
+		return err
+	}
+
+	// t.Redirect (string) (string)
+	if len(t.Redirect) > cbg.MaxLength {
+		return xerrors.Errorf("Value in field t.Redirect was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(t.Redirect))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string(t.Redirect)); err != nil {
+		return err
+	}
+
+	// t.Epoch (uint64) (uint64)
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(t.Epoch)); err != nil {
+		return err
+	}
+
+	// t.Value ([]uint8) (slice)
+	if len(t.Value) > cbg.ByteArrayMaxLen {
+		return xerrors.Errorf("Byte array in field t.Value was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Value))); err != nil {
+		return err
+	}
+
+	if _, err := cw.Write(t.Value[:]); err != nil {
+		return err
+	}
+
+	// t.Exists (bool) (bool)
+	if err := cbg.WriteBool(w, t.Exists); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *BatchResult) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = BatchResult{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 6 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Code (store.ErrCode) (uint8)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint8 field")
+	}
+	if extra > math.MaxUint8 {
+		return fmt.Errorf("integer in input was too large for uint8 field")
+	}
+	t.Code = ErrCode(extra)
+	// t.Msg (string) (string)
+
+	{
+		sval, err := cbg.ReadString(cr)
+		if err != nil {
+			return err
+		}
+
+		t.Msg = string(sval)
+	}
+	// t.Redirect (string) (string)
+
+	{
+		sval, err := cbg.ReadString(cr)
+		if err != nil {
+			return err
+		}
+
+		t.Redirect = string(sval)
+	}
+	// t.Epoch (uint64) (uint64)
+
+	{
+
+		maj, extra, err = cr.ReadHeader()
+		if err != nil {
+			return err
+		}
+		if maj != cbg.MajUnsignedInt {
+			return fmt.Errorf("wrong type for uint64 field")
+		}
+		t.Epoch = uint64(extra)
+
+	}
+	// t.Value ([]uint8) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("t.Value: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+
+	if extra > 0 {
+		t.Value = make([]uint8, extra)
+	}
+
+	if _, err := io.ReadFull(cr, t.Value[:]); err != nil {
+		return err
+	}
+	// t.Exists (bool) (bool)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajOther {
+		return fmt.Errorf("booleans must be major type 7")
+	}
+	switch extra {
+	case 20:
+		t.Exists = false
+	case 21:
+		t.Exists = true
+	default:
+		return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+	}
+	return nil
+}
+
+var lengthBufChunk = []byte{130}
+
+func (t *Chunk) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	cw := cbg.NewCborWriter(w)
+
+	if _, err := cw.Write(lengthBufChunk); err != nil {
+		return err
+	}
+
+	// t.Data ([]uint8) (slice)
+	if len(t.Data) > cbg.ByteArrayMaxLen {
+		return xerrors.Errorf("Byte array in field t.Data was too long")
+	}
+
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(t.Data))); err != nil {
+		return err
+	}
+
+	if _, err := cw.Write(t.Data[:]); err != nil {
+		return err
+	}
+
+	// t.End (bool) (bool)
+	if err := cbg.WriteBool(w, t.End); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Chunk) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = Chunk{}
+
+	cr := cbg.NewCborReader(r)
+
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+
+	if extra != 2 {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+
+	// t.Data ([]uint8) (slice)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("t.Data: byte array too large (%d)", extra)
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+
+	if extra > 0 {
+		t.Data = make([]uint8, extra)
+	}
+
+	if _, err := io.ReadFull(cr, t.Data[:]); err != nil {
+		return err
+	}
+	// t.End (bool) (bool)
+
+	maj, extra, err = cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajOther {
+		return fmt.Errorf("booleans must be major type 7")
+	}
+	switch extra {
+	case 20:
+		t.End = false
+	case 21:
+		t.End = true
+	default:
+		return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+	}
+	return nil
+}
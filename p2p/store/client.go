@@ -2,7 +2,11 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 
+	"github.com/filedrive-team/go-ds-cluster/config"
 	"github.com/filedrive-team/go-ds-cluster/core"
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
@@ -19,19 +23,150 @@ type client struct {
 	src      host.Host
 	target   peer.AddrInfo
 	protocol protocol.ID
+	// asking marks requests following ASK redirection
+	asking bool
+	// token is the capability presented with every request
+	token string
+	// mux keeps the long-lived streams shared by the views of the client
+	mux *muxPool
 }
 
-func NewStoreClient(ctx context.Context, src host.Host, target peer.AddrInfo, pid protocol.ID) core.DataNodeClient {
+// ErrPermissionDenied is returned for the requests the data node refuses to the peer
+var ErrPermissionDenied = xerrors.New("permission denied")
+
+// ClientOption configures the store client
+type ClientOption func(cl *client)
+
+// WithCapability presents the capability token with every request, see config.IssueCapability
+func WithCapability(token string) ClientOption {
+	return func(cl *client) {
+		cl.token = token
+	}
+}
+
+// ErrValueTooLarge is returned for the values larger than MaxValueSize which are not streamed,
+// see StreamClient
+var ErrValueTooLarge = xerrors.New("value too large")
+
+func codeError(code ErrCode, msg string) error {
+	switch code {
+	case ErrDenied:
+		return xerrors.Errorf("%w: %s", ErrPermissionDenied, msg)
+	case ErrTooLarge:
+		return xerrors.Errorf("%w: %s", ErrValueTooLarge, msg)
+	}
+	return xerrors.New(msg)
+}
+
+func tooLargeStream(key string) error {
+	return xerrors.Errorf("%w: streamed value of %s is larger than %d", ErrValueTooLarge, key, MaxStreamSize)
+}
+
+func tooLarge(key string, size int) error {
+	return xerrors.Errorf("%w: value of %s is %d bytes, larger than %d, put it with PutStream", ErrValueTooLarge, key, size, MaxValueSize)
+}
+
+// TopologyClient manages the cluster layout kept by a data node
+type TopologyClient interface {
+	GetTopology() (*config.ClusterConf, error)
+	// GetManifest returns the layout kept by the data node with its signature by the admin key,
+	// Sig is nil if the layout isn't signed
+	GetManifest() (*config.Manifest, error)
+	// SetTopology pushes the layout unsigned, only the nodes of the cluster are allowed to
+	SetTopology(cc *config.ClusterConf) error
+	// SetManifest pushes the layout signed by the admin key, see config.SignManifest
+	SetManifest(m *config.Manifest) error
+	// Asking returns a view of the client whose requests follow an ASK redirection,
+	// the node importing the slot only serves such requests
+	Asking() core.DataNode
+}
+
+// BatchClient applies many writes with a single request
+type BatchClient interface {
+	// Batch applies the ops and returns the error of each of them, a *RedirectError
+	// if the key of the op is served by another node
+	Batch(ops []BatchOp) []error
+}
+
+// StreamClient streams values of any size in chunks of ChunkSize, a *RedirectError is returned
+// before anything is streamed if the key is served by another node
+type StreamClient interface {
+	// PutWriter returns the writer of the value of the key, the value is put once the writer is closed
+	PutWriter(key string) (ValueWriter, error)
+	// PutStream puts the value read from r
+	PutStream(key string, r io.Reader) error
+	// GetStream writes the value of the key to w
+	GetStream(key string, w io.Writer) error
+}
+
+// ValueWriter streams a value to a data node, the value is put by Close and dropped by Abort
+type ValueWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+var (
+	// MaxBatchOps bounds the ops sent in a single ActBatch request
+	MaxBatchOps = 1024
+	// MaxBatchBytes bounds the size of the values sent in a single ActBatch request
+	MaxBatchBytes = 8 << 20
+)
+
+// RedirectError is returned when the data node does not serve the key,
+// Code is either ErrMoved or ErrAsk
+type RedirectError struct {
+	Code     ErrCode
+	Redirect string
+	Epoch    uint64
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("%s %s, epoch %d", e.Code, e.Redirect, e.Epoch)
+}
+
+func redirectError(reply *ReplyMessage) error {
+	if reply.Code == ErrMoved || reply.Code == ErrAsk {
+		return &RedirectError{
+			Code:     reply.Code,
+			Redirect: reply.Redirect,
+			Epoch:    reply.Epoch,
+		}
+	}
+	return nil
+}
+
+func batchError(res BatchResult) error {
+	switch res.Code {
+	case ErrNone:
+		return nil
+	case ErrMoved, ErrAsk:
+		return &RedirectError{
+			Code:     res.Code,
+			Redirect: res.Redirect,
+			Epoch:    res.Epoch,
+		}
+	default:
+		return codeError(res.Code, res.Msg)
+	}
+}
+
+func NewStoreClient(ctx context.Context, src host.Host, target peer.AddrInfo, pid protocol.ID, opts ...ClientOption) core.DataNodeClient {
 	src.Peerstore().AddAddrs(target.ID, target.Addrs, peerstore.PermanentAddrTTL)
-	return &client{
+	cl := &client{
 		ctx:      ctx,
 		src:      src,
 		target:   target,
 		protocol: pid,
+		mux:      newMuxPool(src, target.ID),
 	}
+	for _, opt := range opts {
+		opt(cl)
+	}
+	return cl
 }
 
 func (cl *client) Close() error {
+	cl.mux.close()
 	return cl.src.Close()
 }
 
@@ -47,122 +182,197 @@ func (cl *client) ConnectTarget() error {
 	return cl.src.Connect(cl.ctx, cl.target)
 }
 
-func (cl *client) Put(key string, value []byte) error {
+func (cl *client) Asking() core.DataNode {
+	cp := *cl
+	cp.asking = true
+	return &cp
+}
+
+// request sends the request pipelined on the long-lived streams to the data node,
+// or on a stream of its own if the node doesn't support PROTOCOL_V2
+func (cl *client) request(req *RequestMessage, reply *ReplyMessage) error {
 	_ = cl.ConnectTarget()
+	req.Token = cl.token
+	err := cl.mux.call(cl.ctx, req, reply)
+	if err == errNotMultiplexed {
+		return cl.requestStream(req, reply)
+	}
+	if err != nil {
+		logging.Errorf("%s request failed: %s", req.Action, err)
+	}
+	return err
+}
 
+// requestMux is like request but only sends the request on the long-lived streams, errNotMultiplexed
+// is returned if the data node doesn't support PROTOCOL_V2. The actions added along with PROTOCOL_V2,
+// i.e. ActBatch, ActGetMany and ActHasMany, are sent this way since former data nodes don't reply them.
+func (cl *client) requestMux(req *RequestMessage, reply *ReplyMessage) error {
+	_ = cl.ConnectTarget()
+	req.Token = cl.token
+	err := cl.mux.call(cl.ctx, req, reply)
+	if err != nil && err != errNotMultiplexed {
+		logging.Errorf("%s request failed: %s", req.Action, err)
+	}
+	return err
+}
+
+func (cl *client) requestStream(req *RequestMessage, reply *ReplyMessage) error {
 	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
+	if err := WriteRequstMsg(s, req); err != nil {
+		logging.Errorf("%s write request failed: %s", req.Action, err)
+		return err
+	}
+	if err := ReadReplyMsg(s, reply); err != nil {
+		logging.Errorf("%s read reply failed: %s", req.Action, err)
+		return err
+	}
+	return nil
+}
 
-	// req := &RequestMessage{
-	// 	Key:    key,
-	// 	Value:  value,
-	// 	Action: ActPut,
-	// }
+func (cl *client) GetTopology() (*config.ClusterConf, error) {
+	m, err := cl.GetManifest()
+	if err != nil {
+		return nil, err
+	}
+	return m.Layout, nil
+}
+
+func (cl *client) GetManifest() (*config.Manifest, error) {
 	req := reqMsgPool.Get().(*RequestMessage)
+	req.reset()
 	defer reqMsgPool.Put(req)
-	req.Key = key
-	req.Value = value
-	req.Action = ActPut
-	if err := WriteRequstMsg(s, req); err != nil {
-		logging.Errorf("Put write request failed: %s", err)
+	req.Action = ActGetTopology
+
+	reply := replyMsgPool.Get().(*ReplyMessage)
+	reply.reset()
+	defer replyMsgPool.Put(reply)
+	if err := cl.request(req, reply); err != nil {
+		return nil, err
+	}
+	if reply.Code != ErrNone {
+		if reply.Code == ErrNotFound {
+			return nil, ds.ErrNotFound
+		}
+		return nil, codeError(reply.Code, reply.Msg)
+	}
+	m := new(config.Manifest)
+	if err := json.Unmarshal(reply.Value, m); err != nil {
+		return nil, err
+	}
+	if m.Layout != nil {
+		return m, nil
+	}
+	// data nodes of former versions reply the bare layout
+	cc := new(config.ClusterConf)
+	if err := json.Unmarshal(reply.Value, cc); err != nil {
+		return nil, err
+	}
+	return &config.Manifest{Version: cc.Epoch, Layout: cc}, nil
+}
+
+func (cl *client) SetTopology(cc *config.ClusterConf) error {
+	return cl.SetManifest(&config.Manifest{Version: cc.Epoch, Layout: cc})
+}
+
+func (cl *client) SetManifest(m *config.Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
 		return err
 	}
+	req := reqMsgPool.Get().(*RequestMessage)
+	req.reset()
+	defer reqMsgPool.Put(req)
+	req.Value = b
+	req.Action = ActSetTopology
 
-	//reply := &ReplyMessage{}
 	reply := replyMsgPool.Get().(*ReplyMessage)
 	reply.reset()
 	defer replyMsgPool.Put(reply)
-	if err := ReadReplyMsg(s, reply); err != nil {
-		logging.Errorf("Put read reply failed: %s", err)
+	if err := cl.request(req, reply); err != nil {
 		return err
 	}
-	// var b bytes.Buffer
-	// if err := reply.MarshalCBOR(&b); err == nil {
-	// 	logging.Infof("[Put] reply bytes: %v", b.Bytes())
-	// }
 	if reply.Code != ErrNone {
-		return xerrors.New(reply.Msg)
+		return codeError(reply.Code, reply.Msg)
 	}
 	return nil
 }
 
-func (cl *client) Delete(key string) error {
-	_ = cl.ConnectTarget()
+func (cl *client) Put(key string, value []byte) error {
+	if len(value) > MaxValueSize {
+		return tooLarge(key, len(value))
+	}
+	req := reqMsgPool.Get().(*RequestMessage)
+	req.reset()
+	defer reqMsgPool.Put(req)
+	req.Key = key
+	req.Value = value
+	req.Action = ActPut
+	req.Asking = cl.asking
 
-	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
-	if err != nil {
+	reply := replyMsgPool.Get().(*ReplyMessage)
+	reply.reset()
+	defer replyMsgPool.Put(reply)
+	if err := cl.request(req, reply); err != nil {
 		return err
 	}
-	defer s.Close()
+	if err := redirectError(reply); err != nil {
+		return err
+	}
+	if reply.Code != ErrNone {
+		return codeError(reply.Code, reply.Msg)
+	}
+	return nil
+}
 
-	// req := &RequestMessage{
-	// 	Key:    key,
-	// 	Action: ActDelete,
-	// }
+func (cl *client) Delete(key string) error {
 	req := reqMsgPool.Get().(*RequestMessage)
 	req.reset()
 	defer reqMsgPool.Put(req)
 	req.Key = key
 	req.Action = ActDelete
-	if err := WriteRequstMsg(s, req); err != nil {
-		logging.Errorf("Delete write request failed: %s", err)
-		return err
-	}
+	req.Asking = cl.asking
 
-	//reply := &ReplyMessage{}
 	reply := replyMsgPool.Get().(*ReplyMessage)
 	reply.reset()
 	defer replyMsgPool.Put(reply)
-	if err := ReadReplyMsg(s, reply); err != nil {
-		logging.Errorf("Delete read reply failed: %s", err)
+	if err := cl.request(req, reply); err != nil {
+		return err
+	}
+	if err := redirectError(reply); err != nil {
 		return err
 	}
 	if reply.Code != ErrNone {
-		return xerrors.New(reply.Msg)
+		return codeError(reply.Code, reply.Msg)
 	}
 	return nil
 }
 
 func (cl *client) Get(key string) (value []byte, err error) {
-	_ = cl.ConnectTarget()
-
-	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
-	if err != nil {
-		return nil, err
-	}
-	defer s.Close()
-
-	// req := &RequestMessage{
-	// 	Key:    key,
-	// 	Action: ActGet,
-	// }
 	req := reqMsgPool.Get().(*RequestMessage)
 	req.reset()
 	defer reqMsgPool.Put(req)
 	req.Key = key
 	req.Action = ActGet
+	req.Asking = cl.asking
 
-	if err := WriteRequstMsg(s, req); err != nil {
-		logging.Errorf("Get write request failed: %s", err)
-		return nil, err
-	}
-
-	//reply := &ReplyMessage{}
 	reply := replyMsgPool.Get().(*ReplyMessage)
 	reply.reset()
 	defer replyMsgPool.Put(reply)
-	if err := ReadReplyMsg(s, reply); err != nil {
-		logging.Errorf("Get read reply failed: %s", err)
+	if err := cl.request(req, reply); err != nil {
+		return nil, err
+	}
+	if err := redirectError(reply); err != nil {
 		return nil, err
 	}
 	if reply.Code != ErrNone {
 		if reply.Code == ErrNotFound {
 			return nil, ds.ErrNotFound
 		}
-		return nil, xerrors.New(reply.Msg)
+		return nil, codeError(reply.Code, reply.Msg)
 	}
 	value = make([]byte, len(reply.Value))
 	copy(value, reply.Value)
@@ -170,33 +380,20 @@ func (cl *client) Get(key string) (value []byte, err error) {
 }
 
 func (cl *client) Has(key string) (exists bool, err error) {
-	_ = cl.ConnectTarget()
-	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
-	if err != nil {
-		return false, err
-	}
-	defer s.Close()
-
-	// req := &RequestMessage{
-	// 	Key:    key,
-	// 	Action: ActHas,
-	// }
 	req := reqMsgPool.Get().(*RequestMessage)
 	req.reset()
 	defer reqMsgPool.Put(req)
 	req.Key = key
 	req.Action = ActHas
-	if err := WriteRequstMsg(s, req); err != nil {
-		logging.Errorf("Has write request failed: %s", err)
-		return false, err
-	}
+	req.Asking = cl.asking
 
-	//reply := &ReplyMessage{}
 	reply := replyMsgPool.Get().(*ReplyMessage)
 	reply.reset()
 	defer replyMsgPool.Put(reply)
-	if err := ReadReplyMsg(s, reply); err != nil {
-		logging.Errorf("Has read reply failed: %s", err)
+	if err := cl.request(req, reply); err != nil {
+		return false, err
+	}
+	if err := redirectError(reply); err != nil {
 		return false, err
 	}
 
@@ -204,51 +401,345 @@ func (cl *client) Has(key string) (exists bool, err error) {
 		if reply.Code == ErrNotFound {
 			return false, nil
 		}
-		return false, xerrors.New(reply.Msg)
+		return false, codeError(reply.Code, reply.Msg)
 	}
 
 	return reply.Exists, nil
 }
 
 func (cl *client) GetSize(key string) (size int, err error) {
-	_ = cl.ConnectTarget()
-	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
-	if err != nil {
-		return -1, err
-	}
-	defer s.Close()
-
-	// req := &RequestMessage{
-	// 	Key:    key,
-	// 	Action: ActGetSize,
-	// }
 	req := reqMsgPool.Get().(*RequestMessage)
 	req.reset()
 	defer reqMsgPool.Put(req)
 	req.Key = key
 	req.Action = ActGetSize
-	if err := WriteRequstMsg(s, req); err != nil {
-		logging.Errorf("GetSize write request failed: %s", err)
+	req.Asking = cl.asking
+
+	reply := replyMsgPool.Get().(*ReplyMessage)
+	reply.reset()
+	defer replyMsgPool.Put(reply)
+	if err := cl.request(req, reply); err != nil {
 		return -1, err
 	}
+	if err := redirectError(reply); err != nil {
+		return -1, err
+	}
+	if reply.Code != ErrNone {
+		if reply.Code == ErrNotFound {
+			return -1, ds.ErrNotFound
+		}
+		return -1, codeError(reply.Code, reply.Msg)
+	}
+
+	return int(reply.Size), nil
+}
+
+// Batch sends the ops in requests of at most MaxBatchOps ops and MaxBatchBytes bytes,
+// the ops of a failed request all get its error. Values larger than MaxValueSize are not sent.
+func (cl *client) Batch(ops []BatchOp) []error {
+	errs := make([]error, len(ops))
+	send := make([]BatchOp, 0, len(ops))
+	idx := make([]int, 0, len(ops))
+	for i, op := range ops {
+		if len(op.Value) > MaxValueSize {
+			errs[i] = tooLarge(op.Key, len(op.Value))
+			continue
+		}
+		send = append(send, op)
+		idx = append(idx, i)
+	}
+	sent := make([]error, len(send))
+	for start := 0; start < len(send); {
+		end, size := start, 0
+		for end < len(send) && end-start < MaxBatchOps {
+			if end > start && size+len(send[end].Value) > MaxBatchBytes {
+				break
+			}
+			size += len(send[end].Value)
+			end++
+		}
+		cl.batch(send[start:end], sent[start:end])
+		start = end
+	}
+	for k, i := range idx {
+		errs[i] = sent[k]
+	}
+	return errs
+}
+
+func (cl *client) batch(ops []BatchOp, errs []error) {
+	req := reqMsgPool.Get().(*RequestMessage)
+	req.reset()
+	defer reqMsgPool.Put(req)
+	req.Batch = ops
+	req.Action = ActBatch
+	req.Asking = cl.asking
+
+	reply := replyMsgPool.Get().(*ReplyMessage)
+	reply.reset()
+	defer replyMsgPool.Put(reply)
+	err := cl.requestMux(req, reply)
+	if err == errNotMultiplexed {
+		// the data node doesn't know ActBatch
+		for i, op := range ops {
+			if op.Delete {
+				errs[i] = cl.Delete(op.Key)
+			} else {
+				errs[i] = cl.Put(op.Key, op.Value)
+			}
+		}
+		return
+	}
+	if err == nil && reply.Code != ErrNone {
+		err = codeError(reply.Code, reply.Msg)
+	}
+	if err == nil && len(reply.Batch) != len(ops) {
+		err = xerrors.Errorf("batch of %d ops replied %d results", len(ops), len(reply.Batch))
+	}
+	for i := range ops {
+		if err != nil {
+			errs[i] = err
+		} else {
+			errs[i] = batchError(reply.Batch[i])
+		}
+	}
+}
+
+func (cl *client) GetMany(keys []string) ([]core.KeyResult, error) {
+	return cl.readMany(ActGetMany, keys)
+}
+
+func (cl *client) HasMany(keys []string) ([]core.KeyResult, error) {
+	return cl.readMany(ActHasMany, keys)
+}
+
+// readMany asks the keys in requests of at most MaxBatchOps keys, the keys left unanswered
+// by a reply reaching MaxBatchBytes are asked again. Keys served by other nodes get a *RedirectError.
+func (cl *client) readMany(act Act, keys []string) ([]core.KeyResult, error) {
+	res := make([]core.KeyResult, 0, len(keys))
+	for len(res) < len(keys) {
+		rest := keys[len(res):]
+		if len(rest) > MaxBatchOps {
+			rest = rest[:MaxBatchOps]
+		}
+		results, err := cl.readBatch(act, rest)
+		if err == errNotMultiplexed {
+			// the data node doesn't know ActGetMany and ActHasMany
+			return append(res, cl.readOneByOne(act, keys[len(res):])...), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, r := range results {
+			kr := core.KeyResult{Key: rest[i], Exists: r.Exists}
+			switch r.Code {
+			case ErrNone:
+				if act == ActGetMany && r.Exists {
+					kr.Value = make([]byte, len(r.Value))
+					copy(kr.Value, r.Value)
+				}
+			case ErrNotFound:
+			default:
+				kr.Err = batchError(r)
+			}
+			res = append(res, kr)
+		}
+	}
+	return res, nil
+}
+
+// readOneByOne asks the keys with Get or Has
+func (cl *client) readOneByOne(act Act, keys []string) []core.KeyResult {
+	res := make([]core.KeyResult, len(keys))
+	for i, k := range keys {
+		res[i].Key = k
+		if act == ActHasMany {
+			res[i].Exists, res[i].Err = cl.Has(k)
+			continue
+		}
+		v, err := cl.Get(k)
+		switch {
+		case err == nil:
+			res[i].Exists = true
+			res[i].Value = v
+		case err != ds.ErrNotFound:
+			res[i].Err = err
+		}
+	}
+	return res
+}
+
+func (cl *client) readBatch(act Act, keys []string) ([]BatchResult, error) {
+	req := reqMsgPool.Get().(*RequestMessage)
+	req.reset()
+	defer reqMsgPool.Put(req)
+	req.Batch = make([]BatchOp, len(keys))
+	for i, k := range keys {
+		req.Batch[i].Key = k
+	}
+	req.Action = act
+	req.Asking = cl.asking
 
-	//reply := &ReplyMessage{}
 	reply := replyMsgPool.Get().(*ReplyMessage)
 	reply.reset()
 	defer replyMsgPool.Put(reply)
+	if err := cl.requestMux(req, reply); err != nil {
+		return nil, err
+	}
+	if reply.Code != ErrNone {
+		return nil, codeError(reply.Code, reply.Msg)
+	}
+	if len(reply.Batch) == 0 || len(reply.Batch) > len(keys) {
+		return nil, xerrors.Errorf("%s of %d keys replied %d results", act, len(keys), len(reply.Batch))
+	}
+	return reply.Batch, nil
+}
 
+func (cl *client) PutWriter(key string) (ValueWriter, error) {
+	_ = cl.ConnectTarget()
+	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
+	if err != nil {
+		return nil, err
+	}
+	req := &RequestMessage{
+		Key:    key,
+		Action: ActPutStream,
+		Asking: cl.asking,
+		Token:  cl.token,
+	}
+	if err := WriteRequstMsg(s, req); err != nil {
+		s.Reset()
+		logging.Errorf("PutStream write request failed: %s", err)
+		return nil, err
+	}
+	reply := &ReplyMessage{}
 	if err := ReadReplyMsg(s, reply); err != nil {
-		logging.Errorf("GetSize read reply failed: %s", err)
-		return -1, err
+		s.Reset()
+		logging.Errorf("PutStream read reply failed: %s", err)
+		return nil, err
+	}
+	if reply.Code != ErrNone {
+		s.Close()
+		if err := redirectError(reply); err != nil {
+			return nil, err
+		}
+		return nil, codeError(reply.Code, reply.Msg)
+	}
+	return &valueWriter{s: s, key: key, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (cl *client) PutStream(key string, r io.Reader) error {
+	vw, err := cl.PutWriter(key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(vw, r); err != nil {
+		vw.Abort()
+		return err
+	}
+	return vw.Close()
+}
+
+func (cl *client) GetStream(key string, w io.Writer) error {
+	_ = cl.ConnectTarget()
+	s, err := cl.src.NewStream(cl.ctx, cl.target.ID, cl.protocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	req := &RequestMessage{
+		Key:    key,
+		Action: ActGetStream,
+		Asking: cl.asking,
+		Token:  cl.token,
+	}
+	if err := WriteRequstMsg(s, req); err != nil {
+		logging.Errorf("GetStream write request failed: %s", err)
+		return err
+	}
+	reply := &ReplyMessage{}
+	if err := ReadReplyMsg(s, reply); err != nil {
+		logging.Errorf("GetStream read reply failed: %s", err)
+		return err
+	}
+	if err := redirectError(reply); err != nil {
+		return err
 	}
 	if reply.Code != ErrNone {
 		if reply.Code == ErrNotFound {
-			return -1, ds.ErrNotFound
+			return ds.ErrNotFound
+		}
+		return codeError(reply.Code, reply.Msg)
+	}
+	for {
+		chunk := new(Chunk)
+		if err := ReadChunk(s, chunk); err != nil {
+			s.Reset()
+			return xerrors.Errorf("GetStream %s read chunk failed: %w", key, err)
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			s.Reset()
+			return err
+		}
+		if chunk.End {
+			return nil
 		}
-		return -1, xerrors.New(reply.Msg)
 	}
+}
 
-	return int(reply.Size), nil
+// valueWriter sends the value written in chunks of ChunkSize, values larger than MaxStreamSize are aborted
+type valueWriter struct {
+	s    network.Stream
+	key  string
+	buf  []byte
+	size int64
+}
+
+func (vw *valueWriter) Write(p []byte) (int, error) {
+	if vw.size+int64(len(p)) > MaxStreamSize {
+		vw.s.Reset()
+		return 0, tooLargeStream(vw.key)
+	}
+	vw.size += int64(len(p))
+	n := len(p)
+	for len(p) > 0 {
+		k := ChunkSize - len(vw.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		vw.buf = append(vw.buf, p[:k]...)
+		p = p[k:]
+		if len(vw.buf) == ChunkSize {
+			if err := WriteChunk(vw.s, &Chunk{Data: vw.buf}); err != nil {
+				vw.s.Reset()
+				return n - len(p) - k, err
+			}
+			vw.buf = vw.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Close sends the last chunk and waits for the value to be put
+func (vw *valueWriter) Close() error {
+	defer vw.s.Close()
+	if err := WriteChunk(vw.s, &Chunk{Data: vw.buf, End: true}); err != nil {
+		vw.s.Reset()
+		return err
+	}
+	reply := &ReplyMessage{}
+	if err := ReadReplyMsg(vw.s, reply); err != nil {
+		return err
+	}
+	if reply.Code != ErrNone {
+		return codeError(reply.Code, reply.Msg)
+	}
+	return nil
+}
+
+// Abort drops the value, nothing is put
+func (vw *valueWriter) Abort() error {
+	return vw.s.Reset()
 }
 
 func (cl *client) Query(q dsq.Query) (dsq.Results, error) {
@@ -265,6 +756,7 @@ func (cl *client) Query(q dsq.Query) (dsq.Results, error) {
 	// }
 	req := reqMsgPool.Get().(*RequestMessage)
 	req.reset()
+	req.Token = cl.token
 	defer reqMsgPool.Put(req)
 	req.Query = P2PQuery(q)
 	req.Action = ActQuery
@@ -274,16 +766,26 @@ func (cl *client) Query(q dsq.Query) (dsq.Results, error) {
 		return nil, err
 	}
 
+	// errors replied by the server end the results after being handed out
+	var failed bool
 	nextValue := func() (dsq.Result, bool) {
+		if failed {
+			return dsq.Result{}, false
+		}
 		ent := &QueryResultEntry{}
 
 		if err := ReadQueryResultEntry(s, ent); err != nil {
 			s.Close()
 			return dsq.Result{Error: err}, false
 		}
+		if ent.Code == ErrQueryResultEnd {
+			s.Close()
+			return dsq.Result{}, false
+		}
 		if ent.Code != ErrNone {
 			s.Close()
-			return dsq.Result{Error: xerrors.New(ent.Msg)}, false
+			failed = true
+			return dsq.Result{Error: codeError(ent.Code, ent.Msg)}, true
 		}
 		return dsq.Result{Entry: dsq.Entry{
 			Key:   ent.Key,
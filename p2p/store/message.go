@@ -1,6 +1,9 @@
 package store
 
-import dsq "github.com/ipfs/go-datastore/query"
+import (
+	"github.com/filedrive-team/go-ds-cluster/config"
+	dsq "github.com/ipfs/go-datastore/query"
+)
 
 type Act uint8
 
@@ -11,6 +14,13 @@ const (
 	ActGetSize
 	ActHas
 	ActQuery
+	ActGetTopology
+	ActSetTopology
+	ActBatch
+	ActGetMany
+	ActHasMany
+	ActPutStream
+	ActGetStream
 )
 
 func (act Act) String() string {
@@ -27,26 +37,109 @@ func (act Act) String() string {
 		return "Has"
 	case ActQuery:
 		return "Query"
+	case ActGetTopology:
+		return "GetTopology"
+	case ActSetTopology:
+		return "SetTopology"
+	case ActBatch:
+		return "Batch"
+	case ActGetMany:
+		return "GetMany"
+	case ActHasMany:
+		return "HasMany"
+	case ActPutStream:
+		return "PutStream"
+	case ActGetStream:
+		return "GetStream"
 	default:
 		return "Unknown"
 	}
 }
 
+// Perm returns the permission needed by the action,
+// a batch also needs the permission to delete if it deletes keys
+func (act Act) Perm() string {
+	switch act {
+	case ActPut, ActBatch, ActPutStream:
+		return config.PermWrite
+	case ActDelete:
+		return config.PermDelete
+	case ActSetTopology:
+		return config.PermTopology
+	default:
+		return config.PermRead
+	}
+}
+
 type ErrCode uint8
 
 const (
 	ErrNone ErrCode = iota
 	ErrNotFound
 	ErrQueryResultEnd
+	// ErrMoved means the slot of the key is owned by ReplyMessage.Redirect
+	ErrMoved
+	// ErrAsk means the slot of the key is being migrated and the key should be
+	// asked from the importing node ReplyMessage.Redirect
+	ErrAsk
+	// ErrDenied means the peer is not allowed the action
+	ErrDenied
+	// ErrTooLarge means the value is larger than MaxValueSize and should be streamed
+	ErrTooLarge
 
 	ErrOthers = 100
 )
 
+func (code ErrCode) String() string {
+	switch code {
+	case ErrNone:
+		return "None"
+	case ErrNotFound:
+		return "NotFound"
+	case ErrQueryResultEnd:
+		return "QueryResultEnd"
+	case ErrMoved:
+		return "MOVED"
+	case ErrAsk:
+		return "ASK"
+	case ErrDenied:
+		return "Denied"
+	case ErrTooLarge:
+		return "TooLarge"
+	default:
+		return "Others"
+	}
+}
+
 type RequestMessage struct {
 	Key    string
 	Value  []byte
 	Query  Query
 	Action Act
+	// Asking is set when the request follows an ASK redirection
+	Asking bool
+	// Token is the capability granting permissions to the peer, see config.IssueCapability
+	Token string
+	// Batch is the writes applied together by ActBatch, or the keys of ActGetMany and ActHasMany
+	Batch []BatchOp
+}
+
+// BatchOp is a put or delete of ActBatch, only Key is set for ActGetMany and ActHasMany
+type BatchOp struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// BatchResult is the result of the BatchOp with the same index, Redirect and Epoch
+// are set for ErrMoved and ErrAsk like ReplyMessage. Value and Exists answer ActGetMany and ActHasMany.
+type BatchResult struct {
+	Code     ErrCode
+	Msg      string
+	Redirect string
+	Epoch    uint64
+	Value    []byte
+	Exists   bool
 }
 
 type ReplyMessage struct {
@@ -55,6 +148,21 @@ type ReplyMessage struct {
 	Value  []byte
 	Size   int64
 	Exists bool
+	// Redirect is the id of the node the request should be sent to for ErrMoved and ErrAsk
+	Redirect string
+	// Epoch is the cluster layout epoch known by the node
+	Epoch uint64
+	// Batch is the results of the ops of ActBatch, or of the keys of ActGetMany and ActHasMany.
+	// The values replied to ActGetMany are bounded by MaxBatchBytes, so the results may answer
+	// only the first keys and the rest should be asked again.
+	Batch []BatchResult
+}
+
+// Chunk carries a part of a value streamed by ActPutStream and ActGetStream,
+// End is set on the last one
+type Chunk struct {
+	Data []byte
+	End  bool
 }
 
 type Query struct {
@@ -88,3 +196,17 @@ func P2PQuery(q dsq.Query) Query {
 		KeysOnly: q.KeysOnly,
 	}
 }
+
+// RequestFrame carries a request on the long-lived streams of PROTOCOL_V2,
+// ID is chosen by the client and unique among the requests in flight on the stream
+type RequestFrame struct {
+	ID      uint64
+	Request RequestMessage
+}
+
+// ReplyFrame carries the reply of the request with the same ID,
+// replies are sent as soon as the requests are done so they may be out of order
+type ReplyFrame struct {
+	ID    uint64
+	Reply ReplyMessage
+}
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	msmux "github.com/multiformats/go-multistream"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// maxMuxStreams bounds the long-lived streams a client keeps open to its data node
+	maxMuxStreams = 4
+	// muxStreamPending is the number of requests in flight on each stream before another
+	// stream is opened
+	muxStreamPending = 32
+)
+
+// errStreamClosed is returned for the requests in flight when their stream fails
+var errStreamClosed = xerrors.New("multiplexed stream closed")
+
+// errNotMultiplexed is returned by muxPool.call when the data node doesn't support PROTOCOL_V2
+var errNotMultiplexed = xerrors.New("multiplexed streams not supported")
+
+// muxPool keeps the long-lived PROTOCOL_V2 streams to a data node,
+// requests are pipelined on the least busy stream
+type muxPool struct {
+	src    host.Host
+	target peer.ID
+
+	lk      sync.Mutex
+	streams []*muxStream
+	nextID  uint64
+	// legacy is set if the data node only serves one request per stream
+	legacy bool
+	// dialing is closed once the stream being opened is ready, nil if no stream is being opened
+	dialing chan struct{}
+	closed  bool
+}
+
+func newMuxPool(src host.Host, target peer.ID) *muxPool {
+	return &muxPool{
+		src:    src,
+		target: target,
+	}
+}
+
+// call sends the request and waits for its reply, errNotMultiplexed is returned
+// if the data node doesn't speak PROTOCOL_V2
+func (p *muxPool) call(ctx context.Context, req *RequestMessage, reply *ReplyMessage) error {
+	ms, id, err := p.stream(ctx)
+	if err != nil {
+		return err
+	}
+	ch := ms.register(id)
+	defer ms.unregister(id)
+	if err := ms.write(&RequestFrame{ID: id, Request: *req}); err != nil {
+		ms.fail(err)
+		return err
+	}
+	timer := time.NewTimer(readDeadline)
+	defer timer.Stop()
+	select {
+	case frame, ok := <-ch:
+		if !ok {
+			return ms.error()
+		}
+		*reply = frame.Reply
+		return nil
+	case <-timer.C:
+		// the connection may be half-open, the requests left on the stream fail and the next ones
+		// get a new stream
+		err := xerrors.Errorf("%s: wait reply timeout", req.Action)
+		ms.fail(err)
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stream picks the stream for the next request and allocates the request id,
+// a new stream is opened if every stream is busy and the pool is not full.
+// Streams are opened one at a time without holding lk, requests wait for the stream
+// being opened only if there is no other stream.
+func (p *muxPool) stream(ctx context.Context) (*muxStream, uint64, error) {
+	p.lk.Lock()
+	for {
+		if p.closed {
+			p.lk.Unlock()
+			return nil, 0, errStreamClosed
+		}
+		if p.legacy {
+			p.lk.Unlock()
+			return nil, 0, errNotMultiplexed
+		}
+		best := p.leastBusy()
+		if best != nil && (best.inflight() < muxStreamPending || len(p.streams) >= maxMuxStreams || p.dialing != nil) {
+			return p.take(best)
+		}
+		if p.dialing != nil {
+			dialing := p.dialing
+			p.lk.Unlock()
+			select {
+			case <-dialing:
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+			p.lk.Lock()
+			continue
+		}
+		dialing := make(chan struct{})
+		p.dialing = dialing
+		p.lk.Unlock()
+		s, err := p.src.NewStream(ctx, p.target, PROTOCOL_V2)
+		p.lk.Lock()
+		p.dialing = nil
+		close(dialing)
+		switch {
+		case err != nil && xerrors.Is(err, msmux.ErrNotSupported):
+			p.legacy = true
+		case err != nil && best == nil:
+			p.lk.Unlock()
+			return nil, 0, err
+		case err != nil:
+			logging.Warnf("open stream to %s failed: %s", p.target, err)
+			return p.take(best)
+		case p.closed:
+			_ = s.Reset()
+		default:
+			ms := newMuxStream(s)
+			p.streams = append(p.streams, ms)
+			return p.take(ms)
+		}
+	}
+}
+
+// leastBusy drops the streams failed and returns the stream with the fewest requests in flight,
+// it should be called with lk held
+func (p *muxPool) leastBusy() *muxStream {
+	var best *muxStream
+	alive := p.streams[:0]
+	for _, ms := range p.streams {
+		if ms.error() != nil {
+			continue
+		}
+		alive = append(alive, ms)
+		if best == nil || ms.inflight() < best.inflight() {
+			best = ms
+		}
+	}
+	p.streams = alive
+	return best
+}
+
+// take allocates the request id on the stream and releases lk
+func (p *muxPool) take(ms *muxStream) (*muxStream, uint64, error) {
+	p.nextID++
+	id := p.nextID
+	p.lk.Unlock()
+	return ms, id, nil
+}
+
+// close resets the streams, requests in flight fail with errStreamClosed
+func (p *muxPool) close() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.closed = true
+	for _, ms := range p.streams {
+		ms.fail(errStreamClosed)
+	}
+	p.streams = nil
+}
+
+// muxStream dispatches the replies read from a long-lived stream to the requests waiting for them
+type muxStream struct {
+	s   network.Stream
+	wlk sync.Mutex
+
+	lk      sync.Mutex
+	pending map[uint64]chan *ReplyFrame
+	err     error
+}
+
+func newMuxStream(s network.Stream) *muxStream {
+	ms := &muxStream{
+		s:       s,
+		pending: make(map[uint64]chan *ReplyFrame),
+	}
+	go ms.readLoop()
+	return ms
+}
+
+func (ms *muxStream) readLoop() {
+	for {
+		frame := new(ReplyFrame)
+		if err := ReadFrame(ms.s, frame); err != nil {
+			ms.fail(err)
+			return
+		}
+		ms.lk.Lock()
+		ch, ok := ms.pending[frame.ID]
+		delete(ms.pending, frame.ID)
+		ms.lk.Unlock()
+		if ok {
+			ch <- frame
+		} else {
+			logging.Warnf("drop reply of unknown request %d", frame.ID)
+		}
+	}
+}
+
+func (ms *muxStream) write(frame *RequestFrame) error {
+	ms.wlk.Lock()
+	defer ms.wlk.Unlock()
+	return WriteRequestFrame(ms.s, frame)
+}
+
+func (ms *muxStream) register(id uint64) chan *ReplyFrame {
+	ch := make(chan *ReplyFrame, 1)
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	if ms.err != nil {
+		close(ch)
+		return ch
+	}
+	ms.pending[id] = ch
+	return ch
+}
+
+func (ms *muxStream) unregister(id uint64) {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	delete(ms.pending, id)
+}
+
+func (ms *muxStream) inflight() int {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	return len(ms.pending)
+}
+
+func (ms *muxStream) error() error {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	return ms.err
+}
+
+// fail marks the stream broken and wakes up the requests in flight
+func (ms *muxStream) fail(err error) {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	if ms.err != nil {
+		return
+	}
+	logging.Debugf("multiplexed stream to %s fails: %s", ms.s.Conn().RemotePeer(), err)
+	if err == errStreamClosed {
+		ms.err = err
+	} else {
+		ms.err = xerrors.Errorf("%w: %s", errStreamClosed, err)
+	}
+	for id, ch := range ms.pending {
+		close(ch)
+		delete(ms.pending, id)
+	}
+	_ = ms.s.Reset()
+}
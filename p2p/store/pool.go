@@ -26,6 +26,9 @@ func (req *RequestMessage) reset() {
 	req.Query.Limit = 0
 	req.Query.Offset = 0
 	req.Query.Prefix = ""
+	req.Asking = false
+	req.Token = ""
+	req.Batch = nil
 }
 
 func (rep *ReplyMessage) reset() {
@@ -34,4 +37,7 @@ func (rep *ReplyMessage) reset() {
 	rep.Value = rep.Value[:0]
 	rep.Size = 0
 	rep.Exists = false
+	rep.Redirect = ""
+	rep.Epoch = 0
+	rep.Batch = nil
 }
@@ -2,16 +2,30 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/filedrive-team/go-ds-cluster/config"
 	"github.com/filedrive-team/go-ds-cluster/core"
+	"github.com/filedrive-team/go-ds-cluster/shard"
 	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/xerrors"
 )
 
-const waitClose = 5
+// maxStreamRequests bounds the requests handled concurrently for each multiplexed stream,
+// the stream is not read further until one of them is replied
+const maxStreamRequests = 64
 
 type server struct {
 	ctx           context.Context
@@ -19,16 +33,138 @@ type server struct {
 	protocol      protocol.ID
 	ds            ds.Datastore
 	disableDelete bool
+	topology      *topology
+	// onTopology is called after a newer cluster layout has been applied
+	onTopology func(cc *config.ClusterConf)
+	// propose hands the pushed layouts to the metadata service, nil if layouts are applied directly
+	propose func(m *config.Manifest) error
+	// authorize checks the requests of peers, nil if every peer is allowed everything
+	authorize func(p peer.ID, act Act, token string) error
+	// adminKey verifies the layouts pushed by peers other than the nodes of the cluster
+	adminKey crypto.PubKey
+	// streamBytes bounds the bytes of streamed values held in memory by MaxStreamBytes
+	streamBytes *semaphore.Weighted
 }
 
-func NewStoreServer(ctx context.Context, h host.Host, pid protocol.ID, ds ds.Datastore, disableDelete bool) core.DataNodeServer {
-	return &server{
+// TopologyServer applies the cluster layout decided elsewhere, e.g. by the metadata service
+type TopologyServer interface {
+	UpdateTopology(cc *config.ClusterConf) error
+	// ApplyManifest applies the layout signed by the admin key if it's newer than current one,
+	// the signature of current layout is kept and handed out with it
+	ApplyManifest(m *config.Manifest) error
+}
+
+// ServerOption configures the store server
+type ServerOption func(sv *server) error
+
+// WithClusterConf sets the cluster layout the server starts with. Requests for keys of
+// slots owned by other nodes are redirected with ErrMoved.
+// Without a cluster layout the server serves every key until a layout is pushed to it.
+func WithClusterConf(cc *config.ClusterConf) ServerOption {
+	return func(sv *server) error {
+		return sv.topology.update(cc, nil)
+	}
+}
+
+// WithManifest is like WithClusterConf, the signature of the layout is handed out with it
+func WithManifest(m *config.Manifest) ServerOption {
+	return func(sv *server) error {
+		return sv.topology.update(m.Layout, m.Sig)
+	}
+}
+
+// OnTopologyUpdate registers a callback which is called with every newer cluster layout
+// pushed to the server, e.g. to persist the layout
+func OnTopologyUpdate(f func(cc *config.ClusterConf)) ServerOption {
+	return func(sv *server) error {
+		sv.onTopology = f
+		return nil
+	}
+}
+
+// WithTopologyProposer hands the manifests pushed by clients to f instead of applying them,
+// the layouts are expected to be applied by UpdateTopology once they are agreed by the cluster
+func WithTopologyProposer(f func(m *config.Manifest) error) ServerOption {
+	return func(sv *server) error {
+		sv.propose = f
+		return nil
+	}
+}
+
+// WithAuthorizer checks every request of the peer with f, token is the capability presented
+// with the request if any. The requests f refuses are replied ErrDenied with the error.
+func WithAuthorizer(f func(p peer.ID, act Act, token string) error) ServerOption {
+	return func(sv *server) error {
+		sv.authorize = f
+		return nil
+	}
+}
+
+// WithAdminKey only accepts the layouts pushed signed by the admin key, the nodes of the cluster included.
+// Without it only the layouts pushed by the nodes of the cluster are accepted.
+func WithAdminKey(pk crypto.PubKey) ServerOption {
+	return func(sv *server) error {
+		sv.adminKey = pk
+		return nil
+	}
+}
+
+// WithKeyHashFunc sets the function customizing the part of keys to be hashed,
+// it should be the same as the one used by clients
+func WithKeyHashFunc(f shard.KeyHashFunc) ServerOption {
+	return func(sv *server) error {
+		sv.topology.setKeyHashFunc(f)
+		return nil
+	}
+}
+
+func NewStoreServer(ctx context.Context, h host.Host, pid protocol.ID, ds ds.Datastore, disableDelete bool, opts ...ServerOption) core.DataNodeServer {
+	sv := &server{
 		ctx:           ctx,
 		host:          h,
 		protocol:      pid,
 		ds:            ds,
 		disableDelete: disableDelete,
+		topology:      newTopology(h.ID().Pretty()),
+		streamBytes:   semaphore.NewWeighted(MaxStreamBytes),
+	}
+	for _, opt := range opts {
+		if err := opt(sv); err != nil {
+			logging.Errorf("apply store server option failed: %s", err)
+		}
+	}
+	return sv
+}
+
+// UpdateTopology applies the layout if it's newer than current one
+func (sv *server) UpdateTopology(cc *config.ClusterConf) error {
+	return sv.updateTopology(cc, nil)
+}
+
+func (sv *server) ApplyManifest(m *config.Manifest) error {
+	if sv.adminKey != nil {
+		if err := m.Verify(sv.adminKey); err != nil {
+			return err
+		}
+	}
+	if m.Layout == nil {
+		return xerrors.New("cluster layout missing")
+	}
+	if m.Version == sv.topology.epoch() {
+		return sv.topology.sign(m)
+	}
+	return sv.updateTopology(m.Layout, m.Sig)
+}
+
+func (sv *server) updateTopology(cc *config.ClusterConf, sig []byte) error {
+	if err := sv.topology.update(cc, sig); err != nil {
+		return err
 	}
+	logging.Infof("cluster layout updated to epoch %d", cc.Epoch)
+	if sv.onTopology != nil {
+		sv.onTopology(cc)
+	}
+	return nil
 }
 
 func (sv *server) Close() error {
@@ -45,15 +181,12 @@ func (sv *server) Close() error {
 func (sv *server) Serve() {
 	logging.Info("data node server set stream handler")
 	sv.host.SetStreamHandler(sv.protocol, sv.handleStream)
+	sv.host.SetStreamHandler(PROTOCOL_V2, sv.handleMux)
 }
 
+// handleStream serves a single request on the stream, queries and streamed values are always served this way
 func (sv *server) handleStream(s network.Stream) {
-	defer func() {
-		logging.Info("waitClose start")
-		<-time.After(time.Second * waitClose)
-		logging.Info("waitClose end")
-		s.Close()
-	}()
+	defer s.Close()
 	logging.Info("serve incoming stream")
 	//reqMsg := new(RequestMessage)
 	reqMsg := reqMsgPool.Get().(*RequestMessage)
@@ -65,45 +198,136 @@ func (sv *server) handleStream(s network.Stream) {
 	}
 
 	logging.Infof("req action %v", reqMsg.Action)
+	res := replyMsgPool.Get().(*ReplyMessage)
+	res.reset()
+	defer replyMsgPool.Put(res)
 	switch reqMsg.Action {
+	case ActQuery:
+		sv.query(s, reqMsg)
+		return
+	case ActPutStream:
+		sv.putStream(s, reqMsg, res)
+		return
+	case ActGetStream:
+		sv.getStream(s, reqMsg, res)
+		return
+	}
+	sv.handle(s.Conn().RemotePeer(), reqMsg, res)
+	if err := WriteReplyMsg(s, res); err != nil {
+		logging.Errorf("sever %s write reply failed: %s", reqMsg.Action, err)
+	}
+}
+
+// handleMux serves the requests pipelined on a long-lived stream until the client closes it,
+// every request is handled concurrently and replied with its id as soon as it's done
+func (sv *server) handleMux(s network.Stream) {
+	defer s.Close()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var wlk sync.Mutex
+	sem := make(chan struct{}, maxStreamRequests)
+	p := s.Conn().RemotePeer()
+	for {
+		frame := new(RequestFrame)
+		if err := ReadFrame(s, frame); err != nil {
+			logging.Debugf("multiplexed stream of %s ends: %s", p, err)
+			return
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res := &ReplyFrame{ID: frame.ID}
+			sv.handle(p, &frame.Request, &res.Reply)
+			wlk.Lock()
+			defer wlk.Unlock()
+			if err := WriteReplyFrame(s, res); err != nil {
+				logging.Errorf("sever %s write reply failed: %s", frame.Request.Action, err)
+				_ = s.Reset()
+			}
+		}()
+	}
+}
+
+// admit checks the peer is allowed the request and the node serves its key,
+// res is set to the error replied otherwise
+func (sv *server) admit(p peer.ID, req *RequestMessage, res *ReplyMessage) bool {
+	if sv.authorize != nil {
+		err := sv.authorize(p, req.Action, req.Token)
+		if err == nil && req.Action == ActBatch && batchDeletes(req.Batch) {
+			err = sv.authorize(p, ActDelete, req.Token)
+		}
+		if err != nil && req.Action == ActSetTopology && sv.signedByAdmin(req) {
+			// layouts signed by the admin key are taken whatever the role of the peer
+			err = nil
+		}
+		if err != nil {
+			logging.Warnf("refuse %s from %s: %s", req.Action, p, err)
+			res.Code = ErrDenied
+			res.Msg = err.Error()
+			return false
+		}
+	}
+	switch req.Action {
+	case ActGet, ActGetSize, ActHas, ActPut, ActDelete, ActPutStream, ActGetStream:
+		if sv.redirect(req, res) {
+			return false
+		}
+	}
+	return true
+}
+
+// handle serves the requests having a single reply
+func (sv *server) handle(p peer.ID, req *RequestMessage, res *ReplyMessage) {
+	if !sv.admit(p, req, res) {
+		return
+	}
+	switch req.Action {
 	case ActGet:
-		sv.get(s, reqMsg)
+		sv.get(req, res)
 	case ActGetSize:
-		sv.getSize(s, reqMsg)
+		sv.getSize(req, res)
 	case ActHas:
-		sv.has(s, reqMsg)
+		sv.has(req, res)
 	case ActPut:
-		sv.put(s, reqMsg)
+		sv.put(req, res)
 	case ActDelete:
-		sv.delete(s, reqMsg)
+		sv.delete(req, res)
+	case ActGetTopology:
+		sv.getTopology(req, res)
+	case ActSetTopology:
+		sv.setTopology(p, req, res)
+	case ActBatch:
+		sv.batch(req, res)
+	case ActGetMany, ActHasMany:
+		sv.readMany(req, res)
 	case ActQuery:
-		sv.query(s, reqMsg)
+		res.Code = ErrOthers
+		res.Msg = "query is only served on a stream of its own"
 	default:
-		logging.Warnf("unhandled action: %v", reqMsg.Action)
+		logging.Warnf("unhandled action: %v", req.Action)
+		res.Code = ErrOthers
+		res.Msg = "unhandled action " + req.Action.String()
 	}
 }
 
-func (sv *server) put(s network.Stream, req *RequestMessage) {
+func (sv *server) put(req *RequestMessage, res *ReplyMessage) {
 	logging.Infof("put %s, value size: %d", req.Key, len(req.Value))
-	//res := &ReplyMessage{}
-	res := replyMsgPool.Get().(*ReplyMessage)
-	res.reset()
-	defer replyMsgPool.Put(res)
+	if len(req.Value) > MaxValueSize {
+		res.Code = ErrTooLarge
+		res.Msg = fmt.Sprintf("value of %s is %d bytes, larger than %d, put it with PutStream", req.Key, len(req.Value), MaxValueSize)
+		return
+	}
 	if err := sv.ds.Put(ds.NewKey(req.Key), req.Value); err != nil {
 		res.Code = ErrOthers
 		res.Msg = err.Error()
 	}
-	//res.Msg = "ok"
-	if err := WriteReplyMsg(s, res); err != nil {
-		logging.Errorf("sever put write reply failed: %s", err)
-	}
 }
 
-func (sv *server) has(s network.Stream, req *RequestMessage) {
-	//res := &ReplyMessage{}
-	res := replyMsgPool.Get().(*ReplyMessage)
-	res.reset()
-	defer replyMsgPool.Put(res)
+func (sv *server) has(req *RequestMessage, res *ReplyMessage) {
 	exists, err := sv.ds.Has(ds.NewKey(req.Key))
 	if err != nil {
 		if err == ds.ErrNotFound {
@@ -115,16 +339,9 @@ func (sv *server) has(s network.Stream, req *RequestMessage) {
 	} else {
 		res.Exists = exists
 	}
-	if err := WriteReplyMsg(s, res); err != nil {
-		logging.Errorf("sever has write reply failed: %s", err)
-	}
 }
 
-func (sv *server) getSize(s network.Stream, req *RequestMessage) {
-	//res := &ReplyMessage{}
-	res := replyMsgPool.Get().(*ReplyMessage)
-	res.reset()
-	defer replyMsgPool.Put(res)
+func (sv *server) getSize(req *RequestMessage, res *ReplyMessage) {
 	size, err := sv.ds.GetSize(ds.NewKey(req.Key))
 	if err != nil {
 		if err == ds.ErrNotFound {
@@ -136,16 +353,9 @@ func (sv *server) getSize(s network.Stream, req *RequestMessage) {
 	} else {
 		res.Size = int64(size)
 	}
-	if err := WriteReplyMsg(s, res); err != nil {
-		logging.Errorf("sever getSize write reply failed: %s", err)
-	}
 }
 
-func (sv *server) get(s network.Stream, req *RequestMessage) {
-	//res := &ReplyMessage{}
-	res := replyMsgPool.Get().(*ReplyMessage)
-	res.reset()
-	defer replyMsgPool.Put(res)
+func (sv *server) get(req *RequestMessage, res *ReplyMessage) {
 	v, err := sv.ds.Get(ds.NewKey(req.Key))
 	if err != nil {
 		if err == ds.ErrNotFound {
@@ -154,34 +364,293 @@ func (sv *server) get(s network.Stream, req *RequestMessage) {
 			res.Code = ErrOthers
 		}
 		res.Msg = err.Error()
+	} else if len(v) > MaxValueSize {
+		res.Code = ErrTooLarge
+		res.Msg = fmt.Sprintf("value of %s is %d bytes, larger than %d, get it with GetStream", req.Key, len(v), MaxValueSize)
 	} else {
 		res.Value = v
 	}
+}
+
+// putStream replies whether the value can be put, then reads it chunk by chunk to a temporary file
+// and puts it once the last chunk is read. The client aborts by resetting the stream.
+// Values larger than MaxStreamSize are replied ErrTooLarge.
+func (sv *server) putStream(s network.Stream, req *RequestMessage, res *ReplyMessage) {
+	var f *os.File
+	if sv.admit(s.Conn().RemotePeer(), req, res) {
+		var err error
+		if f, err = ioutil.TempFile("", "dscluster-stream-"); err != nil {
+			res.Code = ErrOthers
+			res.Msg = err.Error()
+		} else {
+			defer func() {
+				f.Close()
+				os.Remove(f.Name())
+			}()
+		}
+	}
+	if err := WriteReplyMsg(s, res); err != nil {
+		logging.Errorf("sever putStream write reply failed: %s", err)
+		return
+	}
+	if res.Code != ErrNone {
+		return
+	}
+	var size int64
+	for {
+		chunk := new(Chunk)
+		if err := ReadChunk(s, chunk); err != nil {
+			logging.Warnf("putStream %s read chunk failed: %s", req.Key, err)
+			return
+		}
+		size += int64(len(chunk.Data))
+		if size > MaxStreamSize {
+			logging.Warnf("putStream %s is larger than %d", req.Key, MaxStreamSize)
+			res.reset()
+			res.Code = ErrTooLarge
+			res.Msg = fmt.Sprintf("streamed value of %s is larger than %d", req.Key, MaxStreamSize)
+			if err := WriteReplyMsg(s, res); err != nil {
+				logging.Errorf("sever putStream write reply failed: %s", err)
+			}
+			return
+		}
+		if _, err := f.Write(chunk.Data); err != nil {
+			logging.Warnf("putStream %s spool chunk failed: %s", req.Key, err)
+			s.Reset()
+			return
+		}
+		if chunk.End {
+			break
+		}
+	}
+	logging.Infof("put %s, streamed value size: %d", req.Key, size)
+	res.reset()
+	if err := sv.putSpooled(req.Key, f, size); err != nil {
+		res.Code = ErrOthers
+		res.Msg = err.Error()
+	}
 	if err := WriteReplyMsg(s, res); err != nil {
-		logging.Errorf("sever get write reply failed: %s", err)
+		logging.Errorf("sever putStream write reply failed: %s", err)
 	}
 }
 
-func (sv *server) delete(s network.Stream, req *RequestMessage) {
-	//res := &ReplyMessage{}
-	res := replyMsgPool.Get().(*ReplyMessage)
-	res.reset()
-	defer replyMsgPool.Put(res)
+// reserveStream waits for size bytes of the streamed values budget, the returned func releases them
+func (sv *server) reserveStream(key string, size int64) (func(), error) {
+	if size > MaxStreamBytes {
+		size = MaxStreamBytes
+	}
+	ctx, cancel := context.WithTimeout(sv.ctx, readDeadline)
+	defer cancel()
+	start := time.Now()
+	if err := sv.streamBytes.Acquire(ctx, size); err != nil {
+		return nil, xerrors.Errorf("streamed value of %s waited %s for memory: %w", key, time.Since(start).Round(time.Millisecond), err)
+	}
+	return func() {
+		sv.streamBytes.Release(size)
+	}, nil
+}
+
+// putSpooled puts the value of size bytes spooled to f, once the bytes are reserved
+func (sv *server) putSpooled(key string, f *os.File, size int64) error {
+	release, err := sv.reserveStream(key, size)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	v := make([]byte, size)
+	if _, err := io.ReadFull(f, v); err != nil {
+		return err
+	}
+	return sv.ds.Put(ds.NewKey(key), v)
+}
+
+// getStream replies the size of the value, then sends it chunk by chunk.
+// Values larger than MaxStreamSize are replied ErrTooLarge without being loaded,
+// the others are loaded once their size is reserved.
+func (sv *server) getStream(s network.Stream, req *RequestMessage, res *ReplyMessage) {
+	var v []byte
+	if sv.admit(s.Conn().RemotePeer(), req, res) {
+		k := ds.NewKey(req.Key)
+		size, err := sv.ds.GetSize(k)
+		if err == nil && int64(size) > MaxStreamSize {
+			res.Code = ErrTooLarge
+			res.Msg = fmt.Sprintf("value of %s is %d bytes, larger than %d", req.Key, size, MaxStreamSize)
+		} else if err == nil {
+			var release func()
+			if release, err = sv.reserveStream(req.Key, int64(size)); err == nil {
+				defer release()
+				v, err = sv.ds.Get(k)
+			}
+		}
+		if err != nil {
+			if err == ds.ErrNotFound {
+				res.Code = ErrNotFound
+			} else {
+				res.Code = ErrOthers
+			}
+			res.Msg = err.Error()
+		} else if res.Code == ErrNone {
+			res.Size = int64(len(v))
+		}
+	}
+	if err := WriteReplyMsg(s, res); err != nil {
+		logging.Errorf("sever getStream write reply failed: %s", err)
+		return
+	}
+	if res.Code != ErrNone {
+		return
+	}
+	for off := 0; ; off += ChunkSize {
+		end := off + ChunkSize
+		if end > len(v) {
+			end = len(v)
+		}
+		if err := WriteChunk(s, &Chunk{Data: v[off:end], End: end == len(v)}); err != nil {
+			logging.Warnf("getStream %s write chunk failed: %s", req.Key, err)
+			return
+		}
+		if end == len(v) {
+			return
+		}
+	}
+}
+
+func (sv *server) delete(req *RequestMessage, res *ReplyMessage) {
 	if sv.disableDelete {
 		logging.Infof("delete operation disabled, ignore delete %s", req.Key)
-	} else {
-		err := sv.ds.Delete(ds.NewKey(req.Key))
-		if err != nil {
+		return
+	}
+	if err := sv.ds.Delete(ds.NewKey(req.Key)); err != nil {
+		res.Code = ErrOthers
+		res.Msg = err.Error()
+	}
+}
+
+// batch applies the ops of the keys served by the node together, through the batch of
+// the datastore if it supports one. Ops of keys served by other nodes are redirected one by one.
+func (sv *server) batch(req *RequestMessage, res *ReplyMessage) {
+	logging.Infof("batch of %d ops", len(req.Batch))
+	res.Batch = make([]BatchResult, len(req.Batch))
+	var b ds.Batch
+	if bds, ok := sv.ds.(ds.Batching); ok {
+		var err error
+		if b, err = bds.Batch(); err != nil {
 			res.Code = ErrOthers
 			res.Msg = err.Error()
+			return
 		}
+	} else {
+		b = ds.NewBasicBatch(sv.ds)
 	}
-	if err := WriteReplyMsg(s, res); err != nil {
-		logging.Errorf("sever delete write reply failed: %s", err)
+	applied := make([]int, 0, len(req.Batch))
+	for i, op := range req.Batch {
+		code, target, epoch := sv.topology.route(op.Key, req.Asking, func() bool {
+			has, err := sv.ds.Has(ds.NewKey(op.Key))
+			return err == nil && has
+		})
+		if code != ErrNone {
+			res.Batch[i] = BatchResult{
+				Code:     code,
+				Msg:      code.String() + " " + target,
+				Redirect: target,
+				Epoch:    epoch,
+			}
+			continue
+		}
+		var err error
+		if !op.Delete {
+			err = b.Put(ds.NewKey(op.Key), op.Value)
+		} else if sv.disableDelete {
+			logging.Infof("delete operation disabled, ignore delete %s", op.Key)
+			continue
+		} else {
+			err = b.Delete(ds.NewKey(op.Key))
+		}
+		if err != nil {
+			res.Batch[i] = BatchResult{Code: ErrOthers, Msg: err.Error()}
+			continue
+		}
+		applied = append(applied, i)
 	}
+	if err := b.Commit(); err != nil {
+		for _, i := range applied {
+			res.Batch[i] = BatchResult{Code: ErrOthers, Msg: err.Error()}
+		}
+	}
+}
+
+// readMany answers the keys in order until the values reach MaxBatchBytes,
+// keys served by other nodes are redirected one by one
+func (sv *server) readMany(req *RequestMessage, res *ReplyMessage) {
+	res.Batch = make([]BatchResult, 0, len(req.Batch))
+	size := 0
+	for _, op := range req.Batch {
+		if size >= MaxBatchBytes {
+			break
+		}
+		k := ds.NewKey(op.Key)
+		var r BatchResult
+		code, target, epoch := sv.topology.route(op.Key, req.Asking, func() bool {
+			has, err := sv.ds.Has(k)
+			return err == nil && has
+		})
+		if code != ErrNone {
+			r = BatchResult{
+				Code:     code,
+				Msg:      code.String() + " " + target,
+				Redirect: target,
+				Epoch:    epoch,
+			}
+		} else if req.Action == ActHasMany {
+			exists, err := sv.ds.Has(k)
+			if err != nil && err != ds.ErrNotFound {
+				r.Code = ErrOthers
+				r.Msg = err.Error()
+			}
+			r.Exists = exists
+		} else {
+			v, err := sv.ds.Get(k)
+			if err == nil && len(v) > MaxValueSize {
+				r.Code = ErrTooLarge
+				r.Msg = fmt.Sprintf("value of %s is %d bytes, larger than %d, get it with GetStream", op.Key, len(v), MaxValueSize)
+			} else if err == nil {
+				r.Value = v
+				r.Exists = true
+				size += len(v)
+			} else if err != ds.ErrNotFound {
+				r.Code = ErrOthers
+				r.Msg = err.Error()
+			}
+		}
+		res.Batch = append(res.Batch, r)
+	}
+}
+
+func batchDeletes(ops []BatchOp) bool {
+	for _, op := range ops {
+		if op.Delete {
+			return true
+		}
+	}
+	return false
 }
 
 func (sv *server) query(s network.Stream, req *RequestMessage) {
+	if sv.authorize != nil {
+		if err := sv.authorize(s.Conn().RemotePeer(), req.Action, req.Token); err != nil {
+			logging.Warnf("refuse %s from %s: %s", req.Action, s.Conn().RemotePeer(), err)
+			res := &QueryResultEntry{}
+			res.Code = ErrDenied
+			res.Msg = err.Error()
+			if err := WriteQueryResultEntry(s, res); err != nil {
+				logging.Error(err)
+			}
+			return
+		}
+	}
 	qresult, err := sv.ds.Query(DSQuery(req.Query))
 	if err != nil {
 		res := &QueryResultEntry{}
@@ -192,6 +661,7 @@ func (sv *server) query(s network.Stream, req *RequestMessage) {
 		}
 		return
 	}
+	defer qresult.Close()
 
 	for result := range qresult.Next() {
 		res := &QueryResultEntry{}
@@ -211,5 +681,95 @@ func (sv *server) query(s network.Stream, req *RequestMessage) {
 			return
 		}
 	}
+	if err := WriteQueryResultEntry(s, &QueryResultEntry{Code: ErrQueryResultEnd}); err != nil {
+		logging.Error(err)
+	}
+}
+
+// redirect replies ErrMoved or ErrAsk if the key should be served by another node,
+// returns true if the request has been replied
+func (sv *server) redirect(req *RequestMessage, res *ReplyMessage) bool {
+	code, target, epoch := sv.topology.route(req.Key, req.Asking, func() bool {
+		has, err := sv.ds.Has(ds.NewKey(req.Key))
+		return err == nil && has
+	})
+	if code == ErrNone {
+		return false
+	}
+	logging.Infof("%s %s %s, epoch %d", code, req.Key, target, epoch)
+	res.Code = code
+	res.Msg = code.String() + " " + target
+	res.Redirect = target
+	res.Epoch = epoch
+	return true
+}
+
+// getTopology replies current layout in a manifest, so its signature is handed out with it
+func (sv *server) getTopology(req *RequestMessage, res *ReplyMessage) {
+	if m := sv.topology.manifest(); m == nil {
+		res.Code = ErrNotFound
+		res.Msg = "cluster layout not found"
+	} else if b, err := json.Marshal(m); err != nil {
+		res.Code = ErrOthers
+		res.Msg = err.Error()
+	} else {
+		res.Value = b
+		res.Epoch = m.Version
+	}
+}
+
+func (sv *server) setTopology(p peer.ID, req *RequestMessage, res *ReplyMessage) {
+	m := new(config.Manifest)
+	err := json.Unmarshal(req.Value, m)
+	if err == nil && m.Layout == nil {
+		err = xerrors.New("cluster layout missing")
+	}
+	if err != nil {
+		res.Code = ErrOthers
+		res.Msg = err.Error()
+	} else if err := sv.checkLayout(p, m); err != nil {
+		logging.Warnf("refuse cluster layout epoch %d from %s: %s", m.Layout.Epoch, p, err)
+		res.Code = ErrDenied
+		res.Msg = err.Error()
+	} else if sv.propose != nil {
+		if err := sv.propose(m); err != nil {
+			res.Code = ErrOthers
+			res.Msg = err.Error()
+		}
+	} else if err := sv.applyPushed(m); err != nil {
+		res.Code = ErrOthers
+		res.Msg = err.Error()
+	}
+	res.Epoch = sv.topology.epoch()
+}
+
+func (sv *server) applyPushed(m *config.Manifest) error {
+	if sv.adminKey != nil {
+		return sv.ApplyManifest(m)
+	}
+	return sv.UpdateTopology(m.Layout)
+}
 
+// signedByAdmin tells whether the layout pushed is signed by the admin key
+func (sv *server) signedByAdmin(req *RequestMessage) bool {
+	if sv.adminKey == nil {
+		return false
+	}
+	m := new(config.Manifest)
+	if err := json.Unmarshal(req.Value, m); err != nil {
+		return false
+	}
+	return m.Verify(sv.adminKey) == nil
+}
+
+// checkLayout accepts the layout signed by the admin key if it's configured,
+// otherwise the layout pushed by a node of current layout
+func (sv *server) checkLayout(p peer.ID, m *config.Manifest) error {
+	if sv.adminKey != nil {
+		return m.Verify(sv.adminKey)
+	}
+	if sv.topology.isNode(p.Pretty()) {
+		return nil
+	}
+	return xerrors.Errorf("%s is not a node of the cluster", p)
 }
@@ -12,11 +12,31 @@ var logging = log.Logger("dscluster/p2p/store")
 
 const (
 	PROTOCOL_V1 = "/cluster/store/0.0.1"
+	// PROTOCOL_V2 keeps streams open and pipelines requests on them, see RequestFrame
+	PROTOCOL_V2 = "/cluster/store/0.0.2"
 )
 
 var readDeadline = time.Second * 20
 var writeDeadline = time.Second * 20
 
+const (
+	// MaxValueSize is the largest value carried by a single message, larger ones are streamed
+	// with ActPutStream and ActGetStream
+	MaxValueSize = 2 << 20
+	// ChunkSize is the size of the chunks of streamed values, each chunk is read and written
+	// under its own deadline
+	ChunkSize = 1 << 20
+)
+
+// MaxStreamSize bounds the values streamed, the data node spools a value put to a temporary file
+// until its last chunk and puts it to the datastore at once
+var MaxStreamSize int64 = 64 << 20
+
+// MaxStreamBytes bounds the bytes of the streamed values a data node holds in memory at once,
+// values put are loaded from their spool and values got from the datastore. It should not be
+// lower than MaxStreamSize. Streams waiting for their share longer than the read deadline fail.
+var MaxStreamBytes int64 = 256 << 20
+
 func ReadRequestMsg(s network.Stream, msg *RequestMessage) error {
 	if err := s.SetReadDeadline(time.Now().Add(readDeadline)); err != nil {
 		return err
@@ -88,3 +108,57 @@ func WriteQueryResultEntry(s network.Stream, msg *QueryResultEntry) error {
 	_ = s.SetWriteDeadline(time.Time{})
 	return nil
 }
+
+func WriteRequestFrame(s network.Stream, msg *RequestFrame) error {
+	if err := s.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.WriteCborRPC(s, msg); err != nil {
+		_ = s.SetWriteDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+func WriteReplyFrame(s network.Stream, msg *ReplyFrame) error {
+	if err := s.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.WriteCborRPC(s, msg); err != nil {
+		_ = s.SetWriteDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+// ReadFrame reads the next frame of a long-lived stream, there is no deadline as the stream
+// may stay idle between requests
+func ReadFrame(s network.Stream, msg interface{}) error {
+	return cborutil.ReadCborRPC(s, msg)
+}
+
+func ReadChunk(s network.Stream, msg *Chunk) error {
+	if err := s.SetReadDeadline(time.Now().Add(readDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.ReadCborRPC(s, msg); err != nil {
+		_ = s.SetReadDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetReadDeadline(time.Time{})
+	return nil
+}
+
+func WriteChunk(s network.Stream, msg *Chunk) error {
+	if err := s.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+		return err
+	}
+	if err := cborutil.WriteCborRPC(s, msg); err != nil {
+		_ = s.SetWriteDeadline(time.Time{})
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Time{})
+	return nil
+}
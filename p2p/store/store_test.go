@@ -3,13 +3,27 @@ package store
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/core"
 	"github.com/filedrive-team/go-ds-cluster/p2p"
+	"github.com/filedrive-team/go-ds-cluster/shard"
 	"github.com/filedrive-team/go-ds-cluster/utils"
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
 )
 
 type Pair struct {
@@ -131,6 +145,79 @@ func TestDisableDelete(t *testing.T) {
 
 }
 
+func TestAuthorizer(t *testing.T) {
+	reader, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+
+	ctx := context.Background()
+	memStore := ds.NewMapDatastore()
+	for _, d := range tdata {
+		if err := memStore.Put(ds.NewKey(d.K), d.V); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the reader may only read unless it presents the token, other peers nothing
+	server := NewStoreServer(ctx, h2, PROTOCOL_V1, memStore, false, WithAuthorizer(func(p peer.ID, act Act, token string) error {
+		if p == reader.ID() && (act.Perm() == config.PermRead || token == "let-me-write") {
+			return nil
+		}
+		return xerrors.New("not allowed")
+	}))
+	defer server.Close()
+	server.Serve()
+
+	client := NewStoreClient(ctx, reader, h2Info, PROTOCOL_V1)
+	defer client.Close()
+	v, err := client.Get(tdata[0].K)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, tdata[0].V) {
+		t.Fatal("retrived value not match")
+	}
+	if err := client.Put(tdata[0].K, []byte("changed")); !xerrors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected put refused, got %v", err)
+	}
+	if err := client.Delete(tdata[0].K); err == nil {
+		t.Fatal("expected delete refused")
+	}
+	if has, _ := memStore.Has(ds.NewKey(tdata[0].K)); !has {
+		t.Fatal("key should be kept")
+	}
+	writer := NewStoreClient(ctx, reader, h2Info, PROTOCOL_V1, WithCapability("let-me-write"))
+	if err := writer.Put(tdata[1].K, []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewStoreClient(ctx, stranger, h2Info, PROTOCOL_V1)
+	defer other.Close()
+	if _, err := other.Get(tdata[0].K); err == nil {
+		t.Fatal("expected get refused")
+	}
+	results, err := other.Query(dsq.Query{})
+	if err == nil {
+		_, err = results.Rest()
+	}
+	if !xerrors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected query refused, got %v", err)
+	}
+}
+
 func TestDataNode(t *testing.T) {
 	h1, err := p2p.MakeBasicHost(utils.RandPort())
 	if err != nil {
@@ -210,6 +297,165 @@ func TestDataNode(t *testing.T) {
 
 }
 
+func TestPipeline(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+
+	ctx := context.Background()
+	server := NewStoreServer(ctx, h2, PROTOCOL_V1, dssync.MutexWrap(ds.NewMapDatastore()), false)
+	defer server.Close()
+	server.Serve()
+
+	dn := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1)
+	defer dn.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 512)
+	for i := 0; i < 512; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k := fmt.Sprintf("/pipeline/%d", i)
+			v := []byte(fmt.Sprintf("value %d", i))
+			if err := dn.Put(k, v); err != nil {
+				errs <- err
+				return
+			}
+			got, err := dn.Get(k)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, v) {
+				errs <- fmt.Errorf("%s value not match: %s", k, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	pool := dn.(*client).mux
+	pool.lk.Lock()
+	n := len(pool.streams)
+	pool.lk.Unlock()
+	if n == 0 || n > maxMuxStreams {
+		t.Fatalf("expected at most %d streams, got %d", maxMuxStreams, n)
+	}
+}
+
+func TestMuxTimeout(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+	defer func(d time.Duration) { readDeadline = d }(readDeadline)
+	readDeadline = 300 * time.Millisecond
+
+	ctx := context.Background()
+	srv := NewStoreServer(ctx, h2, PROTOCOL_V1, ds.NewMapDatastore(), false)
+	defer srv.Close()
+	srv.Serve()
+	// the first stream never replies, like a half-open connection
+	var streams int32
+	h2.SetStreamHandler(PROTOCOL_V2, func(s network.Stream) {
+		if atomic.AddInt32(&streams, 1) == 1 {
+			_, _ = io.Copy(ioutil.Discard, s)
+			return
+		}
+		srv.(*server).handleMux(s)
+	})
+
+	dn := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1)
+	defer dn.Close()
+	if err := dn.Put(tdata[0].K, tdata[0].V); err == nil {
+		t.Fatal("expected timeout")
+	}
+	// the stream timed out is dropped
+	if err := dn.Put(tdata[0].K, tdata[0].V); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&streams); n != 2 {
+		t.Fatalf("expected 2 streams opened, got %d", n)
+	}
+}
+
+func TestLegacyStream(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+
+	ctx := context.Background()
+	server := NewStoreServer(ctx, h2, PROTOCOL_V1, ds.NewMapDatastore(), false)
+	defer server.Close()
+	server.Serve()
+	// a data node serving one request per stream only
+	h2.RemoveStreamHandler(PROTOCOL_V2)
+
+	dn := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1)
+	defer dn.Close()
+	for _, d := range tdata {
+		if err := dn.Put(d.K, d.V); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range tdata {
+		v, err := dn.Get(d.K)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, d.V) {
+			t.Fatalf("%s value not match", d.K)
+		}
+	}
+	if !dn.(*client).mux.legacy {
+		t.Fatal("expected client falls back to a stream per request")
+	}
+
+	// batches and reads of many keys are sent one by one
+	bc := dn.(BatchClient)
+	for _, err := range bc.Batch([]BatchOp{{Key: "/batch/a", Value: []byte("a")}, {Key: tdata[0].K, Delete: true}}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := dn.GetMany([]string{"/batch/a", tdata[0].K})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].Exists || !bytes.Equal(results[0].Value, []byte("a")) || results[1].Exists {
+		t.Fatalf("unexpected results %+v", results)
+	}
+}
+
 func TestDataNodeQuery(t *testing.T) {
 	h1, err := p2p.MakeBasicHost(utils.RandPort())
 	if err != nil {
@@ -271,3 +517,494 @@ func findEntry(k ds.Key, ents []dsq.Entry) (dsq.Entry, bool) {
 	}
 	return dsq.Entry{}, false
 }
+
+func TestStoreServerRedirect(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+	other := h1.ID().Pretty()
+	self := h2.ID().Pretty()
+	layout := func(epoch uint64, ranges ...shard.SlotsRange) *config.ClusterConf {
+		return &config.ClusterConf{
+			Nodes: []config.Node{
+				{Node: shard.Node{ID: other, Slots: ranges[0]}},
+				{Node: shard.Node{ID: self, Slots: ranges[1]}},
+			},
+			Epoch: epoch,
+		}
+	}
+
+	ctx := context.Background()
+	memStore := ds.NewMapDatastore()
+
+	var updated uint64
+	server := NewStoreServer(ctx, h2, PROTOCOL_V1, memStore, false,
+		WithClusterConf(layout(3, shard.SlotsRange{Start: 0, End: 8191}, shard.SlotsRange{Start: 8192, End: 16383})),
+		OnTopologyUpdate(func(cc *config.ClusterConf) {
+			updated = cc.Epoch
+		}),
+	)
+	defer server.Close()
+	server.Serve()
+
+	client := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1)
+	defer client.Close()
+	tc := client.(TopologyClient)
+
+	for _, d := range tdata {
+		err := client.Put(d.K, d.V)
+		slot := shard.CRC16Sum(d.K) & (shard.SLOTS_NUM - 1)
+		if slot >= 8192 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var re *RedirectError
+		if !xerrors.As(err, &re) {
+			t.Fatalf("expected redirect error for %s, got %v", d.K, err)
+		}
+		if re.Code != ErrMoved || re.Redirect != other || re.Epoch != 3 {
+			t.Fatalf("unexpected redirection: %v", re)
+		}
+	}
+
+	cc, err := tc.GetTopology()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Epoch != 3 {
+		t.Fatalf("expected epoch 3, got %d", cc.Epoch)
+	}
+	if err := tc.SetTopology(layout(3, shard.SlotsRange{Start: 0, End: 0}, shard.SlotsRange{Start: 1, End: 16383})); err == nil {
+		t.Fatal("should refuse layout with stale epoch")
+	}
+
+	// the node owns all the slots except slot 0 in the new layout
+	if err := tc.SetTopology(layout(4, shard.SlotsRange{Start: 0, End: 0}, shard.SlotsRange{Start: 1, End: 16383})); err != nil {
+		t.Fatal(err)
+	}
+	if updated != 4 {
+		t.Fatalf("layout update should be notified, got epoch %d", updated)
+	}
+	for _, d := range tdata {
+		if err := client.Put(d.K, d.V); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the slot of the first key is being migrated to the other node
+	k := tdata[0].K
+	migrating := layout(5, shard.SlotsRange{Start: 0, End: 0}, shard.SlotsRange{Start: 1, End: 16383})
+	migrating.Migrating = []shard.SlotMove{{Slot: shard.CRC16Sum(k) & (shard.SLOTS_NUM - 1), From: self, To: other}}
+	if err := tc.SetTopology(migrating); err != nil {
+		t.Fatal(err)
+	}
+	// served as long as the node keeps the key
+	if _, err := client.Get(k); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(k)
+	var re *RedirectError
+	if !xerrors.As(err, &re) || re.Code != ErrAsk || re.Redirect != other {
+		t.Fatalf("expected ASK redirection, got %v", err)
+	}
+	// the node is not importing the slot
+	if _, err := tc.Asking().Get(k); !xerrors.As(err, &re) || re.Code != ErrAsk {
+		t.Fatalf("expected ASK redirection, got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+	other := h1.ID().Pretty()
+	cc := &config.ClusterConf{
+		Nodes: []config.Node{
+			{Node: shard.Node{ID: other, Slots: shard.SlotsRange{Start: 0, End: 8191}}},
+			{Node: shard.Node{ID: h2.ID().Pretty(), Slots: shard.SlotsRange{Start: 8192, End: 16383}}},
+		},
+		Epoch: 1,
+	}
+
+	ctx := context.Background()
+	memStore := ds.NewMapDatastore()
+	server := NewStoreServer(ctx, h2, PROTOCOL_V1, memStore, false, WithClusterConf(cc))
+	defer server.Close()
+	server.Serve()
+
+	client := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1)
+	defer client.Close()
+	bc := client.(BatchClient)
+
+	ops := make([]BatchOp, 0, len(tdata))
+	for _, d := range tdata {
+		ops = append(ops, BatchOp{Key: d.K, Value: d.V})
+	}
+	for i, err := range bc.Batch(ops) {
+		slot := shard.CRC16Sum(ops[i].Key) & (shard.SLOTS_NUM - 1)
+		if slot >= 8192 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := memStore.Get(ds.NewKey(ops[i].Key))
+			if err != nil || !bytes.Equal(v, ops[i].Value) {
+				t.Fatalf("%s should be put: %v", ops[i].Key, err)
+			}
+			continue
+		}
+		var re *RedirectError
+		if !xerrors.As(err, &re) || re.Code != ErrMoved || re.Redirect != other {
+			t.Fatalf("expected redirect error for %s, got %v", ops[i].Key, err)
+		}
+		if has, _ := memStore.Has(ds.NewKey(ops[i].Key)); has {
+			t.Fatalf("%s should not be put", ops[i].Key)
+		}
+	}
+
+	for i := range ops {
+		ops[i] = BatchOp{Key: ops[i].Key, Delete: true}
+	}
+	for i, err := range bc.Batch(ops) {
+		var re *RedirectError
+		if err != nil && !xerrors.As(err, &re) {
+			t.Fatal(err)
+		}
+		if has, _ := memStore.Has(ds.NewKey(ops[i].Key)); has {
+			t.Fatalf("%s should be deleted", ops[i].Key)
+		}
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+	other := h1.ID().Pretty()
+	cc := &config.ClusterConf{
+		Nodes: []config.Node{
+			{Node: shard.Node{ID: other, Slots: shard.SlotsRange{Start: 0, End: 8191}}},
+			{Node: shard.Node{ID: h2.ID().Pretty(), Slots: shard.SlotsRange{Start: 8192, End: 16383}}},
+		},
+		Epoch: 1,
+	}
+
+	ctx := context.Background()
+	memStore := ds.NewMapDatastore()
+	server := NewStoreServer(ctx, h2, PROTOCOL_V1, memStore, false, WithClusterConf(cc))
+	defer server.Close()
+	server.Serve()
+
+	client := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1)
+	defer client.Close()
+
+	keys := []string{"/missing"}
+	for _, d := range tdata {
+		if err := memStore.Put(ds.NewKey(d.K), d.V); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, d.K)
+	}
+	// the values of a reply are bounded, the rest of the keys are asked again
+	defer func(max int) {
+		MaxBatchBytes = max
+	}(MaxBatchBytes)
+	MaxBatchBytes = 1
+
+	check := func(results []core.KeyResult, err error, get bool) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(keys) {
+			t.Fatalf("expected %d results, got %d", len(keys), len(results))
+		}
+		for i, r := range results {
+			if r.Key != keys[i] {
+				t.Fatalf("expected result of %s, got %s", keys[i], r.Key)
+			}
+			slot := shard.CRC16Sum(r.Key) & (shard.SLOTS_NUM - 1)
+			if slot < 8192 {
+				var re *RedirectError
+				if !xerrors.As(r.Err, &re) || re.Code != ErrMoved || re.Redirect != other {
+					t.Fatalf("expected redirect error for %s, got %v", r.Key, r.Err)
+				}
+				continue
+			}
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+			if i == 0 {
+				if r.Exists {
+					t.Fatalf("%s should be missing", r.Key)
+				}
+				continue
+			}
+			if !r.Exists {
+				t.Fatalf("should have %s", r.Key)
+			}
+			if get && !bytes.Equal(r.Value, tdata[i-1].V) {
+				t.Fatalf("%s value not match", r.Key)
+			}
+		}
+	}
+	results, err := client.GetMany(keys)
+	check(results, err, true)
+	results, err = client.HasMany(keys)
+	check(results, err, false)
+}
+
+func TestStream(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+
+	ctx := context.Background()
+	memStore := ds.NewMapDatastore()
+	srv := NewStoreServer(ctx, h2, PROTOCOL_V1, memStore, false)
+	defer srv.Close()
+	srv.Serve()
+
+	dn := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1)
+	defer dn.Close()
+	sc := dn.(StreamClient)
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), (MaxValueSize+ChunkSize/2)/16)
+	if err := dn.Put("/large", large); !xerrors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected too large error, got %v", err)
+	}
+	if err := sc.PutStream("/large", bytes.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.PutStream("/empty", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	v, err := memStore.Get(ds.NewKey("/large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, large) {
+		t.Fatal("streamed value not match")
+	}
+
+	if _, err := dn.Get("/large"); !xerrors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected too large error, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := sc.GetStream("/large", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), large) {
+		t.Fatal("streamed value not match")
+	}
+	buf.Reset()
+	if err := sc.GetStream("/empty", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatal("expected empty value")
+	}
+	if err := sc.GetStream("/missing", &buf); err != ds.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	// an aborted value is not put
+	w, err := sc.PutWriter("/aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(large[:ChunkSize+1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := dn.Has("/aborted"); err != nil || has {
+		t.Fatalf("expected aborted value not put, got %v %v", has, err)
+	}
+
+	// streams wait for the memory held by other streams
+	func() {
+		defer func(d time.Duration) { readDeadline = d }(readDeadline)
+		readDeadline = 300 * time.Millisecond
+		budget := srv.(*server).streamBytes
+		if err := budget.Acquire(ctx, MaxStreamBytes); err != nil {
+			t.Fatal(err)
+		}
+		if err := sc.PutStream("/waiting", bytes.NewReader(large)); err == nil {
+			t.Fatal("expected put failed while the memory is held")
+		}
+		if err := sc.GetStream("/large", &buf); err == nil {
+			t.Fatal("expected get failed while the memory is held")
+		}
+		budget.Release(MaxStreamBytes)
+		if err := sc.PutStream("/waiting", bytes.NewReader(large)); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// values larger than MaxStreamSize are refused both ways
+	defer func(size int64) { MaxStreamSize = size }(MaxStreamSize)
+	MaxStreamSize = int64(len(large) - 1)
+	if err := sc.PutStream("/huge", bytes.NewReader(large)); !xerrors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected too large error, got %v", err)
+	}
+	if err := sc.GetStream("/large", &buf); !xerrors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected too large error, got %v", err)
+	}
+	// the data node stops reading once the limit is passed
+	s, err := h1.NewStream(ctx, h2.ID(), PROTOCOL_V1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := WriteRequstMsg(s, &RequestMessage{Key: "/huge", Action: ActPutStream}); err != nil {
+		t.Fatal(err)
+	}
+	reply := &ReplyMessage{}
+	if err := ReadReplyMsg(s, reply); err != nil || reply.Code != ErrNone {
+		t.Fatalf("expected stream accepted, got %v %v", reply.Code, err)
+	}
+	for off := 0; off < len(large); off += ChunkSize {
+		end := off + ChunkSize
+		if end > len(large) {
+			end = len(large)
+		}
+		if err := WriteChunk(s, &Chunk{Data: large[off:end], End: end == len(large)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ReadReplyMsg(s, reply); err != nil || reply.Code != ErrTooLarge {
+		t.Fatalf("expected too large reply, got %v %v", reply.Code, err)
+	}
+	if has, err := dn.Has("/huge"); err != nil || has {
+		t.Fatalf("expected value too large not put, got %v %v", has, err)
+	}
+}
+
+func TestSetTopologyRefused(t *testing.T) {
+	h1, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := p2p.MakeBasicHost(utils.RandPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2Info := peer.AddrInfo{
+		ID:    h2.ID(),
+		Addrs: h2.Addrs(),
+	}
+	sk, pk, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := crypto.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := func(epoch uint64) *config.ClusterConf {
+		return &config.ClusterConf{
+			Nodes: []config.Node{
+				{Node: shard.Node{ID: h2.ID().Pretty(), Slots: shard.SlotsRange{Start: 0, End: 16383}}},
+			},
+			Epoch: epoch,
+		}
+	}
+
+	ctx := context.Background()
+	// the client isn't granted to publish layouts, those signed by the admin key are taken anyway
+	deny := WithAuthorizer(func(p peer.ID, act Act, token string) error {
+		if act == ActSetTopology {
+			return xerrors.Errorf("%s needs the %q permission", act, act.Perm())
+		}
+		return nil
+	})
+	server := NewStoreServer(ctx, h2, PROTOCOL_V1, ds.NewMapDatastore(), false, WithClusterConf(layout(1)), WithAdminKey(pk), deny)
+	defer server.Close()
+	server.Serve()
+
+	// the client is not a node of the cluster
+	client := NewStoreClient(ctx, h1, h2Info, PROTOCOL_V1)
+	defer client.Close()
+	tc := client.(TopologyClient)
+	if err := tc.SetTopology(layout(2)); !xerrors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected unsigned layout refused, got %v", err)
+	}
+	forged, err := config.SignManifest(other, layout(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetManifest(forged); !xerrors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected layout signed by another key refused, got %v", err)
+	}
+	m, err := config.SignManifest(sk, layout(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	cc, err := tc.GetTopology()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Epoch != 2 {
+		t.Fatalf("expected epoch 2, got %d", cc.Epoch)
+	}
+	// the signature is handed out with the layout
+	got, err := tc.GetManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Verify(pk); err != nil {
+		t.Fatal(err)
+	}
+	// older layouts are refused even if signed
+	old, err := config.SignManifest(sk, layout(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetManifest(old); err == nil {
+		t.Fatal("expected older layout refused")
+	}
+}
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/filedrive-team/go-ds-cluster/config"
+	"github.com/filedrive-team/go-ds-cluster/shard"
+	"golang.org/x/xerrors"
+)
+
+// topology is the cluster layout known by a data node, it decides whether
+// a request for a key should be served by the node or redirected
+type topology struct {
+	lk   sync.RWMutex
+	self string
+	cc   *config.ClusterConf
+	// sig is the admin key signature of cc, nil if the layout isn't signed
+	sig     []byte
+	sm      *shard.SlotsManager
+	keyHash shard.KeyHashFunc
+	// migrating slots of the layout, a slot may be handed over by several replicas
+	migrating map[uint16][]shard.SlotMove
+}
+
+func newTopology(self string) *topology {
+	return &topology{
+		self:      self,
+		migrating: make(map[uint16][]shard.SlotMove),
+	}
+}
+
+// epoch returns the epoch of current layout
+func (t *topology) epoch() uint64 {
+	t.lk.RLock()
+	defer t.lk.RUnlock()
+	if t.cc == nil {
+		return 0
+	}
+	return t.cc.Epoch
+}
+
+// manifest returns current layout with its signature, nil if the node knows nothing about the cluster
+func (t *topology) manifest() *config.Manifest {
+	t.lk.RLock()
+	defer t.lk.RUnlock()
+	if t.cc == nil {
+		return nil
+	}
+	return &config.Manifest{Version: t.cc.Epoch, Layout: t.cc, Sig: t.sig}
+}
+
+// sign keeps the signature of current layout, the layout of m should be the same as current one
+func (t *topology) sign(m *config.Manifest) error {
+	b, err := json.Marshal(m.Layout)
+	if err != nil {
+		return err
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.cc == nil || t.cc.Epoch != m.Version {
+		return xerrors.Errorf("cluster layout epoch %d is not the current one", m.Version)
+	}
+	cur, err := json.Marshal(t.cc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, cur) {
+		return xerrors.Errorf("cluster layout epoch %d differs from the current one", m.Version)
+	}
+	t.sig = m.Sig
+	return nil
+}
+
+// update applies the layout if it's newer than current one, sig is the signature of the layout
+// by the admin key, nil if it's unsigned.
+// The layout with the same epoch is accepted only when the node has no layout.
+func (t *topology) update(cc *config.ClusterConf, sig []byte) error {
+	nds := make([]shard.Node, 0, len(cc.Nodes))
+	for _, nd := range cc.Nodes {
+		nds = append(nds, nd.Node)
+	}
+	sm, err := shard.RestoreSlotsManager(nds)
+	if err != nil {
+		return err
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.cc != nil && cc.Epoch <= t.cc.Epoch {
+		return xerrors.Errorf("stale cluster layout epoch %d, current epoch %d", cc.Epoch, t.cc.Epoch)
+	}
+	sm.SetReplication(cc.Replication)
+	switch {
+	case t.keyHash != nil:
+		sm.SetKeyHashFunc(t.keyHash)
+	case cc.HashTag:
+		sm.SetKeyHashFunc(shard.HashTagKey)
+	}
+	migrating := make(map[uint16][]shard.SlotMove)
+	for _, mv := range cc.Migrating {
+		migrating[mv.Slot] = append(migrating[mv.Slot], mv)
+	}
+	t.cc = cc
+	t.sig = sig
+	t.sm = sm
+	t.migrating = migrating
+	return nil
+}
+
+// isNode tells whether the peer is one of the nodes of current layout, nodes pending to join excluded
+func (t *topology) isNode(id string) bool {
+	t.lk.RLock()
+	defer t.lk.RUnlock()
+	if t.cc == nil {
+		return false
+	}
+	for _, nd := range t.cc.Nodes {
+		if nd.ID == id && !nd.Pending {
+			return true
+		}
+	}
+	return false
+}
+
+// setKeyHashFunc overrides the hash function given by the layout
+func (t *topology) setKeyHashFunc(f shard.KeyHashFunc) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.keyHash = f
+	if t.sm != nil {
+		t.sm.SetKeyHashFunc(f)
+	}
+}
+
+// route decides which node should serve the key, ErrNone means the node itself.
+// A node serves the keys of slots it keeps as the primary or a replica.
+// has reports whether the key is kept by the node, it's only called for migrating slots.
+// Requests are always served before the node knows the cluster layout.
+func (t *topology) route(key string, asking bool, has func() bool) (code ErrCode, redirect string, epoch uint64) {
+	t.lk.RLock()
+	defer t.lk.RUnlock()
+	if t.sm == nil {
+		return ErrNone, "", 0
+	}
+	epoch = t.cc.Epoch
+	slot := t.sm.SlotByKey(key)
+	replicas, err := t.sm.ReplicasBySlot(slot)
+	if err != nil {
+		return ErrNone, "", epoch
+	}
+	for _, nd := range replicas {
+		if nd.ID != t.self {
+			continue
+		}
+		for _, mv := range t.migrating[slot] {
+			if mv.From == t.self && !mv.Copy && !has() {
+				return ErrAsk, mv.To, epoch
+			}
+		}
+		return ErrNone, "", epoch
+	}
+	if asking {
+		for _, mv := range t.migrating[slot] {
+			if mv.To == t.self {
+				return ErrNone, "", epoch
+			}
+		}
+	}
+	return ErrMoved, replicas[0].ID, epoch
+}
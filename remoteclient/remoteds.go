@@ -2,6 +2,7 @@ package remoteclient
 
 import (
 	context "context"
+	"sync"
 
 	"github.com/filedrive-team/go-ds-cluster/core"
 	"github.com/filedrive-team/go-ds-cluster/p2p/remoteds"
@@ -83,25 +84,53 @@ func (d *RemoteStore) Query(q dsq.Query) (dsq.Results, error) {
 	return d.node.Query(q)
 }
 
+// batch buffers the writes until Commit, they are sent in ActBatch requests
+// if the data node supports them
 type batch struct {
-	s ds.Datastore
+	d   *RemoteStore
+	lk  sync.Mutex
+	ops []remoteds.BatchOp
 }
 
 func (d *RemoteStore) Batch() (ds.Batch, error) {
 	return &batch{
-		s: d,
+		d: d,
 	}, nil
 }
 
 func (b *batch) Put(key ds.Key, value []byte) error {
-	return b.s.Put(key, value)
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.ops = append(b.ops, remoteds.BatchOp{Key: key.String(), Value: value})
+	return nil
 }
 
 func (b *batch) Delete(key ds.Key) error {
-	return b.s.Delete(key)
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.ops = append(b.ops, remoteds.BatchOp{Key: key.String(), Delete: true})
+	return nil
 }
 
 func (b *batch) Commit() error {
+	b.lk.Lock()
+	ops := b.ops
+	b.ops = nil
+	b.lk.Unlock()
+	if bc, ok := b.d.node.(remoteds.BatchClient); ok {
+		return bc.Batch(ops)
+	}
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = b.d.node.Delete(op.Key)
+		} else {
+			err = b.d.node.Put(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,393 @@
+package shard
+
+import (
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// SlotMove describes a slot which should be handed over from one node to another
+type SlotMove struct {
+	Slot uint16 `json:"slot"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Copy means From keeps the slot as well, the slot is copied to To
+	Copy bool `json:"copy,omitempty"`
+}
+
+// Clone returns a deep copy of the SlotsManager
+func (sm *SlotsManager) Clone() *SlotsManager {
+	nodes := make([]Node, len(sm.nodes))
+	for i, nd := range sm.nodes {
+		nodes[i] = nd
+		if len(nd.Ranges) > 0 {
+			nodes[i].Ranges = make([]SlotsRange, len(nd.Ranges))
+			copy(nodes[i].Ranges, nd.Ranges)
+		}
+	}
+	table := make([]int, len(sm.table))
+	copy(table, sm.table)
+	cp := newSlotsManager(nodes, table)
+	for id, w := range sm.pendingWeights {
+		cp.SetWeight(id, w)
+	}
+	cp.keyHash = sm.keyHash
+	cp.replication = sm.replication
+	return cp
+}
+
+// SetWeight updates weight of node id, the weight of a node not in the cluster yet
+// will be applied once it's assigned slots
+func (sm *SlotsManager) SetWeight(id string, weight int) {
+	if idx := sm.indexOf(id); idx != -1 {
+		sm.nodes[idx].Weight = weight
+		sm.nodeMap[idx] = sm.nodes[idx]
+		return
+	}
+	if sm.pendingWeights == nil {
+		sm.pendingWeights = make(map[string]int)
+	}
+	sm.pendingWeights[id] = weight
+}
+
+// ForgetWeight drops the weight kept for node id which hasn't joined the cluster
+func (sm *SlotsManager) ForgetWeight(id string) {
+	delete(sm.pendingWeights, id)
+}
+
+// SlotsOf returns all the slots owned by node id in ascending order
+func (sm *SlotsManager) SlotsOf(id string) []uint16 {
+	idx := sm.indexOf(id)
+	res := make([]uint16, 0)
+	if idx == -1 {
+		return res
+	}
+	for slot, owner := range sm.table {
+		if owner == idx {
+			res = append(res, uint16(slot))
+		}
+	}
+	return res
+}
+
+// Assign hands over the slot to node id, the node will be added to
+// the cluster if it's not one of the nodes yet.
+// Node which owns no slot any more will be removed.
+func (sm *SlotsManager) Assign(slot uint16, id string) error {
+	if slot >= SLOTS_NUM {
+		return xerrors.Errorf("slot %d out of range", slot)
+	}
+	if id == "" {
+		return xerrors.New("can not assign slot to node with empty id")
+	}
+	idx := sm.indexOf(id)
+	if idx == -1 {
+		sm.nodes = append(sm.nodes, Node{ID: id, Weight: sm.pendingWeights[id]})
+		delete(sm.pendingWeights, id)
+		idx = len(sm.nodes) - 1
+	}
+	sm.table[slot] = idx
+	sm.rebuild()
+	return nil
+}
+
+// PlanAddNode figures out which slots should be moved to the new node.
+// Every existing node gives up its surplus slots over its weighted share of the
+// enlarged cluster, so that no more slots than necessary are moved.
+func (sm *SlotsManager) PlanAddNode(newNode Node) ([]SlotMove, error) {
+	id := newNode.ID
+	if sm.indexOf(id) != -1 {
+		return nil, xerrors.Errorf("node %s already in the cluster", id)
+	}
+	counts := append(sm.slotsCount(), 0)
+	weights := append(sm.weights(), newNode.SlotsWeight())
+	targets := weightedTargets(weights, counts)
+
+	moves := make([]SlotMove, 0)
+	for i, nd := range sm.nodes {
+		surplus := counts[i] - targets[i]
+		if surplus <= 0 {
+			continue
+		}
+		slots := sm.SlotsOf(nd.ID)
+		// hand over the tail of slots, keep the ranges of the node compact
+		for _, slot := range slots[len(slots)-surplus:] {
+			moves = append(moves, SlotMove{
+				Slot: slot,
+				From: nd.ID,
+				To:   id,
+			})
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].Slot < moves[j].Slot
+	})
+	return moves, nil
+}
+
+// PlanMoveSlots figures out the moves to hand over slots from start to end
+// to node id which should already be in the cluster, e.g. to move hot slots manually
+func (sm *SlotsManager) PlanMoveSlots(start, end uint16, id string) ([]SlotMove, error) {
+	if start > end || end >= SLOTS_NUM {
+		return nil, xerrors.Errorf("invalid slots range %d-%d", start, end)
+	}
+	to := sm.indexOf(id)
+	if to == -1 {
+		return nil, xerrors.Errorf("node %s not in the cluster", id)
+	}
+	moves := make([]SlotMove, 0)
+	for slot := int(start); slot <= int(end); slot++ {
+		from := sm.table[slot]
+		if from == to {
+			continue
+		}
+		moves = append(moves, SlotMove{
+			Slot: uint16(slot),
+			From: sm.nodes[from].ID,
+			To:   id,
+		})
+	}
+	return moves, nil
+}
+
+// PlanRebalance figures out the moves to make every node own its weighted share of slots,
+// nodes owning surplus slots hand over the tail of their slots to nodes lacking slots
+func (sm *SlotsManager) PlanRebalance() []SlotMove {
+	counts := sm.slotsCount()
+	targets := weightedTargets(sm.weights(), counts)
+
+	giving := make([]uint16, 0)
+	givers := make([]string, 0)
+	for i, nd := range sm.nodes {
+		surplus := counts[i] - targets[i]
+		if surplus <= 0 {
+			continue
+		}
+		slots := sm.SlotsOf(nd.ID)
+		for _, slot := range slots[len(slots)-surplus:] {
+			giving = append(giving, slot)
+			givers = append(givers, nd.ID)
+		}
+	}
+
+	moves := make([]SlotMove, 0, len(giving))
+	r := 0
+	for i, slot := range giving {
+		for r < len(sm.nodes) && counts[r] >= targets[r] {
+			r++
+		}
+		if r == len(sm.nodes) {
+			break
+		}
+		counts[r]++
+		moves = append(moves, SlotMove{
+			Slot: slot,
+			From: givers[i],
+			To:   sm.nodes[r].ID,
+		})
+	}
+	return moves
+}
+
+// weightedTargets decides how many slots each node should own according to weights.
+// Slots left over by rounding go to nodes with the largest fractional share,
+// ties are broken by nodes owning more slots currently to reduce moves.
+func weightedTargets(weights []int, counts []int) []int {
+	var total int
+	for _, w := range weights {
+		total += w
+	}
+	targets := make([]int, len(weights))
+	fracs := make([]int, len(weights))
+	allocated := 0
+	for i, w := range weights {
+		targets[i] = SLOTS_NUM * w / total
+		fracs[i] = SLOTS_NUM * w % total
+		allocated += targets[i]
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if fracs[order[i]] != fracs[order[j]] {
+			return fracs[order[i]] > fracs[order[j]]
+		}
+		return counts[order[i]] > counts[order[j]]
+	})
+	for n := 0; n < SLOTS_NUM-allocated; n++ {
+		targets[order[n]]++
+	}
+	return targets
+}
+
+func (sm *SlotsManager) weights() []int {
+	weights := make([]int, len(sm.nodes))
+	for i, nd := range sm.nodes {
+		weights[i] = nd.SlotsWeight()
+	}
+	return weights
+}
+
+func (sm *SlotsManager) slotsCount() []int {
+	counts := make([]int, len(sm.nodes))
+	for _, idx := range sm.table {
+		counts[idx]++
+	}
+	return counts
+}
+
+func (sm *SlotsManager) indexOf(id string) int {
+	for i, nd := range sm.nodes {
+		if nd.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// rebuild refreshes slot ranges of nodes according to the table,
+// drops nodes which own no slot
+func (sm *SlotsManager) rebuild() {
+	ranges := make([][]SlotsRange, len(sm.nodes))
+	for slot, idx := range sm.table {
+		rs := ranges[idx]
+		if n := len(rs); n > 0 && int(rs[n-1].End)+1 == slot {
+			rs[n-1].End = uint16(slot)
+		} else {
+			rs = append(rs, SlotsRange{Start: uint16(slot), End: uint16(slot)})
+		}
+		ranges[idx] = rs
+	}
+	nodes := make([]Node, 0, len(sm.nodes))
+	reindex := make([]int, len(sm.nodes))
+	for i, nd := range sm.nodes {
+		if len(ranges[i]) == 0 {
+			reindex[i] = -1
+			continue
+		}
+		nd.Slots = ranges[i][0]
+		nd.Ranges = nil
+		if len(ranges[i]) > 1 {
+			nd.Ranges = ranges[i]
+		}
+		reindex[i] = len(nodes)
+		nodes = append(nodes, nd)
+	}
+	for slot, idx := range sm.table {
+		sm.table[slot] = reindex[idx]
+	}
+	pending, keyHash, replication := sm.pendingWeights, sm.keyHash, sm.replication
+	*sm = *newSlotsManager(nodes, sm.table)
+	sm.pendingWeights = pending
+	sm.keyHash = keyHash
+	sm.replication = replication
+}
+
+// ReplicaMoves figures out how the replica sets of slots change once the primary moves are done.
+// Every node leaving the replica set of a slot hands over the slot to a node joining the set,
+// a node joining without counterpart copies the slot from the primary.
+// Without replication the result is the same as the primary moves.
+func (sm *SlotsManager) ReplicaMoves(moves []SlotMove) ([]SlotMove, error) {
+	after := sm.Clone()
+	for _, mv := range moves {
+		if err := after.Assign(mv.Slot, mv.To); err != nil {
+			return nil, err
+		}
+	}
+	res := make([]SlotMove, 0, len(moves))
+	for slot := 0; slot < SLOTS_NUM; slot++ {
+		before, err := sm.ReplicasBySlot(uint16(slot))
+		if err != nil {
+			return nil, err
+		}
+		now, err := after.ReplicasBySlot(uint16(slot))
+		if err != nil {
+			return nil, err
+		}
+		leaving := nodesDiff(before, now)
+		joining := nodesDiff(now, before)
+		for i, to := range joining {
+			mv := SlotMove{
+				Slot: uint16(slot),
+				To:   to,
+			}
+			if i < len(leaving) {
+				mv.From = leaving[i]
+			} else {
+				mv.From = before[0].ID
+				mv.Copy = true
+			}
+			res = append(res, mv)
+		}
+	}
+	return res, nil
+}
+
+// nodesDiff returns ids of nodes in a but not in b
+func nodesDiff(a, b []Node) []string {
+	res := make([]string, 0)
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x.ID == y.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, x.ID)
+		}
+	}
+	return res
+}
+
+// PlanRemoveNode figures out how to hand over all the slots of node id
+// to the remaining nodes. Each remaining node receives a contiguous run of
+// the slots, as many as it needs to reach its weighted share of the shrunk cluster.
+func (sm *SlotsManager) PlanRemoveNode(id string) ([]SlotMove, error) {
+	leaving := sm.indexOf(id)
+	if leaving == -1 {
+		return nil, xerrors.Errorf("node %s not in the cluster", id)
+	}
+	if len(sm.nodes) == 1 {
+		return nil, xerrors.Errorf("can not remove the last node %s", id)
+	}
+	counts := sm.slotsCount()
+	remaining := make([]int, 0, len(sm.nodes)-1)
+	remainCounts := make([]int, 0, len(sm.nodes)-1)
+	remainWeights := make([]int, 0, len(sm.nodes)-1)
+	for i, nd := range sm.nodes {
+		if i != leaving {
+			remaining = append(remaining, i)
+			remainCounts = append(remainCounts, counts[i])
+			remainWeights = append(remainWeights, nd.SlotsWeight())
+		}
+	}
+	targets := weightedTargets(remainWeights, remainCounts)
+
+	moves := make([]SlotMove, 0, counts[leaving])
+	r := 0
+	for _, slot := range sm.SlotsOf(id) {
+		for r < len(remaining) && remainCounts[r] >= targets[r] {
+			r++
+		}
+		recv := r
+		if recv == len(remaining) {
+			// all the remaining nodes reached their share, give it to the one owning fewest slots
+			recv = 0
+			for i := range remaining {
+				if remainCounts[i] < remainCounts[recv] {
+					recv = i
+				}
+			}
+		}
+		remainCounts[recv]++
+		moves = append(moves, SlotMove{
+			Slot: slot,
+			From: id,
+			To:   sm.nodes[remaining[recv]].ID,
+		})
+	}
+	return moves, nil
+}
@@ -0,0 +1,298 @@
+package shard
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanAddNode(t *testing.T) {
+	sm := InitSlotManager(nodeFactory(3))
+
+	moves, err := sm.PlanAddNode(Node{ID: "node-003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != SLOTS_NUM/4 {
+		t.Fatalf("expected %d moves, got %d", SLOTS_NUM/4, len(moves))
+	}
+	for _, mv := range moves {
+		nd, err := sm.NodeBySlot(mv.Slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nd.ID != mv.From {
+			t.Fatalf("slot %d should move from %s, got %s", mv.Slot, nd.ID, mv.From)
+		}
+		if err := sm.Assign(mv.Slot, mv.To); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes := sm.Nodes()
+	if len(nodes) != 4 {
+		t.Fatalf("expected 4 nodes, got %d", len(nodes))
+	}
+	for _, nd := range nodes {
+		if nd.SlotsNum() != SLOTS_NUM/4 {
+			t.Fatalf("node %s expected %d slots, got %d", nd.ID, SLOTS_NUM/4, nd.SlotsNum())
+		}
+	}
+
+	// the new layout can be restored from config
+	restored, err := RestoreSlotsManager(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mv := range moves {
+		nd, err := restored.NodeBySlot(mv.Slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nd.ID != mv.To {
+			t.Fatalf("slot %d should be owned by %s, got %s", mv.Slot, mv.To, nd.ID)
+		}
+	}
+
+	if _, err := sm.PlanAddNode(Node{ID: "node-003"}); err == nil {
+		t.Fatal("should not add node twice")
+	}
+}
+
+func TestRestoreSlotsManagerInvalid(t *testing.T) {
+	nodes := InitSlotManager(nodeFactory(3)).Nodes()
+	gap := make([]Node, len(nodes))
+	copy(gap, nodes)
+	gap[1].Slots.End--
+	if _, err := RestoreSlotsManager(gap); err == nil {
+		t.Fatal("should refuse slots layout with unowned slot")
+	}
+
+	overlap := make([]Node, len(nodes))
+	copy(overlap, nodes)
+	overlap[1].Slots.End++
+	if _, err := RestoreSlotsManager(overlap); err == nil {
+		t.Fatal("should refuse slots layout with overlapped ranges")
+	}
+}
+
+func TestPlanRemoveNode(t *testing.T) {
+	sm := InitSlotManager(nodeFactory(4))
+
+	moves, err := sm.PlanRemoveNode("node-001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != SLOTS_NUM/4 {
+		t.Fatalf("expected %d moves, got %d", SLOTS_NUM/4, len(moves))
+	}
+	for _, mv := range moves {
+		if mv.To == "node-001" {
+			t.Fatal("should not move slot to the leaving node")
+		}
+		if err := sm.Assign(mv.Slot, mv.To); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes := sm.Nodes()
+	if len(nodes) != 3 {
+		t.Fatalf("expected 3 nodes, got %d", len(nodes))
+	}
+	for _, nd := range nodes {
+		if nd.ID == "node-001" {
+			t.Fatal("leaving node should be removed")
+		}
+		if n := nd.SlotsNum(); n < SLOTS_NUM/3 || n > SLOTS_NUM/3+1 {
+			t.Fatalf("node %s owns %d slots, not balanced", nd.ID, n)
+		}
+	}
+	if _, err := RestoreSlotsManager(nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sm.PlanRemoveNode("node-001"); err == nil {
+		t.Fatal("should not remove node not in the cluster")
+	}
+	single := InitSlotManager(nodeFactory(1))
+	if _, err := single.PlanRemoveNode("node-000"); err == nil {
+		t.Fatal("should not remove the last node")
+	}
+}
+
+func TestPlanMoveSlots(t *testing.T) {
+	sm := InitSlotManager(nodeFactory(3))
+
+	moves, err := sm.PlanMoveSlots(5000, 5600, "node-002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 5600-5000+1 {
+		t.Fatalf("unexpected moves number: %d", len(moves))
+	}
+	for _, mv := range moves {
+		if err := sm.Assign(mv.Slot, mv.To); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, nd := range sm.Nodes() {
+		if nd.ID == "node-002" && len(nd.SlotRanges()) != 2 {
+			t.Fatalf("node-002 should own 2 slots ranges, got %v", nd.SlotRanges())
+		}
+	}
+	if err := Validate(sm.Nodes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// slots already owned by the node won't be moved
+	moves, err = sm.PlanMoveSlots(5000, 5600, "node-002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 0 {
+		t.Fatalf("expected no move, got %d", len(moves))
+	}
+	if _, err := sm.PlanMoveSlots(0, 10, "node-100"); err == nil {
+		t.Fatal("should not move slots to unknown node")
+	}
+}
+
+func TestWeightedSlots(t *testing.T) {
+	nodes := nodeFactory(3)
+	nodes[2].Weight = 4
+	sm := InitSlotManager(nodes)
+	expected := []int{2731, 2731, 10922}
+	for i, nd := range sm.Nodes() {
+		if nd.SlotsNum() != expected[i] {
+			t.Fatalf("node %s expected %d slots, got %d", nd.ID, expected[i], nd.SlotsNum())
+		}
+	}
+	if err := Validate(sm.Nodes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// new node with weight 2 takes 2/8 of slots
+	moves, err := sm.PlanAddNode(Node{ID: "node-003", Weight: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != SLOTS_NUM/4 {
+		t.Fatalf("expected %d moves, got %d", SLOTS_NUM/4, len(moves))
+	}
+	sm.SetWeight("node-003", 2)
+	for _, mv := range moves {
+		if err := sm.Assign(mv.Slot, mv.To); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if moves := sm.PlanRebalance(); len(moves) != 0 {
+		t.Fatalf("cluster should be balanced, got %d moves", len(moves))
+	}
+	for _, nd := range sm.Nodes() {
+		if nd.ID == "node-003" && nd.Weight != 2 {
+			t.Fatalf("weight of new node should be kept, got %d", nd.Weight)
+		}
+	}
+
+	// all the nodes share the same weight after rebalance
+	for _, nd := range sm.Nodes() {
+		sm.SetWeight(nd.ID, 1)
+	}
+	for _, mv := range sm.PlanRebalance() {
+		if err := sm.Assign(mv.Slot, mv.To); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, nd := range sm.Nodes() {
+		if nd.SlotsNum() != SLOTS_NUM/4 {
+			t.Fatalf("node %s expected %d slots, got %d", nd.ID, SLOTS_NUM/4, nd.SlotsNum())
+		}
+	}
+}
+
+func TestReplicaMoves(t *testing.T) {
+	sm := InitSlotManager(nodeFactory(3))
+	sm.SetReplication(2)
+	primary, err := sm.PlanAddNode(Node{ID: "node-003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves, err := sm.ReplicaMoves(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := sm.Clone()
+	for _, mv := range primary {
+		if err := after.Assign(mv.Slot, mv.To); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// applying the moves to the replica sets gives the new replica sets
+	sets := make(map[uint16]map[string]bool)
+	for slot := 0; slot < SLOTS_NUM; slot++ {
+		nds, err := sm.ReplicasBySlot(uint16(slot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sets[uint16(slot)] = make(map[string]bool)
+		for _, nd := range nds {
+			sets[uint16(slot)][nd.ID] = true
+		}
+	}
+	for _, mv := range moves {
+		if !sets[mv.Slot][mv.From] {
+			t.Fatalf("slot %d is not kept by %s", mv.Slot, mv.From)
+		}
+		if mv.Copy {
+			t.Fatalf("unexpected copy move %v", mv)
+		}
+		delete(sets[mv.Slot], mv.From)
+		sets[mv.Slot][mv.To] = true
+	}
+	for slot := 0; slot < SLOTS_NUM; slot++ {
+		nds, err := after.ReplicasBySlot(uint16(slot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nds) != len(sets[uint16(slot)]) {
+			t.Fatalf("slot %d expected %d replicas, got %d", slot, len(nds), len(sets[uint16(slot)]))
+		}
+		for _, nd := range nds {
+			if !sets[uint16(slot)][nd.ID] {
+				t.Fatalf("slot %d should be kept by %s", slot, nd.ID)
+			}
+		}
+	}
+
+	// without replication the moves are the primary moves
+	single := InitSlotManager(nodeFactory(3))
+	primary, err = single.PlanAddNode(Node{ID: "node-003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves, err = single.ReplicaMoves(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(moves, primary) {
+		t.Fatal("moves should be the same as primary moves without replication")
+	}
+
+	// the replica sets grow with the cluster, node-000 keeps all the slots
+	small := InitSlotManager(nodeFactory(1))
+	small.SetReplication(2)
+	primary, err = small.PlanAddNode(Node{ID: "node-001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves, err = small.ReplicaMoves(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copies int
+	for _, mv := range moves {
+		if mv.Copy {
+			copies++
+		}
+	}
+	if copies != SLOTS_NUM || len(moves) != SLOTS_NUM {
+		t.Fatalf("unexpected moves: %d copies of %d moves", copies, len(moves))
+	}
+}
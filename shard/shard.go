@@ -1,7 +1,31 @@
 package shard
 
-import "github.com/howeyc/crc16"
+import (
+	"strings"
+
+	"github.com/howeyc/crc16"
+)
 
 func CRC16Sum(key string) uint16 {
 	return crc16.Checksum([]byte(key), crc16.IBMTable)
 }
+
+// KeyHashFunc picks the part of a key used to figure out its slot,
+// keys picking the same part will be kept by the same node
+type KeyHashFunc func(key string) string
+
+// HashTagKey implements the redis cluster hash tags.
+// If the key contains a non-empty substring between the first "{" and
+// the first "}" after it, only the substring is hashed.
+// e.g. "/meta/{QmX}/size" and "/dag/{QmX}" are kept in the same slot.
+func HashTagKey(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start == -1 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
@@ -61,3 +61,32 @@ func TestCRC16Sum(t *testing.T) {
 		}
 	}
 }
+
+func TestHashTagKey(t *testing.T) {
+	cases := map[string]string{
+		"/blocks/CIQGEQRABRBZ2IV7GTEGVOGXNHUR7PHXXRX2WO3G76GRXXUKCJVHOUA": "/blocks/CIQGEQRABRBZ2IV7GTEGVOGXNHUR7PHXXRX2WO3G76GRXXUKCJVHOUA",
+		"/meta/{QmTJXRyWuWC287xDaGxrV1GjHTXq2DxnjB7H5A17pUmASy}/size":     "QmTJXRyWuWC287xDaGxrV1GjHTXq2DxnjB7H5A17pUmASy",
+		"{user1000}.following": "user1000",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar}{zap}":        "bar",
+		"{":                    "{",
+		"no-closing-brace{abc": "no-closing-brace{abc",
+	}
+	for in, out := range cases {
+		if res := HashTagKey(in); res != out {
+			t.Fatalf("hash tag of %s expected %s, got %s", in, out, res)
+		}
+	}
+
+	sm := InitSlotManager(nodeFactory(7))
+	sm.SetKeyHashFunc(HashTagKey)
+	a := sm.SlotByKey("/meta/{QmTJXRyWuWC287xDaGxrV1GjHTXq2DxnjB7H5A17pUmASy}/size")
+	b := sm.SlotByKey("/dag/{QmTJXRyWuWC287xDaGxrV1GjHTXq2DxnjB7H5A17pUmASy}")
+	if a != b {
+		t.Fatal("keys with the same hash tag should be in the same slot")
+	}
+	if a != CRC16Sum("QmTJXRyWuWC287xDaGxrV1GjHTXq2DxnjB7H5A17pUmASy")&(SLOTS_NUM-1) {
+		t.Fatal("only hash tag should be hashed")
+	}
+}
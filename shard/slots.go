@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
-	"reflect"
 
 	"golang.org/x/xerrors"
 )
@@ -13,19 +12,57 @@ const (
 	SLOTS_NUM = 1 << 14
 )
 
+// SlotsManager keeps an explicit slot table, every slot maps to the node owning it.
+// Nodes may own any number of non-contiguous slot ranges.
 type SlotsManager struct {
-	nodesNum    uint16
-	rangeLen    uint16
-	rangeFactor float64
-	nodes       []Node
-	slotsRange  []SlotsRange
-	nodeMap     map[int]Node
-	remain      uint16
+	nodes []Node
+	// the first slots range of each node
+	slotsRange []SlotsRange
+	nodeMap    map[int]Node
+	// table maps every slot to the index of its owner in nodes
+	table []int
+	// weights of nodes which are going to join the cluster
+	pendingWeights map[string]int
+	keyHash        KeyHashFunc
+	// replication is how many nodes keep each slot, the primary included
+	replication int
 }
 
+// Node is an entry of the slot table persisted in config
 type Node struct {
 	ID    string     `json:"id"`
 	Slots SlotsRange `json:"slots"`
+	// Ranges holds all the slot ranges of a node which owns more than one range,
+	// in that case Slots is the same as Ranges[0]
+	Ranges []SlotsRange `json:"ranges,omitempty"`
+	// Weight decides the share of slots the node should own, e.g. according to its disk capacity.
+	// Zero is treated as 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// SlotsWeight returns the weight of the node used for slots allocation
+func (n Node) SlotsWeight() int {
+	if n.Weight <= 0 {
+		return 1
+	}
+	return n.Weight
+}
+
+// SlotRanges returns all the slot ranges owned by the node
+func (n Node) SlotRanges() []SlotsRange {
+	if len(n.Ranges) > 0 {
+		return n.Ranges
+	}
+	return []SlotsRange{n.Slots}
+}
+
+// SlotsNum returns how many slots the node owns
+func (n Node) SlotsNum() int {
+	var num int
+	for _, sr := range n.SlotRanges() {
+		num += int(sr.End) - int(sr.Start) + 1
+	}
+	return num
 }
 
 type SlotsRange struct {
@@ -33,34 +70,36 @@ type SlotsRange struct {
 	End   uint16 `json:"end"`
 }
 
+// InitSlotManager allocates all the slots to the start nodes in proportion to
+// their weights, each node owns a contiguous slots range
 func InitSlotManager(startNodes []Node) *SlotsManager {
-	nodeLen := len(startNodes)
-	sm := &SlotsManager{
-		nodes:      startNodes,
-		nodesNum:   uint16(nodeLen),
-		slotsRange: make([]SlotsRange, len(startNodes)),
-		nodeMap:    make(map[int]Node),
+	if !sameWeight(startNodes) {
+		return initWeightedSlotManager(startNodes)
 	}
+	nodeLen := len(startNodes)
+	nodesNum := uint16(nodeLen)
+	slotsRange := make([]SlotsRange, len(startNodes))
+	var rangeFactor float64
 	// generate slots range
 	// how may slots in a range, the real number would be adjusted if have remain
-	sm.rangeLen = SLOTS_NUM / sm.nodesNum
+	rangeLen := SLOTS_NUM / nodesNum
 	// the leftover slots which can't cover all nodes, should allocate these leftover to nodes as distributed as possible
-	sm.remain = SLOTS_NUM % sm.nodesNum
-	if sm.remain > 0 {
+	remain := SLOTS_NUM % nodesNum
+	if remain > 0 {
 		// decide which node should be allocated one leftover
-		sm.rangeFactor = float64(nodeLen) / float64(sm.remain)
+		rangeFactor = float64(nodeLen) / float64(remain)
 	}
 	// allocate remain to slotsRange according to adjustMap
 	adjustMap := make(map[uint16][]uint16)
 	// slotsRange been allocated remain is lucky
 	luckyMap := make(map[uint16]uint16)
 	var i uint16
-	for ; i < sm.remain; i++ {
-		luckyMap[uint16(math.Floor((float64(i)+0.5)*sm.rangeFactor))] = i
+	for ; i < remain; i++ {
+		luckyMap[uint16(math.Floor((float64(i)+0.5)*rangeFactor))] = i
 	}
 
 	var allocatedRemain uint16
-	for i = 0; i < uint16(len(sm.nodes)); i++ {
+	for i = 0; i < nodesNum; i++ {
 		if _, ok := luckyMap[i]; ok {
 			adjustMap[i] = []uint16{allocatedRemain, allocatedRemain + 1}
 			allocatedRemain += 1
@@ -69,14 +108,17 @@ func InitSlotManager(startNodes []Node) *SlotsManager {
 		}
 	}
 
-	for i := range sm.slotsRange {
+	table := make([]int, SLOTS_NUM)
+	for i := range slotsRange {
 		adjust := adjustMap[uint16(i)]
-		sm.slotsRange[i] = SlotsRange{
-			Start: sm.rangeLen*uint16(i) + adjust[0],
-			End:   sm.rangeLen*(uint16(i+1)) - 1 + adjust[1],
+		slotsRange[i] = SlotsRange{
+			Start: rangeLen*uint16(i) + adjust[0],
+			End:   rangeLen*(uint16(i+1)) - 1 + adjust[1],
+		}
+		startNodes[i].Slots = slotsRange[i]
+		for slot := int(slotsRange[i].Start); slot <= int(slotsRange[i].End); slot++ {
+			table[slot] = i
 		}
-		sm.nodes[i].Slots = sm.slotsRange[i]
-		sm.nodeMap[i] = sm.nodes[i]
 	}
 
 	// var factorNext float64 = 0
@@ -107,52 +149,181 @@ func InitSlotManager(startNodes []Node) *SlotsManager {
 	// 	sm.nodeMap[i] = sm.nodes[i]
 	// }
 
-	return sm
+	return newSlotsManager(startNodes, table)
+}
+
+func initWeightedSlotManager(startNodes []Node) *SlotsManager {
+	weights := make([]int, len(startNodes))
+	for i, nd := range startNodes {
+		weights[i] = nd.SlotsWeight()
+	}
+	targets := weightedTargets(weights, make([]int, len(startNodes)))
+	table := make([]int, SLOTS_NUM)
+	start := 0
+	for i, n := range targets {
+		startNodes[i].Slots = SlotsRange{
+			Start: uint16(start),
+			End:   uint16(start + n - 1),
+		}
+		for slot := start; slot < start+n; slot++ {
+			table[slot] = i
+		}
+		start += n
+	}
+	return newSlotsManager(startNodes, table)
+}
+
+func sameWeight(nds []Node) bool {
+	for _, nd := range nds {
+		if nd.SlotsWeight() != nds[0].SlotsWeight() {
+			return false
+		}
+	}
+	return true
 }
 
+// RestoreSlotsManager rebuilds SlotsManager from the slot table kept in config.
+// The slot ranges of the nodes may be any layout which passes Validate.
 func RestoreSlotsManager(nds []Node) (*SlotsManager, error) {
-	startNds := make([]Node, len(nds))
-	copy(startNds, nds)
-	sm := InitSlotManager(startNds)
-	if !reflect.DeepEqual(sm.nodes, nds) {
-		return nil, xerrors.Errorf("restore slots manager failed. expected %v, got %v", nds, sm.nodes)
+	table, err := buildTable(nds)
+	if err != nil {
+		return nil, xerrors.Errorf("restore slots manager failed. %w", err)
 	}
-	return sm, nil
+	nodes := make([]Node, len(nds))
+	copy(nodes, nds)
+	return newSlotsManager(nodes, table), nil
+}
+
+// Validate checks the slot table, every one of SLOTS_NUM slots should be
+// owned by exactly one node
+func Validate(nds []Node) error {
+	_, err := buildTable(nds)
+	return err
+}
+
+func buildTable(nds []Node) ([]int, error) {
+	if len(nds) == 0 {
+		return nil, xerrors.New("slot table has no node")
+	}
+	table := make([]int, SLOTS_NUM)
+	for i := range table {
+		table[i] = -1
+	}
+	ids := make(map[string]struct{})
+	for i, nd := range nds {
+		if nd.ID == "" {
+			return nil, xerrors.Errorf("node %d has empty id", i)
+		}
+		if _, ok := ids[nd.ID]; ok {
+			return nil, xerrors.Errorf("node %s appears more than once", nd.ID)
+		}
+		ids[nd.ID] = struct{}{}
+		for _, sr := range nd.SlotRanges() {
+			if sr.Start > sr.End || sr.End >= SLOTS_NUM {
+				return nil, xerrors.Errorf("node %s has invalid slots range %d-%d", nd.ID, sr.Start, sr.End)
+			}
+			for slot := int(sr.Start); slot <= int(sr.End); slot++ {
+				if table[slot] != -1 {
+					return nil, xerrors.Errorf("slot %d owned by both %s and %s", slot, nds[table[slot]].ID, nd.ID)
+				}
+				table[slot] = i
+			}
+		}
+	}
+	for slot := 0; slot < SLOTS_NUM; slot++ {
+		if table[slot] != -1 {
+			continue
+		}
+		end := slot
+		for end+1 < SLOTS_NUM && table[end+1] == -1 {
+			end++
+		}
+		return nil, xerrors.Errorf("slots %d-%d have no owner", slot, end)
+	}
+	return table, nil
+}
+
+func newSlotsManager(nodes []Node, table []int) *SlotsManager {
+	sm := &SlotsManager{
+		nodes:      nodes,
+		slotsRange: make([]SlotsRange, len(nodes)),
+		nodeMap:    make(map[int]Node),
+		table:      table,
+	}
+	for i, nd := range nodes {
+		sm.slotsRange[i] = nd.Slots
+		sm.nodeMap[i] = nd
+	}
+	return sm
 }
 
 func (sm *SlotsManager) NodeByKey(key string) (*Node, error) {
 	// figure out slot number
-	slotN := CRC16Sum(key) & (SLOTS_NUM - 1)
-	return sm.NodeBySlot(slotN)
+	return sm.NodeBySlot(sm.SlotByKey(key))
 }
 
 func (sm *SlotsManager) NodeBySlot(n uint16) (*Node, error) {
 	slotN := n % SLOTS_NUM
-	// check if slotN out of range
-	if slotN >= (sm.nodesNum * sm.rangeLen) {
-		slotN = slotN - sm.remain
-	}
-	// figure out range number
-	rn := slotN / sm.rangeLen
-	if int(rn) >= len(sm.slotsRange) {
-		return nil, xerrors.Errorf("unexpected slot number,n: %d, slotN: %d, rn: %d, sm.rangeLen: %d, len(sm.slotsRange):%d", n, slotN, rn, sm.rangeLen, len(sm.slotsRange))
-	}
-	maybeRange := sm.slotsRange[rn]
-	// check if really in the range
-	if slotN < maybeRange.Start {
-		rn--
-	} else if slotN > maybeRange.End {
-		rn++
-	}
-	if node, ok := sm.nodeMap[int(rn)]; ok {
+	if node, ok := sm.nodeMap[sm.table[slotN]]; ok {
 		return &node, nil
 	}
-	return nil, xerrors.Errorf("failed to find node by slot: %d; rangeN: %d", slotN, rn)
+	return nil, xerrors.Errorf("failed to find node by slot: %d", slotN)
+}
+
+// SlotByKey figures out which slot the key belongs to
+func (sm *SlotsManager) SlotByKey(key string) uint16 {
+	if sm.keyHash != nil {
+		key = sm.keyHash(key)
+	}
+	return CRC16Sum(key) & (SLOTS_NUM - 1)
+}
+
+// SetKeyHashFunc customizes the part of keys to be hashed, e.g. HashTagKey.
+// All the clients of a cluster must use the same function.
+func (sm *SlotsManager) SetKeyHashFunc(f KeyHashFunc) {
+	sm.keyHash = f
+}
+
+// SetReplication sets how many nodes keep each slot, the primary owner included.
+// The replicas of a slot are the nodes following its primary in the node list.
+func (sm *SlotsManager) SetReplication(n int) {
+	sm.replication = n
+}
+
+// Replication returns how many nodes keep each slot, it's capped by the number of nodes
+func (sm *SlotsManager) Replication() int {
+	n := sm.replication
+	if n < 1 {
+		n = 1
+	}
+	if n > len(sm.nodes) {
+		n = len(sm.nodes)
+	}
+	return n
+}
+
+// ReplicasBySlot returns the nodes keeping the slot, the primary owner comes first
+func (sm *SlotsManager) ReplicasBySlot(n uint16) ([]Node, error) {
+	slotN := n % SLOTS_NUM
+	idx := sm.table[slotN]
+	if idx < 0 || idx >= len(sm.nodes) {
+		return nil, xerrors.Errorf("failed to find node by slot: %d", slotN)
+	}
+	r := sm.Replication()
+	res := make([]Node, 0, r)
+	for i := 0; i < r; i++ {
+		res = append(res, sm.nodes[(idx+i)%len(sm.nodes)])
+	}
+	return res, nil
+}
+
+// ReplicasByKey returns the nodes keeping the key, the primary owner comes first
+func (sm *SlotsManager) ReplicasByKey(key string) ([]Node, error) {
+	return sm.ReplicasBySlot(sm.SlotByKey(key))
 }
 
 func (sm *SlotsManager) Check() {
-	fmt.Printf("nodes: %d\n", sm.nodesNum)
-	fmt.Printf("range len: %d\n", sm.rangeLen)
+	fmt.Printf("nodes: %d\n", len(sm.nodes))
 	// for i, sr := range sm.slotsRange {
 	// 	fmt.Printf("slot range %d start: %d, end: %d, num: %d\n", i, sr.Start, sr.End, sr.End-sr.Start+1)
 	// }
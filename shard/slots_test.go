@@ -209,3 +209,80 @@ func TestRestoreSlotsManager(t *testing.T) {
 		t.Fatal("unexpected nodes restored")
 	}
 }
+
+func TestValidate(t *testing.T) {
+	nodesCfg := `
+	[
+        {"id":"node-000","slots":{"start":0,"end":99},"ranges":[{"start":0,"end":99},{"start":8000,"end":16383}]},
+        {"id":"node-001","slots":{"start":100,"end":7999}}
+    ]
+	`
+	nodes := make([]Node, 0)
+	if err := json.Unmarshal([]byte(nodesCfg), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(nodes); err != nil {
+		t.Fatal(err)
+	}
+	sm, err := RestoreSlotsManager(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot, id := range map[uint16]string{0: "node-000", 99: "node-000", 100: "node-001", 7999: "node-001", 8000: "node-000", 16383: "node-000"} {
+		nd, err := sm.NodeBySlot(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nd.ID != id {
+			t.Fatalf("slot %d should be owned by %s, got %s", slot, id, nd.ID)
+		}
+	}
+
+	gap := []Node{nodes[0], {ID: "node-001", Slots: SlotsRange{100, 6999}}}
+	if err := Validate(gap); err == nil || err.Error() != "slots 7000-7999 have no owner" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dup := []Node{nodes[0], nodes[1], nodes[1]}
+	if err := Validate(dup); err == nil {
+		t.Fatal("should refuse duplicated node")
+	}
+	invalid := []Node{nodes[0], {ID: "node-001", Slots: SlotsRange{7999, 100}}}
+	if err := Validate(invalid); err == nil {
+		t.Fatal("should refuse invalid slots range")
+	}
+	if err := Validate(nil); err == nil {
+		t.Fatal("should refuse empty slot table")
+	}
+}
+
+func TestReplicasBySlot(t *testing.T) {
+	sm := InitSlotManager(nodeFactory(3))
+	sm.SetReplication(2)
+	for _, slot := range []uint16{0, 6000, SLOTS_NUM - 1} {
+		nds, err := sm.ReplicasBySlot(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner, err := sm.NodeBySlot(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nds) != 2 || nds[0].ID != owner.ID || nds[1].ID == owner.ID {
+			t.Fatalf("unexpected replicas of slot %d: %v", slot, nds)
+		}
+	}
+	// the last node is followed by the first one
+	nds, err := sm.ReplicasBySlot(SLOTS_NUM - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nds[1].ID != "node-000" {
+		t.Fatalf("expected node-000 as replica, got %s", nds[1].ID)
+	}
+
+	// replication is capped by the number of nodes
+	sm.SetReplication(5)
+	if sm.Replication() != 3 {
+		t.Fatalf("expected replication 3, got %d", sm.Replication())
+	}
+}